@@ -7,9 +7,11 @@ import (
 	"encoding/json"
 	"encore.dev/beta/auth"
 	"encore.dev/beta/errs"
+	"errors"
 	"fmt"
 	secp256k1btc "github.com/btcsuite/btcd/btcec"
 	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+	"github.com/cosmos/cosmos-sdk/types/bech32"
 	"github.com/tendermint/tendermint/crypto"
 	"math/big"
 	"time"
@@ -17,6 +19,9 @@ import (
 
 const ClientName = "empower-deposit-app"
 
+// AddressPrefix is the bech32 prefix of EmpowerChain addresses
+const AddressPrefix = "empower"
+
 type AuthData struct {
 	Payload   string `json:"payload"`
 	Signature string `json:"signature"`
@@ -51,18 +56,36 @@ func AuthHandler(_ context.Context, token string) (auth.UID, error) {
 		}
 	}
 
-	pk, err := hex.DecodeString(authPayload.PubKey)
+	if err := VerifySignature(authPayload.PubKey, []byte(authData.Payload), authData.Signature); err != nil {
+		return "", &errs.Error{
+			Message: err.Error(),
+			Code:    errs.Unauthenticated,
+		}
+	}
+
+	return auth.UID(authPayload.PubKey), nil
+}
+
+var ErrInvalidSignature = errors.New("failed to verify signature")
+
+// VerifySignature checks a hex encoded secp256k1 signature (R and S, 64 bytes) of the SHA-256 of message,
+// by the hex encoded compressed pub key
+func VerifySignature(pubKeyHex string, message []byte, signatureHex string) error {
+	pk, err := hex.DecodeString(pubKeyHex)
 	if err != nil {
-		return "", errs.WrapCode(err, errs.Unauthenticated, "failed to decode pubKey from hex")
+		return fmt.Errorf("failed to decode pubKey from hex: %w", err)
 	}
 	pub, err := secp256k1btc.ParsePubKey(pk, secp256k1btc.S256())
 	if err != nil {
-		return "", errs.WrapCode(err, errs.Unauthenticated, "failed to parse pubKey")
+		return fmt.Errorf("failed to parse pubKey: %w", err)
 	}
 
-	sig, err := hex.DecodeString(authData.Signature)
+	sig, err := hex.DecodeString(signatureHex)
 	if err != nil {
-		return "", errs.WrapCode(err, errs.Unauthenticated, "failed to decode signature from hex")
+		return fmt.Errorf("failed to decode signature from hex: %w", err)
+	}
+	if len(sig) != 64 {
+		return ErrInvalidSignature
 	}
 
 	signature := &secp256k1btc.Signature{
@@ -70,14 +93,11 @@ func AuthHandler(_ context.Context, token string) (auth.UID, error) {
 		S: new(big.Int).SetBytes(sig[32:64]),
 	}
 
-	if ok := signature.Verify(crypto.Sha256([]byte(authData.Payload)), pub); !ok {
-		return "", &errs.Error{
-			Message: "failed to verify signature",
-			Code:    errs.Unauthenticated,
-		}
+	if ok := signature.Verify(crypto.Sha256(message), pub); !ok {
+		return ErrInvalidSignature
 	}
 
-	return auth.UID(authPayload.PubKey), nil
+	return nil
 }
 
 // FYI, kept here instead of test because it is used by tmp.GenerateKey
@@ -105,3 +125,17 @@ func GetToken(signerPrivKey *secp256k1.PrivKey, pubKey *secp256k1.PubKey, client
 
 	return authDataB64, pubKeyHex, nil
 }
+
+// EmpowerAddress is the EmpowerChain address of a hex encoded secp256k1 pub key, as used to sign transactions with it
+func EmpowerAddress(pubKeyHex string) (string, error) {
+	pk, err := hex.DecodeString(pubKeyHex)
+	if err != nil {
+		return "", err
+	}
+	if len(pk) != secp256k1.PubKeySize {
+		return "", fmt.Errorf("pub key must be %d bytes", secp256k1.PubKeySize)
+	}
+
+	pubKey := &secp256k1.PubKey{Key: pk}
+	return bech32.ConvertAndEncode(AddressPrefix, pubKey.Address())
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"encore.dev/beta/errs"
 	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+	"github.com/cosmos/cosmos-sdk/types/bech32"
 	"github.com/stretchr/testify/require"
 	"testing"
 )
@@ -110,3 +111,32 @@ func TestFrontendCreatedAuth(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "03ee994450ff2e92f48d3c6ad30fe2104dc8b251406b15bbea1ba6e55163cc26e9", string(uid))
 }
+
+func TestVerifySignature(t *testing.T) {
+	privateKey := secp256k1.GenPrivKey()
+	pubKeyHex := hex.EncodeToString(privateKey.PubKey().Bytes())
+	message := []byte(`{"schemeID":"1"}`)
+	signature, err := privateKey.Sign(message)
+	require.NoError(t, err)
+
+	require.NoError(t, VerifySignature(pubKeyHex, message, hex.EncodeToString(signature)))
+	require.ErrorIs(t, VerifySignature(pubKeyHex, []byte(`{"schemeID":"2"}`), hex.EncodeToString(signature)), ErrInvalidSignature)
+	require.ErrorIs(t, VerifySignature(pubKeyHex, message, hex.EncodeToString(signature[:32])), ErrInvalidSignature)
+	require.Error(t, VerifySignature("not hex", message, hex.EncodeToString(signature)))
+}
+
+func TestEmpowerAddress(t *testing.T) {
+	pubKey := defaultSigner.PubKey()
+	address, err := EmpowerAddress(hex.EncodeToString(pubKey.Bytes()))
+	require.NoError(t, err)
+
+	prefix, bz, err := bech32.DecodeAndConvert(address)
+	require.NoError(t, err)
+	require.Equal(t, "empower", prefix)
+	require.Equal(t, []byte(pubKey.Address()), bz)
+
+	_, err = EmpowerAddress("not hex")
+	require.Error(t, err)
+	_, err = EmpowerAddress("0102")
+	require.Error(t, err)
+}
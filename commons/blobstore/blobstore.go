@@ -0,0 +1,76 @@
+// Package blobstore stores files outside the database.
+//
+// Store is the interface services use, so the local filesystem stand-in can be swapped for
+// object storage without touching the services.
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+var ErrInvalidKey = errors.New("invalid blob key")
+
+// keyPattern keeps keys safe to use as file and object names
+var keyPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,128}$`)
+
+type Store interface {
+	// Put stores data under key, replacing what was there before
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns the data stored under key, or ErrNotFound
+	Get(ctx context.Context, key string) ([]byte, error)
+}
+
+// LocalStore is a Store keeping every blob as a file in a directory
+type LocalStore struct {
+	dir string
+}
+
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{dir: dir}
+}
+
+func (s *LocalStore) Put(_ context.Context, key string, data []byte) error {
+	if !keyPattern.MatchString(key) {
+		return ErrInvalidKey
+	}
+
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so readers never see a partially written blob
+	tmp, err := os.CreateTemp(s.dir, "."+key+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, key))
+}
+
+func (s *LocalStore) Get(_ context.Context, key string) ([]byte, error) {
+	if !keyPattern.MatchString(key) {
+		return nil, ErrInvalidKey
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.dir, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+
+	return data, err
+}
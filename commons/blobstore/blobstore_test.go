@@ -0,0 +1,37 @@
+package blobstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewLocalStore(t.TempDir())
+
+	_, err := store.Get(ctx, "missing")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, store.Put(ctx, "key-1", []byte("first")))
+	data, err := store.Get(ctx, "key-1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), data)
+
+	require.NoError(t, store.Put(ctx, "key-1", []byte("second")))
+	data, err = store.Get(ctx, "key-1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), data)
+}
+
+func TestLocalStoreInvalidKey(t *testing.T) {
+	ctx := context.Background()
+	store := NewLocalStore(t.TempDir())
+
+	for _, key := range []string{"", "../escape", "a/b", ".hidden"} {
+		require.ErrorIs(t, store.Put(ctx, key, []byte("data")), ErrInvalidKey, key)
+		_, err := store.Get(ctx, key)
+		require.ErrorIs(t, err, ErrInvalidKey, key)
+	}
+}
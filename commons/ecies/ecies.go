@@ -0,0 +1,192 @@
+// Package ecies implements the envelope format used for content that only an
+// organization should be able to read, such as the personal details users
+// register with an organization. The format is documented in encryption.md.
+package ecies
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	secp256k1btc "github.com/btcsuite/btcd/btcec"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+)
+
+const (
+	Version   = 1
+	Algorithm = "secp256k1-ecdh-sha256-aes256gcm"
+
+	nonceSize       = 12
+	tagSize         = 16
+	sharedSecretLen = 32
+)
+
+var (
+	ErrInvalidEnvelope = errors.New("invalid envelope")
+	ErrWrongRecipient  = errors.New("envelope is not addressed to this key")
+	ErrDecryptFailed   = errors.New("failed to decrypt envelope")
+)
+
+type Envelope struct {
+	Version         int    `json:"version"`
+	Algorithm       string `json:"algorithm"`
+	RecipientPubKey string `json:"recipientPubKey"`
+	EphemeralPubKey string `json:"ephemeralPubKey"`
+	Nonce           string `json:"nonce"`
+	Ciphertext      string `json:"ciphertext"`
+}
+
+// Encrypt seals plaintext for the holder of the private key matching recipientPubKeyHex
+// and returns the JSON encoded envelope.
+func Encrypt(recipientPubKeyHex string, plaintext []byte) (string, error) {
+	recipient, err := parsePubKey(recipientPubKeyHex)
+	if err != nil {
+		return "", err
+	}
+
+	ephemeral, err := secp256k1btc.NewPrivateKey(secp256k1btc.S256())
+	if err != nil {
+		return "", err
+	}
+	ephemeralPub := ephemeral.PubKey().SerializeCompressed()
+	recipientPub := recipient.SerializeCompressed()
+
+	aead, err := newAEAD(secp256k1btc.GenerateSharedSecret(ephemeral, recipient), ephemeralPub, recipientPub)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(&Envelope{
+		Version:         Version,
+		Algorithm:       Algorithm,
+		RecipientPubKey: hex.EncodeToString(recipientPub),
+		EphemeralPubKey: hex.EncodeToString(ephemeralPub),
+		Nonce:           base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext:      base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, plaintext, recipientPub)),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// Decrypt opens a JSON encoded envelope with the recipient's private key.
+func Decrypt(privKey *secp256k1.PrivKey, content string) ([]byte, error) {
+	envelope, err := Parse(content)
+	if err != nil {
+		return nil, err
+	}
+
+	priv, pub := secp256k1btc.PrivKeyFromBytes(secp256k1btc.S256(), privKey.Bytes())
+	recipientPub := pub.SerializeCompressed()
+	if envelope.RecipientPubKey != hex.EncodeToString(recipientPub) {
+		return nil, ErrWrongRecipient
+	}
+
+	// Parse already made sure these decode
+	ephemeralPub, _ := hex.DecodeString(envelope.EphemeralPubKey)
+	ephemeral, _ := secp256k1btc.ParsePubKey(ephemeralPub, secp256k1btc.S256())
+	nonce, _ := base64.StdEncoding.DecodeString(envelope.Nonce)
+	ciphertext, _ := base64.StdEncoding.DecodeString(envelope.Ciphertext)
+
+	aead, err := newAEAD(secp256k1btc.GenerateSharedSecret(priv, ephemeral), ephemeral.SerializeCompressed(), recipientPub)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, recipientPub)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+
+	return plaintext, nil
+}
+
+// Parse decodes a JSON encoded envelope and checks that it is well-formed.
+// It does not (and can not) check that the ciphertext decrypts.
+func Parse(content string) (*Envelope, error) {
+	var envelope Envelope
+	if err := json.Unmarshal([]byte(content), &envelope); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidEnvelope, err)
+	}
+
+	if envelope.Version != Version {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidEnvelope, envelope.Version)
+	}
+	if envelope.Algorithm != Algorithm {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidEnvelope, envelope.Algorithm)
+	}
+	if _, err := parsePubKey(envelope.RecipientPubKey); err != nil {
+		return nil, err
+	}
+	if _, err := parsePubKey(envelope.EphemeralPubKey); err != nil {
+		return nil, err
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(envelope.Nonce)
+	if err != nil || len(nonce) != nonceSize {
+		return nil, fmt.Errorf("%w: invalid nonce", ErrInvalidEnvelope)
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(envelope.Ciphertext)
+	if err != nil || len(ciphertext) < tagSize {
+		return nil, fmt.Errorf("%w: invalid ciphertext", ErrInvalidEnvelope)
+	}
+
+	return &envelope, nil
+}
+
+// IsAddressedTo reports whether the envelope was encrypted for the given public key.
+// Keys are compared in their compressed form, so both compressed and uncompressed hex are accepted.
+func (e *Envelope) IsAddressedTo(pubKeyHex string) bool {
+	pub, err := parsePubKey(pubKeyHex)
+	if err != nil {
+		return false
+	}
+
+	return e.RecipientPubKey == hex.EncodeToString(pub.SerializeCompressed())
+}
+
+func parsePubKey(pubKeyHex string) (*secp256k1btc.PublicKey, error) {
+	b, err := hex.DecodeString(pubKeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode pubKey from hex", ErrInvalidEnvelope)
+	}
+
+	pub, err := secp256k1btc.ParsePubKey(b, secp256k1btc.S256())
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to parse pubKey", ErrInvalidEnvelope)
+	}
+
+	return pub, nil
+}
+
+func newAEAD(sharedSecret []byte, ephemeralPub []byte, recipientPub []byte) (cipher.AEAD, error) {
+	// The x coordinate is returned without leading zeroes, so pad it to get a stable KDF input
+	secret := make([]byte, sharedSecretLen)
+	copy(secret[sharedSecretLen-len(sharedSecret):], sharedSecret)
+
+	h := sha256.New()
+	h.Write(secret)
+	h.Write(ephemeralPub)
+	h.Write(recipientPub)
+
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
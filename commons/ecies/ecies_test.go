@@ -0,0 +1,140 @@
+package ecies
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	privKey := secp256k1.GenPrivKey()
+	pubKeyHex := hex.EncodeToString(privKey.PubKey().Bytes())
+	plaintext := []byte(`{"name":"Jane Doe","phone":"+47 12345678"}`)
+
+	content, err := Encrypt(pubKeyHex, plaintext)
+	require.NoError(t, err)
+	require.NotContains(t, content, "Jane Doe")
+
+	envelope, err := Parse(content)
+	require.NoError(t, err)
+	require.Equal(t, Version, envelope.Version)
+	require.Equal(t, Algorithm, envelope.Algorithm)
+	require.True(t, envelope.IsAddressedTo(pubKeyHex))
+
+	decrypted, err := Decrypt(privKey, content)
+	require.NoError(t, err)
+	require.Equal(t, plaintext, decrypted)
+}
+
+func TestDecryptWithWrongKey(t *testing.T) {
+	privKey := secp256k1.GenPrivKey()
+	otherPrivKey := secp256k1.GenPrivKey()
+
+	content, err := Encrypt(hex.EncodeToString(privKey.PubKey().Bytes()), []byte("secret"))
+	require.NoError(t, err)
+
+	envelope, err := Parse(content)
+	require.NoError(t, err)
+	require.False(t, envelope.IsAddressedTo(hex.EncodeToString(otherPrivKey.PubKey().Bytes())))
+
+	_, err = Decrypt(otherPrivKey, content)
+	require.ErrorIs(t, err, ErrWrongRecipient)
+
+	// Pretending the envelope is for the other key does not help either
+	envelope.RecipientPubKey = hex.EncodeToString(otherPrivKey.PubKey().Bytes())
+	b, err := json.Marshal(envelope)
+	require.NoError(t, err)
+	_, err = Decrypt(otherPrivKey, string(b))
+	require.ErrorIs(t, err, ErrDecryptFailed)
+}
+
+func TestDecryptTamperedCiphertext(t *testing.T) {
+	privKey := secp256k1.GenPrivKey()
+
+	content, err := Encrypt(hex.EncodeToString(privKey.PubKey().Bytes()), []byte("secret"))
+	require.NoError(t, err)
+
+	envelope, err := Parse(content)
+	require.NoError(t, err)
+	ciphertext, err := base64.StdEncoding.DecodeString(envelope.Ciphertext)
+	require.NoError(t, err)
+	ciphertext[0] ^= 0xff
+	envelope.Ciphertext = base64.StdEncoding.EncodeToString(ciphertext)
+
+	b, err := json.Marshal(envelope)
+	require.NoError(t, err)
+	_, err = Decrypt(privKey, string(b))
+	require.ErrorIs(t, err, ErrDecryptFailed)
+}
+
+func TestParse(t *testing.T) {
+	privKey := secp256k1.GenPrivKey()
+	pubKeyHex := hex.EncodeToString(privKey.PubKey().Bytes())
+
+	valid, err := Encrypt(pubKeyHex, []byte("secret"))
+	require.NoError(t, err)
+
+	modified := func(modify func(e *Envelope)) string {
+		var e Envelope
+		require.NoError(t, json.Unmarshal([]byte(valid), &e))
+		modify(&e)
+		b, err := json.Marshal(&e)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	testTable := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{
+			name:    "Valid",
+			content: valid,
+			valid:   true,
+		},
+		{
+			name:    "Plaintext",
+			content: "my name is Jane",
+		},
+		{
+			name:    "Wrong version",
+			content: modified(func(e *Envelope) { e.Version = 2 }),
+		},
+		{
+			name:    "Wrong algorithm",
+			content: modified(func(e *Envelope) { e.Algorithm = "rot13" }),
+		},
+		{
+			name:    "Invalid recipient",
+			content: modified(func(e *Envelope) { e.RecipientPubKey = "not a key" }),
+		},
+		{
+			name:    "Invalid ephemeral key",
+			content: modified(func(e *Envelope) { e.EphemeralPubKey = "02abcdef" }),
+		},
+		{
+			name:    "Short nonce",
+			content: modified(func(e *Envelope) { e.Nonce = base64.StdEncoding.EncodeToString([]byte("short")) }),
+		},
+		{
+			name:    "Missing ciphertext",
+			content: modified(func(e *Envelope) { e.Ciphertext = "" }),
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse(test.content)
+			if test.valid {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, ErrInvalidEnvelope)
+			}
+		})
+	}
+}
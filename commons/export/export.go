@@ -0,0 +1,239 @@
+// Package export writes tables as CSV or XLSX, one row at a time.
+//
+// Rows are written to the underlying writer as they come, so an export of any size can be streamed
+// without holding it in memory.
+package export
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatCSV  = "csv"
+	FormatXLSX = "xlsx"
+)
+
+var ErrUnknownFormat = errors.New("unknown export format")
+
+// Writer writes rows of strings, numbers, bools and times. nil values are left empty.
+type Writer interface {
+	WriteRow(values ...interface{}) error
+	// Close writes what is left and must be called once all rows are written. It does not close the underlying writer.
+	Close() error
+}
+
+// NewWriter returns a Writer for the format, with header as the first row
+func NewWriter(w io.Writer, format string, header ...string) (Writer, error) {
+	var writer Writer
+	switch format {
+	case FormatCSV:
+		writer = &csvWriter{w: csv.NewWriter(w)}
+	case FormatXLSX:
+		x, err := newXLSXWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		writer = x
+	default:
+		return nil, ErrUnknownFormat
+	}
+
+	values := make([]interface{}, len(header))
+	for i, h := range header {
+		values[i] = h
+	}
+	if err := writer.WriteRow(values...); err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// ContentType is the MIME type of the format
+func ContentType(format string) string {
+	if format == FormatXLSX {
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+
+	return "text/csv; charset=utf-8"
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) WriteRow(values ...interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		record[i] = formatValue(v)
+		// Numbers can start with "-", only text can be a formula
+		if _, ok := v.(string); ok {
+			record[i] = escapeFormula(record[i])
+		}
+	}
+
+	return c.w.Write(record)
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// escapeFormula prefixes text that a spreadsheet app would run as a formula with "'", so it is shown as text.
+// XLSX cells are typed, so only CSV needs it.
+func escapeFormula(text string) string {
+	if text != "" && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+	return text
+}
+
+// formatValue is how values are written as text, times in RFC 3339 and UTC
+func formatValue(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case int:
+		return strconv.Itoa(value)
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	case time.Time:
+		return value.UTC().Format(time.RFC3339)
+	case *time.Time:
+		if value == nil {
+			return ""
+		}
+		return value.UTC().Format(time.RFC3339)
+	default:
+		return ""
+	}
+}
+
+// The smallest set of parts a spreadsheet app needs to open a workbook with one sheet
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`
+	xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`
+	xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Export" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`
+	xlsxSheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+	xlsxSheetEnd = `</sheetData></worksheet>`
+)
+
+// xlsxWriter writes the fixed parts of the workbook first, and then streams the rows into the sheet,
+// which is the last file in the zip
+type xlsxWriter struct {
+	zip   *zip.Writer
+	sheet io.Writer
+	row   int
+}
+
+func newXLSXWriter(w io.Writer) (*xlsxWriter, error) {
+	z := zip.NewWriter(w)
+	for _, part := range []struct{ name, content string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", xlsxWorkbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+	} {
+		f, err := z.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return nil, err
+		}
+	}
+
+	sheet, err := z.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(sheet, xlsxSheetStart); err != nil {
+		return nil, err
+	}
+
+	return &xlsxWriter{zip: z, sheet: sheet}, nil
+}
+
+func (x *xlsxWriter) WriteRow(values ...interface{}) error {
+	x.row++
+	var b strings.Builder
+	b.WriteString(`<row r="` + strconv.Itoa(x.row) + `">`)
+	for i, v := range values {
+		ref := columnName(i) + strconv.Itoa(x.row)
+		switch value := v.(type) {
+		case nil:
+			continue
+		case int, int64, float64:
+			b.WriteString(`<c r="` + ref + `"><v>` + formatValue(value) + `</v></c>`)
+		case bool:
+			flag := "0"
+			if value {
+				flag = "1"
+			}
+			b.WriteString(`<c r="` + ref + `" t="b"><v>` + flag + `</v></c>`)
+		default:
+			text := formatValue(value)
+			if text == "" {
+				continue
+			}
+			b.WriteString(`<c r="` + ref + `" t="inlineStr"><is><t xml:space="preserve">`)
+			if err := xml.EscapeText(&b, []byte(text)); err != nil {
+				return err
+			}
+			b.WriteString(`</t></is></c>`)
+		}
+	}
+	b.WriteString(`</row>`)
+
+	_, err := io.WriteString(x.sheet, b.String())
+	return err
+}
+
+func (x *xlsxWriter) Close() error {
+	if _, err := io.WriteString(x.sheet, xlsxSheetEnd); err != nil {
+		return err
+	}
+
+	return x.zip.Close()
+}
+
+// columnName is the spreadsheet name of the zero based column, e.g. "A", "Z", "AA"
+func columnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+
+	return name
+}
@@ -0,0 +1,76 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCSV(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, FormatCSV, "name", "amount", "claimed", "at", "none")
+	require.NoError(t, err)
+
+	at := time.Date(2022, 8, 10, 12, 0, 0, 0, time.FixedZone("", 3600))
+	require.NoError(t, w.WriteRow("PET, clear", 1.5, true, at, nil))
+	require.NoError(t, w.WriteRow("HDPE", 2, false, (*time.Time)(nil), nil))
+	require.NoError(t, w.Close())
+
+	require.Equal(t, "name,amount,claimed,at,none\n\"PET, clear\",1.5,true,2022-08-10T11:00:00Z,\nHDPE,2,false,,\n", buf.String())
+}
+
+func TestCSVEscapesFormulas(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, FormatCSV, "externalRef", "amount")
+	require.NoError(t, err)
+	require.NoError(t, w.WriteRow("=HYPERLINK(\"http://example.com\")", -1.5))
+	require.NoError(t, w.WriteRow("+1", 2))
+	require.NoError(t, w.WriteRow("-1", 3))
+	require.NoError(t, w.WriteRow("@SUM(A1)", 4))
+	require.NoError(t, w.WriteRow("\tcmd", 5))
+	require.NoError(t, w.WriteRow("ref=1", 6))
+	require.NoError(t, w.Close())
+
+	require.Equal(t, "externalRef,amount\n\"'=HYPERLINK(\"\"http://example.com\"\")\",-1.5\n'+1,2\n'-1,3\n'@SUM(A1),4\n'\tcmd,5\nref=1,6\n", buf.String())
+}
+
+func TestXLSX(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, FormatXLSX, "name", "amount", "claimed")
+	require.NoError(t, err)
+	require.NoError(t, w.WriteRow("<PET & co>", 1.5, true))
+	require.NoError(t, w.Close())
+
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	files := map[string]string{}
+	for _, f := range z.File {
+		r, err := f.Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(r)
+		require.NoError(t, err)
+		files[f.Name] = string(content)
+	}
+	require.Contains(t, files, "[Content_Types].xml")
+	require.Contains(t, files, "xl/workbook.xml")
+	require.Equal(t, xlsxSheetStart+
+		`<row r="1"><c r="A1" t="inlineStr"><is><t xml:space="preserve">name</t></is></c><c r="B1" t="inlineStr"><is><t xml:space="preserve">amount</t></is></c><c r="C1" t="inlineStr"><is><t xml:space="preserve">claimed</t></is></c></row>`+
+		`<row r="2"><c r="A2" t="inlineStr"><is><t xml:space="preserve">&lt;PET &amp; co&gt;</t></is></c><c r="B2"><v>1.5</v></c><c r="C2" t="b"><v>1</v></c></row>`+
+		xlsxSheetEnd, files["xl/worksheets/sheet1.xml"])
+}
+
+func TestColumnName(t *testing.T) {
+	for i, name := range map[int]string{0: "A", 25: "Z", 26: "AA", 27: "AB", 701: "ZZ", 702: "AAA"} {
+		require.Equal(t, name, columnName(i))
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	_, err := NewWriter(io.Discard, "pdf")
+	require.ErrorIs(t, err, ErrUnknownFormat)
+}
@@ -0,0 +1,208 @@
+// Package idempotency makes it safe for clients to retry mutating API calls.
+//
+// A client sends an Idempotency-Key header with a value it chooses, and reuses the value
+// when it retries the same request, e.g. after a timeout. The first call runs the request and
+// stores its response. Retries with the same key and payload get the stored response back
+// instead of running the request again. Keys are scoped to the caller's pub key.
+//
+// Only successful responses are stored, so a request that failed can be retried with the same key.
+// A request that never finished, e.g. because the server stopped, may have taken effect without its response
+// being stored. Its key is not run again until it expires, and the client has to check the outcome before retrying.
+//
+// Every service using idempotency keys needs this table in its database:
+//
+//	CREATE TABLE idempotency_key
+//	(
+//	    pub_key      TEXT      NOT NULL,
+//	    key          TEXT      NOT NULL,
+//	    request_hash TEXT      NOT NULL,
+//	    response     JSON,
+//	    completed    BOOLEAN   NOT NULL DEFAULT false,
+//	    created_at   TIMESTAMP NOT NULL DEFAULT now(),
+//	    PRIMARY KEY (pub_key, key)
+//	);
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+const (
+	// keyTTL is how long a key is remembered, completed or interrupted. After that, the same key runs the request again.
+	keyTTL = 24 * time.Hour
+	// interruptedAfter is how long a request can be in progress before it is reported as interrupted
+	interruptedAfter = 1 * time.Minute
+)
+
+// Do runs fn once per caller and key, and returns the stored response for retries.
+// operation names the endpoint, so the same key can't be replayed against a different endpoint.
+// Without a key, fn is simply run.
+func Do[T any](ctx context.Context, begin func(ctx context.Context) (*sqldb.Tx, error), operation string, key string, request interface{}, fn func(ctx context.Context) (T, error)) (T, error) {
+	var zero T
+	if key == "" {
+		return fn(ctx)
+	}
+
+	caller, _ := auth.UserID()
+	requestHash, err := hashRequest(operation, request)
+	if err != nil {
+		return zero, err
+	}
+
+	acquired, err := acquire(ctx, begin, string(caller), key, requestHash)
+	if err != nil {
+		return zero, err
+	}
+
+	if !acquired {
+		return replay[T](ctx, begin, string(caller), key, requestHash)
+	}
+
+	resp, fnErr := fn(ctx)
+	if fnErr != nil {
+		// Forget the key, so the client can retry. A failed release is only logged, the client needs the request's error
+		if err := release(ctx, begin, string(caller), key); err != nil {
+			rlog.Error("could not release idempotency key", "operation", operation, "err", err)
+		}
+		return zero, fnErr
+	}
+
+	if err := complete(ctx, begin, string(caller), key, resp); err != nil {
+		return zero, err
+	}
+
+	return resp, nil
+}
+
+func hashRequest(operation string, request interface{}) (string, error) {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(operation))
+	h.Write([]byte{0})
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// acquire claims the key for this request. It is false if the key is already in use.
+// Keys in progress are not taken over before they expire, as their request may have taken effect.
+func acquire(ctx context.Context, begin func(ctx context.Context) (*sqldb.Tx, error), pubKey string, key string, requestHash string) (bool, error) {
+	tx, err := begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Expired keys of the caller are removed here, so they don't stay in the table
+	now := time.Now().UTC()
+	if _, err := tx.Exec(ctx, "DELETE FROM idempotency_key WHERE pub_key=$1 AND created_at < $2", pubKey, now.Add(-keyTTL)); err != nil {
+		return false, err
+	}
+
+	res, err := tx.Exec(ctx, `
+        INSERT INTO idempotency_key (pub_key, key, request_hash, created_at)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (pub_key, key) DO NOTHING
+    `, pubKey, key, requestHash, now)
+	if err != nil {
+		return false, err
+	}
+
+	return res.RowsAffected() == 1, tx.Commit()
+}
+
+func replay[T any](ctx context.Context, begin func(ctx context.Context) (*sqldb.Tx, error), pubKey string, key string, requestHash string) (T, error) {
+	var zero T
+
+	tx, err := begin(ctx)
+	if err != nil {
+		return zero, err
+	}
+	defer tx.Rollback()
+
+	var storedHash string
+	var response *string
+	var completed bool
+	var createdAt time.Time
+	if err := tx.QueryRow(ctx, `
+        SELECT request_hash, response, completed, created_at FROM idempotency_key WHERE pub_key=$1 AND key=$2
+    `, pubKey, key).Scan(&storedHash, &response, &completed, &createdAt); err != nil {
+		return zero, err
+	}
+
+	if storedHash != requestHash {
+		return zero, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "Idempotency-Key was already used for a different request",
+		}
+	}
+
+	if !completed && time.Since(createdAt) > interruptedAfter {
+		return zero, &errs.Error{
+			Code:    errs.Aborted,
+			Message: "the request with this Idempotency-Key was interrupted and may have taken effect, check before retrying with a new key",
+		}
+	}
+	if !completed {
+		return zero, &errs.Error{
+			Code:    errs.Aborted,
+			Message: "a request with this Idempotency-Key is in progress, try again later",
+		}
+	}
+
+	var resp T
+	if response != nil {
+		if err := json.Unmarshal([]byte(*response), &resp); err != nil {
+			return zero, err
+		}
+	}
+
+	return resp, nil
+}
+
+func complete(ctx context.Context, begin func(ctx context.Context) (*sqldb.Tx, error), pubKey string, key string, resp interface{}) error {
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	tx, err := begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(ctx, `
+        UPDATE idempotency_key SET response=$3, completed=true WHERE pub_key=$1 AND key=$2
+    `, pubKey, key, string(payload)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func release(ctx context.Context, begin func(ctx context.Context) (*sqldb.Tx, error), pubKey string, key string) error {
+	tx, err := begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(ctx, "DELETE FROM idempotency_key WHERE pub_key=$1 AND key=$2 AND completed = false", pubKey, key); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,35 @@
+package idempotency
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashRequest(t *testing.T) {
+	type params struct {
+		VoucherID string `json:"voucherID"`
+	}
+
+	hash, err := hashRequest("deposit.InvalidateVoucher", &params{VoucherID: "a"})
+	require.NoError(t, err)
+
+	testTable := []struct {
+		name      string
+		operation string
+		request   interface{}
+		same      bool
+	}{
+		{name: "Same request", operation: "deposit.InvalidateVoucher", request: &params{VoucherID: "a"}, same: true},
+		{name: "Different payload", operation: "deposit.InvalidateVoucher", request: &params{VoucherID: "b"}, same: false},
+		{name: "Different operation", operation: "deposit.Claim", request: &params{VoucherID: "a"}, same: false},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			other, err := hashRequest(test.operation, test.request)
+			require.NoError(t, err)
+			require.Equal(t, test.same, hash == other)
+		})
+	}
+}
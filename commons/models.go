@@ -2,7 +2,10 @@ package commons
 
 import (
 	"math/big"
+	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
 )
 
 type MagnitudeType int
@@ -12,6 +15,22 @@ const (
 	Count
 )
 
+// Unit is what amounts of the magnitude are measured in
+func (m MagnitudeType) Unit() string {
+	switch m {
+	case Weight:
+		return "kg"
+	case Count:
+		return "items"
+	default:
+		return "unknown"
+	}
+}
+
+// PlasticKey is the material definition attribute that classifies an item as plastic ("true") or not ("false").
+// Schemes set it on the item definitions of their reward definitions.
+const PlasticKey = "plastic"
+
 type ItemDefinition struct {
 	MaterialDefinition map[string]string `json:"materialDefinition"`
 	Magnitude          MagnitudeType     `json:"magnitude"`
@@ -21,6 +40,33 @@ func (id ItemDefinition) SameAs(diff ItemDefinition) bool {
 	return reflect.DeepEqual(id, diff) && id.Magnitude == diff.Magnitude
 }
 
+// MaterialKey is a canonical form of the material definition, with the attributes sorted and escaped,
+// e.g. "color=clear&materialType=PET". Equal material definitions have the same key.
+func (id ItemDefinition) MaterialKey() string {
+	values := url.Values{}
+	for k, v := range id.MaterialDefinition {
+		values.Set(k, v)
+	}
+
+	return values.Encode()
+}
+
+// Key is a canonical form of the whole item definition, e.g. "color=clear&materialType=PET|0".
+// Items with the same key are the same, as in SameAs.
+func (id ItemDefinition) Key() string {
+	return id.MaterialKey() + "|" + strconv.Itoa(int(id.Magnitude))
+}
+
+// IsPlastic tells if the material is a plastic, by its plastic attribute.
+// classified is false for items without the attribute, which are not known to be plastic or not.
+func (id ItemDefinition) IsPlastic() (isPlastic bool, classified bool) {
+	value, ok := id.MaterialDefinition[PlasticKey]
+	if !ok {
+		return false, false
+	}
+	return strings.EqualFold(value, "true"), true
+}
+
 type MassBalance struct {
 	ItemDefinition ItemDefinition `json:"itemDefinition"`
 	Amount         float64        `json:"amount"`
@@ -85,3 +85,76 @@ func TestGetRewardsFor(t *testing.T) {
 		})
 	}
 }
+
+func TestItemDefinitionKey(t *testing.T) {
+	testTable := []struct {
+		name        string
+		definition  ItemDefinition
+		materialKey string
+		key         string
+	}{
+		{
+			name:        "One attribute",
+			definition:  defaultItemDefinition,
+			materialKey: "materialType=PET",
+			key:         "materialType=PET|0",
+		},
+		{
+			name: "Attributes are sorted",
+			definition: ItemDefinition{
+				MaterialDefinition: map[string]string{"materialType": "PET", "color": "clear", "shape": "bottle"},
+				Magnitude:          Count,
+			},
+			materialKey: "color=clear&materialType=PET&shape=bottle",
+			key:         "color=clear&materialType=PET&shape=bottle|1",
+		},
+		{
+			name: "Separators are escaped",
+			definition: ItemDefinition{
+				MaterialDefinition: map[string]string{"materialType": "PET&color=clear"},
+				Magnitude:          Weight,
+			},
+			materialKey: "materialType=PET%26color%3Dclear",
+			key:         "materialType=PET%26color%3Dclear|0",
+		},
+		{
+			name:        "No attributes",
+			definition:  ItemDefinition{Magnitude: Count},
+			materialKey: "",
+			key:         "|1",
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			// Map iteration order must not matter
+			for i := 0; i < 10; i++ {
+				require.Equal(t, test.materialKey, test.definition.MaterialKey())
+				require.Equal(t, test.key, test.definition.Key())
+			}
+		})
+	}
+}
+
+func TestIsPlastic(t *testing.T) {
+	testTable := []struct {
+		materialDefinition map[string]string
+		isPlastic          bool
+		classified         bool
+	}{
+		{map[string]string{"materialType": "PET", "plastic": "true"}, true, true},
+		{map[string]string{"plasticType": "LDPE", "plastic": "TRUE"}, true, true},
+		{map[string]string{"materialType": "GLASS", "plastic": "false"}, false, true},
+		{map[string]string{"materialType": "PET"}, false, false},
+		{map[string]string{"plasticType": "LDPE"}, false, false},
+		{nil, false, false},
+	}
+
+	for _, test := range testTable {
+		t.Run(fmt.Sprintf("%v", test.materialDefinition), func(t *testing.T) {
+			isPlastic, classified := ItemDefinition{MaterialDefinition: test.materialDefinition}.IsPlastic()
+			require.Equal(t, test.isPlastic, isPlastic)
+			require.Equal(t, test.classified, classified)
+		})
+	}
+}
@@ -0,0 +1,203 @@
+// Package outbox implements the transactional outbox used to publish domain events.
+//
+// Services write events to their own outbox table in the same transaction as the change
+// the event describes, so an event is never lost and never sent for a rolled-back
+// transaction. A relay (typically a cron job) then publishes the stored events to Pub/Sub.
+// Events that keep failing to publish are dead-lettered after MaxAttempts, so they never block the rest.
+//
+// Every service using the outbox needs this table in its database:
+//
+//	CREATE TABLE outbox
+//	(
+//	    id               TEXT PRIMARY KEY,
+//	    event_type       TEXT      NOT NULL,
+//	    payload          JSON      NOT NULL,
+//	    created_at       TIMESTAMP NOT NULL DEFAULT now(),
+//	    published_at     TIMESTAMP,
+//	    attempts         INT       NOT NULL DEFAULT 0,
+//	    last_error       TEXT      NOT NULL DEFAULT '',
+//	    claimed_until    TIMESTAMP,
+//	    dead_lettered_at TIMESTAMP
+//	);
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"encore.app/commons"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+const (
+	// relayBatchSize is the maximum number of events published per Relay call
+	relayBatchSize = 100
+	// claimTimeout is how long a relay has to publish the events it claimed, before they can be claimed again
+	claimTimeout = 5 * time.Minute
+	// MaxAttempts is how often an event is tried before it is dead-lettered
+	MaxAttempts = 10
+)
+
+// Metadata is embedded in every event. It is set by Enqueue.
+// Delivery is at-least-once, so consumers should use EventID to deduplicate.
+type Metadata struct {
+	EventID    string    `json:"eventID"`
+	OccurredAt time.Time `json:"occurredAt"`
+}
+
+func (m *Metadata) metadata() *Metadata {
+	return m
+}
+
+type Event interface {
+	EventType() string
+	metadata() *Metadata
+}
+
+// PublishFunc publishes a stored event to the topic matching eventType.
+type PublishFunc func(ctx context.Context, eventType string, payload []byte) error
+
+// Enqueue stores the event in the outbox as part of tx.
+func Enqueue(ctx context.Context, tx *sqldb.Tx, event Event) error {
+	m := event.metadata()
+	m.EventID = commons.GenerateID()
+	m.OccurredAt = time.Now().UTC()
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+        INSERT INTO outbox (id, event_type, payload, created_at)
+        VALUES ($1, $2, $3, $4)
+    `, m.EventID, event.EventType(), string(payload), m.OccurredAt)
+	return err
+}
+
+type RelayResult struct {
+	Published int
+	Failed    int
+	// DeadLettered are the failed events that will not be tried again
+	DeadLettered int
+}
+
+// Relay publishes unpublished events in the order they were stored and marks them as published.
+// Events are claimed in their own transaction before they are published, so concurrent relays never publish
+// the same event twice, and no transaction is held open while publishing. An event that fails to publish is
+// retried by the next Relay call, until it has failed MaxAttempts times and is dead-lettered.
+// Only database errors are returned, publish errors are recorded on the event.
+func Relay(ctx context.Context, begin func(ctx context.Context) (*sqldb.Tx, error), publish PublishFunc) (*RelayResult, error) {
+	pending, err := claim(ctx, begin)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RelayResult{}
+	var published []string
+	failures := map[string]string{}
+	for _, e := range pending {
+		if err := publish(ctx, e.eventType, []byte(e.payload)); err != nil {
+			failures[e.id] = err.Error()
+			result.Failed++
+			if e.attempts >= MaxAttempts {
+				result.DeadLettered++
+				rlog.Error("dead-lettering outbox event", "eventID", e.id, "eventType", e.eventType, "attempts", e.attempts, "err", err)
+			} else {
+				rlog.Info("failed to publish outbox event", "eventID", e.id, "eventType", e.eventType, "attempts", e.attempts, "err", err)
+			}
+			continue
+		}
+		published = append(published, e.id)
+	}
+	result.Published = len(published)
+
+	tx, err := begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if len(published) > 0 {
+		if _, err := tx.Exec(ctx, "UPDATE outbox SET published_at = now(), claimed_until = NULL WHERE id = ANY($1)", published); err != nil {
+			return nil, err
+		}
+	}
+	for id, msg := range failures {
+		if _, err := tx.Exec(ctx, `
+            UPDATE outbox SET claimed_until = NULL, last_error = $2,
+                dead_lettered_at = CASE WHEN attempts >= $3 THEN now() END
+            WHERE id = $1
+        `, id, msg, MaxAttempts); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+type storedEvent struct {
+	id        string
+	eventType string
+	payload   string
+	attempts  int
+	createdAt time.Time
+}
+
+// claim takes the next unpublished events for claimTimeout, and counts the attempt to publish them
+func claim(ctx context.Context, begin func(ctx context.Context) (*sqldb.Tx, error)) ([]storedEvent, error) {
+	tx, err := begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(ctx, `
+        UPDATE outbox SET attempts = attempts + 1, claimed_until = now() + $2 * interval '1 second'
+        WHERE id IN (
+            SELECT id FROM outbox
+            WHERE published_at IS NULL AND dead_lettered_at IS NULL AND (claimed_until IS NULL OR claimed_until < now())
+            ORDER BY created_at, id
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, event_type, payload, attempts, created_at
+    `, relayBatchSize, claimTimeout.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []storedEvent
+	for rows.Next() {
+		var e storedEvent
+		if err := rows.Scan(&e.id, &e.eventType, &e.payload, &e.attempts, &e.createdAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		pending = append(pending, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].createdAt.Equal(pending[j].createdAt) {
+			return pending[i].id < pending[j].id
+		}
+		return pending[i].createdAt.Before(pending[j].createdAt)
+	})
+
+	return pending, nil
+}
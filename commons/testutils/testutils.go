@@ -21,6 +21,7 @@ var (
 	orgDB     = sqldb.Named("organization")
 	depositDB = sqldb.Named("deposit")
 	schemeDB  = sqldb.Named("scheme")
+	webhookDB = sqldb.Named("webhook")
 )
 
 var defaultSigner = secp256k1.GenPrivKey()
@@ -40,13 +41,17 @@ func GenerateKeys() (publicKey string, privateKey *secp256k1.PrivKey) {
 }
 
 func ClearAllDBs() {
-	if err := ClearDB(orgDB, "organization"); err != nil {
+	if err := ClearDB(orgDB, "organization", "user_organization"); err != nil {
 		panic(err)
 	}
-	if err := ClearDB(depositDB, "deposit", "voucher", "voucher_definition"); err != nil {
+	if err := ClearDB(depositDB, "deposit", "voucher", "voucher_definition", "outbox", "activity", "evidence", "claim_code", "claim_code_attempt_window", "idempotency_key",
+		"stats_user", "stats_user_material", "stats_user_scheme", "stats_daily", "stats_daily_material", "credit_batch_item", "credit_batch", "deposit_chain", "deposit_chain_checkpoint", "leaderboard_opt_in"); err != nil {
 		panic(err)
 	}
-	if err := ClearDB(schemeDB, "scheme"); err != nil {
+	if err := ClearDB(schemeDB, "scheme", "outbox", "idempotency_key"); err != nil {
+		panic(err)
+	}
+	if err := ClearDB(webhookDB, "webhook_delivery", "webhook_endpoint"); err != nil {
 		panic(err)
 	}
 }
@@ -86,11 +91,17 @@ func EnsureExclusiveDatabaseAccess(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	webhookLockTx, err := webhookDB.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	t.Cleanup(func() {
 		adminLockTx.Rollback()
 		orgLockTx.Rollback()
 		depLockTx.Rollback()
 		schemeLockTx.Rollback()
+		webhookLockTx.Rollback()
 	})
 
 	if _, err := adminLockTx.Exec(ctx, "SELECT pg_advisory_lock(1)"); err != nil {
@@ -108,4 +119,8 @@ func EnsureExclusiveDatabaseAccess(t *testing.T) {
 	if _, err := schemeLockTx.Exec(ctx, "SELECT pg_advisory_lock(1)"); err != nil {
 		t.Fatal(err)
 	}
+
+	if _, err := webhookLockTx.Exec(ctx, "SELECT pg_advisory_lock(1)"); err != nil {
+		t.Fatal(err)
+	}
 }
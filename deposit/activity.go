@@ -0,0 +1,67 @@
+package deposit
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"encore.app/commons"
+	"encore.dev/storage/sqldb"
+)
+
+// activity is a persisted entry in a user's history, written in the same transaction as the change it describes
+type activity struct {
+	UserPubKey          string
+	EventType           string
+	DepositID           string
+	VoucherID           string
+	VoucherDefinitionID string
+	CounterpartyPubKey  string
+	UnitNameIn          string
+	NumberOfUnitsIn     float64
+	UnitNameOut         string
+	NumberOfUnitsOut    float64
+}
+
+func recordActivity(ctx context.Context, tx *sqldb.Tx, a activity) error {
+	_, err := tx.Exec(ctx, `
+        INSERT INTO activity (user_pub_key, event_type, deposit_id, voucher_id, voucher_definition_id, counterparty_pub_key,
+                              unit_name_in, number_of_units_in, unit_name_out, number_of_units_out)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+    `, a.UserPubKey, a.EventType, a.DepositID, a.VoucherID, a.VoucherDefinitionID, a.CounterpartyPubKey,
+		a.UnitNameIn, a.NumberOfUnitsIn, a.UnitNameOut, a.NumberOfUnitsOut)
+	return err
+}
+
+// recordDepositActivity records one activity per item in the deposit
+func recordDepositActivity(ctx context.Context, tx *sqldb.Tx, eventType string, deposit *Deposit) error {
+	for _, item := range deposit.MassBalanceDeposits {
+		if err := recordActivity(ctx, tx, activity{
+			UserPubKey:       deposit.UserPubKey,
+			EventType:        eventType,
+			DepositID:        deposit.ID,
+			UnitNameOut:      materialName(item.ItemDefinition),
+			NumberOfUnitsOut: item.Amount,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// materialName is a human-readable name for the material, e.g. "PET" for {"materialType": "PET"}
+func materialName(itemDefinition commons.ItemDefinition) string {
+	keys := make([]string, 0, len(itemDefinition.MaterialDefinition))
+	for k := range itemDefinition.MaterialDefinition {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	values := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values = append(values, itemDefinition.MaterialDefinition[k])
+	}
+
+	return strings.Join(values, " ")
+}
@@ -0,0 +1,279 @@
+package deposit
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"encore.app/admin"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+// The stats_ tables aggregate deposits and vouchers for the stats service, see migration 14.
+// Only approved deposits are counted.
+// They are updated in the same transaction as the change they count, and RebuildStats recomputes them.
+
+// countDepositApproved adds a deposit to the daily aggregates once it is approved, when it is made or after review.
+// Pending and rejected deposits are not counted.
+func countDepositApproved(ctx context.Context, tx *sqldb.Tx, deposit *Deposit) error {
+	if err := addDailyDeposits(ctx, tx, deposit, 1, 0); err != nil {
+		return err
+	}
+
+	return addDailyMaterials(ctx, tx, deposit, 1)
+}
+
+// countDepositClaimed adds a deposit that was just claimed to the claim and user aggregates
+func countDepositClaimed(ctx context.Context, tx *sqldb.Tx, deposit *Deposit) error {
+	if err := addDailyDeposits(ctx, tx, deposit, 0, 1); err != nil {
+		return err
+	}
+
+	return addUserDeposit(ctx, tx, deposit, 1)
+}
+
+// countDepositReversed takes a deposit that was just reversed out of all aggregates.
+// The deposit is as it was before the reversal.
+func countDepositReversed(ctx context.Context, tx *sqldb.Tx, deposit *Deposit) error {
+	if deposit.Status != StatusApproved {
+		// Never counted
+		return nil
+	}
+
+	claimed := 0
+	if deposit.Claimed {
+		claimed = -1
+		if err := addUserDeposit(ctx, tx, deposit, -1); err != nil {
+			return err
+		}
+	}
+
+	if err := addDailyDeposits(ctx, tx, deposit, -1, claimed); err != nil {
+		return err
+	}
+
+	return addDailyMaterials(ctx, tx, deposit, -1)
+}
+
+// countVouchers adds to the vouchers available to and used by the user
+func countVouchers(ctx context.Context, tx *sqldb.Tx, userPubKey string, available int, used int) error {
+	_, err := tx.Exec(ctx, `
+        INSERT INTO stats_user (user_pub_key, available_vouchers, used_vouchers) VALUES ($1, $2, $3)
+        ON CONFLICT (user_pub_key) DO UPDATE
+        SET available_vouchers = stats_user.available_vouchers + EXCLUDED.available_vouchers,
+            used_vouchers = stats_user.used_vouchers + EXCLUDED.used_vouchers
+    `, userPubKey, available, used)
+	return err
+}
+
+func addDailyDeposits(ctx context.Context, tx *sqldb.Tx, deposit *Deposit, deposits int, claimed int) error {
+	_, err := tx.Exec(ctx, `
+        INSERT INTO stats_daily (day, scheme_id, collection_point_pub_key, deposits, claimed) VALUES ($1::timestamp::date, $2, $3, $4, $5)
+        ON CONFLICT (day, scheme_id, collection_point_pub_key) DO UPDATE
+        SET deposits = stats_daily.deposits + EXCLUDED.deposits, claimed = stats_daily.claimed + EXCLUDED.claimed
+    `, deposit.CapturedAt.UTC(), deposit.SchemeID, deposit.CollectionPointPubKey, deposits, claimed)
+	return err
+}
+
+func addDailyMaterials(ctx context.Context, tx *sqldb.Tx, deposit *Deposit, sign float64) error {
+	for _, item := range deposit.MassBalanceDeposits {
+		materialDefinition, err := json.Marshal(item.ItemDefinition.MaterialDefinition)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, `
+            INSERT INTO stats_daily_material (day, scheme_id, collection_point_pub_key, material_definition, magnitude, amount)
+            VALUES ($1::timestamp::date, $2, $3, $4::jsonb, $5, $6)
+            ON CONFLICT (day, scheme_id, collection_point_pub_key, material_definition, magnitude) DO UPDATE
+            SET amount = stats_daily_material.amount + EXCLUDED.amount
+        `, deposit.CapturedAt.UTC(), deposit.SchemeID, deposit.CollectionPointPubKey, string(materialDefinition),
+			int(item.ItemDefinition.Magnitude), sign*item.Amount); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addUserDeposit(ctx context.Context, tx *sqldb.Tx, deposit *Deposit, sign int) error {
+	if _, err := tx.Exec(ctx, `
+        INSERT INTO stats_user_scheme (user_pub_key, scheme_id, deposits) VALUES ($1, $2, $3)
+        ON CONFLICT (user_pub_key, scheme_id) DO UPDATE SET deposits = stats_user_scheme.deposits + EXCLUDED.deposits
+    `, deposit.UserPubKey, deposit.SchemeID, sign); err != nil {
+		return err
+	}
+
+	for _, item := range deposit.MassBalanceDeposits {
+		materialDefinition, err := json.Marshal(item.ItemDefinition.MaterialDefinition)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, `
+            INSERT INTO stats_user_material (user_pub_key, material_definition, magnitude, amount) VALUES ($1, $2::jsonb, $3, $4)
+            ON CONFLICT (user_pub_key, material_definition, magnitude) DO UPDATE
+            SET amount = stats_user_material.amount + EXCLUDED.amount
+        `, deposit.UserPubKey, string(materialDefinition), int(item.ItemDefinition.Magnitude), float64(sign)*item.Amount); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// aggregateTable is a stats table and the query that computes it from scratch
+type aggregateTable struct {
+	Name    string
+	Keys    []string
+	Values  []string
+	Rebuild string
+}
+
+// aggregateTables are rebuilt with the same queries as the backfills in migrations 14 and 21
+var aggregateTables = []aggregateTable{
+	{
+		Name:   "stats_user",
+		Keys:   []string{"user_pub_key"},
+		Values: []string{"available_vouchers", "used_vouchers"},
+		Rebuild: `
+            SELECT owner_pub_key AS user_pub_key, count(*) FILTER (WHERE NOT invalidated) AS available_vouchers,
+                   count(*) FILTER (WHERE invalidated) AS used_vouchers
+            FROM voucher
+            WHERE owner_pub_key IS NOT NULL AND owner_pub_key <> ''
+            GROUP BY 1`,
+	},
+	{
+		Name:   "stats_user_material",
+		Keys:   []string{"user_pub_key", "material_definition", "magnitude"},
+		Values: []string{"amount"},
+		Rebuild: `
+            SELECT d.user_pub_key, (item -> 'itemDefinition' -> 'materialDefinition')::jsonb AS material_definition,
+                   (item -> 'itemDefinition' ->> 'magnitude')::int AS magnitude, SUM((item ->> 'amount')::float) AS amount
+            FROM deposit d, json_array_elements(d.mass_balance_deposits) item
+            WHERE d.claimed = true AND d.reversed = false
+            GROUP BY 1, 2, 3`,
+	},
+	{
+		Name:   "stats_user_scheme",
+		Keys:   []string{"user_pub_key", "scheme_id"},
+		Values: []string{"deposits"},
+		Rebuild: `
+            SELECT user_pub_key, scheme_id, count(*) AS deposits
+            FROM deposit
+            WHERE claimed = true AND reversed = false
+            GROUP BY 1, 2`,
+	},
+	{
+		Name:   "stats_daily",
+		Keys:   []string{"day", "scheme_id", "collection_point_pub_key"},
+		Values: []string{"deposits", "claimed"},
+		Rebuild: `
+            SELECT captured_at::date AS day, scheme_id, collection_point_pub_key, count(*) AS deposits,
+                   count(*) FILTER (WHERE claimed) AS claimed
+            FROM deposit
+            WHERE status = 'APPROVED' AND reversed = false
+            GROUP BY 1, 2, 3`,
+	},
+	{
+		Name:   "stats_daily_material",
+		Keys:   []string{"day", "scheme_id", "collection_point_pub_key", "material_definition", "magnitude"},
+		Values: []string{"amount"},
+		Rebuild: `
+            SELECT d.captured_at::date AS day, d.scheme_id, d.collection_point_pub_key,
+                   (item -> 'itemDefinition' -> 'materialDefinition')::jsonb AS material_definition,
+                   (item -> 'itemDefinition' ->> 'magnitude')::int AS magnitude, SUM((item ->> 'amount')::float) AS amount
+            FROM deposit d, json_array_elements(d.mass_balance_deposits) item
+            WHERE d.status = 'APPROVED' AND d.reversed = false
+            GROUP BY 1, 2, 3, 4, 5`,
+	},
+}
+
+type RebuildStatsResponse struct {
+	// Mismatches is the number of rows per table that were different from what was rebuilt, which should be 0
+	Mismatches map[string]int `json:"mismatches"`
+}
+
+// RebuildStats recomputes the stats aggregates from the deposits and vouchers, and reports where they were off
+//encore:api auth method=POST
+func RebuildStats(ctx context.Context) (*RebuildStatsResponse, error) {
+	caller, _ := auth.UserID()
+	isAdminResp, err := admin.IsAdmin(ctx, &admin.IsAdminParams{PubKey: string(caller)})
+	if err != nil {
+		return nil, err
+	}
+	if !isAdminResp.IsAdmin {
+		return nil, &errs.Error{
+			Code: errs.PermissionDenied,
+		}
+	}
+
+	return rebuildStats(ctx)
+}
+
+func rebuildStats(ctx context.Context) (*RebuildStatsResponse, error) {
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Changes made meanwhile wait for the rebuild, and are then counted on top of it
+	names := make([]string, 0, len(aggregateTables))
+	for _, t := range aggregateTables {
+		names = append(names, t.Name)
+	}
+	if _, err := tx.Exec(ctx, "LOCK TABLE "+strings.Join(names, ", ")+" IN EXCLUSIVE MODE"); err != nil {
+		return nil, err
+	}
+
+	resp := &RebuildStatsResponse{Mismatches: map[string]int{}}
+	for _, t := range aggregateTables {
+		mismatches, err := rebuildAggregateTable(ctx, tx, t)
+		if err != nil {
+			return nil, err
+		}
+		resp.Mismatches[t.Name] = mismatches
+	}
+
+	return resp, tx.Commit()
+}
+
+func rebuildAggregateTable(ctx context.Context, tx *sqldb.Tx, t aggregateTable) (int, error) {
+	if _, err := tx.Exec(ctx, "CREATE TEMPORARY TABLE rebuilt ON COMMIT DROP AS "+t.Rebuild); err != nil {
+		return 0, err
+	}
+
+	join := make([]string, 0, len(t.Keys))
+	for _, k := range t.Keys {
+		join = append(join, "cur."+k+" = rebuilt."+k)
+	}
+	// Rows counted down to zero are the same as missing rows, and sums may differ in the last digits
+	differs := make([]string, 0, len(t.Values))
+	for _, v := range t.Values {
+		differs = append(differs, "round(COALESCE(cur."+v+", 0)::numeric, 6) <> round(COALESCE(rebuilt."+v+", 0)::numeric, 6)")
+	}
+
+	var mismatches int
+	if err := tx.QueryRow(ctx, `
+        SELECT count(*) FROM `+t.Name+` cur FULL JOIN rebuilt ON `+strings.Join(join, " AND ")+`
+        WHERE `+strings.Join(differs, " OR "),
+	).Scan(&mismatches); err != nil {
+		return 0, err
+	}
+
+	columns := strings.Join(append(append([]string{}, t.Keys...), t.Values...), ", ")
+	if _, err := tx.Exec(ctx, "DELETE FROM "+t.Name); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, "INSERT INTO "+t.Name+" ("+columns+") SELECT "+columns+" FROM rebuilt"); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, "DROP TABLE rebuilt"); err != nil {
+		return 0, err
+	}
+
+	return mismatches, nil
+}
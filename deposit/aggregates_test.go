@@ -0,0 +1,142 @@
+package deposit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/admin"
+	"encore.app/commons"
+	"encore.app/commons/testutils"
+	"encore.app/scheme"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebuildStats(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	poolPubKey, _ := testutils.GenerateKeys()
+	testScheme, orgSigningKey, collectionPointPubKey := setupTestScheme(t)
+	require.NoError(t, scheme.EditScheme(testutils.GetAuthenticatedContext(orgSigningKey), &scheme.EditSchemeParams{
+		SchemeID:          testScheme.ID,
+		RewardDefinitions: testScheme.RewardDefinitions,
+		CollectionPoints:  []string{collectionPointPubKey},
+		ExpiryPolicy:      &scheme.ExpiryPolicy{ClaimPeriodDays: 30, Destination: scheme.ExpiryDonate, CommunityPoolPubKey: poolPubKey},
+	}))
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+
+	// Every change that is counted: deposits made, claimed, reversed and expired, and vouchers redeemed
+	lastMonth := time.Now().UTC().AddDate(0, 0, -31)
+	_, err := MakeDeposit(ctx, &MakeDepositParams{SchemeID: testScheme.ID, MassBalanceDeposits: defaultTestDeposit, CapturedAt: &lastMonth})
+	require.NoError(t, err)
+	claimed, err := MakeDeposit(ctx, &MakeDepositParams{SchemeID: testScheme.ID, MassBalanceDeposits: defaultTestDeposit, UserPubKey: testUserPubKey})
+	require.NoError(t, err)
+	unclaimed, err := MakeDeposit(ctx, &MakeDepositParams{SchemeID: testScheme.ID, MassBalanceDeposits: defaultTestDeposit})
+	require.NoError(t, err)
+	_, err = Claim(testutils.GetAuthenticatedContext(testUserPubKey), &ClaimParams{DepositID: unclaimed.ID, UserPubKey: testUserPubKey})
+	require.NoError(t, err)
+
+	vouchers, err := GetVouchersForUser(testutils.GetAuthenticatedContext(testUserPubKey), &GetVouchersForUserParams{UserPubKey: testUserPubKey})
+	require.NoError(t, err)
+	require.NoError(t, InvalidateVoucher(testutils.GetAuthenticatedContext(testUserPubKey), &InvalidateVoucherParams{VoucherID: vouchers.Vouchers[0].Voucher.ID}))
+
+	_, err = ReverseDeposit(testutils.GetAuthenticatedContext(orgSigningKey), &ReverseDepositParams{DepositID: claimed.ID, Reason: "Test"})
+	require.NoError(t, err)
+	expired, err := ExpireDeposits(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, expired.Expired)
+
+	resp, err := RebuildStats(testutils.GetAuthenticatedContext(testutils.AdminPubKey))
+	require.NoError(t, err)
+	require.Equal(t, len(aggregateTables), len(resp.Mismatches))
+	for table, mismatches := range resp.Mismatches {
+		require.Equal(t, 0, mismatches, table)
+	}
+
+	// Tampering is found and fixed
+	_, err = depositDB.Exec(context.Background(), "UPDATE stats_user SET available_vouchers = 1000 WHERE user_pub_key=$1", testUserPubKey)
+	require.NoError(t, err)
+	_, err = depositDB.Exec(context.Background(), "DELETE FROM stats_daily_material")
+	require.NoError(t, err)
+
+	resp, err = RebuildStats(testutils.GetAuthenticatedContext(testutils.AdminPubKey))
+	require.NoError(t, err)
+	require.Equal(t, 1, resp.Mismatches["stats_user"])
+	require.Equal(t, 2, resp.Mismatches["stats_daily_material"])
+
+	resp, err = RebuildStats(testutils.GetAuthenticatedContext(testutils.AdminPubKey))
+	require.NoError(t, err)
+	for table, mismatches := range resp.Mismatches {
+		require.Equal(t, 0, mismatches, table)
+	}
+
+	_, err = RebuildStats(testutils.GetAuthenticatedContext(collectionPointPubKey))
+	require.Error(t, err)
+	require.Equal(t, errs.PermissionDenied, err.(*errs.Error).Code)
+}
+
+func TestStatsCountOnlyApprovedDeposits(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupApprovalTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+	orgCtx := testutils.GetAuthenticatedContext(orgSigningKey)
+
+	large := []commons.MassBalance{{ItemDefinition: defaultTestRewards.ItemDefinition, Amount: 50}}
+	var pending []*Deposit
+	for i := 0; i < 3; i++ {
+		deposit, err := MakeDeposit(ctx, &MakeDepositParams{SchemeID: testScheme.ID, MassBalanceDeposits: large})
+		require.NoError(t, err)
+		require.Equal(t, StatusPending, deposit.Status)
+		pending = append(pending, deposit)
+	}
+
+	deposits := func() (int, float64) {
+		stats, err := GetDepositStats(context.Background(), &GetDepositStatsParams{SchemeIDs: []string{testScheme.ID}})
+		require.NoError(t, err)
+		weight := 0.0
+		for _, m := range stats.Materials {
+			weight += m.Amount
+		}
+		if len(stats.Schemes) == 0 {
+			return 0, weight
+		}
+		return stats.Schemes[0].Deposits, weight
+	}
+
+	count, weight := deposits()
+	require.Equal(t, 0, count)
+	require.Equal(t, 0.0, weight)
+
+	_, err := ApproveDeposit(orgCtx, &ApproveDepositParams{DepositID: pending[0].ID})
+	require.NoError(t, err)
+	_, err = RejectDeposit(orgCtx, &RejectDepositParams{DepositID: pending[1].ID, Notes: "Wrong scale"})
+	require.NoError(t, err)
+	_, err = ReverseDeposit(orgCtx, &ReverseDepositParams{DepositID: pending[2].ID, Reason: "Test"})
+	require.NoError(t, err)
+
+	count, weight = deposits()
+	require.Equal(t, 1, count)
+	require.Equal(t, 50.0, weight)
+
+	collectionPoints, err := GetCollectionPointStats(context.Background(), &GetCollectionPointStatsParams{SchemeID: testScheme.ID})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(collectionPoints.CollectionPoints))
+	require.Equal(t, 1, collectionPoints.CollectionPoints[0].Deposits)
+
+	series, err := GetTimeSeries(context.Background(), &GetTimeSeriesParams{SchemeIDs: []string{testScheme.ID}, Interval: IntervalDay, TimeZone: "UTC"})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(series.Buckets))
+	require.Equal(t, 1, series.Buckets[0].Deposits)
+
+	resp, err := RebuildStats(testutils.GetAuthenticatedContext(testutils.AdminPubKey))
+	require.NoError(t, err)
+	for table, mismatches := range resp.Mismatches {
+		require.Equal(t, 0, mismatches, table)
+	}
+}
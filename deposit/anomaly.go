@@ -0,0 +1,127 @@
+package deposit
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/scheme"
+	"encore.dev/storage/sqldb"
+)
+
+// Flags set by the scheme's anomaly rules. Deposits with any of them are held for review.
+const (
+	FlagRepeatedAmount       = "REPEATED_AMOUNT"
+	FlagOutsideOpeningHours  = "OUTSIDE_OPENING_HOURS"
+	FlagVolumeAboveHistory   = "VOLUME_ABOVE_HISTORY"
+	FlagManyCollectionPoints = "USER_AT_MANY_COLLECTION_POINTS"
+)
+
+// minDepositsForVolumeHistory is the history a collection point needs before its volume is compared to it
+const minDepositsForVolumeHistory = 5
+
+// detectAnomalies returns the flags for the deposit under the scheme's anomaly rules.
+// The deposit is not stored yet, so it is not part of the history it is compared to.
+func detectAnomalies(ctx context.Context, rules scheme.AnomalyRules, deposit *Deposit, userPubKey string) ([]string, error) {
+	var flags []string
+
+	if rules.RepeatedAmountCount > 0 {
+		repeated, err := isRepeatedAmount(ctx, rules, deposit)
+		if err != nil {
+			return nil, err
+		}
+		if repeated {
+			flags = append(flags, FlagRepeatedAmount)
+		}
+	}
+
+	if rules.OpeningHours != nil && !rules.OpeningHours.IsOpenAt(deposit.CapturedAt) {
+		flags = append(flags, FlagOutsideOpeningHours)
+	}
+
+	if rules.VolumeFactor > 0 {
+		aboveHistory, err := isVolumeAboveHistory(ctx, rules, deposit)
+		if err != nil {
+			return nil, err
+		}
+		if aboveHistory {
+			flags = append(flags, FlagVolumeAboveHistory)
+		}
+	}
+
+	if rules.MaxCollectionPointsPerUser > 0 && userPubKey != "" {
+		tooMany, err := isUserAtManyCollectionPoints(ctx, rules, deposit, userPubKey)
+		if err != nil {
+			return nil, err
+		}
+		if tooMany {
+			flags = append(flags, FlagManyCollectionPoints)
+		}
+	}
+
+	return flags, nil
+}
+
+func isRepeatedAmount(ctx context.Context, rules scheme.AnomalyRules, deposit *Deposit) (bool, error) {
+	items, err := json.Marshal(deposit.MassBalanceDeposits)
+	if err != nil {
+		return false, err
+	}
+
+	window := time.Duration(rules.RepeatedAmountWindowMinutes) * time.Minute
+	var count int
+	if err := sqldb.QueryRow(ctx, `
+        SELECT count(*) FROM deposit
+        WHERE collection_point_pub_key=$1 AND mass_balance_deposits::jsonb = $2::jsonb
+          AND captured_at > $3 AND captured_at <= $4 AND reversed = false
+    `, deposit.CollectionPointPubKey, string(items), deposit.CapturedAt.Add(-window), deposit.CapturedAt).Scan(&count); err != nil {
+		return false, err
+	}
+
+	return count+1 >= rules.RepeatedAmountCount, nil
+}
+
+func isVolumeAboveHistory(ctx context.Context, rules scheme.AnomalyRules, deposit *Deposit) (bool, error) {
+	var average float64
+	var count int
+	if err := sqldb.QueryRow(ctx, `
+        SELECT COALESCE(AVG(total), 0), count(*) FROM (
+            SELECT (SELECT COALESCE(SUM((item->>'amount')::float), 0) FROM json_array_elements(mass_balance_deposits) item) AS total
+            FROM deposit
+            WHERE collection_point_pub_key=$1 AND captured_at >= $2 AND captured_at < $3 AND reversed = false
+        ) history
+    `, deposit.CollectionPointPubKey, deposit.CapturedAt.AddDate(0, 0, -rules.VolumeHistoryDays), deposit.CapturedAt).Scan(&average, &count); err != nil {
+		return false, err
+	}
+
+	// Too little history to tell what is normal for the collection point
+	if count < minDepositsForVolumeHistory {
+		return false, nil
+	}
+
+	return totalAmount(deposit.MassBalanceDeposits) > average*rules.VolumeFactor, nil
+}
+
+func isUserAtManyCollectionPoints(ctx context.Context, rules scheme.AnomalyRules, deposit *Deposit, userPubKey string) (bool, error) {
+	window := time.Duration(rules.CollectionPointsWindowHours) * time.Hour
+	var count int
+	if err := sqldb.QueryRow(ctx, `
+        SELECT count(DISTINCT collection_point_pub_key) FROM deposit
+        WHERE user_pub_key=$1 AND collection_point_pub_key <> $2 AND captured_at > $3 AND captured_at <= $4 AND reversed = false
+    `, userPubKey, deposit.CollectionPointPubKey, deposit.CapturedAt.Add(-window), deposit.CapturedAt).Scan(&count); err != nil {
+		return false, err
+	}
+
+	// Including the collection point making this deposit
+	return count+1 > rules.MaxCollectionPointsPerUser, nil
+}
+
+func totalAmount(items []commons.MassBalance) float64 {
+	total := 0.0
+	for _, item := range items {
+		total += item.Amount
+	}
+
+	return total
+}
@@ -0,0 +1,170 @@
+package deposit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/admin"
+	"encore.app/commons"
+	"encore.app/commons/testutils"
+	"encore.app/scheme"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakeDepositWithAnomalies(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+
+	capturedAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	deposit := func(amount float64, minutesBefore int) MakeDepositParams {
+		at := capturedAt.Add(-time.Duration(minutesBefore) * time.Minute)
+		return MakeDepositParams{
+			MassBalanceDeposits: []commons.MassBalance{{ItemDefinition: defaultTestRewards.ItemDefinition, Amount: amount}},
+			CapturedAt:          &at,
+		}
+	}
+
+	testTable := []struct {
+		name  string
+		rules scheme.AnomalyRules
+		// history is made before the deposit, by the same collection point unless otherCollectionPoints is set
+		history               []MakeDepositParams
+		otherCollectionPoints bool
+		deposit               MakeDepositParams
+		expectedFlags         []string
+	}{
+		{
+			name:          "No rules",
+			rules:         scheme.AnomalyRules{},
+			history:       []MakeDepositParams{deposit(12, 1), deposit(12, 2)},
+			deposit:       deposit(12, 0),
+			expectedFlags: []string{},
+		},
+		{
+			name:          "Repeated amount",
+			rules:         scheme.AnomalyRules{RepeatedAmountCount: 3, RepeatedAmountWindowMinutes: 10},
+			history:       []MakeDepositParams{deposit(12, 1), deposit(12, 2)},
+			deposit:       deposit(12, 0),
+			expectedFlags: []string{FlagRepeatedAmount},
+		},
+		{
+			name:          "Repeated amount outside window",
+			rules:         scheme.AnomalyRules{RepeatedAmountCount: 3, RepeatedAmountWindowMinutes: 10},
+			history:       []MakeDepositParams{deposit(12, 1), deposit(12, 20)},
+			deposit:       deposit(12, 0),
+			expectedFlags: []string{},
+		},
+		{
+			name:          "Different amounts",
+			rules:         scheme.AnomalyRules{RepeatedAmountCount: 3, RepeatedAmountWindowMinutes: 10},
+			history:       []MakeDepositParams{deposit(11, 1), deposit(12, 2)},
+			deposit:       deposit(12, 0),
+			expectedFlags: []string{},
+		},
+		{
+			name:          "Outside opening hours",
+			rules:         scheme.AnomalyRules{OpeningHours: &scheme.OpeningHours{Open: "06:00", Close: "11:00", TimeZone: "UTC"}},
+			deposit:       deposit(12, 0),
+			expectedFlags: []string{FlagOutsideOpeningHours},
+		},
+		{
+			name:          "Within opening hours",
+			rules:         scheme.AnomalyRules{OpeningHours: &scheme.OpeningHours{Open: "06:00", Close: "18:00", TimeZone: "UTC"}},
+			deposit:       deposit(12, 0),
+			expectedFlags: []string{},
+		},
+		{
+			name:          "Volume above history",
+			rules:         scheme.AnomalyRules{VolumeFactor: 5, VolumeHistoryDays: 30},
+			history:       []MakeDepositParams{deposit(10, 60), deposit(11, 120), deposit(9, 180), deposit(10, 240), deposit(10, 300)},
+			deposit:       deposit(51, 0),
+			expectedFlags: []string{FlagVolumeAboveHistory},
+		},
+		{
+			name:          "Volume within history",
+			rules:         scheme.AnomalyRules{VolumeFactor: 5, VolumeHistoryDays: 30},
+			history:       []MakeDepositParams{deposit(10, 60), deposit(11, 120), deposit(9, 180), deposit(10, 240), deposit(10, 300)},
+			deposit:       deposit(49, 0),
+			expectedFlags: []string{},
+		},
+		{
+			name:          "Volume without enough history",
+			rules:         scheme.AnomalyRules{VolumeFactor: 5, VolumeHistoryDays: 30},
+			history:       []MakeDepositParams{deposit(10, 60)},
+			deposit:       deposit(500, 0),
+			expectedFlags: []string{},
+		},
+		{
+			name:                  "User at many collection points",
+			rules:                 scheme.AnomalyRules{MaxCollectionPointsPerUser: 2, CollectionPointsWindowHours: 24},
+			history:               []MakeDepositParams{deposit(3, 60), deposit(4, 120)},
+			otherCollectionPoints: true,
+			deposit:               deposit(12, 0),
+			expectedFlags:         []string{FlagManyCollectionPoints},
+		},
+		{
+			name:                  "User at few collection points",
+			rules:                 scheme.AnomalyRules{MaxCollectionPointsPerUser: 3, CollectionPointsWindowHours: 24},
+			history:               []MakeDepositParams{deposit(3, 60), deposit(4, 120)},
+			otherCollectionPoints: true,
+			deposit:               deposit(12, 0),
+			expectedFlags:         []string{},
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			testutils.ClearAllDBs()
+			testScheme, orgSigningKey, collectionPointPubKey := setupTestScheme(t)
+
+			collectionPoints := []string{collectionPointPubKey}
+			historyCollectionPoints := make([]string, len(test.history))
+			for i := range test.history {
+				historyCollectionPoints[i] = collectionPointPubKey
+				if test.otherCollectionPoints {
+					historyCollectionPoints[i], _ = testutils.GenerateKeys()
+					collectionPoints = append(collectionPoints, historyCollectionPoints[i])
+				}
+			}
+
+			require.NoError(t, scheme.EditScheme(testutils.GetAuthenticatedContext(orgSigningKey), &scheme.EditSchemeParams{
+				SchemeID:          testScheme.ID,
+				RewardDefinitions: testScheme.RewardDefinitions,
+				CollectionPoints:  collectionPoints,
+			}))
+			for i := range test.history {
+				h := test.history[i]
+				h.SchemeID = testScheme.ID
+				h.UserPubKey = testUserPubKey
+				_, err := MakeDeposit(testutils.GetAuthenticatedContext(historyCollectionPoints[i]), &h)
+				require.NoError(t, err)
+			}
+
+			// The rules only apply from now on, so the history deposits are not flagged themselves
+			require.NoError(t, scheme.EditScheme(testutils.GetAuthenticatedContext(orgSigningKey), &scheme.EditSchemeParams{
+				SchemeID:          testScheme.ID,
+				RewardDefinitions: testScheme.RewardDefinitions,
+				CollectionPoints:  collectionPoints,
+				AnomalyRules:      &test.rules,
+			}))
+
+			params := test.deposit
+			params.SchemeID = testScheme.ID
+			params.UserPubKey = testUserPubKey
+			made, err := MakeDeposit(testutils.GetAuthenticatedContext(collectionPointPubKey), &params)
+			require.NoError(t, err)
+			require.Equal(t, test.expectedFlags, made.Flags)
+
+			if len(test.expectedFlags) > 0 {
+				// Held for review instead of being claimed
+				require.Equal(t, StatusPending, made.Status)
+				require.False(t, made.Claimed)
+				require.Equal(t, testUserPubKey, made.UserPubKey)
+			} else {
+				require.Equal(t, StatusApproved, made.Status)
+				require.True(t, made.Claimed)
+			}
+		})
+	}
+}
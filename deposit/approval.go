@@ -0,0 +1,167 @@
+package deposit
+
+import (
+	"context"
+
+	"encore.app/commons"
+	"encore.app/commons/outbox"
+	"encore.app/organization"
+	"encore.app/scheme"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+type ApproveDepositParams struct {
+	DepositID string `json:"depositID" validate:"required"`
+	Notes     string `json:"notes"`
+}
+
+// ApproveDeposit approves a pending deposit, so it can be claimed.
+// If the user was given when the deposit was made, it is claimed for them right away.
+//encore:api auth method=POST
+func ApproveDeposit(ctx context.Context, params *ApproveDepositParams) (*Deposit, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	return reviewDeposit(ctx, params.DepositID, StatusApproved, params.Notes)
+}
+
+type RejectDepositParams struct {
+	DepositID string `json:"depositID" validate:"required"`
+	Notes     string `json:"notes" validate:"required"`
+}
+
+// RejectDeposit rejects a pending deposit. Rejected deposits can never be claimed.
+//encore:api auth method=POST
+func RejectDeposit(ctx context.Context, params *RejectDepositParams) (*Deposit, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	return reviewDeposit(ctx, params.DepositID, StatusRejected, params.Notes)
+}
+
+func reviewDeposit(ctx context.Context, depositID string, status string, notes string) (*Deposit, error) {
+	deposit, err := GetDeposit(ctx, &GetDepositParams{DepositID: depositID})
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := scheme.GetScheme(ctx, &scheme.GetSchemeParams{SchemeID: deposit.SchemeID})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: s.OrganizationID}); err != nil {
+		return nil, err
+	}
+
+	caller, _ := auth.UserID()
+
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(ctx, `
+        UPDATE deposit SET status=$2, review_notes=$3, reviewed_by=$4, reviewed_at=now()
+        WHERE id=$1 AND status=$5 AND reversed = false
+    `, deposit.ID, status, notes, string(caller), StatusPending)
+	if err != nil {
+		return nil, err
+	}
+	if res.RowsAffected() == 0 {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "deposit is not pending approval",
+		}
+	}
+	deposit.Status = status
+
+	if err := appendToChain(ctx, tx, reviewRecordType(status), deposit.ID); err != nil {
+		return nil, err
+	}
+
+	// Pending deposits are left out of the stats, a rejected one stays out
+	if status == StatusApproved {
+		if err := countDepositApproved(ctx, tx, deposit); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := outbox.Enqueue(ctx, tx, &DepositReviewedEvent{
+		DepositID:      deposit.ID,
+		SchemeID:       deposit.SchemeID,
+		OrganizationID: s.OrganizationID,
+		Status:         status,
+		Notes:          notes,
+		ReviewedBy:     string(caller),
+	}); err != nil {
+		return nil, err
+	}
+
+	if status == StatusApproved && deposit.UserPubKey != "" {
+		if _, err := claim(ctx, tx, deposit, deposit.UserPubKey, EventTypeDeposit); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return GetDeposit(ctx, &GetDepositParams{DepositID: deposit.ID})
+}
+
+type GetPendingDepositsParams struct {
+	OrganizationID string `json:"organizationID" validate:"required"`
+}
+
+type GetPendingDepositsResponse struct {
+	Deposits []Deposit `json:"deposits"`
+}
+
+// GetPendingDeposits is the inbox of deposits waiting for the organization to approve or reject them, oldest first
+//encore:api auth method=POST
+func GetPendingDeposits(ctx context.Context, params *GetPendingDepositsParams) (*GetPendingDepositsResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: params.OrganizationID}); err != nil {
+		return nil, err
+	}
+
+	schemes, err := scheme.GetAllSchemes(ctx, &scheme.GetAllSchemesParams{OrganizationID: params.OrganizationID})
+	if err != nil {
+		return nil, err
+	}
+	schemeIDs := make([]string, 0, len(schemes.Schemes))
+	for _, s := range schemes.Schemes {
+		schemeIDs = append(schemeIDs, s.ID)
+	}
+
+	rows, err := sqldb.Query(ctx, `
+        SELECT `+depositColumns+` FROM deposit
+        WHERE status=$1 AND reversed = false AND scheme_id = ANY($2)
+        ORDER BY created_at
+    `, StatusPending, schemeIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resp := &GetPendingDepositsResponse{Deposits: []Deposit{}}
+	for rows.Next() {
+		d, err := scanDeposit(rows)
+		if err != nil {
+			return nil, err
+		}
+		resp.Deposits = append(resp.Deposits, *d)
+	}
+
+	return resp, rows.Err()
+}
@@ -0,0 +1,202 @@
+package deposit
+
+import (
+	"context"
+	"testing"
+
+	"encore.app/admin"
+	"encore.app/commons"
+	"encore.app/commons/testutils"
+	"encore.app/scheme"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/require"
+)
+
+func setupApprovalTestScheme(t *testing.T) (testScheme *scheme.Scheme, orgSigningKey string, collectionPointPubKey string) {
+	testScheme, orgSigningKey, collectionPointPubKey = setupTestScheme(t)
+
+	err := scheme.EditScheme(testutils.GetAuthenticatedContext(orgSigningKey), &scheme.EditSchemeParams{
+		SchemeID:          testScheme.ID,
+		RewardDefinitions: testScheme.RewardDefinitions,
+		CollectionPoints:  []string{collectionPointPubKey},
+		ApprovalPolicy:    &scheme.ApprovalPolicy{AmountThreshold: 10},
+	})
+	require.NoError(t, err)
+
+	return testScheme, orgSigningKey, collectionPointPubKey
+}
+
+func TestMakeDepositRequiringApproval(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupApprovalTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+
+	small, err := MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID:   testScheme.ID,
+		UserPubKey: testUserPubKey,
+		MassBalanceDeposits: []commons.MassBalance{
+			{ItemDefinition: defaultTestRewards.ItemDefinition, Amount: 10},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, StatusApproved, small.Status)
+	require.True(t, small.Claimed)
+
+	large, err := MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID:   testScheme.ID,
+		UserPubKey: testUserPubKey,
+		MassBalanceDeposits: []commons.MassBalance{
+			{ItemDefinition: defaultTestRewards.ItemDefinition, Amount: 50},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, StatusPending, large.Status)
+	require.False(t, large.Claimed)
+	require.Equal(t, testUserPubKey, large.UserPubKey)
+
+	vouchers, err := GetVouchersForDeposit(ctx, &GetVouchersForDepositParams{DepositID: large.ID})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(vouchers.Vouchers))
+
+	_, err = Claim(testutils.GetAuthenticatedContext(testUserPubKey), &ClaimParams{
+		DepositID:  large.ID,
+		UserPubKey: testUserPubKey,
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.FailedPrecondition, err.(*errs.Error).Code)
+
+	inbox, err := GetPendingDeposits(testutils.GetAuthenticatedContext(orgSigningKey), &GetPendingDepositsParams{OrganizationID: testOrganizationId})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(inbox.Deposits))
+	require.Equal(t, large.ID, inbox.Deposits[0].ID)
+
+	_, err = GetPendingDeposits(ctx, &GetPendingDepositsParams{OrganizationID: testOrganizationId})
+	require.Error(t, err)
+	require.Equal(t, errs.PermissionDenied, err.(*errs.Error).Code)
+
+	approved, err := ApproveDeposit(testutils.GetAuthenticatedContext(orgSigningKey), &ApproveDepositParams{
+		DepositID: large.ID,
+		Notes:     "Checked the scale",
+	})
+	require.NoError(t, err)
+	require.Equal(t, StatusApproved, approved.Status)
+	require.Equal(t, "Checked the scale", approved.ReviewNotes)
+	require.NotNil(t, approved.ReviewedAt)
+	require.True(t, approved.Claimed)
+
+	vouchers, err = GetVouchersForDeposit(ctx, &GetVouchersForDepositParams{DepositID: large.ID})
+	require.NoError(t, err)
+	require.Equal(t, 50, len(vouchers.Vouchers))
+
+	inbox, err = GetPendingDeposits(testutils.GetAuthenticatedContext(orgSigningKey), &GetPendingDepositsParams{OrganizationID: testOrganizationId})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(inbox.Deposits))
+}
+
+func TestReviewDeposit(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupApprovalTestScheme(t)
+
+	testTable := []struct {
+		name          string
+		approve       bool
+		notes         string
+		alreadyStatus string
+		errorCode     errs.ErrCode
+		uid           string
+	}{
+		{
+			name:      "Approve",
+			approve:   true,
+			errorCode: errs.OK,
+			uid:       orgSigningKey,
+		},
+		{
+			name:      "Reject",
+			notes:     "Scale was off",
+			errorCode: errs.OK,
+			uid:       orgSigningKey,
+		},
+		{
+			name:      "Admin approves",
+			approve:   true,
+			errorCode: errs.OK,
+			uid:       testutils.AdminPubKey,
+		},
+		{
+			name:      "Reject without notes",
+			errorCode: errs.InvalidArgument,
+			uid:       orgSigningKey,
+		},
+		{
+			name:      "Collection point approves",
+			approve:   true,
+			errorCode: errs.PermissionDenied,
+			uid:       collectionPointPubKey,
+		},
+		{
+			name:          "Already rejected",
+			approve:       true,
+			alreadyStatus: StatusRejected,
+			errorCode:     errs.FailedPrecondition,
+			uid:           orgSigningKey,
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			// Without a user, so approving doesn't claim it
+			deposit, err := MakeDeposit(testutils.GetAuthenticatedContext(collectionPointPubKey), &MakeDepositParams{
+				SchemeID: testScheme.ID,
+				MassBalanceDeposits: []commons.MassBalance{
+					{ItemDefinition: defaultTestRewards.ItemDefinition, Amount: 50},
+				},
+			})
+			require.NoError(t, err)
+			require.Equal(t, StatusPending, deposit.Status)
+
+			if test.alreadyStatus != "" {
+				_, err = depositDB.Exec(context.Background(), "UPDATE deposit SET status=$2 WHERE id=$1", deposit.ID, test.alreadyStatus)
+				require.NoError(t, err)
+			}
+
+			ctx := testutils.GetAuthenticatedContext(test.uid)
+			var reviewed *Deposit
+			if test.approve {
+				reviewed, err = ApproveDeposit(ctx, &ApproveDepositParams{DepositID: deposit.ID, Notes: test.notes})
+			} else {
+				reviewed, err = RejectDeposit(ctx, &RejectDepositParams{DepositID: deposit.ID, Notes: test.notes})
+			}
+
+			if test.errorCode != errs.OK {
+				require.Error(t, err)
+				require.Equal(t, test.errorCode, err.(*errs.Error).Code)
+				return
+			}
+			require.NoError(t, err)
+			require.False(t, reviewed.Claimed)
+			if test.approve {
+				require.Equal(t, StatusApproved, reviewed.Status)
+			} else {
+				require.Equal(t, StatusRejected, reviewed.Status)
+			}
+
+			_, err = Claim(testutils.GetAuthenticatedContext(testUserPubKey), &ClaimParams{
+				DepositID:  deposit.ID,
+				UserPubKey: testUserPubKey,
+			})
+			if test.approve {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				require.Equal(t, errs.FailedPrecondition, err.(*errs.Error).Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,485 @@
+package deposit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/organization"
+	"encore.app/scheme"
+	"encore.dev/cron"
+	"encore.dev/storage/sqldb"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+)
+
+// Every deposit, approval, rejection, claim and reversal is recorded in a hash chain per scheme, in the same transaction
+// as the change.
+// A record's hash covers its content, read from the deposit, and the hash of the record before it,
+// so editing a deposit, or removing or reordering records, breaks the chain from there on.
+
+const (
+	ChainRecordDeposit   = "DEPOSIT"
+	ChainRecordApproval  = "APPROVAL"
+	ChainRecordRejection = "REJECTION"
+	ChainRecordClaim     = "CLAIM"
+	ChainRecordReversal  = "REVERSAL"
+)
+
+// chainVersion is the version of the record content new records are hashed with.
+// Version 2 added the status to deposit records, records are verified with the version they were made with.
+const chainVersion = 2
+
+// maxChainBreaks keeps the verification of a badly broken chain from making a huge response
+const maxChainBreaks = 100
+
+// maxChainBackfill is how many missing records are added per checkpoint run
+const maxChainBackfill = 1000
+
+// The content of each record type. Only what doesn't change after the record is made is included.
+type (
+	chainDepositContent struct {
+		DepositID             string                `json:"depositID"`
+		SchemeID              string                `json:"schemeID"`
+		CollectionPointPubKey string                `json:"collectionPointPubKey"`
+		ExternalRef           string                `json:"externalRef"`
+		MassBalanceDeposits   []commons.MassBalance `json:"massBalanceDeposits"`
+		CapturedAt            time.Time             `json:"capturedAt"`
+		CreatedAt             time.Time             `json:"createdAt"`
+		// Left out for unsigned deposits, so their records hash the same as before signatures
+		CollectionPointSignature string `json:"collectionPointSignature,omitempty"`
+		// Status is what the deposit was made with, left out of version 1 records
+		Status string `json:"status,omitempty"`
+	}
+	chainReviewContent struct {
+		DepositID   string     `json:"depositID"`
+		Status      string     `json:"status"`
+		ReviewNotes string     `json:"reviewNotes"`
+		ReviewedAt  *time.Time `json:"reviewedAt"`
+	}
+	chainClaimContent struct {
+		DepositID  string `json:"depositID"`
+		UserPubKey string `json:"userPubKey"`
+	}
+	chainReversalContent struct {
+		DepositID      string     `json:"depositID"`
+		ReversalReason string     `json:"reversalReason"`
+		ReversedAt     *time.Time `json:"reversedAt"`
+	}
+)
+
+// chainHash is the hash of a record, hex encoded
+func chainHash(version int, prevHash string, recordType string, deposit *Deposit) (string, error) {
+	var content interface{}
+	switch recordType {
+	case ChainRecordDeposit:
+		c := chainDepositContent{
+			DepositID:                deposit.ID,
+			SchemeID:                 deposit.SchemeID,
+			CollectionPointPubKey:    deposit.CollectionPointPubKey,
+			ExternalRef:              deposit.ExternalRef,
+			MassBalanceDeposits:      deposit.MassBalanceDeposits,
+			CapturedAt:               deposit.CapturedAt.UTC(),
+			CreatedAt:                deposit.CreatedAt.UTC(),
+			CollectionPointSignature: deposit.CollectionPointSignature,
+		}
+		if version >= 2 {
+			c.Status = madeWithStatus(deposit)
+		}
+		content = c
+	case ChainRecordApproval, ChainRecordRejection:
+		content = chainReviewContent{DepositID: deposit.ID, Status: deposit.Status, ReviewNotes: deposit.ReviewNotes, ReviewedAt: utcTime(deposit.ReviewedAt)}
+	case ChainRecordClaim:
+		content = chainClaimContent{DepositID: deposit.ID, UserPubKey: deposit.UserPubKey}
+	case ChainRecordReversal:
+		content = chainReversalContent{DepositID: deposit.ID, ReversalReason: deposit.ReversalReason, ReversedAt: utcTime(deposit.ReversedAt)}
+	default:
+		return "", errors.New("unknown chain record type " + recordType)
+	}
+
+	b, err := json.Marshal(content)
+	if err != nil {
+		return "", err
+	}
+
+	return sha256Hex([]byte(prevHash + "\n" + recordType + "\n" + string(b))), nil
+}
+
+// madeWithStatus is the status the deposit had when it was made. Reviewed deposits were pending,
+// the others still have the status they were made with.
+func madeWithStatus(deposit *Deposit) string {
+	if deposit.ReviewedAt != nil {
+		return StatusPending
+	}
+	return deposit.Status
+}
+
+// reviewRecordType is the record of a review that ended in status
+func reviewRecordType(status string) string {
+	if status == StatusApproved {
+		return ChainRecordApproval
+	}
+	return ChainRecordRejection
+}
+
+// appendToChain adds a record for the deposit to its scheme's chain.
+// The deposit is read back in the transaction, so the record covers what is stored.
+func appendToChain(ctx context.Context, tx *sqldb.Tx, recordType string, depositID string) error {
+	deposit, err := scanDeposit(tx.QueryRow(ctx, "SELECT "+depositColumns+" FROM deposit WHERE id=$1", depositID))
+	if err != nil {
+		return err
+	}
+
+	// Records of a scheme are appended one at a time, the lock is held until the transaction ends
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('deposit_chain'), hashtext($1))", deposit.SchemeID); err != nil {
+		return err
+	}
+
+	var seq int64
+	var prevHash string
+	err = tx.QueryRow(ctx, "SELECT seq, hash FROM deposit_chain WHERE scheme_id=$1 ORDER BY seq DESC LIMIT 1", deposit.SchemeID).Scan(&seq, &prevHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	hash, err := chainHash(chainVersion, prevHash, recordType, deposit)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+        INSERT INTO deposit_chain (scheme_id, seq, record_type, deposit_id, prev_hash, hash, version)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        ON CONFLICT (deposit_id, record_type) DO NOTHING
+    `, deposit.SchemeID, seq+1, recordType, deposit.ID, prevHash, hash, chainVersion)
+	return err
+}
+
+type VerifyChainParams struct {
+	SchemeID string `json:"schemeID" validate:"required"`
+}
+
+type ChainBreak struct {
+	Seq        int64  `json:"seq"`
+	RecordType string `json:"recordType"`
+	DepositID  string `json:"depositID"`
+	Reason     string `json:"reason"`
+}
+
+type ChainCheckpointDocument struct {
+	SchemeID  string    `json:"schemeID"`
+	Seq       int64     `json:"seq"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type ChainCheckpoint struct {
+	Checkpoint ChainCheckpointDocument `json:"checkpoint"`
+	// Document is the signed JSON of the ChainCheckpointDocument
+	Document string `json:"document"`
+	// Signature is the hex encoded secp256k1 signature of the SHA-256 of Document, by SignerPubKey
+	Signature    string `json:"signature"`
+	SignerPubKey string `json:"signerPubKey"`
+}
+
+type VerifyChainResponse struct {
+	// Valid is true when every record matches its deposit and links to the one before it, and every checkpoint matches the chain
+	Valid    bool   `json:"valid"`
+	Records  int64  `json:"records"`
+	HeadHash string `json:"headHash"`
+	// Breaks are where the chain doesn't hold, at most the first 100
+	Breaks []ChainBreak `json:"breaks"`
+	// UnchainedDeposits are deposits of the scheme with a deposit, review, claim or reversal that is not in the chain.
+	// Deposits from before the chain are added to it by the next checkpoint.
+	UnchainedDeposits int `json:"unchainedDeposits"`
+	Checkpoints       int `json:"checkpoints"`
+	// LatestCheckpoint is nil when the scheme has no checkpoints yet
+	LatestCheckpoint *ChainCheckpoint `json:"latestCheckpoint"`
+}
+
+// VerifyChain recomputes the hash chain of a scheme from its deposits, and checks the signed checkpoints against it
+//encore:api auth method=POST
+func VerifyChain(ctx context.Context, params *VerifyChainParams) (*VerifyChainResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	s, err := scheme.GetScheme(ctx, &scheme.GetSchemeParams{SchemeID: params.SchemeID})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: s.OrganizationID}); err != nil {
+		return nil, err
+	}
+
+	return verifyChain(ctx, s.ID)
+}
+
+func verifyChain(ctx context.Context, schemeID string) (*VerifyChainResponse, error) {
+	resp := &VerifyChainResponse{Breaks: []ChainBreak{}}
+	addBreak := func(b ChainBreak) {
+		if len(resp.Breaks) < maxChainBreaks {
+			resp.Breaks = append(resp.Breaks, b)
+		}
+	}
+
+	checkpoints, err := getChainCheckpoints(ctx, schemeID)
+	if err != nil {
+		return nil, err
+	}
+	resp.Checkpoints = len(checkpoints)
+	if len(checkpoints) > 0 {
+		resp.LatestCheckpoint = &checkpoints[len(checkpoints)-1]
+	}
+	checkpointsAt := map[int64][]ChainCheckpoint{}
+	for _, c := range checkpoints {
+		if !verifyCheckpointSignature(c) {
+			addBreak(ChainBreak{Seq: c.Checkpoint.Seq, Reason: "checkpoint signature is invalid"})
+		}
+		checkpointsAt[c.Checkpoint.Seq] = append(checkpointsAt[c.Checkpoint.Seq], c)
+	}
+
+	// Records whose deposit is gone are left out by the join, and show up as a gap
+	rows, err := sqldb.Query(ctx, `
+        SELECT c.seq, c.record_type, c.prev_hash, c.hash, c.version, d.*
+        FROM deposit_chain c
+        JOIN LATERAL (SELECT `+depositColumns+` FROM deposit WHERE id = c.deposit_id) d ON true
+        WHERE c.scheme_id = $1
+        ORDER BY c.seq
+    `, schemeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	expectedSeq := int64(1)
+	lastHash := ""
+	for rows.Next() {
+		var seq int64
+		var recordType, prevHash, hash string
+		var version int
+		deposit, err := scanDeposit(prefixedScanner{rows: rows, prefix: []interface{}{&seq, &recordType, &prevHash, &hash, &version}})
+		if err != nil {
+			return nil, err
+		}
+
+		if seq != expectedSeq {
+			addBreak(ChainBreak{Seq: expectedSeq, Reason: "records or their deposits are missing"})
+		} else if prevHash != lastHash {
+			addBreak(ChainBreak{Seq: seq, RecordType: recordType, DepositID: deposit.ID, Reason: "record does not link to the one before it"})
+		}
+
+		recomputed, err := chainHash(version, prevHash, recordType, deposit)
+		if err != nil {
+			return nil, err
+		}
+		if recomputed != hash {
+			addBreak(ChainBreak{Seq: seq, RecordType: recordType, DepositID: deposit.ID, Reason: "deposit does not match the record"})
+		}
+
+		for _, c := range checkpointsAt[seq] {
+			if c.Checkpoint.Hash != hash {
+				addBreak(ChainBreak{Seq: seq, RecordType: recordType, DepositID: deposit.ID, Reason: "record does not match the checkpoint"})
+			}
+		}
+		delete(checkpointsAt, seq)
+
+		resp.Records++
+		expectedSeq = seq + 1
+		lastHash = hash
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	resp.HeadHash = lastHash
+
+	for seq := range checkpointsAt {
+		addBreak(ChainBreak{Seq: seq, Reason: "checkpointed record is missing"})
+	}
+
+	if err := sqldb.QueryRow(ctx, `
+        SELECT count(*) FROM deposit d
+        WHERE d.scheme_id = $1 AND EXISTS (
+            SELECT 1 FROM (VALUES ($2, true), ($3, d.status = $7 AND d.reviewed_at IS NOT NULL), ($4, d.status = $8),
+                                  ($5, d.claimed), ($6, d.reversed)) t(record_type, applies)
+            WHERE t.applies AND NOT EXISTS (SELECT 1 FROM deposit_chain c WHERE c.deposit_id = d.id AND c.record_type = t.record_type)
+        )
+    `, schemeID, ChainRecordDeposit, ChainRecordApproval, ChainRecordRejection, ChainRecordClaim, ChainRecordReversal,
+		StatusApproved, StatusRejected).Scan(&resp.UnchainedDeposits); err != nil {
+		return nil, err
+	}
+
+	resp.Valid = len(resp.Breaks) == 0
+	return resp, nil
+}
+
+// prefixedScanner scans the first columns of a row into prefix, and the rest into what scanDeposit asks for
+type prefixedScanner struct {
+	rows   *sqldb.Rows
+	prefix []interface{}
+}
+
+func (p prefixedScanner) Scan(dest ...interface{}) error {
+	return p.rows.Scan(append(append([]interface{}{}, p.prefix...), dest...)...)
+}
+
+func getChainCheckpoints(ctx context.Context, schemeID string) ([]ChainCheckpoint, error) {
+	rows, err := sqldb.Query(ctx, `
+        SELECT document, signature, signer_pub_key FROM deposit_chain_checkpoint WHERE scheme_id=$1 ORDER BY seq, id
+    `, schemeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checkpoints := []ChainCheckpoint{}
+	for rows.Next() {
+		var c ChainCheckpoint
+		if err := rows.Scan(&c.Document, &c.Signature, &c.SignerPubKey); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(c.Document), &c.Checkpoint); err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, c)
+	}
+
+	return checkpoints, rows.Err()
+}
+
+func verifyCheckpointSignature(c ChainCheckpoint) bool {
+	pubKey, err := hex.DecodeString(c.SignerPubKey)
+	if err != nil || len(pubKey) != secp256k1.PubKeySize {
+		return false
+	}
+	signature, err := hex.DecodeString(c.Signature)
+	if err != nil {
+		return false
+	}
+
+	return (&secp256k1.PubKey{Key: pubKey}).VerifySignature([]byte(c.Document), signature)
+}
+
+var _ = cron.NewJob("checkpoint-deposit-chains", cron.JobConfig{
+	Title:    "Sign a checkpoint of every scheme's deposit chain",
+	Every:    1 * cron.Hour,
+	Endpoint: CheckpointChains,
+})
+
+type CheckpointChainsResponse struct {
+	// Backfilled is the number of records added for deposits from before the chain
+	Backfilled  int `json:"backfilled"`
+	Checkpoints int `json:"checkpoints"`
+}
+
+// CheckpointChains signs the head of every scheme's deposit chain that moved since its last checkpoint.
+// Deposits from before the chain are added to it first.
+//encore:api private method=POST
+func CheckpointChains(ctx context.Context) (*CheckpointChainsResponse, error) {
+	signer, err := signerFromSecret(secrets.ChainCheckpointSigningKey, "chain checkpoint")
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &CheckpointChainsResponse{}
+	if resp.Backfilled, err = backfillChain(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := sqldb.Query(ctx, `
+        SELECT DISTINCT ON (c.scheme_id) c.scheme_id, c.seq, c.hash
+        FROM deposit_chain c
+        WHERE c.seq > COALESCE((SELECT max(seq) FROM deposit_chain_checkpoint WHERE scheme_id = c.scheme_id), 0)
+        ORDER BY c.scheme_id, c.seq DESC
+    `)
+	if err != nil {
+		return nil, err
+	}
+	var heads []ChainCheckpointDocument
+	for rows.Next() {
+		var head ChainCheckpointDocument
+		if err := rows.Scan(&head.SchemeID, &head.Seq, &head.Hash); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		heads = append(heads, head)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, head := range heads {
+		head.CreatedAt = time.Now().UTC()
+		document, err := json.Marshal(&head)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := signer.Sign(document)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := sqldb.Exec(ctx, `
+            INSERT INTO deposit_chain_checkpoint (scheme_id, seq, hash, document, signature, signer_pub_key, created_at)
+            VALUES ($1, $2, $3, $4, $5, $6, $7)
+        `, head.SchemeID, head.Seq, head.Hash, string(document), hex.EncodeToString(signature),
+			hex.EncodeToString(signer.PubKey().Bytes()), head.CreatedAt); err != nil {
+			return nil, err
+		}
+		resp.Checkpoints++
+	}
+
+	return resp, nil
+}
+
+// backfillChain adds the records that are missing from the chain, which are those of deposits from before it, oldest first
+func backfillChain(ctx context.Context) (int, error) {
+	rows, err := sqldb.Query(ctx, `
+        SELECT d.id, t.record_type
+        FROM deposit d, (VALUES ($1, 1), ($2, 2), ($3, 2), ($4, 3), ($5, 4)) t(record_type, ord)
+        WHERE (t.record_type = $1 OR (t.record_type = $2 AND d.status = $6 AND d.reviewed_at IS NOT NULL)
+                OR (t.record_type = $3 AND d.status = $7) OR (t.record_type = $4 AND d.claimed) OR (t.record_type = $5 AND d.reversed))
+          AND NOT EXISTS (SELECT 1 FROM deposit_chain c WHERE c.deposit_id = d.id AND c.record_type = t.record_type)
+        ORDER BY d.created_at, d.id, t.ord
+        LIMIT $8
+    `, ChainRecordDeposit, ChainRecordApproval, ChainRecordRejection, ChainRecordClaim, ChainRecordReversal,
+		StatusApproved, StatusRejected, maxChainBackfill)
+	if err != nil {
+		return 0, err
+	}
+	type missing struct{ depositID, recordType string }
+	var records []missing
+	for rows.Next() {
+		var m missing
+		if err := rows.Scan(&m.depositID, &m.recordType); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		records = append(records, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, m := range records {
+		tx, err := sqldb.Begin(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if err := appendToChain(ctx, tx, m.recordType, m.depositID); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(records), nil
+}
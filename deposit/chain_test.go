@@ -0,0 +1,173 @@
+package deposit
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"encore.app/admin"
+	"encore.app/commons"
+	"encore.app/commons/testutils"
+	"encore.dev/beta/errs"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyChain(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	secrets.ChainCheckpointSigningKey = hex.EncodeToString(secp256k1.GenPrivKey().Bytes())
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+	orgCtx := testutils.GetAuthenticatedContext(orgSigningKey)
+
+	claimed, err := MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: defaultTestDeposit,
+		UserPubKey:          testUserPubKey,
+	})
+	require.NoError(t, err)
+	reversed, err := MakeDeposit(ctx, &MakeDepositParams{SchemeID: testScheme.ID, MassBalanceDeposits: defaultTestDeposit})
+	require.NoError(t, err)
+	_, err = ReverseDeposit(orgCtx, &ReverseDepositParams{DepositID: reversed.ID, Reason: "Test"})
+	require.NoError(t, err)
+
+	resp, err := VerifyChain(orgCtx, &VerifyChainParams{SchemeID: testScheme.ID})
+	require.NoError(t, err)
+	require.True(t, resp.Valid)
+	// Deposit and claim, and deposit and reversal
+	require.Equal(t, int64(4), resp.Records)
+	require.Equal(t, 0, resp.UnchainedDeposits)
+	require.Nil(t, resp.LatestCheckpoint)
+
+	checkpoints, err := CheckpointChains(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, checkpoints.Checkpoints)
+	// Nothing changed since
+	checkpoints, err = CheckpointChains(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, checkpoints.Checkpoints)
+
+	resp, err = VerifyChain(orgCtx, &VerifyChainParams{SchemeID: testScheme.ID})
+	require.NoError(t, err)
+	require.True(t, resp.Valid)
+	require.Equal(t, 1, resp.Checkpoints)
+	require.Equal(t, int64(4), resp.LatestCheckpoint.Checkpoint.Seq)
+	require.Equal(t, resp.HeadHash, resp.LatestCheckpoint.Checkpoint.Hash)
+
+	// Editing a deposit in the database breaks the chain at its record
+	_, err = depositDB.Exec(context.Background(), `
+        UPDATE deposit SET mass_balance_deposits = '[{"itemDefinition":{"materialDefinition":{"materialType":"PET"},"magnitude":0},"amount":120}]'
+        WHERE id=$1
+    `, claimed.ID)
+	require.NoError(t, err)
+	resp, err = VerifyChain(orgCtx, &VerifyChainParams{SchemeID: testScheme.ID})
+	require.NoError(t, err)
+	require.False(t, resp.Valid)
+	require.Equal(t, []ChainBreak{{Seq: 1, RecordType: ChainRecordDeposit, DepositID: claimed.ID, Reason: "deposit does not match the record"}}, resp.Breaks)
+
+	_, err = VerifyChain(ctx, &VerifyChainParams{SchemeID: testScheme.ID})
+	require.Error(t, err)
+	require.Equal(t, errs.PermissionDenied, err.(*errs.Error).Code)
+}
+
+func TestVerifyChainMissingRecords(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	secrets.ChainCheckpointSigningKey = hex.EncodeToString(secp256k1.GenPrivKey().Bytes())
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupTestScheme(t)
+	orgCtx := testutils.GetAuthenticatedContext(orgSigningKey)
+	var deposits []*Deposit
+	for i := 0; i < 3; i++ {
+		deposit, err := MakeDeposit(testutils.GetAuthenticatedContext(collectionPointPubKey), &MakeDepositParams{
+			SchemeID:            testScheme.ID,
+			MassBalanceDeposits: defaultTestDeposit,
+		})
+		require.NoError(t, err)
+		deposits = append(deposits, deposit)
+	}
+
+	// Deposits from before the chain are added to it by the next checkpoint
+	_, err := depositDB.Exec(context.Background(), "DELETE FROM deposit_chain WHERE seq = 3")
+	require.NoError(t, err)
+	resp, err := VerifyChain(orgCtx, &VerifyChainParams{SchemeID: testScheme.ID})
+	require.NoError(t, err)
+	require.Equal(t, 1, resp.UnchainedDeposits)
+
+	checkpoints, err := CheckpointChains(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, checkpoints.Backfilled)
+	require.Equal(t, 1, checkpoints.Checkpoints)
+
+	resp, err = VerifyChain(orgCtx, &VerifyChainParams{SchemeID: testScheme.ID})
+	require.NoError(t, err)
+	require.True(t, resp.Valid)
+	require.Equal(t, 0, resp.UnchainedDeposits)
+	require.Equal(t, int64(3), resp.Records)
+
+	// Removing a deposit leaves a gap, and the checkpoint shows the tail was cut off
+	_, err = depositDB.Exec(context.Background(), "DELETE FROM deposit_chain WHERE seq = 3")
+	require.NoError(t, err)
+	_, err = depositDB.Exec(context.Background(), "DELETE FROM deposit WHERE id=$1", deposits[0].ID)
+	require.NoError(t, err)
+	resp, err = VerifyChain(orgCtx, &VerifyChainParams{SchemeID: testScheme.ID})
+	require.NoError(t, err)
+	require.False(t, resp.Valid)
+	require.Equal(t, []ChainBreak{
+		{Seq: 1, Reason: "records or their deposits are missing"},
+		{Seq: 3, Reason: "checkpointed record is missing"},
+	}, resp.Breaks)
+
+	secrets.ChainCheckpointSigningKey = ""
+	_, err = CheckpointChains(context.Background())
+	require.Error(t, err)
+}
+
+func TestVerifyChainReviews(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupApprovalTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+	orgCtx := testutils.GetAuthenticatedContext(orgSigningKey)
+
+	large := []commons.MassBalance{{ItemDefinition: defaultTestRewards.ItemDefinition, Amount: 50}}
+	approved, err := MakeDeposit(ctx, &MakeDepositParams{SchemeID: testScheme.ID, MassBalanceDeposits: large, UserPubKey: testUserPubKey})
+	require.NoError(t, err)
+	rejected, err := MakeDeposit(ctx, &MakeDepositParams{SchemeID: testScheme.ID, MassBalanceDeposits: large})
+	require.NoError(t, err)
+	pending, err := MakeDeposit(ctx, &MakeDepositParams{SchemeID: testScheme.ID, MassBalanceDeposits: large})
+	require.NoError(t, err)
+	_, err = ApproveDeposit(orgCtx, &ApproveDepositParams{DepositID: approved.ID})
+	require.NoError(t, err)
+	_, err = RejectDeposit(orgCtx, &RejectDepositParams{DepositID: rejected.ID, Notes: "Looks wrong"})
+	require.NoError(t, err)
+
+	resp, err := VerifyChain(orgCtx, &VerifyChainParams{SchemeID: testScheme.ID})
+	require.NoError(t, err)
+	require.True(t, resp.Valid)
+	// Three deposits, the approval and its claim, and the rejection
+	require.Equal(t, int64(6), resp.Records)
+	require.Equal(t, 0, resp.UnchainedDeposits)
+
+	// Changing the outcome of a review breaks the chain at the review
+	_, err = depositDB.Exec(context.Background(), "UPDATE deposit SET status=$2 WHERE id=$1", rejected.ID, StatusApproved)
+	require.NoError(t, err)
+	// Approving a pending deposit without a review breaks it at the deposit
+	_, err = depositDB.Exec(context.Background(), "UPDATE deposit SET status=$2 WHERE id=$1", pending.ID, StatusApproved)
+	require.NoError(t, err)
+	resp, err = VerifyChain(orgCtx, &VerifyChainParams{SchemeID: testScheme.ID})
+	require.NoError(t, err)
+	require.False(t, resp.Valid)
+	require.Equal(t, []ChainBreak{
+		{Seq: 3, RecordType: ChainRecordDeposit, DepositID: pending.ID, Reason: "deposit does not match the record"},
+		{Seq: 6, RecordType: ChainRecordRejection, DepositID: rejected.ID, Reason: "deposit does not match the record"},
+	}, resp.Breaks)
+}
@@ -2,8 +2,11 @@ package deposit
 
 import (
 	"context"
+	"encoding/json"
 	"encore.app/admin"
 	"encore.app/commons"
+	"encore.app/commons/idempotency"
+	"encore.app/commons/outbox"
 	"encore.app/scheme"
 	"encore.dev/beta/auth"
 	"encore.dev/beta/errs"
@@ -13,6 +16,8 @@ import (
 type ClaimParams struct {
 	DepositID  string `json:"depositID" validate:"required"`
 	UserPubKey string `json:"userPubKey" validate:"required"`
+	// IdempotencyKey makes retries safe, see commons/idempotency
+	IdempotencyKey string `header:"Idempotency-Key"`
 }
 
 type ClaimResponse struct {
@@ -25,6 +30,12 @@ func Claim(ctx context.Context, params *ClaimParams) (*ClaimResponse, error) {
 		return nil, err
 	}
 
+	return idempotency.Do(ctx, sqldb.Begin, "deposit.Claim", params.IdempotencyKey, params, func(ctx context.Context) (*ClaimResponse, error) {
+		return claimDeposit(ctx, params)
+	})
+}
+
+func claimDeposit(ctx context.Context, params *ClaimParams) (*ClaimResponse, error) {
 	deposit, err := GetDeposit(ctx, &GetDepositParams{DepositID: params.DepositID})
 	if err != nil {
 		return nil, err
@@ -34,34 +45,120 @@ func Claim(ctx context.Context, params *ClaimParams) (*ClaimResponse, error) {
 		return nil, err
 	}
 
+	if err := checkClaimable(deposit); err != nil {
+		return nil, err
+	}
+
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rewards, err := claim(ctx, tx, deposit, params.UserPubKey, EventTypeDepositClaim)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &ClaimResponse{
+		Rewards: rewards,
+	}, nil
+}
+
+func checkClaimable(deposit *Deposit) error {
 	if deposit.Claimed {
-		return nil, &errs.Error{
+		return &errs.Error{
 			Code: errs.InvalidArgument,
 		}
 	}
 
-	tx, err := sqldb.Begin(ctx)
+	if deposit.Reversed {
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "deposit is reversed",
+		}
+	}
+
+	if deposit.Expired {
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "deposit has expired",
+		}
+	}
+
+	if deposit.Status != StatusApproved {
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "deposit is not approved",
+		}
+	}
+
+	return nil
+}
+
+// claim assigns the deposit to the user and pays out the rewards as part of tx.
+// The deposit is recorded in the user's history as activityType.
+// The caller is responsible for authorization.
+func claim(ctx context.Context, tx *sqldb.Tx, deposit *Deposit, userPubKey string, activityType string) ([]commons.Reward, error) {
+	res, err := tx.Exec(ctx, "UPDATE deposit SET claimed = true, user_pub_key=$1 WHERE id=$2 AND claimed = false AND reversed = false AND expired = false AND status = $3", userPubKey, deposit.ID, StatusApproved)
 	if err != nil {
 		return nil, err
 	}
+	if res.RowsAffected() == 0 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "deposit is already claimed, reversed, expired or not approved",
+		}
+	}
+
+	deposit.UserPubKey = userPubKey
+	deposit.Claimed = true
+	if err := countDepositClaimed(ctx, tx, deposit); err != nil {
+		return nil, err
+	}
+
+	if err := appendToChain(ctx, tx, ChainRecordClaim, deposit.ID); err != nil {
+		return nil, err
+	}
 
-	if _, err := tx.Exec(ctx, "UPDATE deposit SET claimed = true, user_pub_key=$1 WHERE id=$2", params.UserPubKey, params.DepositID); err != nil {
+	if err := recordDepositActivity(ctx, tx, activityType, deposit); err != nil {
 		return nil, err
 	}
 
-	deposit.UserPubKey = params.UserPubKey
 	rewards, err := payOutRewards(ctx, tx, deposit)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := tx.Commit(); err != nil {
+	rewardsJson, err := json.Marshal(rewards)
+	if err != nil {
 		return nil, err
 	}
+	if _, err := tx.Exec(ctx, "UPDATE deposit SET rewards=$2 WHERE id=$1", deposit.ID, string(rewardsJson)); err != nil {
+		return nil, err
+	}
+	deposit.Rewards = rewards
 
-	return &ClaimResponse{
-		Rewards: rewards,
-	}, nil
+	s, err := scheme.GetScheme(ctx, &scheme.GetSchemeParams{SchemeID: deposit.SchemeID})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := outbox.Enqueue(ctx, tx, &DepositClaimedEvent{
+		DepositID:      deposit.ID,
+		SchemeID:       deposit.SchemeID,
+		OrganizationID: s.OrganizationID,
+		UserPubKey:     userPubKey,
+		Rewards:        rewards,
+	}); err != nil {
+		return nil, err
+	}
+
+	return rewards, nil
 }
 
 func authorizeCallerToClaim(ctx context.Context, userPubKey string, deposit *Deposit) error {
@@ -90,15 +187,16 @@ func authorizeCallerToClaim(ctx context.Context, userPubKey string, deposit *Dep
 }
 
 func payOutRewards(ctx context.Context, tx *sqldb.Tx, deposit *Deposit) ([]commons.Reward, error) {
-	rewards, err := getRewards(ctx, deposit)
+	payouts, err := getRewards(ctx, deposit)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, r := range rewards {
-		switch typ := r.Type; typ {
+	rewards := []commons.Reward{}
+	for _, p := range payouts {
+		switch typ := p.Reward.Type; typ {
 		case commons.Voucher:
-			if err := payOutVoucherRewards(ctx, tx, r, deposit.UserPubKey); err != nil {
+			if err := payOutVoucherRewards(ctx, tx, p, deposit); err != nil {
 				return nil, err
 			}
 		case commons.Token:
@@ -106,37 +204,65 @@ func payOutRewards(ctx context.Context, tx *sqldb.Tx, deposit *Deposit) ([]commo
 		default:
 			panic("Reward type not found!")
 		}
+		rewards = append(rewards, p.Reward)
 	}
 
 	return rewards, nil
 }
 
-func getRewards(ctx context.Context, deposit *Deposit) ([]commons.Reward, error) {
-	var rewards []commons.Reward
+// payout is a reward together with the reward definition in the scheme that gave it
+type payout struct {
+	Reward                commons.Reward
+	RewardDefinitionIndex int
+}
+
+func getRewards(ctx context.Context, deposit *Deposit) ([]payout, error) {
+	var payouts []payout
 	s, err := scheme.GetScheme(ctx, &scheme.GetSchemeParams{SchemeID: deposit.SchemeID})
 	if err != nil {
 		return nil, err
 	}
-	for _, rd := range s.RewardDefinitions {
+	for i, rd := range s.RewardDefinitions {
 		for _, depItem := range deposit.MassBalanceDeposits {
 			if rd.ItemDefinition.SameAs(depItem.ItemDefinition) {
-				rewards = append(rewards, rd.GetRewardsFor(depItem))
+				payouts = append(payouts, payout{
+					Reward:                rd.GetRewardsFor(depItem),
+					RewardDefinitionIndex: i,
+				})
 			}
 		}
 	}
 
-	return rewards, nil
+	return payouts, nil
 }
 
-func payOutVoucherRewards(ctx context.Context, tx *sqldb.Tx, r commons.Reward, userPubKey string) error {
-	voucherDef, err := GetVoucherDefinition(ctx, &GetVoucherDefinitionParams{VoucherDefinitionID: r.TypeID})
+func payOutVoucherRewards(ctx context.Context, tx *sqldb.Tx, p payout, deposit *Deposit) error {
+	voucherDef, err := GetVoucherDefinition(ctx, &GetVoucherDefinitionParams{VoucherDefinitionID: p.Reward.TypeID})
 	if err != nil {
 		return err
 	}
 
-	numberOfVouchers := int(r.Amount)
+	source := &voucherSource{
+		DepositID:             deposit.ID,
+		SchemeID:              deposit.SchemeID,
+		RewardDefinitionIndex: p.RewardDefinitionIndex,
+	}
+	numberOfVouchers := int(p.Reward.Amount)
 	for i := 0; i < numberOfVouchers; i++ {
-		if _, err := mintVoucher(ctx, tx, voucherDef, userPubKey); err != nil {
+		if _, err := mintVoucher(ctx, tx, voucherDef, deposit.UserPubKey, source); err != nil {
+			return err
+		}
+	}
+
+	if numberOfVouchers > 0 {
+		if err := recordActivity(ctx, tx, activity{
+			UserPubKey:          deposit.UserPubKey,
+			EventType:           EventTypeVoucherReceipt,
+			DepositID:           deposit.ID,
+			VoucherDefinitionID: voucherDef.ID,
+			UnitNameIn:          voucherDef.Name,
+			NumberOfUnitsIn:     float64(numberOfVouchers),
+		}); err != nil {
 			return err
 		}
 	}
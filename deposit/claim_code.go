@@ -0,0 +1,300 @@
+package deposit
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/organization"
+	"encore.app/scheme"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+const (
+	claimCodeTTL = 30 * 24 * time.Hour
+	// claimCodeLength is 60 bits of randomness, formatted as XXXX-XXXX-XXXX
+	claimCodeLength = 12
+	// claimCodeIDLength is the first part of the code, which finds it so wrong guesses at it can be counted
+	claimCodeIDLength = 4
+	// claimCodeAlphabet leaves out characters that are easy to mix up, like 0/O and 1/I.
+	// It has 32 characters, so every random byte maps to one without bias.
+	claimCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	// claimCodeQRPrefix is followed by the code in the QR payload, the app opens it to claim the deposit
+	claimCodeQRPrefix = "empower-deposit:claim?code="
+)
+
+// Wrong guesses are limited per code and per caller. A code that is guessed wrong too many times is locked,
+// the collection point has to make a new one. A caller that guesses wrong too many times within the window has to wait.
+const (
+	maxFailedClaimCodeAttempts       = 5
+	maxCallerFailedClaimCodeAttempts = 10
+	claimCodeAttemptWindow           = 15 * time.Minute
+)
+
+type CreateClaimCodeParams struct {
+	DepositID string `json:"depositID" validate:"required"`
+}
+
+type CreateClaimCodeResponse struct {
+	// Code is shown once, only its hash is stored
+	Code      string    `json:"code"`
+	QRPayload string    `json:"qrPayload"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// CreateClaimCode makes a short code that a user without a key at hand can use to claim the deposit later, with ClaimByCode.
+// Making a new code for the same deposit replaces the old one.
+//encore:api auth method=POST
+func CreateClaimCode(ctx context.Context, params *CreateClaimCodeParams) (*CreateClaimCodeResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	deposit, err := GetDeposit(ctx, &GetDepositParams{DepositID: params.DepositID})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := authorizeCallerForClaimCode(ctx, deposit); err != nil {
+		return nil, err
+	}
+
+	if deposit.Claimed || deposit.Reversed || deposit.Expired || deposit.Status == StatusRejected {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "deposit can't be claimed",
+		}
+	}
+
+	expiresAt := time.Now().UTC().Add(claimCodeTTL)
+	caller, _ := auth.UserID()
+
+	// Expired codes free their code ids
+	if _, err := sqldb.Exec(ctx, "DELETE FROM claim_code WHERE expires_at <= now()"); err != nil {
+		return nil, err
+	}
+
+	var code string
+	for attempt := 0; code == ""; attempt++ {
+		if attempt == 3 {
+			return nil, &errs.Error{
+				Code:    errs.Unavailable,
+				Message: "could not make a unique claim code, try again",
+			}
+		}
+
+		candidate := generateClaimCode()
+		res, err := sqldb.Exec(ctx, `
+            INSERT INTO claim_code (deposit_id, code_id, code_hash, created_by, expires_at)
+            SELECT $1, $2, $3, $4, $5
+            WHERE NOT EXISTS (SELECT 1 FROM claim_code WHERE code_id=$2)
+            ON CONFLICT (deposit_id) DO UPDATE
+            SET code_id=EXCLUDED.code_id, code_hash=EXCLUDED.code_hash, failed_attempts=0, created_by=EXCLUDED.created_by,
+                expires_at=EXCLUDED.expires_at, created_at=now()
+        `, deposit.ID, claimCodeID(candidate), hashClaimCode(candidate), string(caller), expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		if res.RowsAffected() == 1 {
+			code = candidate
+		}
+	}
+
+	return &CreateClaimCodeResponse{
+		Code:      code,
+		QRPayload: claimCodeQRPrefix + code,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+type ClaimByCodeParams struct {
+	// Code is case-insensitive, dashes and spaces are ignored
+	Code string `json:"code" validate:"required"`
+}
+
+// ClaimByCode claims the deposit the code was made for, for the caller
+//encore:api auth method=POST
+func ClaimByCode(ctx context.Context, params *ClaimByCodeParams) (*ClaimResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	caller, _ := auth.UserID()
+
+	// Every attempt counts as failed until the code is found to be right, so concurrent guesses can't get past the limits
+	failedAttempts, err := countFailedClaimCodeAttempt(ctx, string(caller), 1)
+	if err != nil {
+		return nil, err
+	}
+	if failedAttempts > maxCallerFailedClaimCodeAttempts {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "too many failed attempts, try again later",
+		}
+	}
+
+	// Unknown and expired codes look the same, so guessing doesn't reveal which codes existed
+	notFound := &errs.Error{
+		Code:    errs.NotFound,
+		Message: "invalid or expired claim code",
+	}
+	if len(normalizeClaimCode(params.Code)) != claimCodeLength {
+		return nil, notFound
+	}
+
+	codeID := claimCodeID(params.Code)
+	var depositID, codeHash string
+	var codeFailedAttempts int
+	err = sqldb.QueryRow(ctx, `
+        UPDATE claim_code SET failed_attempts = failed_attempts + 1
+        WHERE code_id=$1 AND expires_at > now()
+        RETURNING deposit_id, code_hash, failed_attempts
+    `, codeID).Scan(&depositID, &codeHash, &codeFailedAttempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// wrongGuesses are those made before this attempt
+	wrongGuesses := codeFailedAttempts - 1
+	right := subtle.ConstantTimeCompare([]byte(codeHash), []byte(hashClaimCode(params.Code))) == 1
+	if right {
+		// The attempt is not a failed one, so a claim that fails after it doesn't use up the code
+		if err := sqldb.QueryRow(ctx, `
+            UPDATE claim_code SET failed_attempts = failed_attempts - 1 WHERE code_id=$1 RETURNING failed_attempts
+        `, codeID).Scan(&wrongGuesses); err != nil {
+			return nil, err
+		}
+		if _, err := countFailedClaimCodeAttempt(ctx, string(caller), -1); err != nil {
+			return nil, err
+		}
+	}
+	// Even the right code is refused once the wrong guesses reach the limit
+	if wrongGuesses >= maxFailedClaimCodeAttempts {
+		return nil, &errs.Error{
+			Code:    errs.ResourceExhausted,
+			Message: "too many failed attempts, ask for a new claim code",
+		}
+	}
+	if !right {
+		return nil, notFound
+	}
+
+	deposit, err := GetDeposit(ctx, &GetDepositParams{DepositID: depositID})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkClaimable(deposit); err != nil {
+		return nil, err
+	}
+
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// A code can only be used once
+	if _, err := tx.Exec(ctx, "DELETE FROM claim_code WHERE deposit_id=$1", deposit.ID); err != nil {
+		return nil, err
+	}
+
+	rewards, err := claim(ctx, tx, deposit, string(caller), EventTypeDepositClaim)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &ClaimResponse{
+		Rewards: rewards,
+	}, nil
+}
+
+func authorizeCallerForClaimCode(ctx context.Context, deposit *Deposit) error {
+	caller, _ := auth.UserID()
+
+	if string(caller) == deposit.CollectionPointPubKey {
+		return nil
+	}
+
+	s, err := scheme.GetScheme(ctx, &scheme.GetSchemeParams{SchemeID: deposit.SchemeID})
+	if err != nil {
+		return err
+	}
+
+	return organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: s.OrganizationID})
+}
+
+// countFailedClaimCodeAttempt adds to the failed attempts of the caller in the current window, and returns the new total.
+// Earlier windows are no longer needed, and are deleted.
+func countFailedClaimCodeAttempt(ctx context.Context, caller string, attempts int) (int, error) {
+	windowStart := time.Now().UTC().Truncate(claimCodeAttemptWindow)
+	if _, err := sqldb.Exec(ctx, "DELETE FROM claim_code_attempt_window WHERE window_start < $1", windowStart); err != nil {
+		return 0, err
+	}
+
+	var total int
+	err := sqldb.QueryRow(ctx, `
+        INSERT INTO claim_code_attempt_window (caller_pub_key, window_start, failed_attempts) VALUES ($1, $2, $3)
+        ON CONFLICT (caller_pub_key, window_start) DO UPDATE
+        SET failed_attempts = claim_code_attempt_window.failed_attempts + EXCLUDED.failed_attempts
+        RETURNING failed_attempts
+    `, caller, windowStart, attempts).Scan(&total)
+	return total, err
+}
+
+// generateClaimCode returns a random code formatted as XXXX-XXXX-XXXX
+func generateClaimCode() string {
+	var data [claimCodeLength]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		panic(err)
+	}
+
+	var b strings.Builder
+	for i, c := range data {
+		if i > 0 && i%4 == 0 {
+			b.WriteByte('-')
+		}
+		b.WriteByte(claimCodeAlphabet[int(c)%len(claimCodeAlphabet)])
+	}
+
+	return b.String()
+}
+
+func normalizeClaimCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimPrefix(code, claimCodeQRPrefix)))
+}
+
+// claimCodeID is the first part of the code, it is stored as is to find the code
+func claimCodeID(code string) string {
+	normalized := normalizeClaimCode(code)
+	if len(normalized) < claimCodeIDLength {
+		return normalized
+	}
+	return normalized[:claimCodeIDLength]
+}
+
+func hashClaimCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeClaimCode(code)))
+	return hex.EncodeToString(sum[:])
+}
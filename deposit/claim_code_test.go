@@ -0,0 +1,206 @@
+package deposit
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"encore.app/admin"
+	"encore.app/commons"
+	"encore.app/commons/testutils"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimByCode(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+	userPubKey, _ := testutils.GenerateKeys()
+
+	deposit, err := MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: defaultTestDeposit,
+	})
+	require.NoError(t, err)
+
+	_, err = CreateClaimCode(testutils.GetAuthenticatedContext(userPubKey), &CreateClaimCodeParams{DepositID: deposit.ID})
+	require.Error(t, err)
+	require.Equal(t, errs.PermissionDenied, err.(*errs.Error).Code)
+
+	first, err := CreateClaimCode(ctx, &CreateClaimCodeParams{DepositID: deposit.ID})
+	require.NoError(t, err)
+	require.Equal(t, claimCodeQRPrefix+first.Code, first.QRPayload)
+
+	// A new code replaces the old one
+	code, err := CreateClaimCode(testutils.GetAuthenticatedContext(orgSigningKey), &CreateClaimCodeParams{DepositID: deposit.ID})
+	require.NoError(t, err)
+	require.NotEqual(t, first.Code, code.Code)
+
+	_, err = ClaimByCode(testutils.GetAuthenticatedContext(userPubKey), &ClaimByCodeParams{Code: first.Code})
+	require.Error(t, err)
+	require.Equal(t, errs.NotFound, err.(*errs.Error).Code)
+
+	resp, err := ClaimByCode(testutils.GetAuthenticatedContext(userPubKey), &ClaimByCodeParams{Code: strings.ToLower(code.Code)})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(resp.Rewards))
+
+	claimed, err := GetDeposit(ctx, &GetDepositParams{DepositID: deposit.ID})
+	require.NoError(t, err)
+	require.True(t, claimed.Claimed)
+	require.Equal(t, userPubKey, claimed.UserPubKey)
+
+	// Codes can only be used once
+	otherUserPubKey, _ := testutils.GenerateKeys()
+	_, err = ClaimByCode(testutils.GetAuthenticatedContext(otherUserPubKey), &ClaimByCodeParams{Code: code.Code})
+	require.Error(t, err)
+	require.Equal(t, errs.NotFound, err.(*errs.Error).Code)
+
+	_, err = CreateClaimCode(ctx, &CreateClaimCodeParams{DepositID: deposit.ID})
+	require.Error(t, err)
+	require.Equal(t, errs.FailedPrecondition, err.(*errs.Error).Code)
+}
+
+func TestClaimByCodeExpiredAndRateLimited(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, _, collectionPointPubKey := setupTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+	userPubKey, _ := testutils.GenerateKeys()
+
+	deposit, err := MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: defaultTestDeposit,
+	})
+	require.NoError(t, err)
+
+	code, err := CreateClaimCode(ctx, &CreateClaimCodeParams{DepositID: deposit.ID})
+	require.NoError(t, err)
+
+	_, err = depositDB.Exec(context.Background(), "UPDATE claim_code SET expires_at = now() - interval '1 minute' WHERE deposit_id=$1", deposit.ID)
+	require.NoError(t, err)
+
+	_, err = ClaimByCode(testutils.GetAuthenticatedContext(userPubKey), &ClaimByCodeParams{Code: code.Code})
+	require.Error(t, err)
+	require.Equal(t, errs.NotFound, err.(*errs.Error).Code)
+
+	code, err = CreateClaimCode(ctx, &CreateClaimCodeParams{DepositID: deposit.ID})
+	require.NoError(t, err)
+
+	// Guesses at the code come from different keys, the code is locked whoever makes them
+	wrongCode := code.Code[:5] + "AAAA-AAAA"
+	if wrongCode == code.Code {
+		wrongCode = code.Code[:5] + "BBBB-BBBB"
+	}
+	for i := 0; i < maxFailedClaimCodeAttempts; i++ {
+		guesser, _ := testutils.GenerateKeys()
+		_, err = ClaimByCode(testutils.GetAuthenticatedContext(guesser), &ClaimByCodeParams{Code: wrongCode})
+		require.Error(t, err)
+		require.Equal(t, errs.NotFound, err.(*errs.Error).Code)
+	}
+
+	// Even the right code is refused after too many wrong guesses
+	_, err = ClaimByCode(testutils.GetAuthenticatedContext(userPubKey), &ClaimByCodeParams{Code: code.Code})
+	require.Error(t, err)
+	require.Equal(t, errs.ResourceExhausted, err.(*errs.Error).Code)
+
+	// A new code can be used
+	code, err = CreateClaimCode(ctx, &CreateClaimCodeParams{DepositID: deposit.ID})
+	require.NoError(t, err)
+	_, err = ClaimByCode(testutils.GetAuthenticatedContext(userPubKey), &ClaimByCodeParams{Code: code.Code})
+	require.NoError(t, err)
+}
+
+func TestClaimByCodeCallerLimit(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, _, collectionPointPubKey := setupTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+	userPubKey, _ := testutils.GenerateKeys()
+	guesser, _ := testutils.GenerateKeys()
+
+	deposit, err := MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: defaultTestDeposit,
+	})
+	require.NoError(t, err)
+	code, err := CreateClaimCode(ctx, &CreateClaimCodeParams{DepositID: deposit.ID})
+	require.NoError(t, err)
+
+	// Unknown codes count towards the caller's limit
+	for i := 0; i < maxCallerFailedClaimCodeAttempts; i++ {
+		_, err = ClaimByCode(testutils.GetAuthenticatedContext(guesser), &ClaimByCodeParams{Code: "AAAA"})
+		require.Error(t, err)
+		require.Equal(t, errs.NotFound, err.(*errs.Error).Code)
+	}
+	_, err = ClaimByCode(testutils.GetAuthenticatedContext(guesser), &ClaimByCodeParams{Code: code.Code})
+	require.Error(t, err)
+	require.Equal(t, errs.ResourceExhausted, err.(*errs.Error).Code)
+
+	// Other callers are not held up by it
+	_, err = ClaimByCode(testutils.GetAuthenticatedContext(userPubKey), &ClaimByCodeParams{Code: code.Code})
+	require.NoError(t, err)
+}
+
+func TestClaimByCodeRightCodeIsNotAFailedAttempt(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupApprovalTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+	userCtx := testutils.GetAuthenticatedContext(testUserPubKey)
+
+	pending, err := MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: []commons.MassBalance{{ItemDefinition: defaultTestRewards.ItemDefinition, Amount: 50}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, StatusPending, pending.Status)
+	code, err := CreateClaimCode(ctx, &CreateClaimCodeParams{DepositID: pending.ID})
+	require.NoError(t, err)
+
+	// Retrying while the deposit can't be claimed yet doesn't lock the code
+	for i := 0; i < maxFailedClaimCodeAttempts+1; i++ {
+		_, err = ClaimByCode(userCtx, &ClaimByCodeParams{Code: code.Code})
+		require.Error(t, err)
+		require.Equal(t, errs.FailedPrecondition, err.(*errs.Error).Code)
+	}
+
+	_, err = ApproveDeposit(testutils.GetAuthenticatedContext(orgSigningKey), &ApproveDepositParams{DepositID: pending.ID})
+	require.NoError(t, err)
+	_, err = ClaimByCode(userCtx, &ClaimByCodeParams{Code: code.Code})
+	require.NoError(t, err)
+}
+
+func TestNormalizeClaimCode(t *testing.T) {
+	code := generateClaimCode()
+	require.Equal(t, 14, len(code))
+	require.Equal(t, byte('-'), code[4])
+	require.Equal(t, byte('-'), code[9])
+	require.Equal(t, code[:4], claimCodeID(strings.ToLower(code)))
+
+	testTable := []struct {
+		name  string
+		input string
+	}{
+		{name: "As generated", input: code},
+		{name: "Lower case", input: strings.ToLower(code)},
+		{name: "Without dash", input: strings.ReplaceAll(code, "-", "")},
+		{name: "With spaces", input: strings.ReplaceAll(code, "-", " ")},
+		{name: "QR payload", input: claimCodeQRPrefix + code},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, hashClaimCode(code), hashClaimCode(test.input))
+		})
+	}
+}
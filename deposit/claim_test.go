@@ -209,3 +209,63 @@ func TestDoubleClaim(t *testing.T) {
 	require.Error(t, err)
 	require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
 }
+
+func TestClaimWithIdempotencyKey(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, _, collectionPointPubKey := setupTestScheme(t)
+	userPubKey, _ := testutils.GenerateKeys()
+	ctx := testutils.GetAuthenticatedContext(userPubKey)
+
+	deposit, err := MakeDeposit(testutils.GetAuthenticatedContext(collectionPointPubKey), &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: defaultTestDeposit,
+	})
+	require.NoError(t, err)
+
+	params := &ClaimParams{
+		DepositID:      deposit.ID,
+		UserPubKey:     userPubKey,
+		IdempotencyKey: "claim-1",
+	}
+	first, err := Claim(ctx, params)
+	require.NoError(t, err)
+
+	// The retry gets the stored response instead of a double claim error
+	retry, err := Claim(ctx, params)
+	require.NoError(t, err)
+	require.Equal(t, first.Rewards, retry.Rewards)
+
+	vouchers, err := GetVouchersForDeposit(ctx, &GetVouchersForDepositParams{DepositID: deposit.ID})
+	require.NoError(t, err)
+	require.Equal(t, 12, len(vouchers.Vouchers))
+
+	// Reusing the key for another request is rejected
+	_, err = Claim(ctx, &ClaimParams{
+		DepositID:      "someOtherDeposit",
+		UserPubKey:     userPubKey,
+		IdempotencyKey: "claim-1",
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+
+	// Without a key, it is a double claim
+	_, err = Claim(ctx, &ClaimParams{
+		DepositID:  deposit.ID,
+		UserPubKey: userPubKey,
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+
+	// A request interrupted before its response was stored is not run again
+	_, err = depositDB.Exec(context.Background(), `
+        UPDATE idempotency_key SET completed = false, response = NULL, created_at = now() - interval '10 minutes'
+        WHERE pub_key=$1 AND key=$2
+    `, userPubKey, "claim-1")
+	require.NoError(t, err)
+	_, err = Claim(ctx, params)
+	require.Error(t, err)
+	require.Equal(t, errs.Aborted, err.(*errs.Error).Code)
+}
@@ -0,0 +1,6 @@
+// Evidence uploads fail until the directory is set for the environment, e.g.
+//   if #Meta.Environment.Type == "production" { EvidenceStorageDir: "/mnt/evidence" }
+EvidenceStorageDir: string | *""
+
+// Credit batches can't be issued until the URI their documents are published under is set
+CreditMetadataBaseURI: string | *""
@@ -0,0 +1,14 @@
+package deposit
+
+import "encore.dev/config"
+
+type Config struct {
+	// EvidenceStorageDir is the directory evidence files are kept in. It must be on durable storage, like a mounted volume.
+	EvidenceStorageDir config.String
+	// CreditMetadataBaseURI is where credit batch documents and their deposits are published,
+	// e.g. "https://example.org/credit-batches". Credits can't be issued until it is set.
+	CreditMetadataBaseURI config.String
+}
+
+// cfg is set in config.cue, per environment
+var cfg = config.Load[*Config]()
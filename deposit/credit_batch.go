@@ -0,0 +1,385 @@
+package deposit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/organization"
+	"encore.app/scheme"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+)
+
+// Credit batches group the verified deposits of a scheme and material over a period, as the basis for plastic credits.
+// Every deposited item is consumed by at most one batch, and the batch document is signed by the server.
+// Credits are whole, so the mass too small for one more credit is carried to the next batch of the scheme and material.
+
+// kgPerCredit is the mass a credit is issued for
+const kgPerCredit = 1.0
+
+var secrets struct {
+	// CreditBatchSigningKey is the hex encoded secp256k1 private key credit batch documents are signed with
+	CreditBatchSigningKey string
+	// ChainCheckpointSigningKey is the hex encoded secp256k1 private key deposit chain checkpoints are signed with
+	ChainCheckpointSigningKey string
+}
+
+type CreateCreditBatchParams struct {
+	SchemeID           string            `json:"schemeID" validate:"required"`
+	MaterialDefinition map[string]string `json:"materialDefinition" validate:"required,min=1"`
+	// From and To is the period, deposits captured in it that are not in a batch yet are included
+	From *time.Time `json:"from" validate:"required"`
+	To   *time.Time `json:"to" validate:"required,gtfield=From"`
+}
+
+type CreditBatchDeposit struct {
+	DepositID             string    `json:"depositID"`
+	ItemIndex             int       `json:"itemIndex"`
+	CollectionPointPubKey string    `json:"collectionPointPubKey"`
+	CapturedAt            time.Time `json:"capturedAt"`
+	Amount                float64   `json:"amount"`
+}
+
+// CreditBatchDocument is what is signed. It has a fixed field order, UTC times and deposits in order,
+// so the same batch always gives the same bytes.
+type CreditBatchDocument struct {
+	BatchID            string            `json:"batchID"`
+	SchemeID           string            `json:"schemeID"`
+	OrganizationID     string            `json:"organizationID"`
+	MaterialDefinition map[string]string `json:"materialDefinition"`
+	Unit               string            `json:"unit"`
+	From               time.Time         `json:"from"`
+	To                 time.Time         `json:"to"`
+	TotalMass          float64           `json:"totalMass"`
+	// CarriedMass is the remainder of the previous batch, in CarriedFromBatchID, that is added to TotalMass for the credits
+	CarriedMass        float64 `json:"carriedMass"`
+	CarriedFromBatchID string  `json:"carriedFromBatchID"`
+	KgPerCredit        float64 `json:"kgPerCredit"`
+	Credits            uint64  `json:"credits"`
+	// Remainder is the mass too small for one more credit, it is carried to the next batch
+	Remainder float64              `json:"remainder"`
+	Deposits  []CreditBatchDeposit `json:"deposits"`
+	CreatedAt time.Time            `json:"createdAt"`
+}
+
+type CreditBatch struct {
+	Batch CreditBatchDocument `json:"batch"`
+	// Document is the signed JSON of the CreditBatchDocument
+	Document string `json:"document"`
+	// Signature is the hex encoded secp256k1 signature of the SHA-256 of Document, by SignerPubKey
+	Signature    string `json:"signature"`
+	SignerPubKey string `json:"signerPubKey"`
+	CreatedBy    string `json:"createdBy"`
+	// Issuance is nil until the credits are issued with IssueCreditBatch
+	Issuance *CreditBatchIssuance `json:"issuance"`
+}
+
+type CreditBatchIssuance struct {
+	ProjectID uint64 `json:"projectID"`
+	// Tx is the unsigned EmpowerChain transaction issuing the credits
+	Tx        string    `json:"tx"`
+	Reference string    `json:"reference"`
+	IssuedAt  time.Time `json:"issuedAt"`
+}
+
+// CreateCreditBatch groups the approved, not reversed deposits of a scheme and material (by weight) over a period into a batch.
+// The deposited items are consumed by the batch, and are left out of later batches. The batch has the credits for its
+// mass and the remainder of the previous batch, and carries its own remainder to the next one, so no mass is lost.
+//encore:api auth method=POST
+func CreateCreditBatch(ctx context.Context, params *CreateCreditBatchParams) (*CreditBatch, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	s, err := scheme.GetScheme(ctx, &scheme.GetSchemeParams{SchemeID: params.SchemeID})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: s.OrganizationID}); err != nil {
+		return nil, err
+	}
+
+	signer, err := signerFromSecret(secrets.CreditBatchSigningKey, "credit batch")
+	if err != nil {
+		return nil, err
+	}
+
+	caller, _ := auth.UserID()
+	itemDefinition := commons.ItemDefinition{MaterialDefinition: params.MaterialDefinition, Magnitude: commons.Weight}
+	materialDefinition, err := json.Marshal(params.MaterialDefinition)
+	if err != nil {
+		return nil, err
+	}
+
+	// Times are kept at the database's precision, so the document can be read back as it was signed
+	doc := CreditBatchDocument{
+		BatchID:            commons.GenerateID(),
+		SchemeID:           s.ID,
+		OrganizationID:     s.OrganizationID,
+		MaterialDefinition: params.MaterialDefinition,
+		Unit:               itemDefinition.Magnitude.Unit(),
+		KgPerCredit:        kgPerCredit,
+		From:               params.From.UTC().Truncate(time.Microsecond),
+		To:                 params.To.UTC().Truncate(time.Microsecond),
+		Deposits:           []CreditBatchDeposit{},
+		CreatedAt:          time.Now().UTC().Truncate(time.Microsecond),
+	}
+
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Batches of a scheme are created one at a time, so each remainder is carried once
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('credit_batch'), hashtext($1))", s.ID); err != nil {
+		return nil, err
+	}
+	if err := tx.QueryRow(ctx, `
+        SELECT id, remainder FROM credit_batch WHERE scheme_id = $1 AND material_definition = $2::jsonb
+        ORDER BY created_at DESC, id DESC LIMIT 1
+    `, s.ID, string(materialDefinition)).Scan(&doc.CarriedFromBatchID, &doc.CarriedMass); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// The deposits are locked, so they can't be reversed while they are being batched
+	rows, err := tx.Query(ctx, `
+        SELECT d.id, item.idx - 1, d.collection_point_pub_key, d.captured_at, (item.value ->> 'amount')::float
+        FROM deposit d, json_array_elements(d.mass_balance_deposits) WITH ORDINALITY item(value, idx)
+        WHERE d.scheme_id = $1 AND d.status = $2 AND d.reversed = false
+          AND d.captured_at >= $3 AND d.captured_at < $4
+          AND (item.value -> 'itemDefinition' -> 'materialDefinition')::jsonb = $5::jsonb
+          AND (item.value -> 'itemDefinition' ->> 'magnitude')::int = $6
+          AND NOT EXISTS (SELECT 1 FROM credit_batch_item c WHERE c.deposit_id = d.id AND c.item_index = item.idx - 1)
+        ORDER BY d.id, item.idx
+        FOR SHARE OF d
+    `, s.ID, StatusApproved, doc.From, doc.To, string(materialDefinition), int(commons.Weight))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var d CreditBatchDeposit
+		if err := rows.Scan(&d.DepositID, &d.ItemIndex, &d.CollectionPointPubKey, &d.CapturedAt, &d.Amount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		d.CapturedAt = d.CapturedAt.UTC()
+		doc.Deposits = append(doc.Deposits, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(doc.Deposits) == 0 {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "there are no deposits of the material in the period that are not in a batch yet",
+		}
+	}
+
+	sortCreditBatchDeposits(doc.Deposits)
+	for _, d := range doc.Deposits {
+		doc.TotalMass += d.Amount
+	}
+	doc.Credits, doc.Remainder = creditsForMass(doc.TotalMass+doc.CarriedMass, doc.KgPerCredit)
+
+	document, err := json.Marshal(&doc)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := signer.Sign(document)
+	if err != nil {
+		return nil, err
+	}
+	batch := &CreditBatch{
+		Batch:        doc,
+		Document:     string(document),
+		Signature:    hex.EncodeToString(signature),
+		SignerPubKey: hex.EncodeToString(signer.PubKey().Bytes()),
+		CreatedBy:    string(caller),
+	}
+
+	if _, err := tx.Exec(ctx, `
+        INSERT INTO credit_batch (id, scheme_id, organization_id, material_definition, period_start, period_end, total_mass,
+                                  remainder, document, signature, signer_pub_key, created_by, created_at)
+        VALUES ($1, $2, $3, $4::jsonb, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+    `, doc.BatchID, doc.SchemeID, doc.OrganizationID, string(materialDefinition), doc.From, doc.To, doc.TotalMass,
+		doc.Remainder, batch.Document, batch.Signature, batch.SignerPubKey, batch.CreatedBy, doc.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	for _, d := range doc.Deposits {
+		res, err := tx.Exec(ctx, `
+            INSERT INTO credit_batch_item (credit_batch_id, deposit_id, item_index, amount) VALUES ($1, $2, $3, $4)
+            ON CONFLICT (deposit_id, item_index) DO NOTHING
+        `, doc.BatchID, d.DepositID, d.ItemIndex, d.Amount)
+		if err != nil {
+			return nil, err
+		}
+		if res.RowsAffected() == 0 {
+			return nil, &errs.Error{
+				Code:    errs.Aborted,
+				Message: "some of the deposits were batched at the same time, try again",
+			}
+		}
+	}
+
+	return batch, tx.Commit()
+}
+
+type GetCreditBatchParams struct {
+	CreditBatchID string `json:"creditBatchID" validate:"required"`
+}
+
+// GetCreditBatch returns a credit batch with its signed document
+//encore:api auth method=POST
+func GetCreditBatch(ctx context.Context, params *GetCreditBatchParams) (*CreditBatch, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	batch, err := getCreditBatch(ctx, params.CreditBatchID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: batch.Batch.OrganizationID}); err != nil {
+		return nil, err
+	}
+
+	return batch, nil
+}
+
+type GetCreditBatchesParams struct {
+	SchemeID string `json:"schemeID" validate:"required"`
+}
+
+type GetCreditBatchesResponse struct {
+	CreditBatches []CreditBatch `json:"creditBatches"`
+}
+
+// GetCreditBatches returns the credit batches of a scheme, oldest first
+//encore:api auth method=POST
+func GetCreditBatches(ctx context.Context, params *GetCreditBatchesParams) (*GetCreditBatchesResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	s, err := scheme.GetScheme(ctx, &scheme.GetSchemeParams{SchemeID: params.SchemeID})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: s.OrganizationID}); err != nil {
+		return nil, err
+	}
+
+	rows, err := sqldb.Query(ctx, "SELECT id FROM credit_batch WHERE scheme_id=$1 ORDER BY created_at, id", params.SchemeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	resp := &GetCreditBatchesResponse{CreditBatches: []CreditBatch{}}
+	for _, id := range ids {
+		batch, err := getCreditBatch(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		resp.CreditBatches = append(resp.CreditBatches, *batch)
+	}
+
+	return resp, nil
+}
+
+// getCreditBatch reads the batch back from its signed document
+func getCreditBatch(ctx context.Context, id string) (*CreditBatch, error) {
+	var batch CreditBatch
+	var projectID *int64
+	var issuance CreditBatchIssuance
+	var issuedAt *time.Time
+	if err := sqldb.QueryRow(ctx, `
+        SELECT document, signature, signer_pub_key, created_by, project_id, issuance_tx, issuance_reference, issued_at
+        FROM credit_batch WHERE id=$1
+    `, id).Scan(&batch.Document, &batch.Signature, &batch.SignerPubKey, &batch.CreatedBy,
+		&projectID, &issuance.Tx, &issuance.Reference, &issuedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &errs.Error{
+				Code: errs.NotFound,
+			}
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(batch.Document), &batch.Batch); err != nil {
+		return nil, err
+	}
+
+	if issuedAt != nil && projectID != nil {
+		issuance.ProjectID = uint64(*projectID)
+		issuance.IssuedAt = issuedAt.UTC()
+		batch.Issuance = &issuance
+	}
+
+	return &batch, nil
+}
+
+// isInCreditBatch is whether any item of the deposit was consumed by a credit batch
+func isInCreditBatch(ctx context.Context, tx *sqldb.Tx, depositID string) (bool, error) {
+	var exists bool
+	err := tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM credit_batch_item WHERE deposit_id=$1)", depositID).Scan(&exists)
+	return exists, err
+}
+
+// creditsForMass is the whole credits for a mass, and the mass left over. Sums of amounts are not exact, so a mass
+// within a microgram of the next credit is rounded up to it.
+func creditsForMass(mass float64, kgPerCredit float64) (uint64, float64) {
+	credits := math.Floor((mass + 1e-9) / kgPerCredit)
+	remainder := math.Max(0, mass-credits*kgPerCredit)
+	return uint64(credits), remainder
+}
+
+func sortCreditBatchDeposits(deposits []CreditBatchDeposit) {
+	sort.Slice(deposits, func(i, j int) bool {
+		if deposits[i].DepositID != deposits[j].DepositID {
+			return deposits[i].DepositID < deposits[j].DepositID
+		}
+		return deposits[i].ItemIndex < deposits[j].ItemIndex
+	})
+}
+
+// signerFromSecret is the private key in a secret, what is signed with it is named in the error when it is not set up
+func signerFromSecret(secret string, what string) (*secp256k1.PrivKey, error) {
+	key, err := hex.DecodeString(secret)
+	if err != nil || len(key) != secp256k1.PrivKeySize {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "the " + what + " signing key is not set up",
+		}
+	}
+
+	return &secp256k1.PrivKey{Key: key}, nil
+}
@@ -0,0 +1,185 @@
+package deposit
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"encore.app/admin"
+	"encore.app/commons"
+	"encore.app/commons/testutils"
+	"encore.dev/beta/errs"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateCreditBatch(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	signingKey := secp256k1.GenPrivKey()
+	secrets.CreditBatchSigningKey = hex.EncodeToString(signingKey.Bytes())
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+	orgCtx := testutils.GetAuthenticatedContext(orgSigningKey)
+
+	from := time.Now().UTC().AddDate(0, 0, -7)
+	to := time.Now().UTC().Add(time.Hour)
+	lastMonth := time.Now().UTC().AddDate(0, -1, 0)
+	var deposits []*Deposit
+	for _, d := range []struct {
+		items      []commons.MassBalance
+		capturedAt *time.Time
+	}{
+		{[]commons.MassBalance{defaultTestDeposit[0], defaultTestDeposit[0]}, nil},
+		{defaultTestDeposit, nil},
+		{defaultTestDeposit, nil},
+		// Outside the period
+		{defaultTestDeposit, &lastMonth},
+	} {
+		deposit, err := MakeDeposit(ctx, &MakeDepositParams{
+			SchemeID:            testScheme.ID,
+			MassBalanceDeposits: d.items,
+			CapturedAt:          d.capturedAt,
+		})
+		require.NoError(t, err)
+		deposits = append(deposits, deposit)
+	}
+
+	// Reversed deposits are left out
+	_, err := ReverseDeposit(orgCtx, &ReverseDepositParams{DepositID: deposits[2].ID, Reason: "Test"})
+	require.NoError(t, err)
+
+	params := &CreateCreditBatchParams{
+		SchemeID:           testScheme.ID,
+		MaterialDefinition: defaultTestRewards.ItemDefinition.MaterialDefinition,
+		From:               &from,
+		To:                 &to,
+	}
+	batch, err := CreateCreditBatch(orgCtx, params)
+	require.NoError(t, err)
+	require.Equal(t, float64(36), batch.Batch.TotalMass)
+	require.Equal(t, uint64(36), batch.Batch.Credits)
+	require.Equal(t, float64(0), batch.Batch.Remainder)
+	require.Equal(t, "kg", batch.Batch.Unit)
+	require.Equal(t, 3, len(batch.Batch.Deposits))
+	require.Equal(t, hex.EncodeToString(signingKey.PubKey().Bytes()), batch.SignerPubKey)
+
+	signature, err := hex.DecodeString(batch.Signature)
+	require.NoError(t, err)
+	require.True(t, signingKey.PubKey().VerifySignature([]byte(batch.Document), signature))
+
+	// Read back as it was signed
+	stored, err := GetCreditBatch(orgCtx, &GetCreditBatchParams{CreditBatchID: batch.Batch.BatchID})
+	require.NoError(t, err)
+	require.Equal(t, batch.Document, stored.Document)
+	require.Equal(t, batch.Signature, stored.Signature)
+	require.Equal(t, batch.Batch.Deposits, stored.Batch.Deposits)
+
+	// The deposits are consumed
+	_, err = CreateCreditBatch(orgCtx, params)
+	require.Error(t, err)
+	require.Equal(t, errs.FailedPrecondition, err.(*errs.Error).Code)
+
+	_, err = ReverseDeposit(orgCtx, &ReverseDepositParams{DepositID: deposits[1].ID, Reason: "Test"})
+	require.Error(t, err)
+	require.Equal(t, errs.FailedPrecondition, err.(*errs.Error).Code)
+
+	// Only new deposits go in the next batch
+	deposit, err := MakeDeposit(ctx, &MakeDepositParams{SchemeID: testScheme.ID, MassBalanceDeposits: defaultTestDeposit})
+	require.NoError(t, err)
+	next, err := CreateCreditBatch(orgCtx, params)
+	require.NoError(t, err)
+	require.Equal(t, []CreditBatchDeposit{{
+		DepositID:             deposit.ID,
+		ItemIndex:             0,
+		CollectionPointPubKey: collectionPointPubKey,
+		CapturedAt:            next.Batch.Deposits[0].CapturedAt,
+		Amount:                12,
+	}}, next.Batch.Deposits)
+
+	batches, err := GetCreditBatches(orgCtx, &GetCreditBatchesParams{SchemeID: testScheme.ID})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(batches.CreditBatches))
+	require.Equal(t, batch.Batch.BatchID, batches.CreditBatches[0].Batch.BatchID)
+
+	_, err = CreateCreditBatch(ctx, params)
+	require.Error(t, err)
+	require.Equal(t, errs.PermissionDenied, err.(*errs.Error).Code)
+
+	_, err = GetCreditBatch(ctx, &GetCreditBatchParams{CreditBatchID: batch.Batch.BatchID})
+	require.Error(t, err)
+	require.Equal(t, errs.PermissionDenied, err.(*errs.Error).Code)
+
+	secrets.CreditBatchSigningKey = ""
+	_, err = CreateCreditBatch(orgCtx, params)
+	require.Error(t, err)
+	require.Equal(t, errs.Internal, err.(*errs.Error).Code)
+}
+
+func TestCreditBatchCarriesRemainder(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	secrets.CreditBatchSigningKey = hex.EncodeToString(secp256k1.GenPrivKey().Bytes())
+	defer func() { secrets.CreditBatchSigningKey = "" }()
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+	orgCtx := testutils.GetAuthenticatedContext(orgSigningKey)
+
+	from := time.Now().UTC().AddDate(0, 0, -7)
+	to := time.Now().UTC().Add(time.Hour)
+	params := &CreateCreditBatchParams{
+		SchemeID:           testScheme.ID,
+		MaterialDefinition: defaultTestRewards.ItemDefinition.MaterialDefinition,
+		From:               &from,
+		To:                 &to,
+	}
+	makeBatch := func(amount float64) *CreditBatch {
+		_, err := MakeDeposit(ctx, &MakeDepositParams{
+			SchemeID:            testScheme.ID,
+			MassBalanceDeposits: []commons.MassBalance{{ItemDefinition: defaultTestRewards.ItemDefinition, Amount: amount}},
+		})
+		require.NoError(t, err)
+		batch, err := CreateCreditBatch(orgCtx, params)
+		require.NoError(t, err)
+		return batch
+	}
+
+	first := makeBatch(2.6)
+	require.Equal(t, uint64(2), first.Batch.Credits)
+	require.InDelta(t, 0.6, first.Batch.Remainder, 1e-9)
+	require.Equal(t, "", first.Batch.CarriedFromBatchID)
+
+	// Too small for a credit on its own, so all of it is carried on
+	second := makeBatch(0.3)
+	require.Equal(t, uint64(0), second.Batch.Credits)
+	require.Equal(t, first.Batch.BatchID, second.Batch.CarriedFromBatchID)
+	require.InDelta(t, 0.6, second.Batch.CarriedMass, 1e-9)
+	require.InDelta(t, 0.9, second.Batch.Remainder, 1e-9)
+
+	third := makeBatch(0.1)
+	require.Equal(t, second.Batch.BatchID, third.Batch.CarriedFromBatchID)
+	require.Equal(t, uint64(1), third.Batch.Credits)
+	require.InDelta(t, 0, third.Batch.Remainder, 1e-9)
+}
+
+func TestCreditsForMass(t *testing.T) {
+	credits, remainder := creditsForMass(36.5, 10)
+	require.Equal(t, uint64(3), credits)
+	require.InDelta(t, 6.5, remainder, 1e-9)
+
+	// 0.7 + 0.2 + 0.1 as floats
+	credits, remainder = creditsForMass(0.9999999999999999, 1)
+	require.Equal(t, uint64(1), credits)
+	require.Equal(t, float64(0), remainder)
+
+	credits, remainder = creditsForMass(0.5, 1)
+	require.Equal(t, uint64(0), credits)
+	require.Equal(t, 0.5, remainder)
+}
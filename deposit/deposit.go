@@ -5,14 +5,32 @@ import (
 	"database/sql"
 	"encoding/json"
 	"encore.app/commons"
+	"encore.app/commons/outbox"
 	"encore.app/scheme"
 	"encore.dev/beta/auth"
 	"encore.dev/beta/errs"
 	"encore.dev/storage/sqldb"
 	"errors"
+	"fmt"
 	"time"
 )
 
+// FlagOutsideSchemeWindow is set on deposits captured when the scheme was not active
+const FlagOutsideSchemeWindow = "CAPTURED_OUTSIDE_SCHEME_WINDOW"
+
+const (
+	// maxClockSkew is how far ahead of the backend a collection point's clock can be
+	maxClockSkew = 5 * time.Minute
+	// maxOfflinePeriod is how long a collection point can record deposits offline before syncing them
+	maxOfflinePeriod = 90 * 24 * time.Hour
+)
+
+const (
+	StatusPending  = "PENDING"
+	StatusApproved = "APPROVED"
+	StatusRejected = "REJECTED"
+)
+
 type Deposit struct {
 	ID                    string                `json:"id"`
 	SchemeID              string                `json:"schemeID"`
@@ -22,6 +40,29 @@ type Deposit struct {
 	CreatedAt             time.Time             `json:"createdAt"`
 	MassBalanceDeposits   []commons.MassBalance `json:"massBalanceDeposits"`
 	Claimed               bool                  `json:"claimed"`
+	// Rewards are what was paid out when the deposit was claimed
+	Rewards        []commons.Reward `json:"rewards"`
+	Reversed       bool             `json:"reversed"`
+	ReversalReason string           `json:"reversalReason"`
+	ReversedAt     *time.Time       `json:"reversedAt"`
+	// Status is PENDING for deposits that must be approved by the organization before they can be claimed,
+	// either because of the scheme's approval policy or because they were flagged by its anomaly rules
+	Status      string     `json:"status"`
+	ReviewNotes string     `json:"reviewNotes"`
+	ReviewedAt  *time.Time `json:"reviewedAt"`
+	// CapturedAt is when the deposit happened, which is before CreatedAt for deposits recorded offline
+	CapturedAt time.Time `json:"capturedAt"`
+	// Expired deposits were not claimed before the scheme's claim deadline, ExpiryDestination is where their rewards went
+	Expired           bool       `json:"expired"`
+	ExpiredAt         *time.Time `json:"expiredAt"`
+	ExpiryDestination string     `json:"expiryDestination"`
+	// Flags mark deposits that should be looked at, e.g. FlagOutsideSchemeWindow
+	Flags []string `json:"flags"`
+	// CollectionPointSignature is the collection point's hex encoded signature of SignedPayload, if it signed the deposit
+	CollectionPointSignature string `json:"collectionPointSignature"`
+	SignedPayload            string `json:"signedPayload"`
+	// Evidence is only filled in by GetDeposit
+	Evidence []Evidence `json:"evidence"`
 }
 
 type MakeDepositParams struct {
@@ -29,6 +70,51 @@ type MakeDepositParams struct {
 	MassBalanceDeposits []commons.MassBalance `json:"massBalanceDeposits" validate:"required"`
 	UserPubKey          string                `json:"userPubKey"`
 	ExternalRef         string                `json:"externalRef"`
+	// EvidenceIDs are photos or weighing slips from UploadEvidence
+	EvidenceIDs []string `json:"evidenceIDs"`
+	// CapturedAt is when the deposit happened, if it was recorded offline. Defaults to now.
+	CapturedAt *time.Time `json:"capturedAt" validate:"required_with=Signature"`
+	// Signature is an optional hex encoded signature by the collection point of DepositSigningPayload,
+	// so the deposit can be proven to come from it
+	Signature string `json:"signature"`
+}
+
+// DepositSigningPayload is what a collection point signs to sign a deposit
+type DepositSigningPayload struct {
+	SchemeID            string                `json:"schemeID"`
+	MassBalanceDeposits []commons.MassBalance `json:"massBalanceDeposits"`
+	ExternalRef         string                `json:"externalRef"`
+	// CapturedAt is in unix seconds
+	CapturedAt int64 `json:"capturedAt"`
+}
+
+// depositSigningPayload is the canonical encoding of the deposit signed by the collection point
+func depositSigningPayload(params *MakeDepositParams) ([]byte, error) {
+	return json.Marshal(&DepositSigningPayload{
+		SchemeID:            params.SchemeID,
+		MassBalanceDeposits: params.MassBalanceDeposits,
+		ExternalRef:         params.ExternalRef,
+		CapturedAt:          params.CapturedAt.Unix(),
+	})
+}
+
+// checkCapturedAt rejects capture times in the future, beyond the collection point's clock skew,
+// or older than the offline period, as they can't come from a collection point syncing its deposits
+func checkCapturedAt(capturedAt time.Time) error {
+	now := time.Now()
+	if capturedAt.After(now.Add(maxClockSkew)) {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "capturedAt is in the future",
+		}
+	}
+	if capturedAt.Before(now.Add(-maxOfflinePeriod)) {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("capturedAt is more than %d days ago", int(maxOfflinePeriod.Hours()/24)),
+		}
+	}
+	return nil
 }
 
 //encore:api auth method=POST
@@ -44,9 +130,156 @@ func MakeDeposit(ctx context.Context, params *MakeDepositParams) (*Deposit, erro
 		return nil, err
 	}
 
+	existingDeposit, err := checkDeposit(ctx, s, string(collectionPoint), params)
+	if err != nil {
+		return nil, err
+	}
+	if existingDeposit != nil {
+		return existingDeposit, nil
+	}
+
+	deposit := Deposit{
+		ID:                    commons.GenerateID(),
+		SchemeID:              params.SchemeID,
+		CollectionPointPubKey: string(collectionPoint),
+		MassBalanceDeposits:   params.MassBalanceDeposits,
+		ExternalRef:           params.ExternalRef,
+		Status:                StatusApproved,
+		CapturedAt:            time.Now().UTC(),
+		Flags:                 []string{},
+	}
+	if params.CapturedAt != nil {
+		deposit.CapturedAt = params.CapturedAt.UTC()
+		if err := checkCapturedAt(deposit.CapturedAt); err != nil {
+			return nil, err
+		}
+	}
+	if params.Signature != "" {
+		// checkDeposit verified the signature
+		payload, err := depositSigningPayload(params)
+		if err != nil {
+			return nil, err
+		}
+		deposit.CollectionPointSignature = params.Signature
+		deposit.SignedPayload = string(payload)
+	}
+	if !s.IsActiveAt(deposit.CapturedAt) {
+		deposit.Flags = append(deposit.Flags, FlagOutsideSchemeWindow)
+	}
+	rules, err := scheme.GetAnomalyRules(ctx, &scheme.GetAnomalyRulesParams{SchemeID: s.ID})
+	if err != nil {
+		return nil, err
+	}
+	anomalies, err := detectAnomalies(ctx, *rules, &deposit, params.UserPubKey)
+	if err != nil {
+		return nil, err
+	}
+	deposit.Flags = append(deposit.Flags, anomalies...)
+	if len(anomalies) > 0 || s.ApprovalPolicy.RequiresApproval(params.MassBalanceDeposits) {
+		deposit.Status = StatusPending
+		// The user is remembered, so the deposit can be claimed for them when it is approved
+		deposit.UserPubKey = params.UserPubKey
+	}
+
+	jsonb, err := json.Marshal(&deposit.MassBalanceDeposits)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(ctx, `
+	        INSERT INTO deposit (id, scheme_id, collection_point_pub_key, mass_balance_deposits, external_ref, status, user_pub_key, captured_at, flags,
+	                             collection_point_signature, signed_payload)
+	        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	        ON CONFLICT (collection_point_pub_key, external_ref) WHERE external_ref <> '' DO NOTHING
+	    `, deposit.ID, deposit.SchemeID, deposit.CollectionPointPubKey, string(jsonb), deposit.ExternalRef, deposit.Status, deposit.UserPubKey, deposit.CapturedAt, deposit.Flags,
+		deposit.CollectionPointSignature, deposit.SignedPayload)
+	if err != nil {
+		return nil, err
+	}
+	if res.RowsAffected() == 0 {
+		// A concurrent request made a deposit with the same externalRef first
+		tx.Rollback()
+		return replayDeposit(ctx, s, string(collectionPoint), params)
+	}
+
+	if err := attachEvidence(ctx, tx, deposit.ID, deposit.CollectionPointPubKey, params.EvidenceIDs); err != nil {
+		return nil, err
+	}
+
+	if deposit.Status == StatusApproved {
+		if err := countDepositApproved(ctx, tx, &deposit); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := appendToChain(ctx, tx, ChainRecordDeposit, deposit.ID); err != nil {
+		return nil, err
+	}
+
+	if err := outbox.Enqueue(ctx, tx, &DepositMadeEvent{
+		DepositID:             deposit.ID,
+		SchemeID:              deposit.SchemeID,
+		OrganizationID:        s.OrganizationID,
+		CollectionPointPubKey: deposit.CollectionPointPubKey,
+		ExternalRef:           deposit.ExternalRef,
+		MassBalanceDeposits:   deposit.MassBalanceDeposits,
+		Status:                deposit.Status,
+		CapturedAt:            deposit.CapturedAt,
+		Flags:                 deposit.Flags,
+	}); err != nil {
+		return nil, err
+	}
+
+	if params.UserPubKey != "" && deposit.Status == StatusApproved {
+		if _, err := claim(ctx, tx, &deposit, params.UserPubKey, EventTypeDeposit); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return GetDeposit(ctx, &GetDepositParams{
+		DepositID: deposit.ID,
+	})
+}
+
+// verifyDepositSignature checks the collection point's signature of the deposit, if it signed it,
+// and returns the signed payload
+func verifyDepositSignature(collectionPoint string, params *MakeDepositParams) ([]byte, error) {
+	if params.Signature == "" {
+		return nil, nil
+	}
+
+	payload, err := depositSigningPayload(params)
+	if err != nil {
+		return nil, err
+	}
+	// Same check as for the collection point's auth tokens
+	if err := commons.VerifySignature(collectionPoint, payload, params.Signature); err != nil {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "invalid deposit signature: " + err.Error(),
+		}
+	}
+
+	return payload, nil
+}
+
+// checkDeposit checks that the collection point can make the deposit in the scheme, and its signature if it is signed.
+// If the externalRef was already used for the same deposit, that deposit is returned. For a signed deposit,
+// the one that was made must have been signed with the same payload.
+func checkDeposit(ctx context.Context, s *scheme.Scheme, collectionPoint string, params *MakeDepositParams) (*Deposit, error) {
 	collectionPointAllowed := false
 	for _, c := range s.CollectionPoints {
-		if c == string(collectionPoint) {
+		if c == collectionPoint {
 			collectionPointAllowed = true
 			break
 		}
@@ -73,11 +306,21 @@ func MakeDeposit(ctx context.Context, params *MakeDepositParams) (*Deposit, erro
 		}
 	}
 
+	// Checked before the externalRef, so a replay can't return a deposit for a signature that is not valid
+	payload, err := verifyDepositSignature(collectionPoint, params)
+	if err != nil {
+		return nil, err
+	}
+
 	if params.ExternalRef != "" {
-		existingDeposit, _ := GetDepositByExternalRef(ctx, &GetDepositByExternalRefParams{
-			CollectionPointPubKey: string(collectionPoint),
+		existingDeposit, err := GetDepositByExternalRef(ctx, &GetDepositByExternalRefParams{
+			CollectionPointPubKey: collectionPoint,
 			ExternalRef:           params.ExternalRef,
 		})
+		var errsErr *errs.Error
+		if err != nil && !(errors.As(err, &errsErr) && errsErr.Code == errs.NotFound) {
+			return nil, err
+		}
 
 		if existingDeposit != nil {
 			if len(existingDeposit.MassBalanceDeposits) != len(params.MassBalanceDeposits) {
@@ -103,44 +346,34 @@ func MakeDeposit(ctx context.Context, params *MakeDepositParams) (*Deposit, erro
 				}
 			}
 
+			if payload != nil && existingDeposit.SignedPayload != string(payload) {
+				return nil, &errs.Error{
+					Code:    errs.InvalidArgument,
+					Message: "externalRef already exists, but different deposit was signed",
+				}
+			}
+
 			return existingDeposit, nil
 		}
 	}
 
-	deposit := Deposit{
-		ID:                    commons.GenerateID(),
-		SchemeID:              params.SchemeID,
-		CollectionPointPubKey: string(collectionPoint),
-		MassBalanceDeposits:   params.MassBalanceDeposits,
-		ExternalRef:           params.ExternalRef,
-	}
-
-	jsonb, err := json.Marshal(&deposit.MassBalanceDeposits)
-	if err != nil {
-		return nil, err
-	}
+	return nil, nil
+}
 
-	_, err = sqldb.Exec(ctx, `
-	        INSERT INTO deposit (id, scheme_id, collection_point_pub_key, mass_balance_deposits, external_ref)
-	        VALUES ($1, $2, $3, $4, $5)
-	    `, deposit.ID, deposit.SchemeID, deposit.CollectionPointPubKey, string(jsonb), deposit.ExternalRef)
+// replayDeposit returns the deposit that was already made with the externalRef
+func replayDeposit(ctx context.Context, s *scheme.Scheme, collectionPoint string, params *MakeDepositParams) (*Deposit, error) {
+	existingDeposit, err := checkDeposit(ctx, s, collectionPoint, params)
 	if err != nil {
 		return nil, err
 	}
-
-	if params.UserPubKey != "" {
-		if _, err := Claim(ctx, &ClaimParams{
-			DepositID:  deposit.ID,
-			UserPubKey: params.UserPubKey,
-		}); err != nil {
-			// TODO: WE NEED A TRANSACTION SO THE DEPOSIT IS NOT CREATED
-			return nil, err
+	if existingDeposit == nil {
+		return nil, &errs.Error{
+			Code:    errs.Aborted,
+			Message: "deposit with the same externalRef was being made, try again",
 		}
 	}
 
-	return GetDeposit(ctx, &GetDepositParams{
-		DepositID: deposit.ID,
-	})
+	return existingDeposit, nil
 }
 
 type GetDepositParams struct {
@@ -153,9 +386,8 @@ func GetDeposit(ctx context.Context, params *GetDepositParams) (*Deposit, error)
 		return nil, err
 	}
 
-	var d Deposit
-	var massBalanceJson string
-	if err := sqldb.QueryRow(ctx, "SELECT id, scheme_id, collection_point_pub_key, user_pub_key, mass_balance_deposits, claimed, created_at, external_ref FROM deposit WHERE id=$1", params.DepositID).Scan(&d.ID, &d.SchemeID, &d.CollectionPointPubKey, &d.UserPubKey, &massBalanceJson, &d.Claimed, &d.CreatedAt, &d.ExternalRef); err != nil {
+	d, err := scanDeposit(sqldb.QueryRow(ctx, "SELECT "+depositColumns+" FROM deposit WHERE id=$1", params.DepositID))
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, &errs.Error{
 				Code: errs.NotFound,
@@ -164,10 +396,13 @@ func GetDeposit(ctx context.Context, params *GetDepositParams) (*Deposit, error)
 		return nil, err
 	}
 
-	if err := json.Unmarshal([]byte(massBalanceJson), &d.MassBalanceDeposits); err != nil {
+	evidence, err := getEvidenceForDeposit(ctx, d.ID)
+	if err != nil {
 		return nil, err
 	}
-	return &d, nil
+	d.Evidence = evidence
+
+	return d, nil
 }
 
 type GetDepositByExternalRefParams struct {
@@ -181,9 +416,8 @@ func GetDepositByExternalRef(ctx context.Context, params *GetDepositByExternalRe
 		return nil, err
 	}
 
-	var d Deposit
-	var massBalanceJson string
-	if err := sqldb.QueryRow(ctx, "SELECT id, scheme_id, collection_point_pub_key, user_pub_key, mass_balance_deposits, claimed, created_at FROM deposit WHERE collection_point_pub_key=$1 AND external_ref=$2", params.CollectionPointPubKey, params.ExternalRef).Scan(&d.ID, &d.SchemeID, &d.CollectionPointPubKey, &d.UserPubKey, &massBalanceJson, &d.Claimed, &d.CreatedAt); err != nil {
+	d, err := scanDeposit(sqldb.QueryRow(ctx, "SELECT "+depositColumns+" FROM deposit WHERE collection_point_pub_key=$1 AND external_ref=$2", params.CollectionPointPubKey, params.ExternalRef))
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, &errs.Error{
 				Code: errs.NotFound,
@@ -192,10 +426,7 @@ func GetDepositByExternalRef(ctx context.Context, params *GetDepositByExternalRe
 		return nil, err
 	}
 
-	if err := json.Unmarshal([]byte(massBalanceJson), &d.MassBalanceDeposits); err != nil {
-		return nil, err
-	}
-	return &d, nil
+	return d, nil
 }
 
 type GetAllDepositsParams struct {
@@ -219,9 +450,9 @@ func GetAllDeposits(ctx context.Context, params *GetAllDepositsParams) (*GetAllD
 	var rows *sqldb.Rows
 	var err error
 	if params.UserPubKey == "" {
-		rows, err = sqldb.Query(ctx, `SELECT id, scheme_id, collection_point_pub_key, user_pub_key, mass_balance_deposits, claimed, created_at FROM deposit ORDER BY created_at `+order)
+		rows, err = sqldb.Query(ctx, `SELECT `+depositColumns+` FROM deposit ORDER BY created_at `+order)
 	} else {
-		rows, err = sqldb.Query(ctx, `SELECT id, scheme_id, collection_point_pub_key, user_pub_key, mass_balance_deposits, claimed, created_at FROM deposit WHERE user_pub_key=$1 ORDER BY created_at `+order, params.UserPubKey)
+		rows, err = sqldb.Query(ctx, `SELECT `+depositColumns+` FROM deposit WHERE user_pub_key=$1 ORDER BY created_at `+order, params.UserPubKey)
 	}
 	if err != nil {
 		return nil, err
@@ -229,16 +460,41 @@ func GetAllDeposits(ctx context.Context, params *GetAllDepositsParams) (*GetAllD
 	defer rows.Close()
 
 	for rows.Next() {
-		var d Deposit
-		var massBalanceJson string
-		if err := rows.Scan(&d.ID, &d.SchemeID, &d.CollectionPointPubKey, &d.UserPubKey, &massBalanceJson, &d.Claimed, &d.CreatedAt); err != nil {
+		d, err := scanDeposit(rows)
+		if err != nil {
 			return nil, err
 		}
-		if err := json.Unmarshal([]byte(massBalanceJson), &d.MassBalanceDeposits); err != nil {
-			return nil, err
-		}
-		resp.Deposits = append(resp.Deposits, d)
+		resp.Deposits = append(resp.Deposits, *d)
 	}
 
 	return resp, rows.Err()
 }
+
+// depositColumns are the columns scanDeposit reads, in order
+const depositColumns = `id, scheme_id, collection_point_pub_key, user_pub_key, mass_balance_deposits, claimed, created_at,
+    external_ref, reversed, reversal_reason, reversed_at, status, review_notes, reviewed_at, captured_at, flags,
+    expired, expired_at, expiry_destination, rewards, collection_point_signature, signed_payload`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDeposit(row scanner) (*Deposit, error) {
+	var d Deposit
+	var massBalanceJson, rewardsJson string
+	if err := row.Scan(&d.ID, &d.SchemeID, &d.CollectionPointPubKey, &d.UserPubKey, &massBalanceJson, &d.Claimed, &d.CreatedAt,
+		&d.ExternalRef, &d.Reversed, &d.ReversalReason, &d.ReversedAt, &d.Status, &d.ReviewNotes, &d.ReviewedAt, &d.CapturedAt, &d.Flags,
+		&d.Expired, &d.ExpiredAt, &d.ExpiryDestination, &rewardsJson, &d.CollectionPointSignature, &d.SignedPayload); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(massBalanceJson), &d.MassBalanceDeposits); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(rewardsJson), &d.Rewards); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
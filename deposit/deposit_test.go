@@ -2,7 +2,10 @@ package deposit
 
 import (
 	"context"
+	"encoding/hex"
+	"sync"
 	"testing"
+	"time"
 
 	"encore.app/admin"
 	"encore.app/commons"
@@ -362,3 +365,255 @@ func TestGetDeposit(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, deposit.ID, getDepositWithExternalRef.ID)
 }
+
+func TestMakeDepositIsIdempotentOnExternalRef(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, _, collectionPointPubKey := setupTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+
+	params := &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		UserPubKey:          testUserPubKey,
+		MassBalanceDeposits: defaultTestDeposit,
+		ExternalRef:         "receipt-1",
+	}
+	deposit, err := MakeDeposit(ctx, params)
+	require.NoError(t, err)
+	require.Equal(t, "receipt-1", deposit.ExternalRef)
+	require.Equal(t, 1, len(deposit.Rewards))
+	require.Equal(t, float64(12), deposit.Rewards[0].Amount)
+
+	// The replay returns the original deposit, including what was paid out when it was claimed
+	replay, err := MakeDeposit(ctx, params)
+	require.NoError(t, err)
+	require.Equal(t, deposit.ID, replay.ID)
+	require.Equal(t, deposit.Rewards, replay.Rewards)
+
+	vouchers, err := GetVouchersForDeposit(ctx, &GetVouchersForDepositParams{DepositID: deposit.ID})
+	require.NoError(t, err)
+	require.Equal(t, 12, len(vouchers.Vouchers))
+
+	_, err = MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID: testScheme.ID,
+		MassBalanceDeposits: []commons.MassBalance{
+			{ItemDefinition: defaultTestRewards.ItemDefinition, Amount: 13},
+		},
+		ExternalRef: "receipt-1",
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+
+	// Concurrent requests with the same externalRef make one deposit
+	concurrentParams := &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: defaultTestDeposit,
+		ExternalRef:         "receipt-2",
+	}
+	const concurrency = 5
+	ids := make(chan string, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d, err := MakeDeposit(ctx, concurrentParams)
+			if err == nil {
+				ids <- d.ID
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	var madeIDs []string
+	for id := range ids {
+		madeIDs = append(madeIDs, id)
+	}
+	require.NotEmpty(t, madeIDs)
+	for _, id := range madeIDs {
+		require.Equal(t, madeIDs[0], id)
+	}
+
+	var count int
+	require.NoError(t, depositDB.QueryRow(context.Background(), "SELECT count(*) FROM deposit WHERE external_ref=$1", "receipt-2").Scan(&count))
+	require.Equal(t, 1, count)
+
+	// Deposits without an externalRef are never treated as duplicates
+	for i := 0; i < 2; i++ {
+		_, err := MakeDeposit(ctx, &MakeDepositParams{
+			SchemeID:            testScheme.ID,
+			MassBalanceDeposits: defaultTestDeposit,
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, depositDB.QueryRow(context.Background(), "SELECT count(*) FROM deposit WHERE external_ref=''").Scan(&count))
+	require.Equal(t, 2, count)
+}
+
+func TestMakeSignedDeposit(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, orgSigningKey, _ := setupTestScheme(t)
+	collectionPointPubKey, collectionPointPrivKey := testutils.GenerateKeys()
+	require.NoError(t, scheme.AddCollectionPoint(testutils.GetAuthenticatedContext(orgSigningKey), &scheme.AddCollectionPointParams{
+		SchemeID:              testScheme.ID,
+		CollectionPointPubKey: collectionPointPubKey,
+	}))
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+
+	capturedAt := time.Now().Add(-time.Hour)
+	params := &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: defaultTestDeposit,
+		ExternalRef:         "receipt-1",
+		CapturedAt:          &capturedAt,
+	}
+	payload, err := depositSigningPayload(params)
+	require.NoError(t, err)
+	signature, err := collectionPointPrivKey.Sign(payload)
+	require.NoError(t, err)
+	params.Signature = hex.EncodeToString(signature)
+
+	deposit, err := MakeDeposit(ctx, params)
+	require.NoError(t, err)
+
+	stored, err := GetDeposit(ctx, &GetDepositParams{DepositID: deposit.ID})
+	require.NoError(t, err)
+	require.Equal(t, params.Signature, stored.CollectionPointSignature)
+	require.Equal(t, string(payload), stored.SignedPayload)
+	require.NoError(t, commons.VerifySignature(stored.CollectionPointPubKey, []byte(stored.SignedPayload), stored.CollectionPointSignature))
+
+	// Replaying the signed deposit returns it
+	replayed, err := MakeDeposit(ctx, params)
+	require.NoError(t, err)
+	require.Equal(t, deposit.ID, replayed.ID)
+
+	// A replay is checked like a new deposit, so an invalid signature does not return the deposit
+	invalid := *params
+	invalid.Signature = hex.EncodeToString(make([]byte, 64))
+	_, err = MakeDeposit(ctx, &invalid)
+	require.Error(t, err)
+	require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+
+	// Nor does a valid signature of a different payload
+	otherCapturedAt := capturedAt.Add(-time.Hour)
+	other := *params
+	other.CapturedAt = &otherCapturedAt
+	otherPayload, err := depositSigningPayload(&other)
+	require.NoError(t, err)
+	otherSignature, err := collectionPointPrivKey.Sign(otherPayload)
+	require.NoError(t, err)
+	other.Signature = hex.EncodeToString(otherSignature)
+	_, err = MakeDeposit(ctx, &other)
+	require.Error(t, err)
+	require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+
+	// The signature does not cover different amounts
+	_, err = MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID: testScheme.ID,
+		MassBalanceDeposits: []commons.MassBalance{
+			{ItemDefinition: defaultTestRewards.ItemDefinition, Amount: 13},
+		},
+		ExternalRef: "receipt-2",
+		CapturedAt:  &capturedAt,
+		Signature:   params.Signature,
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+
+	// A signature needs the capture time it covers
+	_, err = MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: defaultTestDeposit,
+		ExternalRef:         "receipt-3",
+		Signature:           params.Signature,
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+
+	unsigned, err := MakeDeposit(ctx, &MakeDepositParams{SchemeID: testScheme.ID, MassBalanceDeposits: defaultTestDeposit})
+	require.NoError(t, err)
+	require.Equal(t, "", unsigned.CollectionPointSignature)
+}
+
+func TestMakeDepositCapturedAtBounds(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, _, collectionPointPubKey := setupTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+
+	now := time.Now()
+	testTable := []struct {
+		name       string
+		capturedAt time.Time
+		valid      bool
+	}{
+		{"Within the clock skew", now.Add(maxClockSkew / 2), true},
+		{"In the future", now.Add(maxClockSkew + time.Minute), false},
+		{"Within the offline period", now.Add(-maxOfflinePeriod + time.Hour), true},
+		{"Before the offline period", now.Add(-maxOfflinePeriod - time.Hour), false},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := MakeDeposit(ctx, &MakeDepositParams{
+				SchemeID:            testScheme.ID,
+				MassBalanceDeposits: defaultTestDeposit,
+				CapturedAt:          &test.capturedAt,
+			})
+			if test.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+			}
+		})
+	}
+}
+
+// setupTestScheme creates an organization with a voucher definition and a scheme with defaultTestRewards
+// and one collection point.
+func setupTestScheme(t *testing.T) (testScheme *scheme.Scheme, orgSigningKey string, collectionPointPubKey string) {
+	orgSigningKey, _ = testutils.GenerateKeys()
+	orgEncryptionPubKey, _ := testutils.GenerateKeys()
+	_, err := organization.CreateOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &organization.CreateOrgParams{
+		ID:               testOrganizationId,
+		Name:             testOrganizationId,
+		SigningPubKey:    orgSigningKey,
+		EncryptionPubKey: orgEncryptionPubKey,
+	})
+	require.NoError(t, err)
+
+	definition, err := CreateVoucherDefinition(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &CreateVoucherDefinitionParams{
+		OrganizationID: testOrganizationId,
+		Name:           "Voucher def name",
+		PictureURL:     "https://does.not.matter.com",
+	})
+	require.NoError(t, err)
+	defaultTestRewards.RewardTypeID = definition.ID
+
+	collectionPointPubKey, _ = testutils.GenerateKeys()
+	testScheme, err = scheme.CreateScheme(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &scheme.CreateSchemeParams{
+		Name: "TestScheme",
+		RewardDefinitions: []commons.RewardDefinition{
+			defaultTestRewards,
+		},
+		OrganizationID: testOrganizationId,
+	})
+	require.NoError(t, err)
+
+	err = scheme.AddCollectionPoint(testutils.GetAuthenticatedContext(orgSigningKey), &scheme.AddCollectionPointParams{
+		SchemeID:              testScheme.ID,
+		CollectionPointPubKey: collectionPointPubKey,
+	})
+	require.NoError(t, err)
+
+	return testScheme, orgSigningKey, collectionPointPubKey
+}
@@ -0,0 +1,214 @@
+package deposit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/commons/outbox"
+	"encore.dev/cron"
+	"encore.dev/pubsub"
+	"encore.dev/storage/sqldb"
+)
+
+const (
+	EventTypeDepositMade        = "DepositMade"
+	EventTypeDepositClaimed     = "DepositClaimed"
+	EventTypeDepositReversed    = "DepositReversed"
+	EventTypeDepositReviewed    = "DepositReviewed"
+	EventTypeDepositExpired     = "DepositExpired"
+	EventTypeVoucherMinted      = "VoucherMinted"
+	EventTypeVoucherInvalidated = "VoucherInvalidated"
+)
+
+type DepositMadeEvent struct {
+	outbox.Metadata
+	DepositID             string                `json:"depositID"`
+	SchemeID              string                `json:"schemeID"`
+	OrganizationID        string                `json:"organizationID"`
+	CollectionPointPubKey string                `json:"collectionPointPubKey"`
+	ExternalRef           string                `json:"externalRef"`
+	MassBalanceDeposits   []commons.MassBalance `json:"massBalanceDeposits"`
+	Status                string                `json:"status"`
+	CapturedAt            time.Time             `json:"capturedAt"`
+	Flags                 []string              `json:"flags"`
+}
+
+func (*DepositMadeEvent) EventType() string { return EventTypeDepositMade }
+
+type DepositClaimedEvent struct {
+	outbox.Metadata
+	DepositID      string           `json:"depositID"`
+	SchemeID       string           `json:"schemeID"`
+	OrganizationID string           `json:"organizationID"`
+	UserPubKey     string           `json:"userPubKey"`
+	Rewards        []commons.Reward `json:"rewards"`
+}
+
+func (*DepositClaimedEvent) EventType() string { return EventTypeDepositClaimed }
+
+type DepositReversedEvent struct {
+	outbox.Metadata
+	DepositID             string   `json:"depositID"`
+	SchemeID              string   `json:"schemeID"`
+	OrganizationID        string   `json:"organizationID"`
+	CollectionPointPubKey string   `json:"collectionPointPubKey"`
+	UserPubKey            string   `json:"userPubKey"`
+	Reason                string   `json:"reason"`
+	ReversedBy            string   `json:"reversedBy"`
+	InvalidatedVoucherIDs []string `json:"invalidatedVoucherIDs"`
+}
+
+func (*DepositReversedEvent) EventType() string { return EventTypeDepositReversed }
+
+type DepositReviewedEvent struct {
+	outbox.Metadata
+	DepositID      string `json:"depositID"`
+	SchemeID       string `json:"schemeID"`
+	OrganizationID string `json:"organizationID"`
+	Status         string `json:"status"`
+	Notes          string `json:"notes"`
+	ReviewedBy     string `json:"reviewedBy"`
+}
+
+func (*DepositReviewedEvent) EventType() string { return EventTypeDepositReviewed }
+
+type DepositExpiredEvent struct {
+	outbox.Metadata
+	DepositID             string `json:"depositID"`
+	SchemeID              string `json:"schemeID"`
+	OrganizationID        string `json:"organizationID"`
+	CollectionPointPubKey string `json:"collectionPointPubKey"`
+	// Destination is where the rewards went: FORFEIT, DONATE or RETURN
+	Destination         string           `json:"destination"`
+	CommunityPoolPubKey string           `json:"communityPoolPubKey"`
+	Rewards             []commons.Reward `json:"rewards"`
+}
+
+func (*DepositExpiredEvent) EventType() string { return EventTypeDepositExpired }
+
+type VoucherMintedEvent struct {
+	outbox.Metadata
+	VoucherID           string `json:"voucherID"`
+	VoucherDefinitionID string `json:"voucherDefinitionID"`
+	OrganizationID      string `json:"organizationID"`
+	OwnerPubKey         string `json:"ownerPubKey"`
+	DepositID           string `json:"depositID"`
+	SchemeID            string `json:"schemeID"`
+}
+
+func (*VoucherMintedEvent) EventType() string { return EventTypeVoucherMinted }
+
+type VoucherInvalidatedEvent struct {
+	outbox.Metadata
+	VoucherID           string `json:"voucherID"`
+	VoucherDefinitionID string `json:"voucherDefinitionID"`
+	OrganizationID      string `json:"organizationID"`
+	OwnerPubKey         string `json:"ownerPubKey"`
+}
+
+func (*VoucherInvalidatedEvent) EventType() string { return EventTypeVoucherInvalidated }
+
+var DepositMade = pubsub.NewTopic[*DepositMadeEvent]("deposit-made", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var DepositClaimed = pubsub.NewTopic[*DepositClaimedEvent]("deposit-claimed", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var DepositReversed = pubsub.NewTopic[*DepositReversedEvent]("deposit-reversed", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var DepositReviewed = pubsub.NewTopic[*DepositReviewedEvent]("deposit-reviewed", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var DepositExpired = pubsub.NewTopic[*DepositExpiredEvent]("deposit-expired", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var VoucherMinted = pubsub.NewTopic[*VoucherMintedEvent]("voucher-minted", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var VoucherInvalidated = pubsub.NewTopic[*VoucherInvalidatedEvent]("voucher-invalidated", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var _ = cron.NewJob("relay-deposit-outbox", cron.JobConfig{
+	Title:    "Publish deposit events from the outbox",
+	Every:    1 * cron.Minute,
+	Endpoint: RelayOutbox,
+})
+
+type RelayOutboxResponse struct {
+	Published int `json:"published"`
+	Failed    int `json:"failed"`
+	// DeadLettered events failed too often and will not be tried again
+	DeadLettered int `json:"deadLettered"`
+}
+
+//encore:api private method=POST
+func RelayOutbox(ctx context.Context) (*RelayOutboxResponse, error) {
+	result, err := outbox.Relay(ctx, sqldb.Begin, publishEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RelayOutboxResponse{Published: result.Published, Failed: result.Failed, DeadLettered: result.DeadLettered}, nil
+}
+
+func publishEvent(ctx context.Context, eventType string, payload []byte) (err error) {
+	switch eventType {
+	case EventTypeDepositMade:
+		var e DepositMadeEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return err
+		}
+		_, err = DepositMade.Publish(ctx, &e)
+	case EventTypeDepositClaimed:
+		var e DepositClaimedEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return err
+		}
+		_, err = DepositClaimed.Publish(ctx, &e)
+	case EventTypeDepositReversed:
+		var e DepositReversedEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return err
+		}
+		_, err = DepositReversed.Publish(ctx, &e)
+	case EventTypeDepositReviewed:
+		var e DepositReviewedEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return err
+		}
+		_, err = DepositReviewed.Publish(ctx, &e)
+	case EventTypeDepositExpired:
+		var e DepositExpiredEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return err
+		}
+		_, err = DepositExpired.Publish(ctx, &e)
+	case EventTypeVoucherMinted:
+		var e VoucherMintedEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return err
+		}
+		_, err = VoucherMinted.Publish(ctx, &e)
+	case EventTypeVoucherInvalidated:
+		var e VoucherInvalidatedEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return err
+		}
+		_, err = VoucherInvalidated.Publish(ctx, &e)
+	default:
+		return fmt.Errorf("unknown event type %q in outbox", eventType)
+	}
+
+	return err
+}
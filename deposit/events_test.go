@@ -0,0 +1,152 @@
+package deposit
+
+import (
+	"context"
+	"testing"
+
+	"encore.app/admin"
+	"encore.app/commons"
+	"encore.app/commons/outbox"
+	"encore.app/commons/testutils"
+	"encore.app/scheme"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventsAreStoredInOutbox(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, _, collectionPointPubKey := setupTestScheme(t)
+	_, err := RelayOutbox(context.Background())
+	require.NoError(t, err)
+
+	deposit, err := MakeDeposit(testutils.GetAuthenticatedContext(collectionPointPubKey), &MakeDepositParams{
+		SchemeID:   testScheme.ID,
+		UserPubKey: testUserPubKey,
+		MassBalanceDeposits: []commons.MassBalance{
+			{
+				ItemDefinition: defaultTestRewards.ItemDefinition,
+				Amount:         3,
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	vouchers, err := GetVouchersForUser(testutils.GetAuthenticatedContext(testUserPubKey), &GetVouchersForUserParams{UserPubKey: testUserPubKey})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(vouchers.Vouchers))
+
+	require.NoError(t, InvalidateVoucher(testutils.GetAuthenticatedContext(testUserPubKey), &InvalidateVoucherParams{VoucherID: vouchers.Vouchers[0].Voucher.ID}))
+
+	require.Equal(t, map[string]int{
+		EventTypeDepositMade:        1,
+		EventTypeVoucherMinted:      3,
+		EventTypeDepositClaimed:     1,
+		EventTypeVoucherInvalidated: 1,
+	}, unpublishedEvents(t))
+
+	var depositID string
+	require.NoError(t, depositDB.QueryRow(context.Background(), "SELECT payload->>'depositID' FROM outbox WHERE event_type=$1", EventTypeDepositMade).Scan(&depositID))
+	require.Equal(t, deposit.ID, depositID)
+
+	resp, err := RelayOutbox(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 6, resp.Published)
+	require.Equal(t, map[string]int{}, unpublishedEvents(t))
+
+	resp, err = RelayOutbox(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, resp.Published)
+}
+
+func TestNoEventsForRolledBackDeposit(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupTestScheme(t)
+
+	// Paying out the reward fails because the voucher definition does not exist
+	brokenRewards := defaultTestRewards
+	brokenRewards.RewardTypeID = "doesNotExist"
+	require.NoError(t, scheme.EditScheme(testutils.GetAuthenticatedContext(orgSigningKey), &scheme.EditSchemeParams{
+		SchemeID:          testScheme.ID,
+		RewardDefinitions: []commons.RewardDefinition{brokenRewards},
+		CollectionPoints:  []string{collectionPointPubKey},
+	}))
+	_, err := RelayOutbox(context.Background())
+	require.NoError(t, err)
+
+	_, err = MakeDeposit(testutils.GetAuthenticatedContext(collectionPointPubKey), &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		UserPubKey:          testUserPubKey,
+		MassBalanceDeposits: defaultTestDeposit,
+	})
+	require.Error(t, err)
+
+	getAllResp, err := GetAllDeposits(testutils.GetAuthenticatedContext(""), &GetAllDepositsParams{})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(getAllResp.Deposits))
+	require.Equal(t, map[string]int{}, unpublishedEvents(t))
+}
+
+func TestRelaySkipsEventsThatFailToPublish(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, _, collectionPointPubKey := setupTestScheme(t)
+	_, err := RelayOutbox(context.Background())
+	require.NoError(t, err)
+
+	// An event no topic exists for, stored before the deposit
+	_, err = depositDB.Exec(context.Background(), `
+        INSERT INTO outbox (id, event_type, payload, created_at) VALUES ('poison', 'Unknown', '{}', now() - interval '1 minute')
+    `)
+	require.NoError(t, err)
+	_, err = MakeDeposit(testutils.GetAuthenticatedContext(collectionPointPubKey), &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: defaultTestDeposit,
+	})
+	require.NoError(t, err)
+
+	resp, err := RelayOutbox(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, &RelayOutboxResponse{Published: 1, Failed: 1}, resp)
+	require.Equal(t, map[string]int{"Unknown": 1}, unpublishedEvents(t))
+
+	var attempts int
+	var lastError string
+	require.NoError(t, depositDB.QueryRow(context.Background(), "SELECT attempts, last_error FROM outbox WHERE id='poison'").Scan(&attempts, &lastError))
+	require.Equal(t, 1, attempts)
+	require.Contains(t, lastError, "unknown event type")
+
+	// The last attempt dead-letters the event, after which it is not tried again
+	_, err = depositDB.Exec(context.Background(), "UPDATE outbox SET attempts=$1 WHERE id='poison'", outbox.MaxAttempts-1)
+	require.NoError(t, err)
+	resp, err = RelayOutbox(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, &RelayOutboxResponse{Failed: 1, DeadLettered: 1}, resp)
+
+	resp, err = RelayOutbox(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, &RelayOutboxResponse{}, resp)
+}
+
+func unpublishedEvents(t *testing.T) map[string]int {
+	rows, err := depositDB.Query(context.Background(), "SELECT event_type, count(*) FROM outbox WHERE published_at IS NULL GROUP BY event_type")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	events := map[string]int{}
+	for rows.Next() {
+		var eventType string
+		var count int
+		require.NoError(t, rows.Scan(&eventType, &count))
+		events[eventType] = count
+	}
+	require.NoError(t, rows.Err())
+
+	return events
+}
@@ -0,0 +1,267 @@
+package deposit
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/commons/blobstore"
+	"encore.app/organization"
+	"encore.app/scheme"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+const maxEvidenceSize = 10 << 20
+
+// allowedEvidenceTypes are the MIME types accepted as evidence: photos and scanned weighing slips
+var allowedEvidenceTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+// evidenceStore keeps the evidence files, content-addressed by their SHA-256.
+// It is a variable so it can be replaced by object storage. Nil means the EvidenceStorageDir directory from the config.
+var evidenceStore blobstore.Store
+
+// getEvidenceStore fails when no storage is set up, rather than keeping evidence somewhere it would be lost
+func getEvidenceStore() (blobstore.Store, error) {
+	if evidenceStore != nil {
+		return evidenceStore, nil
+	}
+
+	if cfg.EvidenceStorageDir() == "" {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "the evidence storage is not set up",
+		}
+	}
+	// The directory is not created, so a volume that failed to mount is noticed
+	if info, err := os.Stat(cfg.EvidenceStorageDir()); err != nil || !info.IsDir() {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "the evidence storage directory does not exist",
+		}
+	}
+
+	return blobstore.NewLocalStore(cfg.EvidenceStorageDir()), nil
+}
+
+type Evidence struct {
+	ID             string `json:"id"`
+	UploaderPubKey string `json:"uploaderPubKey"`
+	// SHA256 is the hex encoded hash of the content, so anyone can check a copy hasn't been tampered with
+	SHA256     string    `json:"sha256"`
+	MimeType   string    `json:"mimeType"`
+	Size       int64     `json:"size"`
+	CapturedAt time.Time `json:"capturedAt"`
+	DepositID  string    `json:"depositID"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+type UploadEvidenceParams struct {
+	// Content is the file, base64 encoded in JSON
+	Content []byte `json:"content" validate:"required"`
+	// CapturedAt is when the photo was taken or the slip was printed
+	CapturedAt time.Time `json:"capturedAt" validate:"required"`
+}
+
+// UploadEvidence stores a photo or weighing slip, to be attached to a deposit with MakeDeposit
+//encore:api auth method=POST
+func UploadEvidence(ctx context.Context, params *UploadEvidenceParams) (*Evidence, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	if len(params.Content) > maxEvidenceSize {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "evidence is too large",
+		}
+	}
+
+	mimeType := http.DetectContentType(params.Content)
+	if !allowedEvidenceTypes[mimeType] {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "unsupported evidence type: " + mimeType,
+		}
+	}
+
+	store, err := getEvidenceStore()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(params.Content)
+	hashHex := hex.EncodeToString(hash[:])
+	if err := store.Put(ctx, hashHex, params.Content); err != nil {
+		return nil, err
+	}
+
+	uploader, _ := auth.UserID()
+	id := commons.GenerateID()
+	if _, err := sqldb.Exec(ctx, `
+        INSERT INTO evidence (id, uploader_pub_key, sha256, mime_type, size, captured_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+    `, id, string(uploader), hashHex, mimeType, len(params.Content), params.CapturedAt.UTC()); err != nil {
+		return nil, err
+	}
+
+	return getEvidence(ctx, id)
+}
+
+type GetEvidenceContentParams struct {
+	EvidenceID string `json:"evidenceID" validate:"required"`
+}
+
+type GetEvidenceContentResponse struct {
+	Evidence Evidence `json:"evidence"`
+	Content  []byte   `json:"content"`
+}
+
+// GetEvidenceContent returns the evidence file to the uploader, or the organization running the scheme of its deposit
+//encore:api auth method=POST
+func GetEvidenceContent(ctx context.Context, params *GetEvidenceContentParams) (*GetEvidenceContentResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	evidence, err := getEvidence(ctx, params.EvidenceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := authorizeCallerForEvidence(ctx, evidence); err != nil {
+		return nil, err
+	}
+
+	store, err := getEvidenceStore()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := store.Get(ctx, evidence.SHA256)
+	if err != nil {
+		if errors.Is(err, blobstore.ErrNotFound) {
+			return nil, &errs.Error{
+				Code:    errs.DataLoss,
+				Message: "evidence content is missing",
+			}
+		}
+		return nil, err
+	}
+
+	hash := sha256.Sum256(content)
+	if hex.EncodeToString(hash[:]) != evidence.SHA256 {
+		return nil, &errs.Error{
+			Code:    errs.DataLoss,
+			Message: "evidence content does not match its hash",
+		}
+	}
+
+	return &GetEvidenceContentResponse{
+		Evidence: *evidence,
+		Content:  content,
+	}, nil
+}
+
+func authorizeCallerForEvidence(ctx context.Context, evidence *Evidence) error {
+	caller, _ := auth.UserID()
+	if string(caller) == evidence.UploaderPubKey {
+		return nil
+	}
+
+	if evidence.DepositID == "" {
+		return &errs.Error{
+			Code: errs.PermissionDenied,
+		}
+	}
+
+	deposit, err := GetDeposit(ctx, &GetDepositParams{DepositID: evidence.DepositID})
+	if err != nil {
+		return err
+	}
+
+	s, err := scheme.GetScheme(ctx, &scheme.GetSchemeParams{SchemeID: deposit.SchemeID})
+	if err != nil {
+		return err
+	}
+
+	return organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: s.OrganizationID})
+}
+
+// attachEvidence links the evidence uploaded by the collection point to the deposit as part of tx
+func attachEvidence(ctx context.Context, tx *sqldb.Tx, depositID string, collectionPointPubKey string, evidenceIDs []string) error {
+	if len(evidenceIDs) == 0 {
+		return nil
+	}
+
+	unique := map[string]bool{}
+	for _, id := range evidenceIDs {
+		unique[id] = true
+	}
+
+	res, err := tx.Exec(ctx, `
+        UPDATE evidence SET deposit_id=$1
+        WHERE id = ANY($2) AND uploader_pub_key=$3 AND deposit_id=''
+    `, depositID, evidenceIDs, collectionPointPubKey)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() != int64(len(unique)) {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "evidence not found, uploaded by someone else, or already attached to a deposit",
+		}
+	}
+
+	return nil
+}
+
+func getEvidence(ctx context.Context, id string) (*Evidence, error) {
+	var e Evidence
+	if err := sqldb.QueryRow(ctx, `
+        SELECT id, uploader_pub_key, sha256, mime_type, size, captured_at, deposit_id, created_at FROM evidence WHERE id=$1
+    `, id).Scan(&e.ID, &e.UploaderPubKey, &e.SHA256, &e.MimeType, &e.Size, &e.CapturedAt, &e.DepositID, &e.CreatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &errs.Error{
+				Code: errs.NotFound,
+			}
+		}
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func getEvidenceForDeposit(ctx context.Context, depositID string) ([]Evidence, error) {
+	rows, err := sqldb.Query(ctx, `
+        SELECT id, uploader_pub_key, sha256, mime_type, size, captured_at, deposit_id, created_at FROM evidence
+        WHERE deposit_id=$1 ORDER BY captured_at, id
+    `, depositID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	evidence := []Evidence{}
+	for rows.Next() {
+		var e Evidence
+		if err := rows.Scan(&e.ID, &e.UploaderPubKey, &e.SHA256, &e.MimeType, &e.Size, &e.CapturedAt, &e.DepositID, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		evidence = append(evidence, e)
+	}
+
+	return evidence, rows.Err()
+}
@@ -0,0 +1,174 @@
+package deposit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"encore.app/admin"
+	"encore.app/commons/blobstore"
+	"encore.app/commons/testutils"
+	"encore.dev/beta/errs"
+	"encore.dev/et"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testJPEG = append([]byte("\xFF\xD8\xFF\xE0\x00\x10JFIF\x00"), make([]byte, 64)...)
+	testPNG  = append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), make([]byte, 64)...)
+)
+
+func TestUploadEvidence(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	testutils.ClearAllDBs()
+	et.SetCfg(cfg.EvidenceStorageDir, t.TempDir())
+
+	uploader, _ := testutils.GenerateKeys()
+	capturedAt := time.Date(2022, 8, 1, 12, 30, 0, 0, time.UTC)
+
+	testTable := []struct {
+		name             string
+		params           UploadEvidenceParams
+		expectedMimeType string
+		errorCode        errs.ErrCode
+	}{
+		{
+			name:             "Photo",
+			params:           UploadEvidenceParams{Content: testJPEG, CapturedAt: capturedAt},
+			expectedMimeType: "image/jpeg",
+			errorCode:        errs.OK,
+		},
+		{
+			name:             "PNG",
+			params:           UploadEvidenceParams{Content: testPNG, CapturedAt: capturedAt},
+			expectedMimeType: "image/png",
+			errorCode:        errs.OK,
+		},
+		{
+			name:      "Unsupported type",
+			params:    UploadEvidenceParams{Content: []byte("just some text"), CapturedAt: capturedAt},
+			errorCode: errs.InvalidArgument,
+		},
+		{
+			name:      "Too large",
+			params:    UploadEvidenceParams{Content: append(testJPEG, make([]byte, maxEvidenceSize)...), CapturedAt: capturedAt},
+			errorCode: errs.InvalidArgument,
+		},
+		{
+			name:      "Missing captured at",
+			params:    UploadEvidenceParams{Content: testJPEG},
+			errorCode: errs.InvalidArgument,
+		},
+		{
+			name:      "Missing content",
+			params:    UploadEvidenceParams{CapturedAt: capturedAt},
+			errorCode: errs.InvalidArgument,
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			evidence, err := UploadEvidence(testutils.GetAuthenticatedContext(uploader), &test.params)
+			if test.errorCode != errs.OK {
+				require.Error(t, err)
+				require.Equal(t, test.errorCode, err.(*errs.Error).Code)
+				return
+			}
+			require.NoError(t, err)
+
+			hash := sha256.Sum256(test.params.Content)
+			require.Equal(t, hex.EncodeToString(hash[:]), evidence.SHA256)
+			require.Equal(t, test.expectedMimeType, evidence.MimeType)
+			require.Equal(t, int64(len(test.params.Content)), evidence.Size)
+			require.True(t, capturedAt.Equal(evidence.CapturedAt))
+			require.Equal(t, uploader, evidence.UploaderPubKey)
+			require.Equal(t, "", evidence.DepositID)
+		})
+	}
+}
+
+func TestDepositWithEvidence(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+	et.SetCfg(cfg.EvidenceStorageDir, t.TempDir())
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupTestScheme(t)
+	otherUser, _ := testutils.GenerateKeys()
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+
+	photo, err := UploadEvidence(ctx, &UploadEvidenceParams{Content: testJPEG, CapturedAt: time.Now()})
+	require.NoError(t, err)
+	slip, err := UploadEvidence(ctx, &UploadEvidenceParams{Content: testPNG, CapturedAt: time.Now()})
+	require.NoError(t, err)
+	othersEvidence, err := UploadEvidence(testutils.GetAuthenticatedContext(otherUser), &UploadEvidenceParams{Content: testJPEG, CapturedAt: time.Now()})
+	require.NoError(t, err)
+
+	_, err = MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: defaultTestDeposit,
+		EvidenceIDs:         []string{othersEvidence.ID},
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+
+	deposit, err := MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: defaultTestDeposit,
+		EvidenceIDs:         []string{photo.ID, slip.ID},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(deposit.Evidence))
+	for _, e := range deposit.Evidence {
+		require.Equal(t, deposit.ID, e.DepositID)
+		require.Contains(t, []string{photo.SHA256, slip.SHA256}, e.SHA256)
+	}
+
+	// Evidence can only be attached once
+	_, err = MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: defaultTestDeposit,
+		EvidenceIDs:         []string{photo.ID},
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+
+	content, err := GetEvidenceContent(testutils.GetAuthenticatedContext(orgSigningKey), &GetEvidenceContentParams{EvidenceID: photo.ID})
+	require.NoError(t, err)
+	require.Equal(t, testJPEG, content.Content)
+
+	_, err = GetEvidenceContent(testutils.GetAuthenticatedContext(otherUser), &GetEvidenceContentParams{EvidenceID: photo.ID})
+	require.Error(t, err)
+	require.Equal(t, errs.PermissionDenied, err.(*errs.Error).Code)
+
+	// Tampering with the stored file is detected
+	require.NoError(t, blobstore.NewLocalStore(cfg.EvidenceStorageDir()).Put(context.Background(), photo.SHA256, testPNG))
+	_, err = GetEvidenceContent(ctx, &GetEvidenceContentParams{EvidenceID: photo.ID})
+	require.Error(t, err)
+	require.Equal(t, errs.DataLoss, err.(*errs.Error).Code)
+}
+
+func TestEvidenceStorageMustBeSetUp(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	testutils.ClearAllDBs()
+	uploader, _ := testutils.GenerateKeys()
+	ctx := testutils.GetAuthenticatedContext(uploader)
+	params := &UploadEvidenceParams{Content: testJPEG, CapturedAt: time.Now()}
+
+	et.SetCfg(cfg.EvidenceStorageDir, "")
+	_, err := UploadEvidence(ctx, params)
+	require.Error(t, err)
+	require.Equal(t, errs.Internal, err.(*errs.Error).Code)
+
+	// A volume that is not mounted
+	et.SetCfg(cfg.EvidenceStorageDir, filepath.Join(t.TempDir(), "missing"))
+	_, err = UploadEvidence(ctx, params)
+	require.Error(t, err)
+	require.Equal(t, errs.Internal, err.(*errs.Error).Code)
+	_, err = os.Stat(cfg.EvidenceStorageDir())
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,243 @@
+package deposit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/commons/outbox"
+	"encore.app/organization"
+	"encore.app/scheme"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+var _ = cron.NewJob("expire-unclaimed-deposits", cron.JobConfig{
+	Title:    "Expire deposits that were not claimed before the scheme's claim deadline",
+	Every:    1 * cron.Hour,
+	Endpoint: ExpireDeposits,
+})
+
+type ExpireDepositsResponse struct {
+	Expired int `json:"expired"`
+	// Failed deposits are tried again on the next run
+	Failed int `json:"failed"`
+}
+
+// ExpireDeposits expires the unclaimed deposits that are past their scheme's claim deadline,
+// and sends their rewards where the scheme's expiry policy says
+//encore:api private method=POST
+func ExpireDeposits(ctx context.Context) (*ExpireDepositsResponse, error) {
+	schemes, err := scheme.GetAllSchemes(ctx, &scheme.GetAllSchemesParams{})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &ExpireDepositsResponse{}
+	for _, summary := range schemes.Schemes {
+		s, err := scheme.GetScheme(ctx, &scheme.GetSchemeParams{SchemeID: summary.ID})
+		if err != nil {
+			return nil, err
+		}
+		if s.ExpiryPolicy.ClaimPeriodDays == 0 {
+			continue
+		}
+
+		depositIDs, err := getExpiredDepositIDs(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, depositID := range depositIDs {
+			expired, err := expireDeposit(ctx, s, depositID)
+			if err != nil {
+				// Don't let one deposit hold up the rest
+				rlog.Error("failed to expire deposit", "depositID", depositID, "schemeID", s.ID, "err", err)
+				resp.Failed++
+				continue
+			}
+			if expired {
+				resp.Expired++
+			}
+		}
+	}
+
+	return resp, nil
+}
+
+func getExpiredDepositIDs(ctx context.Context, s *scheme.Scheme) ([]string, error) {
+	// Deposits captured before this are past their claim deadline
+	capturedBefore := time.Now().UTC().AddDate(0, 0, -s.ExpiryPolicy.ClaimPeriodDays)
+
+	rows, err := sqldb.Query(ctx, `
+        SELECT id FROM deposit
+        WHERE scheme_id=$1 AND claimed = false AND reversed = false AND expired = false AND status=$2 AND captured_at < $3
+        ORDER BY captured_at
+    `, s.ID, StatusApproved, capturedBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// expireDeposit expires the deposit, unless it was claimed in the meantime
+func expireDeposit(ctx context.Context, s *scheme.Scheme, depositID string) (bool, error) {
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	deposit, err := scanDeposit(tx.QueryRow(ctx, `
+        SELECT `+depositColumns+` FROM deposit
+        WHERE id=$1 AND claimed = false AND reversed = false AND expired = false
+        FOR UPDATE
+    `, depositID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	destination := s.ExpiryPolicy.ExpiryDestination()
+
+	var rewards []commons.Reward
+	var communityPoolPubKey string
+	if destination == scheme.ExpiryDonate {
+		communityPoolPubKey = s.ExpiryPolicy.CommunityPoolPubKey
+		// Claimed before it is marked as expired, since expired deposits can't be claimed
+		if rewards, err = claim(ctx, tx, deposit, communityPoolPubKey, EventTypeDepositClaim); err != nil {
+			return false, err
+		}
+	} else {
+		// FORFEIT and RETURN pay nothing out, the rewards are only recorded on the event
+		payouts, err := getRewards(ctx, deposit)
+		if err != nil {
+			return false, err
+		}
+		for _, p := range payouts {
+			rewards = append(rewards, p.Reward)
+		}
+	}
+
+	if _, err := tx.Exec(ctx, `
+        UPDATE deposit SET expired = true, expired_at=now(), expiry_destination=$2 WHERE id=$1
+    `, deposit.ID, destination); err != nil {
+		return false, err
+	}
+
+	if err := outbox.Enqueue(ctx, tx, &DepositExpiredEvent{
+		DepositID:             deposit.ID,
+		SchemeID:              deposit.SchemeID,
+		OrganizationID:        s.OrganizationID,
+		CollectionPointPubKey: deposit.CollectionPointPubKey,
+		Destination:           destination,
+		CommunityPoolPubKey:   communityPoolPubKey,
+		Rewards:               rewards,
+	}); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+type GetExpiredDepositsReportParams struct {
+	OrganizationID string `json:"organizationID" validate:"required"`
+	// From and To limit the report to deposits that expired in this period, nil means no limit
+	From *time.Time `json:"from"`
+	To   *time.Time `json:"to"`
+}
+
+type ExpiredDepositsForCollectionPoint struct {
+	CollectionPointPubKey string `json:"collectionPointPubKey"`
+	Count                 int    `json:"count"`
+	// CountByDestination is the number of deposits per expiry destination
+	CountByDestination map[string]int `json:"countByDestination"`
+	Deposits           []Deposit      `json:"deposits"`
+}
+
+type GetExpiredDepositsReportResponse struct {
+	CollectionPoints []ExpiredDepositsForCollectionPoint `json:"collectionPoints"`
+}
+
+// GetExpiredDepositsReport lists the organization's expired deposits per collection point
+//encore:api auth method=POST
+func GetExpiredDepositsReport(ctx context.Context, params *GetExpiredDepositsReportParams) (*GetExpiredDepositsReportResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: params.OrganizationID}); err != nil {
+		return nil, err
+	}
+
+	schemes, err := scheme.GetAllSchemes(ctx, &scheme.GetAllSchemesParams{OrganizationID: params.OrganizationID})
+	if err != nil {
+		return nil, err
+	}
+	schemeIDs := make([]string, 0, len(schemes.Schemes))
+	for _, s := range schemes.Schemes {
+		schemeIDs = append(schemeIDs, s.ID)
+	}
+
+	rows, err := sqldb.Query(ctx, `
+        SELECT `+depositColumns+` FROM deposit
+        WHERE expired = true AND scheme_id = ANY($1)
+          AND ($2::timestamp IS NULL OR expired_at >= $2) AND ($3::timestamp IS NULL OR expired_at < $3)
+        ORDER BY collection_point_pub_key, expired_at
+    `, schemeIDs, utcTime(params.From), utcTime(params.To))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resp := &GetExpiredDepositsReportResponse{CollectionPoints: []ExpiredDepositsForCollectionPoint{}}
+	for rows.Next() {
+		d, err := scanDeposit(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		last := len(resp.CollectionPoints) - 1
+		if last < 0 || resp.CollectionPoints[last].CollectionPointPubKey != d.CollectionPointPubKey {
+			resp.CollectionPoints = append(resp.CollectionPoints, ExpiredDepositsForCollectionPoint{
+				CollectionPointPubKey: d.CollectionPointPubKey,
+				CountByDestination:    map[string]int{},
+				Deposits:              []Deposit{},
+			})
+			last++
+		}
+
+		cp := &resp.CollectionPoints[last]
+		cp.Count++
+		cp.CountByDestination[d.ExpiryDestination]++
+		cp.Deposits = append(cp.Deposits, *d)
+	}
+
+	return resp, rows.Err()
+}
+
+// utcTime is t in UTC, since the columns are without time zone
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	u := t.UTC()
+	return &u
+}
@@ -0,0 +1,195 @@
+package deposit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/admin"
+	"encore.app/commons/testutils"
+	"encore.app/scheme"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpireDeposits(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+
+	poolPubKey, _ := testutils.GenerateKeys()
+
+	testTable := []struct {
+		name            string
+		policy          scheme.ExpiryPolicy
+		capturedDaysAgo int
+		expired         bool
+		destination     string
+		poolVouchers    int
+	}{
+		{
+			name:            "No claim deadline",
+			policy:          scheme.ExpiryPolicy{},
+			capturedDaysAgo: 89,
+			expired:         false,
+		},
+		{
+			name:            "Before the deadline",
+			policy:          scheme.ExpiryPolicy{ClaimPeriodDays: 30},
+			capturedDaysAgo: 29,
+			expired:         false,
+		},
+		{
+			name:            "Forfeit by default",
+			policy:          scheme.ExpiryPolicy{ClaimPeriodDays: 30},
+			capturedDaysAgo: 31,
+			expired:         true,
+			destination:     scheme.ExpiryForfeit,
+		},
+		{
+			name:            "Return",
+			policy:          scheme.ExpiryPolicy{ClaimPeriodDays: 30, Destination: scheme.ExpiryReturn},
+			capturedDaysAgo: 31,
+			expired:         true,
+			destination:     scheme.ExpiryReturn,
+		},
+		{
+			name:            "Donate",
+			policy:          scheme.ExpiryPolicy{ClaimPeriodDays: 30, Destination: scheme.ExpiryDonate, CommunityPoolPubKey: poolPubKey},
+			capturedDaysAgo: 31,
+			expired:         true,
+			destination:     scheme.ExpiryDonate,
+			poolVouchers:    12,
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			testutils.ClearAllDBs()
+			testScheme, orgSigningKey, collectionPointPubKey := setupTestScheme(t)
+			require.NoError(t, scheme.EditScheme(testutils.GetAuthenticatedContext(orgSigningKey), &scheme.EditSchemeParams{
+				SchemeID:          testScheme.ID,
+				RewardDefinitions: testScheme.RewardDefinitions,
+				CollectionPoints:  []string{collectionPointPubKey},
+				ExpiryPolicy:      &test.policy,
+			}))
+
+			ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+			capturedAt := time.Now().UTC().AddDate(0, 0, -test.capturedDaysAgo)
+			deposit, err := MakeDeposit(ctx, &MakeDepositParams{
+				SchemeID:            testScheme.ID,
+				MassBalanceDeposits: defaultTestDeposit,
+				CapturedAt:          &capturedAt,
+			})
+			require.NoError(t, err)
+			claimed, err := MakeDeposit(ctx, &MakeDepositParams{
+				SchemeID:            testScheme.ID,
+				MassBalanceDeposits: defaultTestDeposit,
+				UserPubKey:          testUserPubKey,
+				CapturedAt:          &capturedAt,
+			})
+			require.NoError(t, err)
+
+			resp, err := ExpireDeposits(context.Background())
+			require.NoError(t, err)
+
+			expected := 0
+			if test.expired {
+				expected = 1
+			}
+			require.Equal(t, expected, resp.Expired)
+			require.Equal(t, 0, resp.Failed)
+
+			deposit, err = GetDeposit(ctx, &GetDepositParams{DepositID: deposit.ID})
+			require.NoError(t, err)
+			require.Equal(t, test.expired, deposit.Expired)
+			require.Equal(t, test.destination, deposit.ExpiryDestination)
+
+			claimed, err = GetDeposit(ctx, &GetDepositParams{DepositID: claimed.ID})
+			require.NoError(t, err)
+			require.False(t, claimed.Expired)
+
+			vouchers, err := GetVouchersForDeposit(ctx, &GetVouchersForDepositParams{DepositID: deposit.ID})
+			require.NoError(t, err)
+			require.Equal(t, test.poolVouchers, len(vouchers.Vouchers))
+			for _, v := range vouchers.Vouchers {
+				require.Equal(t, poolPubKey, v.Voucher.OwnerPubKey)
+			}
+
+			_, err = Claim(testutils.GetAuthenticatedContext(testUserPubKey), &ClaimParams{
+				DepositID:  deposit.ID,
+				UserPubKey: testUserPubKey,
+			})
+			if test.expired {
+				require.Error(t, err)
+				if test.destination != scheme.ExpiryDonate {
+					require.Equal(t, errs.FailedPrecondition, err.(*errs.Error).Code)
+				}
+			} else {
+				require.NoError(t, err)
+			}
+
+			// Running again doesn't expire anything twice
+			resp, err = ExpireDeposits(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, 0, resp.Expired)
+		})
+	}
+}
+
+func TestGetExpiredDepositsReport(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupTestScheme(t)
+	otherCollectionPointPubKey, _ := testutils.GenerateKeys()
+	require.NoError(t, scheme.EditScheme(testutils.GetAuthenticatedContext(orgSigningKey), &scheme.EditSchemeParams{
+		SchemeID:          testScheme.ID,
+		RewardDefinitions: testScheme.RewardDefinitions,
+		CollectionPoints:  []string{collectionPointPubKey, otherCollectionPointPubKey},
+		ExpiryPolicy:      &scheme.ExpiryPolicy{ClaimPeriodDays: 7},
+	}))
+
+	capturedAt := time.Now().UTC().AddDate(0, 0, -8)
+	for _, cp := range []string{collectionPointPubKey, collectionPointPubKey, otherCollectionPointPubKey} {
+		_, err := MakeDeposit(testutils.GetAuthenticatedContext(cp), &MakeDepositParams{
+			SchemeID:            testScheme.ID,
+			MassBalanceDeposits: defaultTestDeposit,
+			CapturedAt:          &capturedAt,
+		})
+		require.NoError(t, err)
+	}
+
+	resp, err := ExpireDeposits(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 3, resp.Expired)
+
+	report, err := GetExpiredDepositsReport(testutils.GetAuthenticatedContext(orgSigningKey), &GetExpiredDepositsReportParams{
+		OrganizationID: testOrganizationId,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(report.CollectionPoints))
+
+	counts := map[string]int{}
+	for _, cp := range report.CollectionPoints {
+		counts[cp.CollectionPointPubKey] = cp.Count
+		require.Equal(t, cp.Count, len(cp.Deposits))
+		require.Equal(t, cp.Count, cp.CountByDestination[scheme.ExpiryForfeit])
+	}
+	require.Equal(t, 2, counts[collectionPointPubKey])
+	require.Equal(t, 1, counts[otherCollectionPointPubKey])
+
+	future := time.Now().UTC().Add(time.Hour)
+	report, err = GetExpiredDepositsReport(testutils.GetAuthenticatedContext(orgSigningKey), &GetExpiredDepositsReportParams{
+		OrganizationID: testOrganizationId,
+		From:           &future,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(report.CollectionPoints))
+
+	_, err = GetExpiredDepositsReport(testutils.GetAuthenticatedContext(collectionPointPubKey), &GetExpiredDepositsReportParams{
+		OrganizationID: testOrganizationId,
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.PermissionDenied, err.(*errs.Error).Code)
+}
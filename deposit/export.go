@@ -0,0 +1,341 @@
+package deposit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/commons/export"
+	"encore.app/organization"
+	"encore.app/scheme"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+// Exports are spreadsheets with one row per deposited item, for the organization's finance and impact teams.
+// They are streamed straight from the database, so they can be of any size.
+
+var (
+	depositExportHeader = []string{"depositID", "schemeID", "collectionPointPubKey", "userPubKey", "externalRef", "capturedAt",
+		"createdAt", "status", "claimed", "reversed", "expired", "itemIndex", "material", "unit", "amount"}
+	claimExportHeader = []string{"depositID", "schemeID", "collectionPointPubKey", "userPubKey", "claimedAt", "reversed",
+		"itemIndex", "material", "unit", "amount"}
+	voucherExportHeader = []string{"voucherID", "voucherDefinitionID", "voucherDefinitionName", "schemeID", "depositID",
+		"ownerPubKey", "invalidated", "createdAt"}
+	// Deposits and claims are per day, and repeated on the row of every material of that day
+	statsExportHeader = []string{"day", "schemeID", "collectionPointPubKey", "deposits", "claimed", "material", "unit", "amount"}
+)
+
+// ExportParams are read from the query string, e.g. ?organizationID=org1&format=xlsx&from=2022-08-01
+type ExportParams struct {
+	// OrganizationID or SchemeID is what to export, a scheme must be one of the organization's if both are given
+	OrganizationID string `validate:"required_without=SchemeID"`
+	SchemeID       string
+	// Format is csv (the default) or xlsx
+	Format string `validate:"oneof=csv xlsx"`
+	// From and To limit the export to this period, as RFC 3339 or YYYY-MM-DD. Stats are by UTC day.
+	From *time.Time
+	To   *time.Time
+}
+
+// exportScope is what the caller is allowed to export
+type exportScope struct {
+	OrganizationID string
+	SchemeID       string
+	SchemeIDs      []string
+	From           *time.Time
+	To             *time.Time
+}
+
+// ExportDeposits exports deposits, by when they were captured
+//encore:api auth raw method=GET path=/deposit/export/deposits
+func ExportDeposits(w http.ResponseWriter, req *http.Request) {
+	serveExport(w, req, "deposits", depositExportHeader, exportDeposits)
+}
+
+// ExportClaims exports claimed deposits, by when they were claimed
+//encore:api auth raw method=GET path=/deposit/export/claims
+func ExportClaims(w http.ResponseWriter, req *http.Request) {
+	serveExport(w, req, "claims", claimExportHeader, exportClaims)
+}
+
+// ExportVouchers exports the vouchers minted from the organization's voucher definitions, by when they were minted
+//encore:api auth raw method=GET path=/deposit/export/vouchers
+func ExportVouchers(w http.ResponseWriter, req *http.Request) {
+	serveExport(w, req, "vouchers", voucherExportHeader, exportVouchers)
+}
+
+// ExportStats exports the daily deposit stats per collection point and material
+//encore:api auth raw method=GET path=/deposit/export/stats
+func ExportStats(w http.ResponseWriter, req *http.Request) {
+	serveExport(w, req, "stats", statsExportHeader, exportStats)
+}
+
+func serveExport(w http.ResponseWriter, req *http.Request, name string, header []string,
+	write func(ctx context.Context, out export.Writer, scope *exportScope) error) {
+	ctx := req.Context()
+
+	params, err := parseExportParams(req)
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+
+	scope, err := authorizeExport(ctx, params)
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", export.ContentType(params.Format))
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+"."+params.Format+`"`)
+
+	out, err := export.NewWriter(w, params.Format, header...)
+	if err == nil {
+		err = write(ctx, out, scope)
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		// The status is already sent, so abort the response to let the client know it is incomplete
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func parseExportParams(req *http.Request) (*ExportParams, error) {
+	query := req.URL.Query()
+	params := &ExportParams{
+		OrganizationID: query.Get("organizationID"),
+		SchemeID:       query.Get("schemeID"),
+		Format:         query.Get("format"),
+	}
+	if params.Format == "" {
+		params.Format = export.FormatCSV
+	}
+
+	for _, p := range []struct {
+		name string
+		dest **time.Time
+	}{{"from", &params.From}, {"to", &params.To}} {
+		value := query.Get(p.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t, err = time.Parse("2006-01-02", value)
+		}
+		if err != nil {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: p.name + " must be RFC 3339 or YYYY-MM-DD",
+			}
+		}
+		*p.dest = &t
+	}
+
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	return params, nil
+}
+
+func authorizeExport(ctx context.Context, params *ExportParams) (*exportScope, error) {
+	scope := &exportScope{
+		OrganizationID: params.OrganizationID,
+		SchemeID:       params.SchemeID,
+		From:           utcTime(params.From),
+		To:             utcTime(params.To),
+	}
+
+	if params.SchemeID != "" {
+		s, err := scheme.GetScheme(ctx, &scheme.GetSchemeParams{SchemeID: params.SchemeID})
+		if err != nil {
+			return nil, err
+		}
+		if params.OrganizationID != "" && params.OrganizationID != s.OrganizationID {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "the scheme is not one of the organization's",
+			}
+		}
+		scope.OrganizationID = s.OrganizationID
+		scope.SchemeIDs = []string{s.ID}
+	}
+
+	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: scope.OrganizationID}); err != nil {
+		return nil, err
+	}
+
+	if scope.SchemeIDs == nil {
+		schemes, err := scheme.GetAllSchemes(ctx, &scheme.GetAllSchemesParams{OrganizationID: scope.OrganizationID})
+		if err != nil {
+			return nil, err
+		}
+		scope.SchemeIDs = []string{}
+		for _, s := range schemes.Schemes {
+			scope.SchemeIDs = append(scope.SchemeIDs, s.ID)
+		}
+	}
+
+	return scope, nil
+}
+
+func exportDeposits(ctx context.Context, out export.Writer, scope *exportScope) error {
+	rows, err := sqldb.Query(ctx, `
+        SELECT d.id, d.scheme_id, d.collection_point_pub_key, d.user_pub_key, d.external_ref, d.captured_at, d.created_at,
+               d.status, d.claimed, d.reversed, d.expired, item.idx - 1, item.value
+        FROM deposit d, json_array_elements(d.mass_balance_deposits) WITH ORDINALITY item(value, idx)
+        WHERE d.scheme_id = ANY($1)
+          AND ($2::timestamp IS NULL OR d.captured_at >= $2) AND ($3::timestamp IS NULL OR d.captured_at < $3)
+        ORDER BY d.captured_at, d.id, item.idx
+    `, scope.SchemeIDs, scope.From, scope.To)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, schemeID, collectionPoint, user, externalRef, status, itemJson string
+		var capturedAt, createdAt time.Time
+		var claimed, reversed, expired bool
+		var index int
+		if err := rows.Scan(&id, &schemeID, &collectionPoint, &user, &externalRef, &capturedAt, &createdAt,
+			&status, &claimed, &reversed, &expired, &index, &itemJson); err != nil {
+			return err
+		}
+
+		var item commons.MassBalance
+		if err := json.Unmarshal([]byte(itemJson), &item); err != nil {
+			return err
+		}
+
+		if err := out.WriteRow(id, schemeID, collectionPoint, user, externalRef, capturedAt, createdAt, status, claimed,
+			reversed, expired, index, item.ItemDefinition.MaterialKey(), item.ItemDefinition.Magnitude.Unit(), item.Amount); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func exportClaims(ctx context.Context, out export.Writer, scope *exportScope) error {
+	// Deposits made for a user are claimed when they are made, the rest when the claim is recorded in the activity
+	rows, err := sqldb.Query(ctx, `
+        SELECT id, scheme_id, collection_point_pub_key, user_pub_key, claimed_at, reversed, item.idx - 1, item.value
+        FROM (
+            SELECT d.*, COALESCE((SELECT min(a.event_time) FROM activity a
+                                  WHERE a.user_pub_key = d.user_pub_key AND a.deposit_id = d.id AND a.event_type IN ($4, $5)),
+                                 d.created_at) AS claimed_at
+            FROM deposit d
+            WHERE d.claimed = true AND d.scheme_id = ANY($1)
+        ) d, json_array_elements(d.mass_balance_deposits) WITH ORDINALITY item(value, idx)
+        WHERE ($2::timestamp IS NULL OR claimed_at >= $2) AND ($3::timestamp IS NULL OR claimed_at < $3)
+        ORDER BY claimed_at, id, item.idx
+    `, scope.SchemeIDs, scope.From, scope.To, EventTypeDeposit, EventTypeDepositClaim)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, schemeID, collectionPoint, user, itemJson string
+		var claimedAt time.Time
+		var reversed bool
+		var index int
+		if err := rows.Scan(&id, &schemeID, &collectionPoint, &user, &claimedAt, &reversed, &index, &itemJson); err != nil {
+			return err
+		}
+
+		var item commons.MassBalance
+		if err := json.Unmarshal([]byte(itemJson), &item); err != nil {
+			return err
+		}
+
+		if err := out.WriteRow(id, schemeID, collectionPoint, user, claimedAt, reversed, index,
+			item.ItemDefinition.MaterialKey(), item.ItemDefinition.Magnitude.Unit(), item.Amount); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func exportVouchers(ctx context.Context, out export.Writer, scope *exportScope) error {
+	rows, err := sqldb.Query(ctx, `
+        SELECT v.id, v.voucher_definition_id, vd.name, v.scheme_id, v.deposit_id, COALESCE(v.owner_pub_key, ''), v.invalidated, v.created_at
+        FROM voucher v JOIN voucher_definition vd ON vd.id = v.voucher_definition_id
+        WHERE vd.organization_id = $1 AND ($2::text = '' OR v.scheme_id = $2)
+          AND ($3::timestamp IS NULL OR v.created_at >= $3) AND ($4::timestamp IS NULL OR v.created_at < $4)
+        ORDER BY v.created_at, v.id
+    `, scope.OrganizationID, scope.SchemeID, scope.From, scope.To)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, definitionID, definitionName, schemeID, depositID, owner string
+		var invalidated bool
+		var createdAt time.Time
+		if err := rows.Scan(&id, &definitionID, &definitionName, &schemeID, &depositID, &owner, &invalidated, &createdAt); err != nil {
+			return err
+		}
+
+		if err := out.WriteRow(id, definitionID, definitionName, schemeID, depositID, owner, invalidated, createdAt); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func exportStats(ctx context.Context, out export.Writer, scope *exportScope) error {
+	rows, err := sqldb.Query(ctx, `
+        SELECT s.day, s.scheme_id, s.collection_point_pub_key, s.deposits, s.claimed, m.material_definition::text, m.magnitude, m.amount
+        FROM stats_daily s
+        LEFT JOIN stats_daily_material m
+            ON m.day = s.day AND m.scheme_id = s.scheme_id AND m.collection_point_pub_key = s.collection_point_pub_key
+        WHERE s.scheme_id = ANY($1) AND ($2::date IS NULL OR s.day >= $2) AND ($3::date IS NULL OR s.day < $3)
+        ORDER BY s.day, s.scheme_id, s.collection_point_pub_key, m.material_definition::text, m.magnitude
+    `, scope.SchemeIDs, utcDay(scope.From), utcDay(scope.To))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var day time.Time
+		var schemeID, collectionPoint string
+		var deposits, claimed int
+		var materialDefinitionJson *string
+		var magnitude *int
+		var amount *float64
+		if err := rows.Scan(&day, &schemeID, &collectionPoint, &deposits, &claimed, &materialDefinitionJson, &magnitude, &amount); err != nil {
+			return err
+		}
+
+		var material, unit interface{}
+		if materialDefinitionJson != nil && magnitude != nil {
+			itemDefinition := commons.ItemDefinition{Magnitude: commons.MagnitudeType(*magnitude)}
+			if err := json.Unmarshal([]byte(*materialDefinitionJson), &itemDefinition.MaterialDefinition); err != nil {
+				return err
+			}
+			material, unit = itemDefinition.MaterialKey(), itemDefinition.Magnitude.Unit()
+		}
+		var amountValue interface{}
+		if amount != nil {
+			amountValue = *amount
+		}
+
+		if err := out.WriteRow(day.Format("2006-01-02"), schemeID, collectionPoint, deposits, claimed, material, unit, amountValue); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
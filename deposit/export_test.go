@@ -0,0 +1,103 @@
+package deposit
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"encore.app/admin"
+	"encore.app/commons"
+	"encore.app/commons/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExport(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+
+	_, err := MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: []commons.MassBalance{defaultTestDeposit[0], defaultTestDeposit[0]},
+		UserPubKey:          testUserPubKey,
+		ExternalRef:         "ref-1",
+	})
+	require.NoError(t, err)
+	_, err = MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: defaultTestDeposit,
+	})
+	require.NoError(t, err)
+
+	testTable := []struct {
+		name    string
+		handler http.HandlerFunc
+		header  []string
+		rows    int
+	}{
+		{name: "Deposits", handler: ExportDeposits, header: depositExportHeader, rows: 3},
+		{name: "Claims", handler: ExportClaims, header: claimExportHeader, rows: 2},
+		{name: "Vouchers", handler: ExportVouchers, header: voucherExportHeader, rows: 24},
+		{name: "Stats", handler: ExportStats, header: statsExportHeader, rows: 1},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			resp := serveTestExport(orgSigningKey, test.handler, "?organizationID="+testOrganizationId)
+			require.Equal(t, http.StatusOK, resp.Code)
+			require.Equal(t, "text/csv; charset=utf-8", resp.Header().Get("Content-Type"))
+
+			records, err := csv.NewReader(resp.Body).ReadAll()
+			require.NoError(t, err)
+			require.Equal(t, test.header, records[0])
+			require.Equal(t, test.rows, len(records)-1)
+		})
+	}
+
+	// One row per item
+	resp := serveTestExport(orgSigningKey, ExportDeposits, "?schemeID="+testScheme.ID)
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, []string{"ref-1", "ref-1", ""}, []string{records[1][4], records[2][4], records[3][4]})
+	require.Equal(t, []string{"0", "1", "0"}, []string{records[1][11], records[2][11], records[3][11]})
+	require.Equal(t, []string{"materialType=PET", "kg", "12"}, records[1][12:])
+
+	resp = serveTestExport(orgSigningKey, ExportStats, "?organizationID="+testOrganizationId)
+	records, err = csv.NewReader(resp.Body).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, []string{"2", "1", "materialType=PET", "kg", "36"}, records[1][3:])
+
+	resp = serveTestExport(orgSigningKey, ExportDeposits, "?organizationID="+testOrganizationId+"&from=2100-01-01")
+	records, err = csv.NewReader(resp.Body).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+
+	resp = serveTestExport(orgSigningKey, ExportDeposits, "?organizationID="+testOrganizationId+"&format=xlsx")
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.Equal(t, `attachment; filename="deposits.xlsx"`, resp.Header().Get("Content-Disposition"))
+	_, err = zip.NewReader(bytes.NewReader(resp.Body.Bytes()), int64(resp.Body.Len()))
+	require.NoError(t, err)
+
+	for _, query := range []string{"", "?organizationID=" + testOrganizationId + "&format=pdf", "?organizationID=" + testOrganizationId + "&from=yesterday",
+		"?organizationID=other&schemeID=" + testScheme.ID} {
+		resp = serveTestExport(orgSigningKey, ExportDeposits, query)
+		require.Equal(t, http.StatusBadRequest, resp.Code, query)
+	}
+
+	resp = serveTestExport(collectionPointPubKey, ExportDeposits, "?organizationID="+testOrganizationId)
+	require.Equal(t, http.StatusForbidden, resp.Code)
+}
+
+func serveTestExport(caller string, handler http.HandlerFunc, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/deposit/export"+query, nil).WithContext(testutils.GetAuthenticatedContext(caller))
+	resp := httptest.NewRecorder()
+	handler(resp, req)
+	return resp
+}
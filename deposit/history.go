@@ -2,63 +2,111 @@ package deposit
 
 import (
 	"context"
-	"encore.app/commons"
+	"strconv"
 	"time"
+
+	"encore.app/commons"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
 )
 
 const (
-	EventTypeDeposit = "DEPOSIT"
+	EventTypeDeposit             = "DEPOSIT"
+	EventTypeDepositClaim        = "DEPOSIT_CLAIMED"
+	EventTypeDepositReversal     = "DEPOSIT_REVERSED"
+	EventTypeVoucherReceipt      = "VOUCHER_RECEIVED"
+	EventTypeVoucherRedemption   = "VOUCHER_REDEEMED"
+	EventTypeVoucherInvalidation = "VOUCHER_INVALIDATED"
+	EventTypeVoucherTransferIn   = "VOUCHER_TRANSFERRED_IN"
+	EventTypeVoucherTransferOut  = "VOUCHER_TRANSFERRED_OUT"
 )
 
+const defaultHistoryPageSize = 50
+
 type Event struct {
-	EventType       string    `json:"eventType"`
-	EventTime       time.Time `json:"eventTime"`
-	UnitNameIn      string    `json:"unitNameIn"`
-	NumberOfUnitsIn float64   `json:"numberOfUnitsIn"`
+	ID                  string    `json:"id"`
+	EventType           string    `json:"eventType"`
+	EventTime           time.Time `json:"eventTime"`
+	DepositID           string    `json:"depositID"`
+	VoucherID           string    `json:"voucherID"`
+	VoucherDefinitionID string    `json:"voucherDefinitionID"`
+	CounterpartyPubKey  string    `json:"counterpartyPubKey"`
+	UnitNameIn          string    `json:"unitNameIn"`
+	NumberOfUnitsIn     float64   `json:"numberOfUnitsIn"`
+	UnitNameOut         string    `json:"unitNameOut"`
+	NumberOfUnitsOut    float64   `json:"numberOfUnitsOut"`
 }
 
 type GetHistoryParams struct {
 	UserPubKey string `json:"userPubKey" validate:"required"`
+	PageSize   int    `json:"pageSize" validate:"min=0,max=200"`
+	// Cursor is the NextCursor from the previous page, empty for the first page
+	Cursor string `json:"cursor"`
 }
 
 type GetHistoryResponse struct {
 	Events []Event `json:"events"`
+	// NextCursor is empty when there are no more events
+	NextCursor string `json:"nextCursor"`
 }
 
-// TODO: TEST THIS
+// GetHistory returns the activity feed of the user, newest first
 //encore:api public method=POST
 func GetHistory(ctx context.Context, params *GetHistoryParams) (*GetHistoryResponse, error) {
 	if err := commons.Validate(params); err != nil {
 		return nil, err
 	}
 
-	deposits, err := GetAllDeposits(ctx, &GetAllDepositsParams{
-		UserPubKey: params.UserPubKey,
-		Desc:       true,
-	})
+	pageSize := params.PageSize
+	if pageSize == 0 {
+		pageSize = defaultHistoryPageSize
+	}
+
+	before := int64(0)
+	if params.Cursor != "" {
+		var err error
+		if before, err = strconv.ParseInt(params.Cursor, 10, 64); err != nil || before <= 0 {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "invalid cursor",
+			}
+		}
+	}
+
+	var rows *sqldb.Rows
+	var err error
+	const query = `
+        SELECT id, event_type, event_time, deposit_id, voucher_id, voucher_definition_id, counterparty_pub_key,
+               unit_name_in, number_of_units_in, unit_name_out, number_of_units_out
+        FROM activity`
+	// Fetch one extra to know if there is another page
+	if before == 0 {
+		rows, err = sqldb.Query(ctx, query+` WHERE user_pub_key=$1 ORDER BY id DESC LIMIT $2`, params.UserPubKey, pageSize+1)
+	} else {
+		rows, err = sqldb.Query(ctx, query+` WHERE user_pub_key=$1 AND id < $2 ORDER BY id DESC LIMIT $3`, params.UserPubKey, before, pageSize+1)
+	}
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	var events []Event
-	for _, d := range deposits.Deposits {
-		rewards, err := getRewards(ctx, &d)
-		if err != nil {
+	resp := &GetHistoryResponse{Events: []Event{}}
+	for rows.Next() {
+		var e Event
+		var id int64
+		if err := rows.Scan(&id, &e.EventType, &e.EventTime, &e.DepositID, &e.VoucherID, &e.VoucherDefinitionID, &e.CounterpartyPubKey,
+			&e.UnitNameIn, &e.NumberOfUnitsIn, &e.UnitNameOut, &e.NumberOfUnitsOut); err != nil {
 			return nil, err
 		}
-		for _, r := range rewards {
 
-			events = append(events, Event{
-				EventType:       EventTypeDeposit,
-				EventTime:       d.CreatedAt,
-				UnitNameIn:      "Voucher", //TODO: Make better
-				NumberOfUnitsIn: r.Amount,
-			})
+		if len(resp.Events) == pageSize {
+			resp.NextCursor = resp.Events[pageSize-1].ID
+			break
 		}
-	}
 
-	if events == nil {
-		events = []Event{}
+		e.ID = strconv.FormatInt(id, 10)
+		resp.Events = append(resp.Events, e)
 	}
-	return &GetHistoryResponse{Events: events}, nil
+
+	return resp, rows.Err()
 }
@@ -2,16 +2,17 @@ package deposit
 
 import (
 	"context"
+	"testing"
+
 	"encore.app/admin"
 	"encore.app/commons"
 	"encore.app/commons/testutils"
-	"encore.app/organization"
-	"encore.app/scheme"
+	"encore.dev/beta/errs"
 	"github.com/stretchr/testify/require"
-	"testing"
 )
 
 func TestHistory(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
 	require.NoError(t, admin.InsertTestData(context.Background()))
 	testutils.ClearAllDBs()
 
@@ -19,42 +20,10 @@ func TestHistory(t *testing.T) {
 	user2, _ := testutils.GenerateKeys()
 	user3, _ := testutils.GenerateKeys()
 
-	orgSigningPubKey, _ := testutils.GenerateKeys()
-	orgEncryptionPubKey, _ := testutils.GenerateKeys()
-	_, err := organization.CreateOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &organization.CreateOrgParams{
-		ID:               testOrganizationId,
-		Name:             testOrganizationId,
-		SigningPubKey:    orgSigningPubKey,
-		EncryptionPubKey: orgEncryptionPubKey,
-	})
-	require.NoError(t, err)
-
-	definition, err := CreateVoucherDefinition(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &CreateVoucherDefinitionParams{
-		OrganizationID: testOrganizationId,
-		Name:           "Voucher def name",
-		PictureURL:     "https://does.not.matter.com",
-	})
-	require.NoError(t, err)
-	defaultTestRewards.RewardTypeID = definition.ID
-
-	collectionPointPubKey, _ := testutils.GenerateKeys()
-	testScheme, err := scheme.CreateScheme(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &scheme.CreateSchemeParams{
-		Name: "TestScheme",
-		RewardDefinitions: []commons.RewardDefinition{
-			defaultTestRewards,
-		},
-		OrganizationID: testOrganizationId,
-	})
-	require.NoError(t, err)
-
-	err = scheme.AddCollectionPoint(testutils.GetAuthenticatedContext(orgSigningPubKey), &scheme.AddCollectionPointParams{
-		SchemeID:              testScheme.ID,
-		CollectionPointPubKey: collectionPointPubKey,
-	})
-	require.NoError(t, err)
+	testScheme, _, collectionPointPubKey := setupTestScheme(t)
 
 	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
-	user1Deposit1, err := MakeDeposit(ctx, &MakeDepositParams{
+	user1Deposit, err := MakeDeposit(ctx, &MakeDepositParams{
 		SchemeID:   testScheme.ID,
 		UserPubKey: user1,
 		MassBalanceDeposits: []commons.MassBalance{
@@ -66,56 +35,190 @@ func TestHistory(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	user1Deposit2, err := MakeDeposit(ctx, &MakeDepositParams{
-		SchemeID:   testScheme.ID,
-		UserPubKey: user1,
+	// Claimed later by user2
+	user2Deposit, err := MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID: testScheme.ID,
 		MassBalanceDeposits: []commons.MassBalance{
 			{
 				ItemDefinition: defaultTestRewards.ItemDefinition,
-				Amount:         7,
+				Amount:         2,
 			},
 		},
 	})
 	require.NoError(t, err)
-
-	user2Deposit1, err := MakeDeposit(ctx, &MakeDepositParams{
-		SchemeID:   testScheme.ID,
+	_, err = Claim(testutils.GetAuthenticatedContext(user2), &ClaimParams{
+		DepositID:  user2Deposit.ID,
 		UserPubKey: user2,
-		MassBalanceDeposits: []commons.MassBalance{
-			{
-				ItemDefinition: defaultTestRewards.ItemDefinition,
-				Amount:         42,
-			},
-		},
 	})
 	require.NoError(t, err)
 
+	user1Vouchers, err := GetVouchersForUser(ctx, &GetVouchersForUserParams{UserPubKey: user1})
+	require.NoError(t, err)
+	require.Equal(t, 12, len(user1Vouchers.Vouchers))
+	redeemedVoucher := user1Vouchers.Vouchers[0].Voucher
+	transferredVoucher := user1Vouchers.Vouchers[1].Voucher
+
+	require.NoError(t, InvalidateVoucher(testutils.GetAuthenticatedContext(user1), &InvalidateVoucherParams{VoucherID: redeemedVoucher.ID}))
+	recordTestTransfer(t, transferredVoucher, user1, user2)
+
 	user1History, err := GetHistory(ctx, &GetHistoryParams{
 		UserPubKey: user1,
 	})
 	require.NoError(t, err)
-	require.Equal(t, 2, len(user1History.Events))
-	// user1Deposit2 first because newest first
-	require.Equal(t, user1Deposit2.MassBalanceDeposits[0].Amount, user1History.Events[0].NumberOfUnitsIn)
-	require.Equal(t, EventTypeDeposit, user1History.Events[0].EventType)
-	require.Equal(t, "Voucher", user1History.Events[0].UnitNameIn)
+	require.Equal(t, "", user1History.NextCursor)
+	require.Equal(t, 4, len(user1History.Events))
 
-	require.Equal(t, user1Deposit1.MassBalanceDeposits[0].Amount, user1History.Events[1].NumberOfUnitsIn)
-	require.Equal(t, EventTypeDeposit, user1History.Events[1].EventType)
-	require.Equal(t, "Voucher", user1History.Events[1].UnitNameIn)
+	// Newest first
+	require.Equal(t, EventTypeVoucherTransferOut, user1History.Events[0].EventType)
+	require.Equal(t, transferredVoucher.ID, user1History.Events[0].VoucherID)
+	require.Equal(t, user2, user1History.Events[0].CounterpartyPubKey)
+	require.Equal(t, "Voucher def name", user1History.Events[0].UnitNameOut)
+	require.Equal(t, float64(1), user1History.Events[0].NumberOfUnitsOut)
+
+	require.Equal(t, EventTypeVoucherRedemption, user1History.Events[1].EventType)
+	require.Equal(t, redeemedVoucher.ID, user1History.Events[1].VoucherID)
+	require.Equal(t, "Voucher def name", user1History.Events[1].UnitNameOut)
+
+	require.Equal(t, EventTypeVoucherReceipt, user1History.Events[2].EventType)
+	require.Equal(t, user1Deposit.ID, user1History.Events[2].DepositID)
+	require.Equal(t, defaultTestRewards.RewardTypeID, user1History.Events[2].VoucherDefinitionID)
+	require.Equal(t, "Voucher def name", user1History.Events[2].UnitNameIn)
+	require.Equal(t, float64(12), user1History.Events[2].NumberOfUnitsIn)
+
+	require.Equal(t, EventTypeDeposit, user1History.Events[3].EventType)
+	require.Equal(t, user1Deposit.ID, user1History.Events[3].DepositID)
+	require.Equal(t, "PET", user1History.Events[3].UnitNameOut)
+	require.Equal(t, user1Deposit.MassBalanceDeposits[0].Amount, user1History.Events[3].NumberOfUnitsOut)
 
 	user2History, err := GetHistory(ctx, &GetHistoryParams{
 		UserPubKey: user2,
 	})
 	require.NoError(t, err)
-	require.Equal(t, 1, len(user2History.Events))
-	require.Equal(t, user2Deposit1.MassBalanceDeposits[0].Amount, user2History.Events[0].NumberOfUnitsIn)
-	require.Equal(t, EventTypeDeposit, user2History.Events[0].EventType)
-	require.Equal(t, "Voucher", user2History.Events[0].UnitNameIn)
+	require.Equal(t, 3, len(user2History.Events))
+
+	require.Equal(t, EventTypeVoucherTransferIn, user2History.Events[0].EventType)
+	require.Equal(t, transferredVoucher.ID, user2History.Events[0].VoucherID)
+	require.Equal(t, user1, user2History.Events[0].CounterpartyPubKey)
+	require.Equal(t, "Voucher def name", user2History.Events[0].UnitNameIn)
+
+	require.Equal(t, EventTypeVoucherReceipt, user2History.Events[1].EventType)
+	require.Equal(t, float64(2), user2History.Events[1].NumberOfUnitsIn)
+
+	require.Equal(t, EventTypeDepositClaim, user2History.Events[2].EventType)
+	require.Equal(t, user2Deposit.ID, user2History.Events[2].DepositID)
+	require.Equal(t, float64(2), user2History.Events[2].NumberOfUnitsOut)
 
 	user3History, err := GetHistory(ctx, &GetHistoryParams{
 		UserPubKey: user3,
 	})
 	require.NoError(t, err)
 	require.Equal(t, 0, len(user3History.Events))
+	require.Equal(t, "", user3History.NextCursor)
+}
+
+func TestHistoryPagination(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	userPubKey, _ := testutils.GenerateKeys()
+	testScheme, _, collectionPointPubKey := setupTestScheme(t)
+
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+	for i := 0; i < 3; i++ {
+		// Each deposit gives two events: the deposit and the vouchers received
+		_, err := MakeDeposit(ctx, &MakeDepositParams{
+			SchemeID:   testScheme.ID,
+			UserPubKey: userPubKey,
+			MassBalanceDeposits: []commons.MassBalance{
+				{
+					ItemDefinition: defaultTestRewards.ItemDefinition,
+					Amount:         1,
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	var all []Event
+	cursor := ""
+	pages := 0
+	for {
+		page, err := GetHistory(ctx, &GetHistoryParams{
+			UserPubKey: userPubKey,
+			PageSize:   4,
+			Cursor:     cursor,
+		})
+		require.NoError(t, err)
+		pages++
+		all = append(all, page.Events...)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	require.Equal(t, 2, pages)
+	require.Equal(t, 6, len(all))
+
+	everything, err := GetHistory(ctx, &GetHistoryParams{UserPubKey: userPubKey})
+	require.NoError(t, err)
+	require.Equal(t, everything.Events, all)
+
+	testTable := []struct {
+		name   string
+		params GetHistoryParams
+	}{
+		{
+			name:   "Invalid cursor",
+			params: GetHistoryParams{UserPubKey: userPubKey, Cursor: "not a cursor"},
+		},
+		{
+			name:   "Negative cursor",
+			params: GetHistoryParams{UserPubKey: userPubKey, Cursor: "-1"},
+		},
+		{
+			name:   "Page size too big",
+			params: GetHistoryParams{UserPubKey: userPubKey, PageSize: 201},
+		},
+		{
+			name:   "Missing user",
+			params: GetHistoryParams{},
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := GetHistory(ctx, &test.params)
+			require.Error(t, err)
+			require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+		})
+	}
+}
+
+// recordTestTransfer writes the history entries of a voucher given from one user to another
+func recordTestTransfer(t *testing.T, voucher Voucher, from string, to string) {
+	ctx := context.Background()
+	tx, err := depositDB.Begin(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	require.NoError(t, recordActivity(ctx, tx, activity{
+		UserPubKey:          from,
+		EventType:           EventTypeVoucherTransferOut,
+		VoucherID:           voucher.ID,
+		VoucherDefinitionID: voucher.VoucherDefinitionID,
+		CounterpartyPubKey:  to,
+		UnitNameOut:         "Voucher def name",
+		NumberOfUnitsOut:    1,
+	}))
+	require.NoError(t, recordActivity(ctx, tx, activity{
+		UserPubKey:          to,
+		EventType:           EventTypeVoucherTransferIn,
+		VoucherID:           voucher.ID,
+		VoucherDefinitionID: voucher.VoucherDefinitionID,
+		CounterpartyPubKey:  from,
+		UnitNameIn:          "Voucher def name",
+		NumberOfUnitsIn:     1,
+	}))
+	require.NoError(t, tx.Commit())
 }
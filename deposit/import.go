@@ -0,0 +1,328 @@
+package deposit
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/scheme"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+)
+
+const (
+	ImportFormatCSV   = "csv"
+	ImportFormatJSONL = "jsonl"
+)
+
+const (
+	ImportRowCreated  = "CREATED"
+	ImportRowExisting = "EXISTING"
+	ImportRowValid    = "VALID"
+	ImportRowError    = "ERROR"
+)
+
+const maxImportRows = 1000
+
+// CSV columns with a fixed meaning. Every other column is a key in the item's material definition.
+const (
+	csvColumnExternalRef = "externalRef"
+	csvColumnUserPubKey  = "userPubKey"
+	csvColumnAmount      = "amount"
+	csvColumnMagnitude   = "magnitude"
+	csvColumnCapturedAt  = "capturedAt"
+)
+
+type ImportDepositsParams struct {
+	SchemeID string `json:"schemeID" validate:"required"`
+	Format   string `json:"format" validate:"required,oneof=csv jsonl"`
+	// Data is the file to import.
+	// CSV has a header row and one deposit of a single item per row, e.g.:
+	//   externalRef,userPubKey,amount,magnitude,capturedAt,materialType
+	//   week32-001,,12.5,weight,2022-08-10T09:15:00Z,PET
+	// capturedAt is optional, in RFC 3339, and defaults to the time of the import.
+	// JSON Lines has one MakeDepositParams per line, without schemeID.
+	Data string `json:"data" validate:"required"`
+	// DryRun validates every row without making any deposits
+	DryRun bool `json:"dryRun"`
+}
+
+type ImportRowResult struct {
+	// Row is the line number in the file, starting at 1 (the CSV header is line 1)
+	Row         int    `json:"row"`
+	ExternalRef string `json:"externalRef"`
+	Status      string `json:"status"`
+	DepositID   string `json:"depositID"`
+	Error       string `json:"error"`
+}
+
+type ImportDepositsResponse struct {
+	Rows     []ImportRowResult `json:"rows"`
+	Created  int               `json:"created"`
+	Existing int               `json:"existing"`
+	Failed   int               `json:"failed"`
+}
+
+// ImportDeposits makes deposits in bulk for the calling collection point.
+// Every row needs an externalRef, so an import can safely be retried: rows that were already imported are reported as EXISTING.
+// Rows are independent, a failing row doesn't stop the rest of the import.
+//encore:api auth method=POST
+func ImportDeposits(ctx context.Context, params *ImportDepositsParams) (*ImportDepositsResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	collectionPoint, _ := auth.UserID()
+
+	s, err := scheme.GetScheme(ctx, &scheme.GetSchemeParams{SchemeID: params.SchemeID})
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []importRow
+	switch params.Format {
+	case ImportFormatCSV:
+		rows, err = parseCSVDeposits(params.Data)
+	case ImportFormatJSONL:
+		rows, err = parseJSONLDeposits(params.Data)
+	}
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: err.Error(),
+		}
+	}
+
+	if len(rows) > maxImportRows {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("too many rows, the maximum is %d", maxImportRows),
+		}
+	}
+
+	resp := &ImportDepositsResponse{Rows: []ImportRowResult{}}
+	seenExternalRefs := map[string]int{}
+	for _, row := range rows {
+		result := ImportRowResult{Row: row.Line}
+		if row.Params != nil {
+			result.ExternalRef = row.Params.ExternalRef
+		}
+
+		deposit, status, err := importRowDeposit(ctx, s, string(collectionPoint), row, seenExternalRefs, params.DryRun)
+		if err != nil {
+			var errsErr *errs.Error
+			if errors.As(err, &errsErr) && errsErr.Code == errs.PermissionDenied {
+				// Not a collection point of the scheme, so no row can succeed
+				return nil, err
+			}
+			result.Status = ImportRowError
+			result.Error = err.Error()
+			resp.Failed++
+		} else {
+			result.Status = status
+			if deposit != nil {
+				result.DepositID = deposit.ID
+			}
+			switch status {
+			case ImportRowCreated:
+				resp.Created++
+			case ImportRowExisting:
+				resp.Existing++
+			}
+		}
+
+		resp.Rows = append(resp.Rows, result)
+	}
+
+	return resp, nil
+}
+
+func importRowDeposit(ctx context.Context, s *scheme.Scheme, collectionPoint string, row importRow, seenExternalRefs map[string]int, dryRun bool) (*Deposit, string, error) {
+	if row.Err != nil {
+		return nil, "", row.Err
+	}
+
+	params := row.Params
+	if params.SchemeID != "" && params.SchemeID != s.ID {
+		return nil, "", errors.New("schemeID does not match the import")
+	}
+	params.SchemeID = s.ID
+	if params.ExternalRef == "" {
+		return nil, "", errors.New("externalRef is required when importing")
+	}
+	if line, ok := seenExternalRefs[params.ExternalRef]; ok {
+		return nil, "", fmt.Errorf("externalRef is also used on row %d", line)
+	}
+	seenExternalRefs[params.ExternalRef] = row.Line
+
+	if err := commons.Validate(params); err != nil {
+		return nil, "", err
+	}
+	if params.CapturedAt != nil {
+		if err := checkCapturedAt(*params.CapturedAt); err != nil {
+			return nil, "", err
+		}
+	}
+
+	existing, err := checkDeposit(ctx, s, collectionPoint, params)
+	if err != nil {
+		return nil, "", err
+	}
+	if existing != nil {
+		return existing, ImportRowExisting, nil
+	}
+
+	if dryRun {
+		return nil, ImportRowValid, nil
+	}
+
+	deposit, err := MakeDeposit(ctx, params)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return deposit, ImportRowCreated, nil
+}
+
+// importRow is a parsed row, or the reason it couldn't be parsed
+type importRow struct {
+	Line   int
+	Params *MakeDepositParams
+	Err    error
+}
+
+func parseCSVDeposits(data string) ([]importRow, error) {
+	r := csv.NewReader(strings.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read CSV header: %w", err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	var rows []importRow
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return nil, err
+			}
+			rows = append(rows, importRow{Line: parseErr.StartLine, Err: err})
+			continue
+		}
+		// Only valid after a record was read
+		line, _ := r.FieldPos(0)
+
+		params, err := csvRecordToDeposit(header, record)
+		rows = append(rows, importRow{Line: line, Params: params, Err: err})
+	}
+
+	return rows, nil
+}
+
+func csvRecordToDeposit(header []string, record []string) (*MakeDepositParams, error) {
+	if len(record) != len(header) {
+		return nil, fmt.Errorf("expected %d columns, got %d", len(header), len(record))
+	}
+
+	params := &MakeDepositParams{}
+	item := commons.MassBalance{
+		ItemDefinition: commons.ItemDefinition{
+			MaterialDefinition: map[string]string{},
+		},
+	}
+	hasAmount := false
+	for i, column := range header {
+		value := strings.TrimSpace(record[i])
+		switch column {
+		case csvColumnExternalRef:
+			params.ExternalRef = value
+		case csvColumnUserPubKey:
+			params.UserPubKey = value
+		case csvColumnAmount:
+			amount, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid amount %q", value)
+			}
+			item.Amount = amount
+			hasAmount = true
+		case csvColumnMagnitude:
+			magnitude, err := parseMagnitude(value)
+			if err != nil {
+				return nil, err
+			}
+			item.ItemDefinition.Magnitude = magnitude
+		case csvColumnCapturedAt:
+			if value == "" {
+				continue
+			}
+			capturedAt, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid capturedAt %q, must be RFC 3339", value)
+			}
+			params.CapturedAt = &capturedAt
+		default:
+			if value != "" {
+				item.ItemDefinition.MaterialDefinition[column] = value
+			}
+		}
+	}
+
+	if !hasAmount {
+		return nil, errors.New("amount is required")
+	}
+	params.MassBalanceDeposits = []commons.MassBalance{item}
+
+	return params, nil
+}
+
+func parseMagnitude(value string) (commons.MagnitudeType, error) {
+	switch strings.ToLower(value) {
+	case "", "weight":
+		return commons.Weight, nil
+	case "count":
+		return commons.Count, nil
+	default:
+		return 0, fmt.Errorf("invalid magnitude %q, must be weight or count", value)
+	}
+}
+
+func parseJSONLDeposits(data string) ([]importRow, error) {
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+
+	var rows []importRow
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var params MakeDepositParams
+		if err := json.Unmarshal([]byte(text), &params); err != nil {
+			rows = append(rows, importRow{Line: line, Err: fmt.Errorf("invalid JSON: %w", err)})
+			continue
+		}
+		rows = append(rows, importRow{Line: line, Params: &params})
+	}
+
+	return rows, scanner.Err()
+}
@@ -0,0 +1,197 @@
+package deposit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/admin"
+	"encore.app/commons"
+	"encore.app/commons/testutils"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCSVDeposits(t *testing.T) {
+	rows, err := parseCSVDeposits("externalRef,userPubKey,amount,magnitude,materialType\n" +
+		"ref-1,,12.5,weight,PET\n" +
+		"ref-2,user,3,count,LDPE\n" +
+		"ref-3,,lots,weight,PET\n" +
+		"ref-4,,1\n" +
+		"ref-5,,2,kilos,PET\n")
+	require.NoError(t, err)
+	require.Equal(t, 5, len(rows))
+
+	require.NoError(t, rows[0].Err)
+	require.Equal(t, 2, rows[0].Line)
+	require.Equal(t, "ref-1", rows[0].Params.ExternalRef)
+	require.Equal(t, "", rows[0].Params.UserPubKey)
+	require.Equal(t, []commons.MassBalance{
+		{
+			ItemDefinition: commons.ItemDefinition{
+				MaterialDefinition: map[string]string{"materialType": "PET"},
+				Magnitude:          commons.Weight,
+			},
+			Amount: 12.5,
+		},
+	}, rows[0].Params.MassBalanceDeposits)
+
+	require.NoError(t, rows[1].Err)
+	require.Equal(t, "user", rows[1].Params.UserPubKey)
+	require.Equal(t, commons.Count, rows[1].Params.MassBalanceDeposits[0].ItemDefinition.Magnitude)
+
+	require.Error(t, rows[2].Err)
+	require.Equal(t, 4, rows[2].Line)
+	require.Error(t, rows[3].Err)
+	require.Error(t, rows[4].Err)
+
+	rows, err = parseCSVDeposits("externalRef,amount,capturedAt,materialType\n" +
+		"ref-1,12,2022-08-10T09:15:00Z,PET\n" +
+		"ref-2,12,,PET\n" +
+		"ref-3,12,10/08/2022,PET\n")
+	require.NoError(t, err)
+	require.Equal(t, 3, len(rows))
+	require.NoError(t, rows[0].Err)
+	require.True(t, time.Date(2022, 8, 10, 9, 15, 0, 0, time.UTC).Equal(*rows[0].Params.CapturedAt))
+	require.Equal(t, map[string]string{"materialType": "PET"}, rows[0].Params.MassBalanceDeposits[0].ItemDefinition.MaterialDefinition)
+	require.NoError(t, rows[1].Err)
+	require.Nil(t, rows[1].Params.CapturedAt)
+	require.Error(t, rows[2].Err)
+
+	// A malformed row is reported, and the rows after it are still read
+	rows, err = parseCSVDeposits("externalRef,amount,materialType\n" +
+		"ref-1,1\"2,PET\n" +
+		"ref-2,12,PET\n")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(rows))
+	require.Error(t, rows[0].Err)
+	require.Equal(t, 2, rows[0].Line)
+	require.NoError(t, rows[1].Err)
+	require.Equal(t, 3, rows[1].Line)
+
+	rows, err = parseCSVDeposits("externalRef,amount,materialType\n" +
+		"\"ref-1,12,PET\n")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(rows))
+	require.Error(t, rows[0].Err)
+
+	_, err = parseCSVDeposits("")
+	require.Error(t, err)
+}
+
+func TestParseJSONLDeposits(t *testing.T) {
+	rows, err := parseJSONLDeposits(`{"externalRef": "ref-1", "massBalanceDeposits": [{"itemDefinition": {"materialDefinition": {"materialType": "PET"}, "magnitude": 0}, "amount": 4}]}
+
+not json
+`)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(rows))
+
+	require.NoError(t, rows[0].Err)
+	require.Equal(t, 1, rows[0].Line)
+	require.Equal(t, "ref-1", rows[0].Params.ExternalRef)
+	require.Equal(t, float64(4), rows[0].Params.MassBalanceDeposits[0].Amount)
+
+	require.Error(t, rows[1].Err)
+	require.Equal(t, 3, rows[1].Line)
+}
+
+func TestImportDeposits(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, _, collectionPointPubKey := setupTestScheme(t)
+	notCollectionPoint, _ := testutils.GenerateKeys()
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+
+	data := "externalRef,userPubKey,amount,magnitude,materialType\n" +
+		"ref-1,,12,weight,PET\n" +
+		"ref-2," + testUserPubKey + ",3,weight,PET\n" +
+		"ref-3,,3,weight,GLASS\n" +
+		",,3,weight,PET\n" +
+		"ref-1,,12,weight,PET\n"
+
+	dryRun, err := ImportDeposits(ctx, &ImportDepositsParams{
+		SchemeID: testScheme.ID,
+		Format:   ImportFormatCSV,
+		Data:     data,
+		DryRun:   true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 0, dryRun.Created)
+	require.Equal(t, 3, dryRun.Failed)
+	require.Equal(t, ImportRowValid, dryRun.Rows[0].Status)
+	require.Equal(t, ImportRowValid, dryRun.Rows[1].Status)
+	require.Equal(t, ImportRowError, dryRun.Rows[2].Status)
+	require.Equal(t, ImportRowError, dryRun.Rows[3].Status)
+	require.Equal(t, ImportRowError, dryRun.Rows[4].Status)
+	require.Equal(t, 6, dryRun.Rows[4].Row)
+
+	all, err := GetAllDeposits(ctx, &GetAllDepositsParams{})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(all.Deposits))
+
+	imported, err := ImportDeposits(ctx, &ImportDepositsParams{
+		SchemeID: testScheme.ID,
+		Format:   ImportFormatCSV,
+		Data:     data,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, imported.Created)
+	require.Equal(t, 3, imported.Failed)
+	require.Equal(t, ImportRowCreated, imported.Rows[0].Status)
+	require.NotEmpty(t, imported.Rows[0].DepositID)
+
+	claimed, err := GetDeposit(ctx, &GetDepositParams{DepositID: imported.Rows[1].DepositID})
+	require.NoError(t, err)
+	require.True(t, claimed.Claimed)
+	require.Equal(t, testUserPubKey, claimed.UserPubKey)
+
+	// Importing the same file again doesn't make new deposits
+	retried, err := ImportDeposits(ctx, &ImportDepositsParams{
+		SchemeID: testScheme.ID,
+		Format:   ImportFormatCSV,
+		Data:     data,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 0, retried.Created)
+	require.Equal(t, 2, retried.Existing)
+	require.Equal(t, imported.Rows[0].DepositID, retried.Rows[0].DepositID)
+
+	all, err = GetAllDeposits(ctx, &GetAllDepositsParams{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(all.Deposits))
+
+	// Deposits recorded offline keep their capture time, within the offline period
+	lastWeek := time.Now().UTC().AddDate(0, 0, -7).Truncate(time.Second)
+	offline, err := ImportDeposits(ctx, &ImportDepositsParams{
+		SchemeID: testScheme.ID,
+		Format:   ImportFormatCSV,
+		Data: "externalRef,amount,capturedAt,materialType\n" +
+			"ref-4,12," + lastWeek.Format(time.RFC3339) + ",PET\n" +
+			"ref-5,12," + lastWeek.AddDate(-1, 0, 0).Format(time.RFC3339) + ",PET\n",
+	})
+	require.NoError(t, err)
+	require.Equal(t, ImportRowCreated, offline.Rows[0].Status)
+	require.Equal(t, ImportRowError, offline.Rows[1].Status)
+	capturedOffline, err := GetDeposit(ctx, &GetDepositParams{DepositID: offline.Rows[0].DepositID})
+	require.NoError(t, err)
+	require.True(t, lastWeek.Equal(capturedOffline.CapturedAt))
+
+	_, err = ImportDeposits(testutils.GetAuthenticatedContext(notCollectionPoint), &ImportDepositsParams{
+		SchemeID: testScheme.ID,
+		Format:   ImportFormatCSV,
+		Data:     data,
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.PermissionDenied, err.(*errs.Error).Code)
+
+	_, err = ImportDeposits(ctx, &ImportDepositsParams{
+		SchemeID: testScheme.ID,
+		Format:   "xlsx",
+		Data:     data,
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+}
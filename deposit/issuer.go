@@ -0,0 +1,383 @@
+package deposit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/organization"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+// IssueCreditsTypeURL is the type of the EmpowerChain plasticcredit message that issues credits
+const IssueCreditsTypeURL = "/empowerchain.plasticcredit.MsgIssueCredits"
+
+// ErrNoCredits is returned for a batch that is too small for a single credit
+var ErrNoCredits = errors.New("the batch is too small for a credit, its mass is carried to the next batch")
+
+type IssueCreditsRequest struct {
+	Batch *CreditBatch
+	// Deposits are the deposits the batch consumed items of
+	Deposits []Deposit
+	// ProjectID is the plastic credit project on the chain
+	ProjectID uint64
+	// IssuerPubKey is the hex encoded pub key of the organization, which signs the transaction
+	IssuerPubKey string
+}
+
+type IssuedCredits struct {
+	// Tx is the unsigned transaction, as JSON the chain's CLI can sign offline
+	Tx string
+	// Reference is where the issuer put the credits, empty when they are only rendered
+	Reference string
+}
+
+// CreditIssuer issues the credits of a batch.
+// EmpowerChainIssuer only renders the transaction, FileIssuer also writes it to files, as a stand-in for the chain.
+type CreditIssuer interface {
+	Issue(ctx context.Context, req *IssueCreditsRequest) (*IssuedCredits, error)
+}
+
+// creditIssuer is a variable so it can be replaced by a FileIssuer in tests.
+// Nil means an EmpowerChainIssuer with the CreditMetadataBaseURI from the config.
+var creditIssuer CreditIssuer
+
+// getCreditIssuer fails when the metadata URI is not set up, rather than issuing credits whose metadata can't be found
+func getCreditIssuer() (CreditIssuer, error) {
+	if creditIssuer != nil {
+		return creditIssuer, nil
+	}
+
+	if cfg.CreditMetadataBaseURI() == "" {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "the credit metadata base URI is not set up",
+		}
+	}
+
+	return &EmpowerChainIssuer{MetadataBaseURI: cfg.CreditMetadataBaseURI()}, nil
+}
+
+// EmpowerChainIssuer renders a batch as a MsgIssueCredits of the EmpowerChain plasticcredit module.
+// The batch document and its deposits are referred to by URI and SHA-256, so anyone can check the credits against them.
+type EmpowerChainIssuer struct {
+	// MetadataBaseURI is where the batch documents and deposits are published, e.g. "https://example.org/credit-batches"
+	MetadataBaseURI string
+}
+
+func (e *EmpowerChainIssuer) Issue(_ context.Context, req *IssueCreditsRequest) (*IssuedCredits, error) {
+	tx, err := e.render(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IssuedCredits{Tx: string(tx)}, nil
+}
+
+// The transaction in the JSON of the Cosmos SDK, as printed by `tx --generate-only`.
+// 64 bit integers are strings, and the fee is left to the signer.
+type (
+	cosmosTx struct {
+		Body       cosmosTxBody   `json:"body"`
+		AuthInfo   cosmosAuthInfo `json:"auth_info"`
+		Signatures []string       `json:"signatures"`
+	}
+	cosmosTxBody struct {
+		Messages                    []msgIssueCredits `json:"messages"`
+		Memo                        string            `json:"memo"`
+		TimeoutHeight               uint64            `json:"timeout_height,string"`
+		ExtensionOptions            []json.RawMessage `json:"extension_options"`
+		NonCriticalExtensionOptions []json.RawMessage `json:"non_critical_extension_options"`
+	}
+	cosmosAuthInfo struct {
+		SignerInfos []json.RawMessage `json:"signer_infos"`
+		Fee         cosmosFee         `json:"fee"`
+	}
+	cosmosFee struct {
+		Amount   []json.RawMessage `json:"amount"`
+		GasLimit uint64            `json:"gas_limit,string"`
+		Payer    string            `json:"payer"`
+		Granter  string            `json:"granter"`
+	}
+	msgIssueCredits struct {
+		Type         string       `json:"@type"`
+		Creator      string       `json:"creator"`
+		ProjectID    uint64       `json:"project_id,string"`
+		SerialNumber string       `json:"serial_number"`
+		CreditAmount uint64       `json:"credit_amount,string"`
+		MetadataURIs []provenData `json:"metadata_uris"`
+	}
+	provenData struct {
+		URI  string `json:"uri"`
+		Hash string `json:"hash"`
+	}
+)
+
+const defaultGasLimit = 200000
+
+func (e *EmpowerChainIssuer) render(req *IssueCreditsRequest) ([]byte, error) {
+	if e.MetadataBaseURI == "" {
+		return nil, errors.New("the metadata base URI is not set")
+	}
+
+	creator, err := commons.EmpowerAddress(req.IssuerPubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	credits := req.Batch.Batch.Credits
+	if req.Batch.Batch.KgPerCredit == 0 {
+		// Batches created before the credits were in the document had one credit per kg, rounded down
+		credits = uint64(math.Floor(req.Batch.Batch.TotalMass))
+	}
+	if credits == 0 {
+		return nil, ErrNoCredits
+	}
+
+	deposits, err := creditBatchDepositsDocument(req.Batch, req.Deposits)
+	if err != nil {
+		return nil, err
+	}
+
+	baseURI := strings.TrimSuffix(e.MetadataBaseURI, "/") + "/" + req.Batch.Batch.BatchID
+	tx := cosmosTx{
+		Body: cosmosTxBody{
+			Messages: []msgIssueCredits{{
+				Type:         IssueCreditsTypeURL,
+				Creator:      creator,
+				ProjectID:    req.ProjectID,
+				SerialNumber: req.Batch.Batch.BatchID,
+				CreditAmount: credits,
+				MetadataURIs: []provenData{
+					{URI: baseURI + "/document.json", Hash: sha256Hex([]byte(req.Batch.Document))},
+					{URI: baseURI + "/deposits.json", Hash: sha256Hex(deposits)},
+				},
+			}},
+			ExtensionOptions:            []json.RawMessage{},
+			NonCriticalExtensionOptions: []json.RawMessage{},
+		},
+		AuthInfo: cosmosAuthInfo{
+			SignerInfos: []json.RawMessage{},
+			Fee:         cosmosFee{Amount: []json.RawMessage{}, GasLimit: defaultGasLimit},
+		},
+		Signatures: []string{},
+	}
+
+	return json.MarshalIndent(&tx, "", "  ")
+}
+
+// FileIssuer writes the transaction, batch document and deposits of every batch to files in a directory
+type FileIssuer struct {
+	Dir    string
+	Render EmpowerChainIssuer
+}
+
+func NewFileIssuer(dir string) *FileIssuer {
+	return &FileIssuer{Dir: dir, Render: EmpowerChainIssuer{MetadataBaseURI: "file://" + dir}}
+}
+
+func (f *FileIssuer) Issue(ctx context.Context, req *IssueCreditsRequest) (*IssuedCredits, error) {
+	issued, err := f.Render.Issue(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	deposits, err := creditBatchDepositsDocument(req.Batch, req.Deposits)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(f.Dir, req.Batch.Batch.BatchID)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	for name, content := range map[string]string{
+		"tx.json":       issued.Tx,
+		"document.json": req.Batch.Document,
+		"deposits.json": string(deposits),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			return nil, err
+		}
+	}
+
+	issued.Reference = filepath.Join(dir, "tx.json")
+	return issued, nil
+}
+
+type creditBatchDepositItem struct {
+	ItemIndex      int                    `json:"itemIndex"`
+	ItemDefinition commons.ItemDefinition `json:"itemDefinition"`
+	Amount         float64                `json:"amount"`
+}
+
+type creditBatchDepositData struct {
+	DepositID             string                   `json:"depositID"`
+	SchemeID              string                   `json:"schemeID"`
+	CollectionPointPubKey string                   `json:"collectionPointPubKey"`
+	CapturedAt            time.Time                `json:"capturedAt"`
+	Items                 []creditBatchDepositItem `json:"items"`
+}
+
+// creditBatchDepositsDocument is the deposits of the batch with the items it consumed, in the order of the batch
+func creditBatchDepositsDocument(batch *CreditBatch, deposits []Deposit) ([]byte, error) {
+	byID := make(map[string]Deposit, len(deposits))
+	for _, d := range deposits {
+		byID[d.ID] = d
+	}
+
+	data := []creditBatchDepositData{}
+	for _, item := range batch.Batch.Deposits {
+		d, ok := byID[item.DepositID]
+		if !ok || item.ItemIndex >= len(d.MassBalanceDeposits) {
+			return nil, errors.New("the deposits don't match the batch")
+		}
+
+		if len(data) == 0 || data[len(data)-1].DepositID != d.ID {
+			data = append(data, creditBatchDepositData{
+				DepositID:             d.ID,
+				SchemeID:              d.SchemeID,
+				CollectionPointPubKey: d.CollectionPointPubKey,
+				CapturedAt:            d.CapturedAt.UTC(),
+				Items:                 []creditBatchDepositItem{},
+			})
+		}
+		last := &data[len(data)-1]
+		last.Items = append(last.Items, creditBatchDepositItem{
+			ItemIndex:      item.ItemIndex,
+			ItemDefinition: d.MassBalanceDeposits[item.ItemIndex].ItemDefinition,
+			Amount:         d.MassBalanceDeposits[item.ItemIndex].Amount,
+		})
+	}
+
+	return json.Marshal(data)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+type IssueCreditBatchParams struct {
+	CreditBatchID string `json:"creditBatchID" validate:"required"`
+	// ProjectID is the organization's plastic credit project on EmpowerChain
+	ProjectID uint64 `json:"projectID" validate:"required"`
+}
+
+// IssueCreditBatch renders the credits of a batch as an EmpowerChain transaction, for the organization to sign offline.
+// The credits of a batch are issued once.
+//encore:api auth method=POST
+func IssueCreditBatch(ctx context.Context, params *IssueCreditBatchParams) (*CreditBatch, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	batch, err := getCreditBatch(ctx, params.CreditBatchID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: batch.Batch.OrganizationID}); err != nil {
+		return nil, err
+	}
+
+	if batch.Issuance != nil {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "the credits of the batch are already issued",
+		}
+	}
+
+	org, err := organization.GetOrganization(ctx, &organization.GetOrganizationParams{ID: batch.Batch.OrganizationID})
+	if err != nil {
+		return nil, err
+	}
+
+	deposits, err := getCreditBatchDeposits(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	issuer, err := getCreditIssuer()
+	if err != nil {
+		return nil, err
+	}
+
+	issued, err := issuer.Issue(ctx, &IssueCreditsRequest{
+		Batch:        batch,
+		Deposits:     deposits,
+		ProjectID:    params.ProjectID,
+		IssuerPubKey: org.SigningPubKey,
+	})
+	if errors.Is(err, ErrNoCredits) {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: err.Error(),
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	issuance := &CreditBatchIssuance{
+		ProjectID: params.ProjectID,
+		Tx:        issued.Tx,
+		Reference: issued.Reference,
+		IssuedAt:  time.Now().UTC(),
+	}
+	res, err := sqldb.Exec(ctx, `
+        UPDATE credit_batch SET project_id=$2, issuance_tx=$3, issuance_reference=$4, issued_at=$5
+        WHERE id=$1 AND issued_at IS NULL
+    `, batch.Batch.BatchID, int64(issuance.ProjectID), issuance.Tx, issuance.Reference, issuance.IssuedAt)
+	if err != nil {
+		return nil, err
+	}
+	if res.RowsAffected() == 0 {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "the credits of the batch are already issued",
+		}
+	}
+
+	batch.Issuance = issuance
+	return batch, nil
+}
+
+func getCreditBatchDeposits(ctx context.Context, batch *CreditBatch) ([]Deposit, error) {
+	ids := []string{}
+	for _, d := range batch.Batch.Deposits {
+		if len(ids) == 0 || ids[len(ids)-1] != d.DepositID {
+			ids = append(ids, d.DepositID)
+		}
+	}
+
+	rows, err := sqldb.Query(ctx, "SELECT "+depositColumns+" FROM deposit WHERE id = ANY($1)", ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deposits := []Deposit{}
+	for rows.Next() {
+		d, err := scanDeposit(rows)
+		if err != nil {
+			return nil, err
+		}
+		deposits = append(deposits, *d)
+	}
+	sort.Slice(deposits, func(i, j int) bool {
+		return deposits[i].ID < deposits[j].ID
+	})
+
+	return deposits, rows.Err()
+}
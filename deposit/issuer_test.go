@@ -0,0 +1,173 @@
+package deposit
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"encore.app/admin"
+	"encore.app/commons"
+	"encore.app/commons/testutils"
+	"encore.dev/beta/errs"
+	"encore.dev/et"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmpowerChainIssuer(t *testing.T) {
+	capturedAt := time.Date(2022, 8, 10, 12, 0, 0, 0, time.UTC)
+	batch := &CreditBatch{
+		Batch: CreditBatchDocument{
+			BatchID:     "batch1",
+			TotalMass:   36.5,
+			KgPerCredit: 10,
+			Credits:     3,
+			Remainder:   6.5,
+			Deposits: []CreditBatchDeposit{
+				{DepositID: "d1", ItemIndex: 1, Amount: 24.5},
+				{DepositID: "d2", ItemIndex: 0, Amount: 12},
+			},
+		},
+		Document: `{"batchID":"batch1"}`,
+	}
+	deposits := []Deposit{
+		{ID: "d1", CapturedAt: capturedAt, MassBalanceDeposits: []commons.MassBalance{otherTestDeposit(), {ItemDefinition: defaultTestRewards.ItemDefinition, Amount: 24.5}}},
+		{ID: "d2", CapturedAt: capturedAt, MassBalanceDeposits: defaultTestDeposit},
+	}
+	issuerPubKey, _ := testutils.GenerateKeys()
+	req := &IssueCreditsRequest{Batch: batch, Deposits: deposits, ProjectID: 7, IssuerPubKey: issuerPubKey}
+
+	issuer := &EmpowerChainIssuer{MetadataBaseURI: "https://example.org/batches/"}
+	issued, err := issuer.Issue(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, "", issued.Reference)
+
+	var tx struct {
+		Body struct {
+			Messages []map[string]interface{} `json:"messages"`
+		} `json:"body"`
+		Signatures []string `json:"signatures"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(issued.Tx), &tx))
+	require.Equal(t, 0, len(tx.Signatures))
+	require.Equal(t, 1, len(tx.Body.Messages))
+
+	msg := tx.Body.Messages[0]
+	creator, err := commons.EmpowerAddress(issuerPubKey)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(creator, "empower1"))
+	require.Equal(t, IssueCreditsTypeURL, msg["@type"])
+	require.Equal(t, creator, msg["creator"])
+	require.Equal(t, "7", msg["project_id"])
+	require.Equal(t, "batch1", msg["serial_number"])
+	require.Equal(t, "3", msg["credit_amount"])
+
+	documents, err := creditBatchDepositsDocument(batch, deposits)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{
+		map[string]interface{}{"uri": "https://example.org/batches/batch1/document.json", "hash": sha256Hex([]byte(batch.Document))},
+		map[string]interface{}{"uri": "https://example.org/batches/batch1/deposits.json", "hash": sha256Hex(documents)},
+	}, msg["metadata_uris"])
+
+	// Only the items in the batch are in the deposits document
+	var data []creditBatchDepositData
+	require.NoError(t, json.Unmarshal(documents, &data))
+	require.Equal(t, 2, len(data))
+	require.Equal(t, []creditBatchDepositItem{{ItemIndex: 1, ItemDefinition: defaultTestRewards.ItemDefinition, Amount: 24.5}}, data[0].Items)
+
+	// Rendering is deterministic
+	again, err := issuer.Issue(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, issued.Tx, again.Tx)
+
+	small := *batch
+	small.Batch.Credits = 0
+	_, err = issuer.Issue(context.Background(), &IssueCreditsRequest{Batch: &small, Deposits: deposits, ProjectID: 7, IssuerPubKey: issuerPubKey})
+	require.ErrorIs(t, err, ErrNoCredits)
+
+	// Batches created before the credits were in the document have one credit per kg
+	legacy := *batch
+	legacy.Batch.KgPerCredit, legacy.Batch.Credits = 0, 0
+	issued, err = issuer.Issue(context.Background(), &IssueCreditsRequest{Batch: &legacy, Deposits: deposits, ProjectID: 7, IssuerPubKey: issuerPubKey})
+	require.NoError(t, err)
+	require.Contains(t, issued.Tx, `"credit_amount": "36"`)
+
+	_, err = issuer.Issue(context.Background(), &IssueCreditsRequest{Batch: batch, Deposits: deposits[:1], ProjectID: 7, IssuerPubKey: issuerPubKey})
+	require.Error(t, err)
+
+	_, err = (&EmpowerChainIssuer{}).Issue(context.Background(), req)
+	require.Error(t, err)
+}
+
+func TestIssueCreditBatch(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	secrets.CreditBatchSigningKey = hex.EncodeToString(secp256k1.GenPrivKey().Bytes())
+	dir := t.TempDir()
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupTestScheme(t)
+	orgCtx := testutils.GetAuthenticatedContext(orgSigningKey)
+	_, err := MakeDeposit(testutils.GetAuthenticatedContext(collectionPointPubKey), &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: defaultTestDeposit,
+	})
+	require.NoError(t, err)
+
+	from := time.Now().UTC().Add(-time.Hour)
+	to := time.Now().UTC().Add(time.Hour)
+	batch, err := CreateCreditBatch(orgCtx, &CreateCreditBatchParams{
+		SchemeID:           testScheme.ID,
+		MaterialDefinition: defaultTestRewards.ItemDefinition.MaterialDefinition,
+		From:               &from,
+		To:                 &to,
+	})
+	require.NoError(t, err)
+	require.Nil(t, batch.Issuance)
+
+	// Credits can't be issued without the URI their metadata is published under
+	creditIssuer = nil
+	et.SetCfg(cfg.CreditMetadataBaseURI, "")
+	_, err = IssueCreditBatch(orgCtx, &IssueCreditBatchParams{CreditBatchID: batch.Batch.BatchID, ProjectID: 1})
+	require.Error(t, err)
+	require.Equal(t, errs.Internal, err.(*errs.Error).Code)
+
+	creditIssuer = NewFileIssuer(dir)
+	defer func() { creditIssuer = nil }()
+
+	_, err = IssueCreditBatch(testutils.GetAuthenticatedContext(collectionPointPubKey), &IssueCreditBatchParams{CreditBatchID: batch.Batch.BatchID, ProjectID: 1})
+	require.Error(t, err)
+	require.Equal(t, errs.PermissionDenied, err.(*errs.Error).Code)
+
+	issued, err := IssueCreditBatch(orgCtx, &IssueCreditBatchParams{CreditBatchID: batch.Batch.BatchID, ProjectID: 1})
+	require.NoError(t, err)
+	require.NotNil(t, issued.Issuance)
+	require.Equal(t, uint64(1), issued.Issuance.ProjectID)
+	require.Equal(t, filepath.Join(dir, batch.Batch.BatchID, "tx.json"), issued.Issuance.Reference)
+
+	tx, err := os.ReadFile(issued.Issuance.Reference)
+	require.NoError(t, err)
+	require.Equal(t, issued.Issuance.Tx, string(tx))
+	document, err := os.ReadFile(filepath.Join(dir, batch.Batch.BatchID, "document.json"))
+	require.NoError(t, err)
+	require.Equal(t, batch.Document, string(document))
+
+	stored, err := GetCreditBatch(orgCtx, &GetCreditBatchParams{CreditBatchID: batch.Batch.BatchID})
+	require.NoError(t, err)
+	require.NotNil(t, stored.Issuance)
+	require.Equal(t, issued.Issuance.Tx, stored.Issuance.Tx)
+
+	_, err = IssueCreditBatch(orgCtx, &IssueCreditBatchParams{CreditBatchID: batch.Batch.BatchID, ProjectID: 1})
+	require.Error(t, err)
+	require.Equal(t, errs.FailedPrecondition, err.(*errs.Error).Code)
+}
+
+func otherTestDeposit() commons.MassBalance {
+	return commons.MassBalance{ItemDefinition: otherTestRewards.ItemDefinition, Amount: 3}
+}
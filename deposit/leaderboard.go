@@ -0,0 +1,46 @@
+package deposit
+
+import (
+	"context"
+
+	"encore.app/commons"
+	"encore.dev/storage/sqldb"
+)
+
+type UpdateLeaderboardOptInParams struct {
+	UserPubKey string `json:"userPubKey" validate:"required"`
+	OptIn      bool   `json:"optIn"`
+}
+
+type UpdateLeaderboardOptInResponse struct {
+	// Pseudonym is what the user is shown as on the leaderboard, empty when they opted out
+	Pseudonym string `json:"pseudonym"`
+}
+
+// UpdateLeaderboardOptIn adds a user to the leaderboard, or takes them off it, for the stats service.
+// Users get a random pseudonym when they opt in, and keep it until they opt out.
+//encore:api private method=POST
+func UpdateLeaderboardOptIn(ctx context.Context, params *UpdateLeaderboardOptInParams) (*UpdateLeaderboardOptInResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	if !params.OptIn {
+		if _, err := sqldb.Exec(ctx, "DELETE FROM leaderboard_opt_in WHERE user_pub_key=$1", params.UserPubKey); err != nil {
+			return nil, err
+		}
+		return &UpdateLeaderboardOptInResponse{}, nil
+	}
+
+	// Updating on conflict returns the pseudonym the user already has
+	var pseudonym string
+	if err := sqldb.QueryRow(ctx, `
+        INSERT INTO leaderboard_opt_in (user_pub_key, pseudonym) VALUES ($1, $2)
+        ON CONFLICT (user_pub_key) DO UPDATE SET user_pub_key = EXCLUDED.user_pub_key
+        RETURNING pseudonym
+    `, params.UserPubKey, commons.GenerateID()).Scan(&pseudonym); err != nil {
+		return nil, err
+	}
+
+	return &UpdateLeaderboardOptInResponse{Pseudonym: pseudonym}, nil
+}
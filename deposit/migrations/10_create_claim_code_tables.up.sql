@@ -0,0 +1,20 @@
+CREATE TABLE claim_code
+(
+    -- A deposit has at most one claim code, making a new one replaces the old one
+    deposit_id     TEXT PRIMARY KEY,
+    -- Only the SHA-256 of the code is stored, the code itself is shown once to the collection point
+    code_hash      TEXT      NOT NULL UNIQUE,
+    created_by     TEXT      NOT NULL,
+    expires_at     TIMESTAMP NOT NULL,
+    created_at     TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE TABLE claim_code_attempt
+(
+    pub_key      TEXT      NOT NULL,
+    succeeded    BOOLEAN   NOT NULL,
+    attempted_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX claim_code_attempt_pub_key_index
+ON claim_code_attempt (pub_key, attempted_at);
@@ -0,0 +1,8 @@
+ALTER TABLE deposit
+ADD COLUMN expired            BOOLEAN   NOT NULL DEFAULT false,
+ADD COLUMN expired_at         TIMESTAMP,
+-- Where the rewards went: FORFEIT, DONATE or RETURN
+ADD COLUMN expiry_destination TEXT      NOT NULL DEFAULT '';
+
+CREATE INDEX deposit_unclaimed_index
+ON deposit (scheme_id, captured_at) WHERE claimed = false AND reversed = false AND expired = false;
@@ -0,0 +1,29 @@
+UPDATE deposit SET external_ref = '' WHERE external_ref IS NULL;
+
+ALTER TABLE deposit
+ALTER COLUMN external_ref SET DEFAULT '',
+ALTER COLUMN external_ref SET NOT NULL;
+
+-- Concurrent requests could make the same deposit twice before the index existed.
+-- Every copy but the first gets the deposit ID appended, so they stay visible but no longer match the externalRef.
+UPDATE deposit d
+SET external_ref = d.external_ref || '#' || d.id
+FROM deposit first
+WHERE d.external_ref <> ''
+  AND first.collection_point_pub_key = d.collection_point_pub_key
+  AND first.external_ref = d.external_ref
+  AND (first.created_at, first.id) < (d.created_at, d.id);
+
+DROP INDEX external_ref_index;
+
+CREATE UNIQUE INDEX deposit_external_ref_index
+ON deposit (collection_point_pub_key, external_ref) WHERE external_ref <> '';
+
+-- The rewards paid out when the deposit was claimed, so replays of MakeDeposit can return them
+ALTER TABLE deposit
+ADD COLUMN rewards JSON NOT NULL DEFAULT '[]';
+
+UPDATE deposit d
+SET rewards = o.payload -> 'rewards'
+FROM outbox o
+WHERE o.event_type = 'DepositClaimed' AND o.payload ->> 'depositID' = d.id AND json_typeof(o.payload -> 'rewards') = 'array';
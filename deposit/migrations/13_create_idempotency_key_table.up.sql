@@ -0,0 +1,10 @@
+CREATE TABLE idempotency_key
+(
+    pub_key      TEXT      NOT NULL,
+    key          TEXT      NOT NULL,
+    request_hash TEXT      NOT NULL,
+    response     JSON,
+    completed    BOOLEAN   NOT NULL DEFAULT false,
+    created_at   TIMESTAMP NOT NULL DEFAULT now(),
+    PRIMARY KEY (pub_key, key)
+);
@@ -0,0 +1,83 @@
+-- Aggregates for the stats service, kept up to date in the same transaction as the changes they count.
+-- RebuildStats recomputes them with the same queries as the backfill below.
+
+-- Vouchers per current owner
+CREATE TABLE stats_user
+(
+    user_pub_key       TEXT PRIMARY KEY,
+    available_vouchers BIGINT NOT NULL DEFAULT 0,
+    used_vouchers      BIGINT NOT NULL DEFAULT 0
+);
+
+-- Claimed deposits that are not reversed, per user and item definition
+CREATE TABLE stats_user_material
+(
+    user_pub_key        TEXT             NOT NULL,
+    material_definition JSONB            NOT NULL,
+    magnitude           INT              NOT NULL,
+    amount              DOUBLE PRECISION NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_pub_key, material_definition, magnitude)
+);
+
+-- Claimed deposits that are not reversed, per user and scheme
+CREATE TABLE stats_user_scheme
+(
+    user_pub_key TEXT   NOT NULL,
+    scheme_id    TEXT   NOT NULL,
+    deposits     BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_pub_key, scheme_id)
+);
+
+-- Deposits that are not reversed, per UTC day they were captured, scheme and collection point
+CREATE TABLE stats_daily
+(
+    day                      DATE   NOT NULL,
+    scheme_id                TEXT   NOT NULL,
+    collection_point_pub_key TEXT   NOT NULL,
+    deposits                 BIGINT NOT NULL DEFAULT 0,
+    claimed                  BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (day, scheme_id, collection_point_pub_key)
+);
+
+CREATE TABLE stats_daily_material
+(
+    day                      DATE             NOT NULL,
+    scheme_id                TEXT             NOT NULL,
+    collection_point_pub_key TEXT             NOT NULL,
+    material_definition      JSONB            NOT NULL,
+    magnitude                INT              NOT NULL,
+    amount                   DOUBLE PRECISION NOT NULL DEFAULT 0,
+    PRIMARY KEY (day, scheme_id, collection_point_pub_key, material_definition, magnitude)
+);
+
+INSERT INTO stats_user (user_pub_key, available_vouchers, used_vouchers)
+SELECT owner_pub_key, count(*) FILTER (WHERE NOT invalidated), count(*) FILTER (WHERE invalidated)
+FROM voucher
+WHERE owner_pub_key IS NOT NULL AND owner_pub_key <> ''
+GROUP BY owner_pub_key;
+
+INSERT INTO stats_user_material (user_pub_key, material_definition, magnitude, amount)
+SELECT d.user_pub_key, (item -> 'itemDefinition' -> 'materialDefinition')::jsonb,
+       (item -> 'itemDefinition' ->> 'magnitude')::int, SUM((item ->> 'amount')::float)
+FROM deposit d, json_array_elements(d.mass_balance_deposits) item
+WHERE d.claimed = true AND d.reversed = false
+GROUP BY 1, 2, 3;
+
+INSERT INTO stats_user_scheme (user_pub_key, scheme_id, deposits)
+SELECT user_pub_key, scheme_id, count(*)
+FROM deposit
+WHERE claimed = true AND reversed = false
+GROUP BY 1, 2;
+
+INSERT INTO stats_daily (day, scheme_id, collection_point_pub_key, deposits, claimed)
+SELECT captured_at::date, scheme_id, collection_point_pub_key, count(*), count(*) FILTER (WHERE claimed)
+FROM deposit
+WHERE reversed = false
+GROUP BY 1, 2, 3;
+
+INSERT INTO stats_daily_material (day, scheme_id, collection_point_pub_key, material_definition, magnitude, amount)
+SELECT d.captured_at::date, d.scheme_id, d.collection_point_pub_key, (item -> 'itemDefinition' -> 'materialDefinition')::jsonb,
+       (item -> 'itemDefinition' ->> 'magnitude')::int, SUM((item ->> 'amount')::float)
+FROM deposit d, json_array_elements(d.mass_balance_deposits) item
+WHERE d.reversed = false
+GROUP BY 1, 2, 3, 4, 5;
@@ -0,0 +1,32 @@
+CREATE TABLE credit_batch
+(
+    id                  TEXT PRIMARY KEY,
+    scheme_id           TEXT             NOT NULL,
+    organization_id     TEXT             NOT NULL,
+    material_definition JSONB            NOT NULL,
+    period_start        TIMESTAMP        NOT NULL,
+    period_end          TIMESTAMP        NOT NULL,
+    total_mass          DOUBLE PRECISION NOT NULL,
+    -- The signed document, kept byte for byte so the signature can be checked against it
+    document            TEXT             NOT NULL,
+    signature           TEXT             NOT NULL,
+    signer_pub_key      TEXT             NOT NULL,
+    created_by          TEXT             NOT NULL,
+    created_at          TIMESTAMP        NOT NULL DEFAULT now()
+);
+
+CREATE INDEX credit_batch_scheme_index
+ON credit_batch (scheme_id, created_at);
+
+-- An item of a deposit is consumed by at most one batch, so it can't be counted twice
+CREATE TABLE credit_batch_item
+(
+    credit_batch_id TEXT             NOT NULL REFERENCES credit_batch (id),
+    deposit_id      TEXT             NOT NULL,
+    item_index      INT              NOT NULL,
+    amount          DOUBLE PRECISION NOT NULL,
+    PRIMARY KEY (deposit_id, item_index)
+);
+
+CREATE INDEX credit_batch_item_batch_index
+ON credit_batch_item (credit_batch_id);
@@ -0,0 +1,6 @@
+ALTER TABLE credit_batch
+ADD COLUMN project_id         BIGINT,
+-- The unsigned transaction issuing the credits, to be signed by the organization
+ADD COLUMN issuance_tx        TEXT      NOT NULL DEFAULT '',
+ADD COLUMN issuance_reference TEXT      NOT NULL DEFAULT '',
+ADD COLUMN issued_at          TIMESTAMP;
@@ -0,0 +1,30 @@
+-- Every deposit, claim and reversal is a record in its scheme's hash chain.
+-- The hash covers the record's content, which is read from the deposit when the chain is verified, and the previous hash.
+CREATE TABLE deposit_chain
+(
+    scheme_id   TEXT      NOT NULL,
+    seq         BIGINT    NOT NULL,
+    record_type TEXT      NOT NULL,
+    deposit_id  TEXT      NOT NULL,
+    prev_hash   TEXT      NOT NULL,
+    hash        TEXT      NOT NULL,
+    created_at  TIMESTAMP NOT NULL DEFAULT now(),
+    PRIMARY KEY (scheme_id, seq),
+    UNIQUE (deposit_id, record_type)
+);
+
+CREATE TABLE deposit_chain_checkpoint
+(
+    id             BIGSERIAL PRIMARY KEY,
+    scheme_id      TEXT      NOT NULL,
+    seq            BIGINT    NOT NULL,
+    hash           TEXT      NOT NULL,
+    -- The signed document, kept byte for byte so the signature can be checked against it
+    document       TEXT      NOT NULL,
+    signature      TEXT      NOT NULL,
+    signer_pub_key TEXT      NOT NULL,
+    created_at     TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX deposit_chain_checkpoint_scheme_index
+ON deposit_chain_checkpoint (scheme_id, seq);
@@ -0,0 +1,3 @@
+ALTER TABLE deposit
+ADD COLUMN collection_point_signature TEXT NOT NULL DEFAULT '',
+ADD COLUMN signed_payload             TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,16 @@
+-- Codes made before this are too short to be safe, collection points have to make new ones
+DELETE FROM claim_code;
+
+ALTER TABLE claim_code
+-- code_id is the first part of the code, so wrong guesses at a code can be counted and the code locked
+ADD COLUMN code_id         TEXT NOT NULL UNIQUE,
+ADD COLUMN failed_attempts INT  NOT NULL DEFAULT 0;
+
+-- Attempts are limited per code and for everyone together, callers can make as many keys as they want
+DROP TABLE claim_code_attempt;
+
+CREATE TABLE claim_code_attempt_window
+(
+    window_start    TIMESTAMP PRIMARY KEY,
+    failed_attempts INT NOT NULL
+);
@@ -0,0 +1,16 @@
+-- Only approved deposits are counted, pending and rejected deposits used to be counted in the daily aggregates as well
+DELETE FROM stats_daily;
+DELETE FROM stats_daily_material;
+
+INSERT INTO stats_daily (day, scheme_id, collection_point_pub_key, deposits, claimed)
+SELECT captured_at::date, scheme_id, collection_point_pub_key, count(*), count(*) FILTER (WHERE claimed)
+FROM deposit
+WHERE status = 'APPROVED' AND reversed = false
+GROUP BY 1, 2, 3;
+
+INSERT INTO stats_daily_material (day, scheme_id, collection_point_pub_key, material_definition, magnitude, amount)
+SELECT d.captured_at::date, d.scheme_id, d.collection_point_pub_key, (item -> 'itemDefinition' -> 'materialDefinition')::jsonb,
+       (item -> 'itemDefinition' ->> 'magnitude')::int, SUM((item ->> 'amount')::float)
+FROM deposit d, json_array_elements(d.mass_balance_deposits) item
+WHERE d.status = 'APPROVED' AND d.reversed = false
+GROUP BY 1, 2, 3, 4, 5;
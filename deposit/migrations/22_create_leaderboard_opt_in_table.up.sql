@@ -0,0 +1,8 @@
+-- Moved from the stats service, so the leaderboard can be ranked in one query.
+-- The pseudonym is random, so it can't be linked to the user's pub key.
+CREATE TABLE leaderboard_opt_in
+(
+    user_pub_key TEXT PRIMARY KEY,
+    pseudonym    TEXT      NOT NULL UNIQUE,
+    created_at   TIMESTAMP NOT NULL DEFAULT now()
+);
@@ -0,0 +1,4 @@
+-- The mass of a batch too small for one more credit, carried to the next batch of the scheme and material.
+-- Earlier batches did not carry it, so theirs is 0.
+ALTER TABLE credit_batch
+ADD COLUMN remainder DOUBLE PRECISION NOT NULL DEFAULT 0;
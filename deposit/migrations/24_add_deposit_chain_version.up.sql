@@ -0,0 +1,4 @@
+-- The version of the content a record was hashed with. Records made before the status was added to deposit records
+-- are version 1, and are still verified without it.
+ALTER TABLE deposit_chain
+ADD COLUMN version INT NOT NULL DEFAULT 1;
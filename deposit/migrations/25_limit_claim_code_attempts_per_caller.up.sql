@@ -0,0 +1,14 @@
+-- Wrong guesses are limited per caller and per code. A limit for everyone together let anyone with a key turn off
+-- claiming by code for all users.
+DROP TABLE claim_code_attempt_window;
+
+CREATE TABLE claim_code_attempt_window
+(
+    caller_pub_key  TEXT      NOT NULL,
+    window_start    TIMESTAMP NOT NULL,
+    failed_attempts INT       NOT NULL,
+    PRIMARY KEY (caller_pub_key, window_start)
+);
+
+CREATE INDEX claim_code_attempt_window_start_index
+ON claim_code_attempt_window (window_start);
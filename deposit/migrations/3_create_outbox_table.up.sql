@@ -0,0 +1,11 @@
+CREATE TABLE outbox
+(
+    id           TEXT PRIMARY KEY,
+    event_type   TEXT      NOT NULL,
+    payload      JSON      NOT NULL,
+    created_at   TIMESTAMP NOT NULL DEFAULT now(),
+    published_at TIMESTAMP
+);
+
+CREATE INDEX outbox_unpublished_index
+ON outbox (created_at) WHERE published_at IS NULL;
@@ -0,0 +1,50 @@
+CREATE TABLE activity
+(
+    id                    BIGSERIAL PRIMARY KEY,
+    user_pub_key          TEXT             NOT NULL,
+    event_type            TEXT             NOT NULL,
+    event_time            TIMESTAMP        NOT NULL DEFAULT now(),
+    deposit_id            TEXT             NOT NULL DEFAULT '',
+    voucher_id            TEXT             NOT NULL DEFAULT '',
+    voucher_definition_id TEXT             NOT NULL DEFAULT '',
+    counterparty_pub_key  TEXT             NOT NULL DEFAULT '',
+    unit_name_in          TEXT             NOT NULL DEFAULT '',
+    number_of_units_in    DOUBLE PRECISION NOT NULL DEFAULT 0,
+    unit_name_out         TEXT             NOT NULL DEFAULT '',
+    number_of_units_out   DOUBLE PRECISION NOT NULL DEFAULT 0
+);
+
+CREATE INDEX activity_user_index
+ON activity (user_pub_key, id);
+
+-- Backfill from existing data, oldest first so ids follow time.
+-- Vouchers minted in the same transaction share created_at, so they are grouped into one VOUCHER_RECEIVED.
+-- We don't know when vouchers were redeemed before this, so they are placed at the time they were minted.
+INSERT INTO activity (user_pub_key, event_type, event_time, deposit_id, voucher_id, voucher_definition_id,
+                      unit_name_in, number_of_units_in, unit_name_out, number_of_units_out)
+SELECT user_pub_key, event_type, event_time, deposit_id, voucher_id, voucher_definition_id,
+       unit_name_in, number_of_units_in, unit_name_out, number_of_units_out
+FROM (
+    SELECT d.user_pub_key, 'DEPOSIT' AS event_type, d.created_at AS event_time, d.id AS deposit_id,
+           '' AS voucher_id, '' AS voucher_definition_id, '' AS unit_name_in, 0 AS number_of_units_in,
+           (SELECT string_agg(value, ' ' ORDER BY key)
+            FROM json_each_text(item -> 'itemDefinition' -> 'materialDefinition')) AS unit_name_out,
+           (item ->> 'amount')::DOUBLE PRECISION AS number_of_units_out,
+           0 AS sort_order
+    FROM deposit d, json_array_elements(d.mass_balance_deposits) item
+    WHERE d.claimed = true
+
+    UNION ALL
+
+    SELECT v.owner_pub_key, 'VOUCHER_RECEIVED', v.created_at, '', '', v.voucher_definition_id, vd.name, count(*), '', 0, 1
+    FROM voucher v JOIN voucher_definition vd ON vd.id = v.voucher_definition_id
+    WHERE v.owner_pub_key IS NOT NULL
+    GROUP BY v.owner_pub_key, v.created_at, v.voucher_definition_id, vd.name
+
+    UNION ALL
+
+    SELECT v.owner_pub_key, 'VOUCHER_REDEEMED', v.created_at, '', v.id, v.voucher_definition_id, '', 0, vd.name, 1, 2
+    FROM voucher v JOIN voucher_definition vd ON vd.id = v.voucher_definition_id
+    WHERE v.owner_pub_key IS NOT NULL AND v.invalidated = true
+) backfill
+ORDER BY event_time, sort_order;
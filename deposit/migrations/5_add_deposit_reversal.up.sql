@@ -0,0 +1,18 @@
+ALTER TABLE deposit
+ADD COLUMN reversed        BOOL      NOT NULL DEFAULT false,
+ADD COLUMN reversal_reason TEXT      NOT NULL DEFAULT '',
+ADD COLUMN reversed_by     TEXT      NOT NULL DEFAULT '',
+ADD COLUMN reversed_at     TIMESTAMP;
+
+ALTER TABLE voucher
+ADD COLUMN deposit_id TEXT NOT NULL DEFAULT '';
+
+-- Vouchers minted since the outbox was introduced can be linked through their VoucherMinted event.
+-- Older vouchers stay unlinked and are not clawed back when their deposit is reversed.
+UPDATE voucher v
+SET deposit_id = o.payload ->> 'depositID'
+FROM outbox o
+WHERE o.event_type = 'VoucherMinted' AND o.payload ->> 'voucherID' = v.id;
+
+CREATE INDEX voucher_deposit_index
+ON voucher (deposit_id) WHERE deposit_id <> '';
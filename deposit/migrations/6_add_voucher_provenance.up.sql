@@ -0,0 +1,9 @@
+ALTER TABLE voucher
+ADD COLUMN scheme_id               TEXT NOT NULL DEFAULT '',
+-- Index into the scheme's reward definitions at the time the voucher was minted, NULL when unknown
+ADD COLUMN reward_definition_index INT;
+
+UPDATE voucher v
+SET scheme_id = d.scheme_id
+FROM deposit d
+WHERE d.id = v.deposit_id;
@@ -0,0 +1,8 @@
+ALTER TABLE deposit
+ADD COLUMN status       TEXT NOT NULL DEFAULT 'APPROVED',
+ADD COLUMN review_notes TEXT NOT NULL DEFAULT '',
+ADD COLUMN reviewed_by  TEXT NOT NULL DEFAULT '',
+ADD COLUMN reviewed_at  TIMESTAMP;
+
+CREATE INDEX deposit_pending_index
+ON deposit (scheme_id, created_at) WHERE status = 'PENDING';
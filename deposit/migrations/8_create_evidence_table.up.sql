@@ -0,0 +1,15 @@
+CREATE TABLE evidence
+(
+    id               TEXT PRIMARY KEY,
+    uploader_pub_key TEXT      NOT NULL,
+    sha256           TEXT      NOT NULL,
+    mime_type        TEXT      NOT NULL,
+    size             BIGINT    NOT NULL,
+    captured_at      TIMESTAMP NOT NULL,
+    -- Set when the evidence is attached to a deposit, evidence can only be attached once
+    deposit_id       TEXT      NOT NULL DEFAULT '',
+    created_at       TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX evidence_deposit_index
+ON evidence (deposit_id) WHERE deposit_id <> '';
@@ -0,0 +1,9 @@
+ALTER TABLE deposit
+ADD COLUMN captured_at TIMESTAMP,
+ADD COLUMN flags       TEXT[] NOT NULL DEFAULT '{}';
+
+UPDATE deposit SET captured_at = created_at;
+
+ALTER TABLE deposit
+ALTER COLUMN captured_at SET NOT NULL,
+ALTER COLUMN captured_at SET DEFAULT now();
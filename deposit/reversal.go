@@ -0,0 +1,230 @@
+package deposit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/commons/outbox"
+	"encore.app/organization"
+	"encore.app/scheme"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+// reversalGracePeriod is how long a collection point can reverse its own deposits.
+// After that only the organization (or an admin) can.
+const reversalGracePeriod = 24 * time.Hour
+
+type ReverseDepositParams struct {
+	DepositID string `json:"depositID" validate:"required"`
+	Reason    string `json:"reason" validate:"required"`
+}
+
+type ReverseDepositResponse struct {
+	Deposit Deposit `json:"deposit"`
+	// InvalidatedVoucherIDs are the vouchers paid out for the deposit that were clawed back
+	InvalidatedVoucherIDs []string `json:"invalidatedVoucherIDs"`
+	// RedeemedVoucherIDs are the vouchers paid out for the deposit that were already used, and could not be clawed back
+	RedeemedVoucherIDs []string `json:"redeemedVoucherIDs"`
+}
+
+// ReverseDeposit marks a deposit as reversed and invalidates the vouchers it paid out.
+// To correct a deposit, reverse it and make a new one with the right amounts.
+//encore:api auth method=POST
+func ReverseDeposit(ctx context.Context, params *ReverseDepositParams) (*ReverseDepositResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	deposit, err := GetDeposit(ctx, &GetDepositParams{DepositID: params.DepositID})
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := scheme.GetScheme(ctx, &scheme.GetSchemeParams{SchemeID: deposit.SchemeID})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := authorizeCallerToReverse(ctx, deposit, s.OrganizationID); err != nil {
+		return nil, err
+	}
+
+	caller, _ := auth.UserID()
+
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The deposit may have been reviewed or claimed meanwhile, so they are read back for the stats
+	err = tx.QueryRow(ctx, `
+        UPDATE deposit SET reversed = true, reversal_reason=$2, reversed_by=$3, reversed_at=now()
+        WHERE id=$1 AND reversed = false
+        RETURNING status, claimed, user_pub_key
+    `, deposit.ID, params.Reason, string(caller)).Scan(&deposit.Status, &deposit.Claimed, &deposit.UserPubKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "deposit is already reversed",
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Credits may already be issued for the deposit
+	inCreditBatch, err := isInCreditBatch(ctx, tx, deposit.ID)
+	if err != nil {
+		return nil, err
+	}
+	if inCreditBatch {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "deposit is in a credit batch",
+		}
+	}
+
+	if err := countDepositReversed(ctx, tx, deposit); err != nil {
+		return nil, err
+	}
+
+	if err := appendToChain(ctx, tx, ChainRecordReversal, deposit.ID); err != nil {
+		return nil, err
+	}
+
+	resp := &ReverseDepositResponse{
+		InvalidatedVoucherIDs: []string{},
+		RedeemedVoucherIDs:    []string{},
+	}
+	vouchers, err := getVouchersForDepositForUpdate(ctx, tx, deposit.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	voucherDefs := map[string]*VoucherDefinition{}
+	for _, v := range vouchers {
+		if v.Invalidated {
+			resp.RedeemedVoucherIDs = append(resp.RedeemedVoucherIDs, v.ID)
+			continue
+		}
+
+		voucherDef, ok := voucherDefs[v.VoucherDefinitionID]
+		if !ok {
+			if voucherDef, err = GetVoucherDefinition(ctx, &GetVoucherDefinitionParams{VoucherDefinitionID: v.VoucherDefinitionID}); err != nil {
+				return nil, err
+			}
+			voucherDefs[v.VoucherDefinitionID] = voucherDef
+		}
+
+		if _, err := tx.Exec(ctx, "UPDATE voucher SET invalidated = true WHERE id=$1", v.ID); err != nil {
+			return nil, err
+		}
+
+		if err := countVouchers(ctx, tx, v.OwnerPubKey, -1, 1); err != nil {
+			return nil, err
+		}
+
+		if err := outbox.Enqueue(ctx, tx, &VoucherInvalidatedEvent{
+			VoucherID:           v.ID,
+			VoucherDefinitionID: voucherDef.ID,
+			OrganizationID:      voucherDef.OrganizationID,
+			OwnerPubKey:         v.OwnerPubKey,
+		}); err != nil {
+			return nil, err
+		}
+
+		// This goes in the history of whoever owns the voucher now
+		if err := recordActivity(ctx, tx, activity{
+			UserPubKey:          v.OwnerPubKey,
+			EventType:           EventTypeVoucherInvalidation,
+			DepositID:           deposit.ID,
+			VoucherID:           v.ID,
+			VoucherDefinitionID: voucherDef.ID,
+			UnitNameOut:         voucherDef.Name,
+			NumberOfUnitsOut:    1,
+		}); err != nil {
+			return nil, err
+		}
+
+		resp.InvalidatedVoucherIDs = append(resp.InvalidatedVoucherIDs, v.ID)
+	}
+
+	if deposit.Claimed {
+		for _, item := range deposit.MassBalanceDeposits {
+			if err := recordActivity(ctx, tx, activity{
+				UserPubKey:      deposit.UserPubKey,
+				EventType:       EventTypeDepositReversal,
+				DepositID:       deposit.ID,
+				UnitNameIn:      materialName(item.ItemDefinition),
+				NumberOfUnitsIn: item.Amount,
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := outbox.Enqueue(ctx, tx, &DepositReversedEvent{
+		DepositID:             deposit.ID,
+		SchemeID:              deposit.SchemeID,
+		OrganizationID:        s.OrganizationID,
+		CollectionPointPubKey: deposit.CollectionPointPubKey,
+		UserPubKey:            deposit.UserPubKey,
+		Reason:                params.Reason,
+		ReversedBy:            string(caller),
+		InvalidatedVoucherIDs: resp.InvalidatedVoucherIDs,
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	reversed, err := GetDeposit(ctx, &GetDepositParams{DepositID: deposit.ID})
+	if err != nil {
+		return nil, err
+	}
+	resp.Deposit = *reversed
+
+	return resp, nil
+}
+
+func authorizeCallerToReverse(ctx context.Context, deposit *Deposit, organizationID string) error {
+	caller, _ := auth.UserID()
+
+	if string(caller) == deposit.CollectionPointPubKey && time.Since(deposit.CreatedAt) <= reversalGracePeriod {
+		return nil
+	}
+
+	return organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: organizationID})
+}
+
+// getVouchersForDepositForUpdate returns the vouchers paid out for the deposit, locked until tx ends
+func getVouchersForDepositForUpdate(ctx context.Context, tx *sqldb.Tx, depositID string) ([]Voucher, error) {
+	rows, err := tx.Query(ctx, `
+        SELECT id, voucher_definition_id, owner_pub_key, invalidated, created_at, deposit_id, scheme_id, reward_definition_index
+        FROM voucher WHERE deposit_id=$1 ORDER BY id
+        FOR UPDATE
+    `, depositID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var vouchers []Voucher
+	for rows.Next() {
+		var v Voucher
+		if err := rows.Scan(&v.ID, &v.VoucherDefinitionID, &v.OwnerPubKey, &v.Invalidated, &v.CreatedAt, &v.DepositID, &v.SchemeID, &v.RewardDefinitionIndex); err != nil {
+			return nil, err
+		}
+		vouchers = append(vouchers, v)
+	}
+
+	return vouchers, rows.Err()
+}
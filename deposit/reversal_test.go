@@ -0,0 +1,201 @@
+package deposit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/admin"
+	"encore.app/commons"
+	"encore.app/commons/testutils"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReverseDeposit(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	otherUser, _ := testutils.GenerateKeys()
+	testScheme, orgSigningKey, collectionPointPubKey := setupTestScheme(t)
+
+	testTable := []struct {
+		name            string
+		reason          string
+		afterGrace      bool
+		alreadyReversed bool
+		errorCode       errs.ErrCode
+		uid             string
+	}{
+		{
+			name:      "Collection point within grace period",
+			reason:    "50 instead of 5.0",
+			errorCode: errs.OK,
+			uid:       collectionPointPubKey,
+		},
+		{
+			name:       "Collection point after grace period",
+			reason:     "50 instead of 5.0",
+			afterGrace: true,
+			errorCode:  errs.PermissionDenied,
+			uid:        collectionPointPubKey,
+		},
+		{
+			name:       "Organization after grace period",
+			reason:     "50 instead of 5.0",
+			afterGrace: true,
+			errorCode:  errs.OK,
+			uid:        orgSigningKey,
+		},
+		{
+			name:       "Admin after grace period",
+			reason:     "50 instead of 5.0",
+			afterGrace: true,
+			errorCode:  errs.OK,
+			uid:        testutils.AdminPubKey,
+		},
+		{
+			name:      "Other user",
+			reason:    "50 instead of 5.0",
+			errorCode: errs.PermissionDenied,
+			uid:       otherUser,
+		},
+		{
+			name:      "Missing reason",
+			errorCode: errs.InvalidArgument,
+			uid:       collectionPointPubKey,
+		},
+		{
+			name:            "Already reversed",
+			reason:          "50 instead of 5.0",
+			alreadyReversed: true,
+			errorCode:       errs.FailedPrecondition,
+			uid:             collectionPointPubKey,
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			deposit, err := MakeDeposit(testutils.GetAuthenticatedContext(collectionPointPubKey), &MakeDepositParams{
+				SchemeID:            testScheme.ID,
+				UserPubKey:          testUserPubKey,
+				MassBalanceDeposits: defaultTestDeposit,
+			})
+			require.NoError(t, err)
+
+			if test.afterGrace {
+				_, err = depositDB.Exec(context.Background(), "UPDATE deposit SET created_at=$2 WHERE id=$1", deposit.ID, time.Now().UTC().Add(-reversalGracePeriod-time.Hour))
+				require.NoError(t, err)
+			}
+
+			if test.alreadyReversed {
+				_, err = ReverseDeposit(testutils.GetAuthenticatedContext(collectionPointPubKey), &ReverseDepositParams{
+					DepositID: deposit.ID,
+					Reason:    "first reversal",
+				})
+				require.NoError(t, err)
+			}
+
+			resp, err := ReverseDeposit(testutils.GetAuthenticatedContext(test.uid), &ReverseDepositParams{
+				DepositID: deposit.ID,
+				Reason:    test.reason,
+			})
+			if test.errorCode != errs.OK {
+				require.Error(t, err)
+				require.Equal(t, test.errorCode, err.(*errs.Error).Code)
+
+				if !test.alreadyReversed {
+					dbDeposit, err := GetDeposit(context.Background(), &GetDepositParams{DepositID: deposit.ID})
+					require.NoError(t, err)
+					require.False(t, dbDeposit.Reversed)
+				}
+				return
+			}
+			require.NoError(t, err)
+
+			require.True(t, resp.Deposit.Reversed)
+			require.Equal(t, test.reason, resp.Deposit.ReversalReason)
+			require.NotNil(t, resp.Deposit.ReversedAt)
+			require.Equal(t, int(defaultTestDeposit[0].Amount), len(resp.InvalidatedVoucherIDs))
+			require.Equal(t, 0, len(resp.RedeemedVoucherIDs))
+
+			for _, voucherID := range resp.InvalidatedVoucherIDs {
+				v, err := GetVoucher(context.Background(), &GetVoucherParams{VoucherID: voucherID})
+				require.NoError(t, err)
+				require.True(t, v.Voucher.Invalidated)
+			}
+		})
+	}
+}
+
+func TestReverseDepositWithRedeemedVouchers(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	userPubKey, _ := testutils.GenerateKeys()
+	testScheme, _, collectionPointPubKey := setupTestScheme(t)
+
+	deposit, err := MakeDeposit(testutils.GetAuthenticatedContext(collectionPointPubKey), &MakeDepositParams{
+		SchemeID:   testScheme.ID,
+		UserPubKey: userPubKey,
+		MassBalanceDeposits: []commons.MassBalance{
+			{
+				ItemDefinition: defaultTestRewards.ItemDefinition,
+				Amount:         3,
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	vouchers, err := GetVouchersForUser(context.Background(), &GetVouchersForUserParams{UserPubKey: userPubKey})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(vouchers.Vouchers))
+	redeemed := vouchers.Vouchers[0].Voucher.ID
+
+	require.NoError(t, InvalidateVoucher(testutils.GetAuthenticatedContext(userPubKey), &InvalidateVoucherParams{VoucherID: redeemed}))
+
+	resp, err := ReverseDeposit(testutils.GetAuthenticatedContext(collectionPointPubKey), &ReverseDepositParams{
+		DepositID: deposit.ID,
+		Reason:    "wrong material",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{redeemed}, resp.RedeemedVoucherIDs)
+	require.Equal(t, 2, len(resp.InvalidatedVoucherIDs))
+	require.NotContains(t, resp.InvalidatedVoucherIDs, redeemed)
+
+	userHistory, err := GetHistory(context.Background(), &GetHistoryParams{UserPubKey: userPubKey})
+	require.NoError(t, err)
+	require.Equal(t, EventTypeDepositReversal, userHistory.Events[0].EventType)
+	require.Equal(t, float64(3), userHistory.Events[0].NumberOfUnitsIn)
+}
+
+func TestClaimReversedDeposit(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, _, collectionPointPubKey := setupTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+
+	deposit, err := MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: defaultTestDeposit,
+	})
+	require.NoError(t, err)
+
+	resp, err := ReverseDeposit(ctx, &ReverseDepositParams{
+		DepositID: deposit.ID,
+		Reason:    "test",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(resp.InvalidatedVoucherIDs))
+
+	_, err = Claim(ctx, &ClaimParams{
+		DepositID:  deposit.ID,
+		UserPubKey: testUserPubKey,
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.FailedPrecondition, err.(*errs.Error).Code)
+}
@@ -0,0 +1,550 @@
+package deposit
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"encore.app/commons"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+type MaterialAmount struct {
+	ItemDefinition commons.ItemDefinition `json:"itemDefinition"`
+	Amount         float64                `json:"amount"`
+}
+
+type GetUserStatsParams struct {
+	UserPubKey string `json:"userPubKey" validate:"required"`
+}
+
+type UserStats struct {
+	AvailableVouchers int64 `json:"availableVouchers"`
+	UsedVouchers      int64 `json:"usedVouchers"`
+	// Materials are the items in the user's claimed deposits, reversed deposits are left out
+	Materials []MaterialAmount `json:"materials"`
+	// SchemeIDs are the schemes the user claimed deposits in
+	SchemeIDs []string `json:"schemeIDs"`
+}
+
+// GetUserStats reads the user's aggregates, for the stats service
+//encore:api private method=POST
+func GetUserStats(ctx context.Context, params *GetUserStatsParams) (*UserStats, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	resp := &UserStats{Materials: []MaterialAmount{}, SchemeIDs: []string{}}
+	if err := sqldb.QueryRow(ctx, `
+        SELECT COALESCE(SUM(available_vouchers), 0), COALESCE(SUM(used_vouchers), 0) FROM stats_user WHERE user_pub_key=$1
+    `, params.UserPubKey).Scan(&resp.AvailableVouchers, &resp.UsedVouchers); err != nil {
+		return nil, err
+	}
+
+	materials, err := queryMaterials(ctx, `
+        SELECT material_definition::text, magnitude, amount FROM stats_user_material
+        WHERE user_pub_key=$1 AND amount <> 0
+        ORDER BY material_definition::text, magnitude
+    `, params.UserPubKey)
+	if err != nil {
+		return nil, err
+	}
+	resp.Materials = materials
+
+	rows, err := sqldb.Query(ctx, `
+        SELECT scheme_id FROM stats_user_scheme WHERE user_pub_key=$1 AND deposits > 0 ORDER BY scheme_id
+    `, params.UserPubKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schemeID string
+		if err := rows.Scan(&schemeID); err != nil {
+			return nil, err
+		}
+		resp.SchemeIDs = append(resp.SchemeIDs, schemeID)
+	}
+
+	return resp, rows.Err()
+}
+
+type GetDepositStatsParams struct {
+	SchemeIDs []string `json:"schemeIDs"`
+	// From and To limit the stats to deposits captured in this period, rounded down to UTC days. nil means no limit.
+	From *time.Time `json:"from"`
+	To   *time.Time `json:"to"`
+}
+
+type SchemeDeposits struct {
+	SchemeID string `json:"schemeID"`
+	Deposits int    `json:"deposits"`
+	Claimed  int    `json:"claimed"`
+}
+
+type CollectionPointDeposits struct {
+	CollectionPointPubKey string `json:"collectionPointPubKey"`
+	Deposits              int    `json:"deposits"`
+	Claimed               int    `json:"claimed"`
+}
+
+type DepositStats struct {
+	Schemes          []SchemeDeposits          `json:"schemes"`
+	CollectionPoints []CollectionPointDeposits `json:"collectionPoints"`
+	Materials        []MaterialAmount          `json:"materials"`
+	UniqueDepositors int                       `json:"uniqueDepositors"`
+}
+
+// GetDepositStats sums up the daily aggregates of the schemes, for the stats service.
+// Only approved deposits are counted, and reversed deposits are left out.
+//encore:api private method=POST
+func GetDepositStats(ctx context.Context, params *GetDepositStatsParams) (*DepositStats, error) {
+	from, to := utcDay(params.From), utcDay(params.To)
+	resp := &DepositStats{
+		Schemes:          []SchemeDeposits{},
+		CollectionPoints: []CollectionPointDeposits{},
+	}
+
+	rows, err := sqldb.Query(ctx, `
+        SELECT scheme_id, collection_point_pub_key, SUM(deposits), SUM(claimed) FROM stats_daily
+        WHERE scheme_id = ANY($1) AND ($2::date IS NULL OR day >= $2) AND ($3::date IS NULL OR day < $3)
+        GROUP BY ROLLUP (scheme_id, collection_point_pub_key)
+        ORDER BY scheme_id, collection_point_pub_key
+    `, params.SchemeIDs, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// The rollup has a row per scheme and collection point, a total per scheme, and a grand total
+	collectionPoints := map[string]int{}
+	for rows.Next() {
+		var schemeID, collectionPoint *string
+		var deposits, claimed int
+		if err := rows.Scan(&schemeID, &collectionPoint, &deposits, &claimed); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case schemeID == nil:
+		case collectionPoint == nil:
+			resp.Schemes = append(resp.Schemes, SchemeDeposits{SchemeID: *schemeID, Deposits: deposits, Claimed: claimed})
+		default:
+			i, ok := collectionPoints[*collectionPoint]
+			if !ok {
+				i = len(resp.CollectionPoints)
+				collectionPoints[*collectionPoint] = i
+				resp.CollectionPoints = append(resp.CollectionPoints, CollectionPointDeposits{CollectionPointPubKey: *collectionPoint})
+			}
+			resp.CollectionPoints[i].Deposits += deposits
+			resp.CollectionPoints[i].Claimed += claimed
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	materials, err := queryMaterials(ctx, `
+        SELECT material_definition::text, magnitude, SUM(amount) FROM stats_daily_material
+        WHERE scheme_id = ANY($1) AND ($2::date IS NULL OR day >= $2) AND ($3::date IS NULL OR day < $3)
+        GROUP BY material_definition, magnitude
+        HAVING SUM(amount) <> 0
+        ORDER BY material_definition::text, magnitude
+    `, params.SchemeIDs, from, to)
+	if err != nil {
+		return nil, err
+	}
+	resp.Materials = materials
+
+	// Users can't be summed up per day, so they are counted from the deposits
+	if err := sqldb.QueryRow(ctx, `
+        SELECT count(DISTINCT user_pub_key) FROM deposit
+        WHERE scheme_id = ANY($1) AND user_pub_key <> '' AND status = 'APPROVED' AND reversed = false
+          AND ($2::date IS NULL OR captured_at >= $2) AND ($3::date IS NULL OR captured_at < $3)
+    `, params.SchemeIDs, from, to).Scan(&resp.UniqueDepositors); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// queryMaterials runs a query returning a material definition, magnitude and amount per row
+func queryMaterials(ctx context.Context, query string, args ...interface{}) ([]MaterialAmount, error) {
+	rows, err := sqldb.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	materials := []MaterialAmount{}
+	for rows.Next() {
+		var materialDefinition string
+		var m MaterialAmount
+		if err := rows.Scan(&materialDefinition, &m.ItemDefinition.Magnitude, &m.Amount); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(materialDefinition), &m.ItemDefinition.MaterialDefinition); err != nil {
+			return nil, err
+		}
+		materials = append(materials, m)
+	}
+
+	return materials, rows.Err()
+}
+
+// utcDay is the UTC date of t, as the start of the day
+func utcDay(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	u := t.UTC()
+	day := time.Date(u.Year(), u.Month(), u.Day(), 0, 0, 0, 0, time.UTC)
+	return &day
+}
+
+type GetVoucherStatsParams struct {
+	OrganizationID string `json:"organizationID" validate:"required"`
+	// From and To limit minted and redeemed to this period, nil means no limit
+	From *time.Time `json:"from"`
+	To   *time.Time `json:"to"`
+}
+
+type VoucherStats struct {
+	VoucherDefinitionID string `json:"voucherDefinitionID"`
+	Name                string `json:"name"`
+	Minted              int    `json:"minted"`
+	// Redeemed only counts vouchers invalidated by their owner, not by an admin or a reversal
+	Redeemed int `json:"redeemed"`
+	// Outstanding is the vouchers minted before To that can still be redeemed today
+	Outstanding int `json:"outstanding"`
+}
+
+type GetVoucherStatsResponse struct {
+	VoucherDefinitions []VoucherStats `json:"voucherDefinitions"`
+}
+
+// GetVoucherStats counts the organization's vouchers per voucher definition, for the stats service
+//encore:api private method=POST
+func GetVoucherStats(ctx context.Context, params *GetVoucherStatsParams) (*GetVoucherStatsResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	rows, err := sqldb.Query(ctx, `
+        SELECT vd.id, vd.name,
+            (SELECT count(*) FROM voucher v
+             WHERE v.voucher_definition_id = vd.id
+               AND ($2::timestamp IS NULL OR v.created_at >= $2) AND ($3::timestamp IS NULL OR v.created_at < $3)),
+            (SELECT count(*) FROM activity a
+             WHERE a.voucher_definition_id = vd.id AND a.event_type = $4
+               AND ($2::timestamp IS NULL OR a.event_time >= $2) AND ($3::timestamp IS NULL OR a.event_time < $3)),
+            (SELECT count(*) FROM voucher v
+             WHERE v.voucher_definition_id = vd.id AND v.invalidated = false
+               AND ($3::timestamp IS NULL OR v.created_at < $3))
+        FROM voucher_definition vd
+        WHERE vd.organization_id = $1
+        ORDER BY vd.name, vd.id
+    `, params.OrganizationID, utcTime(params.From), utcTime(params.To), EventTypeVoucherRedemption)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resp := &GetVoucherStatsResponse{VoucherDefinitions: []VoucherStats{}}
+	for rows.Next() {
+		var s VoucherStats
+		if err := rows.Scan(&s.VoucherDefinitionID, &s.Name, &s.Minted, &s.Redeemed, &s.Outstanding); err != nil {
+			return nil, err
+		}
+		resp.VoucherDefinitions = append(resp.VoucherDefinitions, s)
+	}
+
+	return resp, rows.Err()
+}
+
+// Intervals of a time series
+const (
+	IntervalDay   = "DAY"
+	IntervalWeek  = "WEEK"
+	IntervalMonth = "MONTH"
+)
+
+type GetTimeSeriesParams struct {
+	SchemeIDs []string `json:"schemeIDs"`
+	// CollectionPointPubKey limits the series to one collection point, empty means all of them
+	CollectionPointPubKey string `json:"collectionPointPubKey"`
+	Interval              string `json:"interval" validate:"required,oneof=DAY WEEK MONTH"`
+	// TimeZone is where days start, e.g. "Africa/Lagos". Weeks start on Monday.
+	TimeZone string `json:"timeZone" validate:"required,timezone"`
+	// From and To limit the series to this period, nil means no limit
+	From *time.Time `json:"from"`
+	To   *time.Time `json:"to"`
+}
+
+type MaterialWeight struct {
+	MaterialDefinition map[string]string `json:"materialDefinition"`
+	Amount             float64           `json:"amount"`
+}
+
+type TimeSeriesBucket struct {
+	// Start is the start of the bucket in the time zone of the series
+	Start            time.Time        `json:"start"`
+	Deposits         int              `json:"deposits"`
+	Weights          []MaterialWeight `json:"weights"`
+	VouchersMinted   int              `json:"vouchersMinted"`
+	VouchersRedeemed int              `json:"vouchersRedeemed"`
+}
+
+type GetTimeSeriesResponse struct {
+	// Buckets are in order, and only the buckets with any data are included
+	Buckets []TimeSeriesBucket `json:"buckets"`
+}
+
+// GetTimeSeries buckets the deposits and vouchers of the schemes by time, for the stats service.
+// Only approved deposits are counted and reversed deposits are left out.
+// Vouchers count for the scheme and collection point that paid them out.
+//encore:api private method=POST
+func GetTimeSeries(ctx context.Context, params *GetTimeSeriesParams) (*GetTimeSeriesResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	loc, err := time.LoadLocation(params.TimeZone)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "unknown time zone",
+		}
+	}
+
+	buckets := map[time.Time]*TimeSeriesBucket{}
+	bucket := func(start time.Time) *TimeSeriesBucket {
+		// The database returns the wall clock time in the time zone as UTC
+		start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+		b, ok := buckets[start]
+		if !ok {
+			b = &TimeSeriesBucket{Start: start, Weights: []MaterialWeight{}}
+			buckets[start] = b
+		}
+		return b
+	}
+
+	args := []interface{}{strings.ToLower(params.Interval), params.TimeZone, params.SchemeIDs, params.CollectionPointPubKey, utcTime(params.From), utcTime(params.To)}
+
+	if err := queryBuckets(ctx, `
+        SELECT `+bucketColumn("d.captured_at")+`, count(*) FROM deposit d
+        WHERE d.scheme_id = ANY($3) AND ($4::text = '' OR d.collection_point_pub_key = $4) AND d.status = 'APPROVED' AND d.reversed = false
+          AND ($5::timestamp IS NULL OR d.captured_at >= $5) AND ($6::timestamp IS NULL OR d.captured_at < $6)
+        GROUP BY 1
+    `, args, func(start time.Time, count int) { bucket(start).Deposits = count }); err != nil {
+		return nil, err
+	}
+
+	rows, err := sqldb.Query(ctx, `
+        SELECT `+bucketColumn("d.captured_at")+`, (item -> 'itemDefinition' -> 'materialDefinition')::jsonb::text,
+               SUM((item ->> 'amount')::float)
+        FROM deposit d, json_array_elements(d.mass_balance_deposits) item
+        WHERE d.scheme_id = ANY($3) AND ($4::text = '' OR d.collection_point_pub_key = $4) AND d.status = 'APPROVED' AND d.reversed = false
+          AND ($5::timestamp IS NULL OR d.captured_at >= $5) AND ($6::timestamp IS NULL OR d.captured_at < $6)
+          AND (item -> 'itemDefinition' ->> 'magnitude')::int = $7
+        GROUP BY 1, 2
+        ORDER BY 1, 2
+    `, append(args, int(commons.Weight))...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var start time.Time
+		var materialDefinition string
+		var w MaterialWeight
+		if err := rows.Scan(&start, &materialDefinition, &w.Amount); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(materialDefinition), &w.MaterialDefinition); err != nil {
+			return nil, err
+		}
+		b := bucket(start)
+		b.Weights = append(b.Weights, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := queryBuckets(ctx, `
+        SELECT `+bucketColumn("v.created_at")+`, count(*) FROM voucher v
+        LEFT JOIN deposit d ON d.id = v.deposit_id
+        WHERE v.scheme_id = ANY($3) AND ($4::text = '' OR d.collection_point_pub_key = $4)
+          AND ($5::timestamp IS NULL OR v.created_at >= $5) AND ($6::timestamp IS NULL OR v.created_at < $6)
+        GROUP BY 1
+    `, args, func(start time.Time, count int) { bucket(start).VouchersMinted = count }); err != nil {
+		return nil, err
+	}
+
+	if err := queryBuckets(ctx, `
+        SELECT `+bucketColumn("a.event_time")+`, count(*) FROM activity a
+        JOIN voucher v ON v.id = a.voucher_id
+        LEFT JOIN deposit d ON d.id = v.deposit_id
+        WHERE a.event_type = $7 AND v.scheme_id = ANY($3) AND ($4::text = '' OR d.collection_point_pub_key = $4)
+          AND ($5::timestamp IS NULL OR a.event_time >= $5) AND ($6::timestamp IS NULL OR a.event_time < $6)
+        GROUP BY 1
+    `, append(args, EventTypeVoucherRedemption), func(start time.Time, count int) { bucket(start).VouchersRedeemed = count }); err != nil {
+		return nil, err
+	}
+
+	resp := &GetTimeSeriesResponse{Buckets: make([]TimeSeriesBucket, 0, len(buckets))}
+	for _, b := range buckets {
+		resp.Buckets = append(resp.Buckets, *b)
+	}
+	sort.Slice(resp.Buckets, func(i, j int) bool {
+		return resp.Buckets[i].Start.Before(resp.Buckets[j].Start)
+	})
+
+	return resp, nil
+}
+
+// bucketColumn truncates the UTC timestamp column to the interval $1 in the time zone $2
+func bucketColumn(column string) string {
+	return "date_trunc($1::text, " + column + " AT TIME ZONE 'UTC' AT TIME ZONE $2::text)"
+}
+
+// queryBuckets runs a query returning a bucket start and a count per row
+func queryBuckets(ctx context.Context, query string, args []interface{}, fn func(start time.Time, count int)) error {
+	rows, err := sqldb.Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var start time.Time
+		var count int
+		if err := rows.Scan(&start, &count); err != nil {
+			return err
+		}
+		fn(start, count)
+	}
+
+	return rows.Err()
+}
+
+type GetCollectionPointStatsParams struct {
+	SchemeID string `json:"schemeID" validate:"required"`
+	// From and To limit the stats to deposits captured in this period, nil means no limit
+	From *time.Time `json:"from"`
+	To   *time.Time `json:"to"`
+}
+
+type CollectionPointStats struct {
+	CollectionPointPubKey string `json:"collectionPointPubKey"`
+	Deposits              int    `json:"deposits"`
+	Unclaimed             int    `json:"unclaimed"`
+	UniqueUsers           int    `json:"uniqueUsers"`
+	// Weight is the total of the items measured by weight, in kg
+	Weight float64 `json:"weight"`
+}
+
+type GetCollectionPointStatsResponse struct {
+	CollectionPoints []CollectionPointStats `json:"collectionPoints"`
+}
+
+// GetCollectionPointStats sums up the deposits of each collection point in the scheme, for the stats service.
+// Only collection points with approved deposits are included, and reversed deposits are left out.
+//encore:api private method=POST
+func GetCollectionPointStats(ctx context.Context, params *GetCollectionPointStatsParams) (*GetCollectionPointStatsResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	rows, err := sqldb.Query(ctx, `
+        SELECT collection_point_pub_key, count(*), count(*) FILTER (WHERE NOT claimed),
+               count(DISTINCT NULLIF(user_pub_key, '')),
+               COALESCE(SUM((SELECT SUM((item ->> 'amount')::float) FROM json_array_elements(mass_balance_deposits) item
+                             WHERE (item -> 'itemDefinition' ->> 'magnitude')::int = $4)), 0)
+        FROM deposit
+        WHERE scheme_id = $1 AND status = 'APPROVED' AND reversed = false
+          AND ($2::timestamp IS NULL OR captured_at >= $2) AND ($3::timestamp IS NULL OR captured_at < $3)
+        GROUP BY collection_point_pub_key
+        ORDER BY collection_point_pub_key
+    `, params.SchemeID, utcTime(params.From), utcTime(params.To), int(commons.Weight))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resp := &GetCollectionPointStatsResponse{CollectionPoints: []CollectionPointStats{}}
+	for rows.Next() {
+		var s CollectionPointStats
+		if err := rows.Scan(&s.CollectionPointPubKey, &s.Deposits, &s.Unclaimed, &s.UniqueUsers, &s.Weight); err != nil {
+			return nil, err
+		}
+		resp.CollectionPoints = append(resp.CollectionPoints, s)
+	}
+
+	return resp, rows.Err()
+}
+
+type GetTopDepositorsParams struct {
+	// SchemeID limits the ranking to one scheme, empty means all schemes
+	SchemeID string `json:"schemeID"`
+	// From and To limit the ranking to deposits captured in this period, nil means no limit
+	From  *time.Time `json:"from"`
+	To    *time.Time `json:"to"`
+	Limit int        `json:"limit" validate:"min=1"`
+}
+
+type Depositor struct {
+	// Pseudonym is the random name the user got when they opted in to the leaderboard
+	Pseudonym string `json:"pseudonym"`
+	Deposits  int    `json:"deposits"`
+	// Weight is the total of the items measured by weight, in kg
+	Weight float64 `json:"weight"`
+}
+
+type GetTopDepositorsResponse struct {
+	// Depositors are ordered by weight and then number of deposits, most first
+	Depositors []Depositor `json:"depositors"`
+}
+
+// GetTopDepositors ranks the users that opted in to the leaderboard by what they deposited in claimed deposits,
+// for the stats service. Reversed deposits are left out.
+//encore:api private method=POST
+func GetTopDepositors(ctx context.Context, params *GetTopDepositorsParams) (*GetTopDepositorsResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	rows, err := sqldb.Query(ctx, `
+        SELECT o.pseudonym, count(*),
+               COALESCE(SUM((SELECT SUM((item ->> 'amount')::float) FROM json_array_elements(d.mass_balance_deposits) item
+                             WHERE (item -> 'itemDefinition' ->> 'magnitude')::int = $4)), 0) AS weight
+        FROM deposit d
+        JOIN leaderboard_opt_in o ON o.user_pub_key = d.user_pub_key
+        WHERE d.claimed = true AND d.reversed = false AND ($1::text = '' OR d.scheme_id = $1)
+          AND ($2::timestamp IS NULL OR d.captured_at >= $2) AND ($3::timestamp IS NULL OR d.captured_at < $3)
+        GROUP BY o.pseudonym
+        ORDER BY weight DESC, count(*) DESC, o.pseudonym
+        LIMIT $5
+    `, params.SchemeID, utcTime(params.From), utcTime(params.To), int(commons.Weight), params.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resp := &GetTopDepositorsResponse{Depositors: []Depositor{}}
+	for rows.Next() {
+		var d Depositor
+		if err := rows.Scan(&d.Pseudonym, &d.Deposits, &d.Weight); err != nil {
+			return nil, err
+		}
+		resp.Depositors = append(resp.Depositors, d)
+	}
+
+	return resp, rows.Err()
+}
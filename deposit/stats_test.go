@@ -0,0 +1,309 @@
+package deposit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/admin"
+	"encore.app/commons/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetDepositStats(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+
+	lastWeek := time.Now().UTC().AddDate(0, 0, -7)
+	var deposits []*Deposit
+	for _, d := range []struct {
+		user       string
+		capturedAt *time.Time
+	}{
+		{testUserPubKey, &lastWeek},
+		{"", nil},
+		{"otherUser", nil},
+	} {
+		deposit, err := MakeDeposit(ctx, &MakeDepositParams{
+			SchemeID:            testScheme.ID,
+			MassBalanceDeposits: defaultTestDeposit,
+			UserPubKey:          d.user,
+			CapturedAt:          d.capturedAt,
+		})
+		require.NoError(t, err)
+		deposits = append(deposits, deposit)
+	}
+
+	// Reversed deposits are left out
+	_, err := ReverseDeposit(testutils.GetAuthenticatedContext(orgSigningKey), &ReverseDepositParams{DepositID: deposits[2].ID, Reason: "Test"})
+	require.NoError(t, err)
+
+	yesterday := time.Now().UTC().AddDate(0, 0, -1)
+	testTable := []struct {
+		name       string
+		params     GetDepositStatsParams
+		deposits   int
+		claimed    int
+		depositors int
+	}{
+		{
+			name:       "All",
+			params:     GetDepositStatsParams{SchemeIDs: []string{testScheme.ID}},
+			deposits:   2,
+			claimed:    1,
+			depositors: 1,
+		},
+		{
+			name:       "From",
+			params:     GetDepositStatsParams{SchemeIDs: []string{testScheme.ID}, From: &yesterday},
+			deposits:   1,
+			claimed:    0,
+			depositors: 0,
+		},
+		{
+			name:       "To",
+			params:     GetDepositStatsParams{SchemeIDs: []string{testScheme.ID}, To: &yesterday},
+			deposits:   1,
+			claimed:    1,
+			depositors: 1,
+		},
+		{
+			name:       "Other scheme",
+			params:     GetDepositStatsParams{SchemeIDs: []string{"other"}},
+			deposits:   0,
+			depositors: 0,
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := GetDepositStats(context.Background(), &test.params)
+			require.NoError(t, err)
+			require.Equal(t, test.depositors, resp.UniqueDepositors)
+			if test.deposits == 0 {
+				require.Equal(t, 0, len(resp.Schemes))
+				require.Equal(t, 0, len(resp.CollectionPoints))
+				require.Equal(t, 0, len(resp.Materials))
+				return
+			}
+
+			require.Equal(t, []SchemeDeposits{{SchemeID: testScheme.ID, Deposits: test.deposits, Claimed: test.claimed}}, resp.Schemes)
+			require.Equal(t, []CollectionPointDeposits{{CollectionPointPubKey: collectionPointPubKey, Deposits: test.deposits, Claimed: test.claimed}}, resp.CollectionPoints)
+			require.Equal(t, []MaterialAmount{{ItemDefinition: defaultTestRewards.ItemDefinition, Amount: 12 * float64(test.deposits)}}, resp.Materials)
+		})
+	}
+}
+
+func TestGetUserStats(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, _, collectionPointPubKey := setupTestScheme(t)
+	for i := 0; i < 2; i++ {
+		_, err := MakeDeposit(testutils.GetAuthenticatedContext(collectionPointPubKey), &MakeDepositParams{
+			SchemeID:            testScheme.ID,
+			MassBalanceDeposits: defaultTestDeposit,
+			UserPubKey:          testUserPubKey,
+		})
+		require.NoError(t, err)
+	}
+
+	vouchers, err := GetVouchersForUser(testutils.GetAuthenticatedContext(testUserPubKey), &GetVouchersForUserParams{UserPubKey: testUserPubKey})
+	require.NoError(t, err)
+	require.NoError(t, InvalidateVoucher(testutils.GetAuthenticatedContext(testUserPubKey), &InvalidateVoucherParams{VoucherID: vouchers.Vouchers[0].Voucher.ID}))
+
+	resp, err := GetUserStats(context.Background(), &GetUserStatsParams{UserPubKey: testUserPubKey})
+	require.NoError(t, err)
+	require.Equal(t, int64(23), resp.AvailableVouchers)
+	require.Equal(t, int64(1), resp.UsedVouchers)
+	require.Equal(t, []MaterialAmount{{ItemDefinition: defaultTestRewards.ItemDefinition, Amount: 24}}, resp.Materials)
+	require.Equal(t, []string{testScheme.ID}, resp.SchemeIDs)
+}
+
+func TestGetVoucherStats(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, _, collectionPointPubKey := setupTestScheme(t)
+	_, err := MakeDeposit(testutils.GetAuthenticatedContext(collectionPointPubKey), &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: defaultTestDeposit,
+		UserPubKey:          testUserPubKey,
+	})
+	require.NoError(t, err)
+
+	vouchers, err := GetVouchersForUser(testutils.GetAuthenticatedContext(testUserPubKey), &GetVouchersForUserParams{UserPubKey: testUserPubKey})
+	require.NoError(t, err)
+	require.Equal(t, 12, len(vouchers.Vouchers))
+
+	// Redeemed by the owner
+	require.NoError(t, InvalidateVoucher(testutils.GetAuthenticatedContext(testUserPubKey), &InvalidateVoucherParams{VoucherID: vouchers.Vouchers[0].Voucher.ID}))
+	// Invalidated by an admin, which is not a redemption
+	require.NoError(t, InvalidateVoucher(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &InvalidateVoucherParams{VoucherID: vouchers.Vouchers[1].Voucher.ID}))
+
+	resp, err := GetVoucherStats(context.Background(), &GetVoucherStatsParams{OrganizationID: testOrganizationId})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(resp.VoucherDefinitions))
+	require.Equal(t, defaultTestRewards.RewardTypeID, resp.VoucherDefinitions[0].VoucherDefinitionID)
+	require.Equal(t, 12, resp.VoucherDefinitions[0].Minted)
+	require.Equal(t, 1, resp.VoucherDefinitions[0].Redeemed)
+	require.Equal(t, 10, resp.VoucherDefinitions[0].Outstanding)
+
+	future := time.Now().UTC().Add(time.Hour)
+	resp, err = GetVoucherStats(context.Background(), &GetVoucherStatsParams{OrganizationID: testOrganizationId, From: &future})
+	require.NoError(t, err)
+	require.Equal(t, 0, resp.VoucherDefinitions[0].Minted)
+	require.Equal(t, 0, resp.VoucherDefinitions[0].Redeemed)
+	require.Equal(t, 10, resp.VoucherDefinitions[0].Outstanding)
+
+	_, err = GetVoucherStats(context.Background(), &GetVoucherStatsParams{})
+	require.Error(t, err)
+}
+
+func TestGetTimeSeries(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, _, collectionPointPubKey := setupTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+
+	// A recent Wednesday followed by a Thursday of the same month, so both deposits are in the same week and month
+	wednesday := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -14)
+	for wednesday.Weekday() != time.Wednesday || wednesday.AddDate(0, 0, 1).Month() != wednesday.Month() {
+		wednesday = wednesday.AddDate(0, 0, -1)
+	}
+	thursday := wednesday.AddDate(0, 0, 1)
+
+	for _, capturedAt := range []time.Time{
+		wednesday.Add(23*time.Hour + 30*time.Minute),
+		thursday.Add(time.Hour),
+	} {
+		_, err := MakeDeposit(ctx, &MakeDepositParams{
+			SchemeID:            testScheme.ID,
+			MassBalanceDeposits: defaultTestDeposit,
+			CapturedAt:          &capturedAt,
+		})
+		require.NoError(t, err)
+	}
+
+	lagos, err := time.LoadLocation("Africa/Lagos")
+	require.NoError(t, err)
+
+	testTable := []struct {
+		name     string
+		interval string
+		timeZone string
+		starts   []time.Time
+		deposits []int
+	}{
+		{
+			name:     "Days in UTC",
+			interval: IntervalDay,
+			timeZone: "UTC",
+			starts:   []time.Time{wednesday, thursday},
+			deposits: []int{1, 1},
+		},
+		{
+			name:     "Days in Lagos",
+			interval: IntervalDay,
+			timeZone: "Africa/Lagos",
+			starts:   []time.Time{time.Date(thursday.Year(), thursday.Month(), thursday.Day(), 0, 0, 0, 0, lagos)},
+			deposits: []int{2},
+		},
+		{
+			name:     "Weeks start on Monday",
+			interval: IntervalWeek,
+			timeZone: "UTC",
+			starts:   []time.Time{wednesday.AddDate(0, 0, -2)},
+			deposits: []int{2},
+		},
+		{
+			name:     "Months",
+			interval: IntervalMonth,
+			timeZone: "UTC",
+			starts:   []time.Time{time.Date(wednesday.Year(), wednesday.Month(), 1, 0, 0, 0, 0, time.UTC)},
+			deposits: []int{2},
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := GetTimeSeries(context.Background(), &GetTimeSeriesParams{
+				SchemeIDs: []string{testScheme.ID},
+				Interval:  test.interval,
+				TimeZone:  test.timeZone,
+			})
+			require.NoError(t, err)
+			require.Equal(t, len(test.starts), len(resp.Buckets))
+			for i, b := range resp.Buckets {
+				require.True(t, test.starts[i].Equal(b.Start), "bucket %d starts at %s, not %s", i, b.Start, test.starts[i])
+				require.Equal(t, test.deposits[i], b.Deposits)
+				require.Equal(t, 1, len(b.Weights))
+				require.Equal(t, defaultTestRewards.ItemDefinition.MaterialDefinition, b.Weights[0].MaterialDefinition)
+				require.Equal(t, 12*float64(test.deposits[i]), b.Weights[0].Amount)
+				require.Equal(t, 0, b.VouchersMinted)
+			}
+		})
+	}
+
+	resp, err := GetTimeSeries(context.Background(), &GetTimeSeriesParams{
+		SchemeIDs:             []string{testScheme.ID},
+		CollectionPointPubKey: "other",
+		Interval:              IntervalDay,
+		TimeZone:              "UTC",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(resp.Buckets))
+}
+
+func TestGetCollectionPointStatsAndTopDepositors(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+
+	var deposits []*Deposit
+	for _, user := range []string{testUserPubKey, testUserPubKey, "", "otherUser"} {
+		deposit, err := MakeDeposit(ctx, &MakeDepositParams{
+			SchemeID:            testScheme.ID,
+			MassBalanceDeposits: defaultTestDeposit,
+			UserPubKey:          user,
+		})
+		require.NoError(t, err)
+		deposits = append(deposits, deposit)
+	}
+
+	// Reversed deposits are left out
+	_, err := ReverseDeposit(testutils.GetAuthenticatedContext(orgSigningKey), &ReverseDepositParams{DepositID: deposits[3].ID, Reason: "Test"})
+	require.NoError(t, err)
+
+	cpStats, err := GetCollectionPointStats(context.Background(), &GetCollectionPointStatsParams{SchemeID: testScheme.ID})
+	require.NoError(t, err)
+	require.Equal(t, []CollectionPointStats{{
+		CollectionPointPubKey: collectionPointPubKey,
+		Deposits:              3,
+		Unclaimed:             1,
+		UniqueUsers:           1,
+		Weight:                36,
+	}}, cpStats.CollectionPoints)
+
+	// Only users that opted in are ranked
+	top, err := GetTopDepositors(context.Background(), &GetTopDepositorsParams{SchemeID: testScheme.ID, Limit: 10})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(top.Depositors))
+
+	optIn, err := UpdateLeaderboardOptIn(context.Background(), &UpdateLeaderboardOptInParams{UserPubKey: testUserPubKey, OptIn: true})
+	require.NoError(t, err)
+	top, err = GetTopDepositors(context.Background(), &GetTopDepositorsParams{SchemeID: testScheme.ID, Limit: 10})
+	require.NoError(t, err)
+	require.Equal(t, []Depositor{{Pseudonym: optIn.Pseudonym, Deposits: 2, Weight: 24}}, top.Depositors)
+}
@@ -0,0 +1,114 @@
+package deposit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"encore.app/commons"
+	"encore.app/scheme"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+)
+
+const (
+	SyncCreated  = "CREATED"
+	SyncExisting = "EXISTING"
+	SyncError    = "ERROR"
+)
+
+const maxSyncDeposits = 500
+
+type SyncDepositsParams struct {
+	// Deposits are processed in order. Each needs an externalRef and capturedAt.
+	Deposits []MakeDepositParams `json:"deposits" validate:"required,min=1"`
+}
+
+type SyncDepositResult struct {
+	Index       int      `json:"index"`
+	ExternalRef string   `json:"externalRef"`
+	Status      string   `json:"status"`
+	Deposit     *Deposit `json:"deposit"`
+	Error       string   `json:"error"`
+}
+
+type SyncDepositsResponse struct {
+	Results []SyncDepositResult `json:"results"`
+}
+
+// SyncDeposits makes the deposits a collection point recorded while offline.
+// Deposits that were already synced are returned as EXISTING, so a batch can be retried after a lost response.
+//encore:api auth method=POST
+func SyncDeposits(ctx context.Context, params *SyncDepositsParams) (*SyncDepositsResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	if len(params.Deposits) > maxSyncDeposits {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("too many deposits, the maximum is %d", maxSyncDeposits),
+		}
+	}
+
+	collectionPoint, _ := auth.UserID()
+
+	resp := &SyncDepositsResponse{Results: []SyncDepositResult{}}
+	schemes := map[string]*scheme.Scheme{}
+	for i := range params.Deposits {
+		item := &params.Deposits[i]
+		result := SyncDepositResult{
+			Index:       i,
+			ExternalRef: item.ExternalRef,
+		}
+
+		deposit, status, err := syncDeposit(ctx, schemes, string(collectionPoint), item)
+		if err != nil {
+			result.Status = SyncError
+			result.Error = err.Error()
+		} else {
+			result.Status = status
+			result.Deposit = deposit
+		}
+
+		resp.Results = append(resp.Results, result)
+	}
+
+	return resp, nil
+}
+
+func syncDeposit(ctx context.Context, schemes map[string]*scheme.Scheme, collectionPoint string, params *MakeDepositParams) (*Deposit, string, error) {
+	if params.ExternalRef == "" {
+		return nil, "", errors.New("externalRef is required when syncing")
+	}
+	if params.CapturedAt == nil {
+		return nil, "", errors.New("capturedAt is required when syncing")
+	}
+	if err := commons.Validate(params); err != nil {
+		return nil, "", err
+	}
+
+	s, ok := schemes[params.SchemeID]
+	if !ok {
+		var err error
+		if s, err = scheme.GetScheme(ctx, &scheme.GetSchemeParams{SchemeID: params.SchemeID}); err != nil {
+			return nil, "", err
+		}
+		schemes[params.SchemeID] = s
+	}
+
+	existing, err := checkDeposit(ctx, s, collectionPoint, params)
+	if err != nil {
+		return nil, "", err
+	}
+	if existing != nil {
+		return existing, SyncExisting, nil
+	}
+
+	deposit, err := MakeDeposit(ctx, params)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return deposit, SyncCreated, nil
+}
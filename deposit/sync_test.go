@@ -0,0 +1,91 @@
+package deposit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/admin"
+	"encore.app/commons/testutils"
+	"encore.app/scheme"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncDeposits(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, orgSigningKey, collectionPointPubKey := setupTestScheme(t)
+	activeFrom := time.Now().UTC().AddDate(0, 0, -10)
+	require.NoError(t, scheme.EditScheme(testutils.GetAuthenticatedContext(orgSigningKey), &scheme.EditSchemeParams{
+		SchemeID:          testScheme.ID,
+		RewardDefinitions: testScheme.RewardDefinitions,
+		CollectionPoints:  []string{collectionPointPubKey},
+		ActiveFrom:        &activeFrom,
+	}))
+
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+	insideWindow := activeFrom.AddDate(0, 0, 9).Truncate(time.Second)
+	beforeWindow := activeFrom.AddDate(0, 0, -2).Truncate(time.Second)
+
+	batch := []MakeDepositParams{
+		{
+			SchemeID:            testScheme.ID,
+			MassBalanceDeposits: defaultTestDeposit,
+			ExternalRef:         "offline-1",
+			CapturedAt:          &insideWindow,
+		},
+		{
+			SchemeID:            testScheme.ID,
+			MassBalanceDeposits: defaultTestDeposit,
+			UserPubKey:          testUserPubKey,
+			ExternalRef:         "offline-2",
+			CapturedAt:          &beforeWindow,
+		},
+		{
+			SchemeID:            testScheme.ID,
+			MassBalanceDeposits: defaultTestDeposit,
+			ExternalRef:         "offline-3",
+		},
+		{
+			SchemeID:            "does not exist",
+			MassBalanceDeposits: defaultTestDeposit,
+			ExternalRef:         "offline-4",
+			CapturedAt:          &insideWindow,
+		},
+	}
+
+	resp, err := SyncDeposits(ctx, &SyncDepositsParams{Deposits: batch})
+	require.NoError(t, err)
+	require.Equal(t, 4, len(resp.Results))
+
+	require.Equal(t, SyncCreated, resp.Results[0].Status)
+	require.True(t, insideWindow.Equal(resp.Results[0].Deposit.CapturedAt))
+	require.True(t, resp.Results[0].Deposit.CreatedAt.After(insideWindow))
+	require.Equal(t, []string{}, resp.Results[0].Deposit.Flags)
+
+	require.Equal(t, SyncCreated, resp.Results[1].Status)
+	require.Equal(t, []string{FlagOutsideSchemeWindow}, resp.Results[1].Deposit.Flags)
+	require.True(t, resp.Results[1].Deposit.Claimed)
+
+	require.Equal(t, SyncError, resp.Results[2].Status)
+	require.Nil(t, resp.Results[2].Deposit)
+	require.Equal(t, SyncError, resp.Results[3].Status)
+
+	// Retrying the batch doesn't make new deposits
+	retried, err := SyncDeposits(ctx, &SyncDepositsParams{Deposits: batch[:2]})
+	require.NoError(t, err)
+	require.Equal(t, SyncExisting, retried.Results[0].Status)
+	require.Equal(t, resp.Results[0].Deposit.ID, retried.Results[0].Deposit.ID)
+	require.Equal(t, SyncExisting, retried.Results[1].Status)
+
+	all, err := GetAllDeposits(ctx, &GetAllDepositsParams{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(all.Deposits))
+
+	_, err = SyncDeposits(ctx, &SyncDepositsParams{})
+	require.Error(t, err)
+	require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+}
@@ -8,6 +8,8 @@ import (
 
 	"encore.app/admin"
 	"encore.app/commons"
+	"encore.app/commons/idempotency"
+	"encore.app/commons/outbox"
 	"encore.dev/beta/auth"
 	"encore.dev/beta/errs"
 	"encore.dev/storage/sqldb"
@@ -19,6 +21,11 @@ type Voucher struct {
 	OwnerPubKey         string    `json:"ownerPubKey"`
 	Invalidated         bool      `json:"invalidated"`
 	CreatedAt           time.Time `json:"createdAt"`
+	// DepositID, SchemeID and RewardDefinitionIndex tell which deposit and reward paid out the voucher.
+	// They are empty for vouchers that were not minted as a reward, or minted before this was recorded.
+	DepositID             string `json:"depositID"`
+	SchemeID              string `json:"schemeID"`
+	RewardDefinitionIndex *int   `json:"rewardDefinitionIndex"`
 }
 
 // TODO: Test that voucher def gets returned everywhere
@@ -27,12 +34,43 @@ type VoucherResponse struct {
 	VoucherDefinition VoucherDefinition `json:"voucherDefinition"`
 }
 
-func mintVoucher(ctx context.Context, tx *sqldb.Tx, voucherDef *VoucherDefinition, ownerPubKey string) (string, error) {
+// voucherSource is the deposit and reward definition a voucher is paid out for
+type voucherSource struct {
+	DepositID             string
+	SchemeID              string
+	RewardDefinitionIndex int
+}
+
+// mintVoucher mints a voucher to the owner as part of tx. source is nil for vouchers not paid out for a deposit.
+func mintVoucher(ctx context.Context, tx *sqldb.Tx, voucherDef *VoucherDefinition, ownerPubKey string, source *voucherSource) (string, error) {
 	id := commons.GenerateID()
+	var depositID, schemeID string
+	var rewardDefinitionIndex *int
+	if source != nil {
+		depositID = source.DepositID
+		schemeID = source.SchemeID
+		rewardDefinitionIndex = &source.RewardDefinitionIndex
+	}
+
 	if _, err := tx.Exec(ctx, `
-        INSERT INTO voucher (id, voucher_definition_id, owner_pub_key, invalidated)
-        VALUES ($1, $2, $3, $4);
-    `, id, voucherDef.ID, ownerPubKey, false); err != nil {
+        INSERT INTO voucher (id, voucher_definition_id, owner_pub_key, invalidated, deposit_id, scheme_id, reward_definition_index)
+        VALUES ($1, $2, $3, $4, $5, $6, $7);
+    `, id, voucherDef.ID, ownerPubKey, false, depositID, schemeID, rewardDefinitionIndex); err != nil {
+		return "", err
+	}
+
+	if err := countVouchers(ctx, tx, ownerPubKey, 1, 0); err != nil {
+		return "", err
+	}
+
+	if err := outbox.Enqueue(ctx, tx, &VoucherMintedEvent{
+		VoucherID:           id,
+		VoucherDefinitionID: voucherDef.ID,
+		OrganizationID:      voucherDef.OrganizationID,
+		OwnerPubKey:         ownerPubKey,
+		DepositID:           depositID,
+		SchemeID:            schemeID,
+	}); err != nil {
 		return "", err
 	}
 
@@ -50,7 +88,10 @@ func GetVoucher(ctx context.Context, params *GetVoucherParams) (*VoucherResponse
 	}
 
 	var v Voucher
-	if err := sqldb.QueryRow(ctx, "SELECT id, voucher_definition_id, owner_pub_key, invalidated FROM voucher WHERE id=$1", params.VoucherID).Scan(&v.ID, &v.VoucherDefinitionID, &v.OwnerPubKey, &v.Invalidated); err != nil {
+	if err := sqldb.QueryRow(ctx, `
+        SELECT id, voucher_definition_id, owner_pub_key, invalidated, created_at, deposit_id, scheme_id, reward_definition_index
+        FROM voucher WHERE id=$1
+    `, params.VoucherID).Scan(&v.ID, &v.VoucherDefinitionID, &v.OwnerPubKey, &v.Invalidated, &v.CreatedAt, &v.DepositID, &v.SchemeID, &v.RewardDefinitionIndex); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, &errs.Error{
 				Code: errs.NotFound,
@@ -89,11 +130,11 @@ func GetAllVouchers(ctx context.Context, params *GetAllVouchersParams) (*GetAllV
 
 	if params.PubKey == "" {
 		rows, err = sqldb.Query(ctx, `
-			SELECT id, voucher_definition_id, owner_pub_key, invalidated FROM voucher
+			SELECT id, voucher_definition_id, owner_pub_key, invalidated, created_at, deposit_id, scheme_id, reward_definition_index FROM voucher
 		`)
 	} else {
 		rows, err = sqldb.Query(ctx, `
-			SELECT id, voucher_definition_id, owner_pub_key, invalidated FROM voucher WHERE owner_pub_key=$1
+			SELECT id, voucher_definition_id, owner_pub_key, invalidated, created_at, deposit_id, scheme_id, reward_definition_index FROM voucher WHERE owner_pub_key=$1
 		`, params.PubKey)
 	}
 
@@ -104,7 +145,7 @@ func GetAllVouchers(ctx context.Context, params *GetAllVouchersParams) (*GetAllV
 
 	for rows.Next() {
 		var v Voucher
-		if err := rows.Scan(&v.ID, &v.VoucherDefinitionID, &v.OwnerPubKey, &v.Invalidated); err != nil {
+		if err := rows.Scan(&v.ID, &v.VoucherDefinitionID, &v.OwnerPubKey, &v.Invalidated, &v.CreatedAt, &v.DepositID, &v.SchemeID, &v.RewardDefinitionIndex); err != nil {
 			return nil, err
 		}
 
@@ -140,7 +181,8 @@ func GetVouchersForUser(ctx context.Context, params *GetVouchersForUserParams) (
 		Vouchers: []VoucherResponse{},
 	}
 	rows, err := sqldb.Query(ctx, `
-        SELECT id, voucher_definition_id, owner_pub_key, invalidated, created_at FROM voucher WHERE owner_pub_key=$1 ORDER BY created_at DESC
+        SELECT id, voucher_definition_id, owner_pub_key, invalidated, created_at, deposit_id, scheme_id, reward_definition_index
+        FROM voucher WHERE owner_pub_key=$1 ORDER BY created_at DESC
     `, params.UserPubKey)
 	if err != nil {
 		return nil, err
@@ -149,7 +191,7 @@ func GetVouchersForUser(ctx context.Context, params *GetVouchersForUserParams) (
 
 	for rows.Next() {
 		var v Voucher
-		if err := rows.Scan(&v.ID, &v.VoucherDefinitionID, &v.OwnerPubKey, &v.Invalidated, &v.CreatedAt); err != nil {
+		if err := rows.Scan(&v.ID, &v.VoucherDefinitionID, &v.OwnerPubKey, &v.Invalidated, &v.CreatedAt, &v.DepositID, &v.SchemeID, &v.RewardDefinitionIndex); err != nil {
 			return nil, err
 		}
 
@@ -166,8 +208,60 @@ func GetVouchersForUser(ctx context.Context, params *GetVouchersForUserParams) (
 	return resp, rows.Err()
 }
 
+type GetVouchersForDepositParams struct {
+	DepositID string `json:"depositID" validate:"required"`
+}
+
+type GetVouchersForDepositResponse struct {
+	Vouchers []VoucherResponse `json:"vouchers"`
+}
+
+// GetVouchersForDeposit returns the vouchers that were paid out for the deposit, including invalidated ones
+//encore:api public method=POST
+func GetVouchersForDeposit(ctx context.Context, params *GetVouchersForDepositParams) (*GetVouchersForDepositResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	resp := &GetVouchersForDepositResponse{
+		Vouchers: []VoucherResponse{},
+	}
+	rows, err := sqldb.Query(ctx, `
+        SELECT id, voucher_definition_id, owner_pub_key, invalidated, created_at, deposit_id, scheme_id, reward_definition_index
+        FROM voucher WHERE deposit_id=$1 ORDER BY created_at, id
+    `, params.DepositID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	voucherDefs := map[string]*VoucherDefinition{}
+	for rows.Next() {
+		var v Voucher
+		if err := rows.Scan(&v.ID, &v.VoucherDefinitionID, &v.OwnerPubKey, &v.Invalidated, &v.CreatedAt, &v.DepositID, &v.SchemeID, &v.RewardDefinitionIndex); err != nil {
+			return nil, err
+		}
+
+		vd, ok := voucherDefs[v.VoucherDefinitionID]
+		if !ok {
+			if vd, err = GetVoucherDefinition(ctx, &GetVoucherDefinitionParams{VoucherDefinitionID: v.VoucherDefinitionID}); err != nil {
+				return nil, err
+			}
+			voucherDefs[v.VoucherDefinitionID] = vd
+		}
+		resp.Vouchers = append(resp.Vouchers, VoucherResponse{
+			Voucher:           v,
+			VoucherDefinition: *vd,
+		})
+	}
+
+	return resp, rows.Err()
+}
+
 type InvalidateVoucherParams struct {
 	VoucherID string `json:"voucherID" validate:"required"`
+	// IdempotencyKey makes retries safe, see commons/idempotency
+	IdempotencyKey string `header:"Idempotency-Key"`
 }
 
 //encore:api auth method=POST
@@ -176,6 +270,13 @@ func InvalidateVoucher(ctx context.Context, params *InvalidateVoucherParams) err
 		return err
 	}
 
+	_, err := idempotency.Do(ctx, sqldb.Begin, "deposit.InvalidateVoucher", params.IdempotencyKey, params, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, invalidateVoucher(ctx, params)
+	})
+	return err
+}
+
+func invalidateVoucher(ctx context.Context, params *InvalidateVoucherParams) error {
 	voucherRes, err := GetVoucher(ctx, &GetVoucherParams{VoucherID: params.VoucherID})
 	if err != nil {
 		return err
@@ -185,8 +286,54 @@ func InvalidateVoucher(ctx context.Context, params *InvalidateVoucherParams) err
 		return err
 	}
 
-	_, err = sqldb.Exec(ctx, "UPDATE voucher SET invalidated = true WHERE id=$1", voucherRes.Voucher.ID)
-	return err
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The guard makes sure a voucher is only counted as used once, even if it is invalidated concurrently
+	res, err := tx.Exec(ctx, "UPDATE voucher SET invalidated = true WHERE id=$1 AND invalidated = false", voucherRes.Voucher.ID)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "voucher is already invalidated",
+		}
+	}
+
+	if err := countVouchers(ctx, tx, voucherRes.Voucher.OwnerPubKey, -1, 1); err != nil {
+		return err
+	}
+
+	if err := outbox.Enqueue(ctx, tx, &VoucherInvalidatedEvent{
+		VoucherID:           voucherRes.Voucher.ID,
+		VoucherDefinitionID: voucherRes.VoucherDefinition.ID,
+		OrganizationID:      voucherRes.VoucherDefinition.OrganizationID,
+		OwnerPubKey:         voucherRes.Voucher.OwnerPubKey,
+	}); err != nil {
+		return err
+	}
+
+	// The owner invalidating their own voucher is a redemption, anyone else (an admin) is invalidating it
+	eventType := EventTypeVoucherInvalidation
+	if caller, _ := auth.UserID(); string(caller) == voucherRes.Voucher.OwnerPubKey {
+		eventType = EventTypeVoucherRedemption
+	}
+	if err := recordActivity(ctx, tx, activity{
+		UserPubKey:          voucherRes.Voucher.OwnerPubKey,
+		EventType:           eventType,
+		VoucherID:           voucherRes.Voucher.ID,
+		VoucherDefinitionID: voucherRes.VoucherDefinition.ID,
+		UnitNameOut:         voucherRes.VoucherDefinition.Name,
+		NumberOfUnitsOut:    1,
+	}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func authorizeCallerForVoucher(ctx context.Context, voucher *Voucher) error {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encore.app/commons"
+	"encore.app/commons/idempotency"
 	"encore.app/organization"
 	"encore.dev/beta/errs"
 	"encore.dev/storage/sqldb"
@@ -21,6 +22,8 @@ type CreateVoucherDefinitionParams struct {
 	OrganizationID string `json:"organizationID" validate:"required"`
 	Name           string `json:"name" validate:"required"`
 	PictureURL     string `json:"pictureURL" validate:"required"`
+	// IdempotencyKey makes retries safe, see commons/idempotency
+	IdempotencyKey string `header:"Idempotency-Key"`
 }
 
 //encore:api auth method=POST
@@ -29,6 +32,12 @@ func CreateVoucherDefinition(ctx context.Context, params *CreateVoucherDefinitio
 		return nil, err
 	}
 
+	return idempotency.Do(ctx, sqldb.Begin, "deposit.CreateVoucherDefinition", params.IdempotencyKey, params, func(ctx context.Context) (*VoucherDefinition, error) {
+		return createVoucherDefinition(ctx, params)
+	})
+}
+
+func createVoucherDefinition(ctx context.Context, params *CreateVoucherDefinitionParams) (*VoucherDefinition, error) {
 	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: params.OrganizationID}); err != nil {
 		return nil, err
 	}
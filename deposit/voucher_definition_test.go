@@ -189,3 +189,51 @@ func TestEditVoucherDefinition(t *testing.T) {
 	require.Equal(t, newName, vdAfterEdit.Name)
 	require.Equal(t, newPictureURL, vdAfterEdit.PictureURL)
 }
+
+func TestCreateVoucherDefinitionWithIdempotencyKey(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	testutils.ClearAllDBs()
+	require.NoError(t, admin.InsertTestData(context.Background()))
+
+	orgSigningPubKey, _ := testutils.GenerateKeys()
+	orgEncryptionPubKey, _ := testutils.GenerateKeys()
+	_, err := organization.CreateOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &organization.CreateOrgParams{
+		ID:               testOrganizationId,
+		Name:             testOrganizationId,
+		SigningPubKey:    orgSigningPubKey,
+		EncryptionPubKey: orgEncryptionPubKey,
+	})
+	require.NoError(t, err)
+
+	params := &CreateVoucherDefinitionParams{
+		OrganizationID: testOrganizationId,
+		Name:           "Voucher def name",
+		PictureURL:     "https://does.not.matter.com",
+		IdempotencyKey: "create-1",
+	}
+	ctx := testutils.GetAuthenticatedContext(orgSigningPubKey)
+	first, err := CreateVoucherDefinition(ctx, params)
+	require.NoError(t, err)
+
+	retry, err := CreateVoucherDefinition(ctx, params)
+	require.NoError(t, err)
+	require.Equal(t, first, retry)
+
+	// Keys are per caller, so an admin using the same key makes a new voucher definition
+	admins, err := CreateVoucherDefinition(testutils.GetAuthenticatedContext(testutils.AdminPubKey), params)
+	require.NoError(t, err)
+	require.NotEqual(t, first.ID, admins.ID)
+
+	all, err := GetAllVoucherDefinitions(ctx, &GetAllVoucherDefinitionsParams{OrganizationID: testOrganizationId})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(all.VoucherDefinitions))
+
+	_, err = CreateVoucherDefinition(ctx, &CreateVoucherDefinitionParams{
+		OrganizationID: testOrganizationId,
+		Name:           "Another name",
+		PictureURL:     "https://does.not.matter.com",
+		IdempotencyKey: "create-1",
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+}
@@ -39,7 +39,7 @@ func TestGetAllVouchers(t *testing.T) {
 	for i := 0; i < numberOfVouchers; i++ {
 		pubKey, _ := testutils.GenerateKeys()
 
-		_, err := mintVoucher(testutils.GetAuthenticatedContext(testutils.AdminPubKey), tx, voucherDefinition, pubKey)
+		_, err := mintVoucher(testutils.GetAuthenticatedContext(testutils.AdminPubKey), tx, voucherDefinition, pubKey, nil)
 		require.NoError(t, err)
 	}
 	require.NoError(t, tx.Commit())
@@ -84,12 +84,12 @@ func TestGetAllVouchersForUser(t *testing.T) {
 	tx, err := depositDB.Begin(context.Background())
 	require.NoError(t, err)
 	for i := 0; i < numberOfVouchersForUser; i++ {
-		_, err := mintVoucher(testutils.GetAuthenticatedContext(testutils.AdminPubKey), tx, voucherDefinition, userPubKey)
+		_, err := mintVoucher(testutils.GetAuthenticatedContext(testutils.AdminPubKey), tx, voucherDefinition, userPubKey, nil)
 		require.NoError(t, err)
 	}
 
 	for i := 0; i < numberOfVouchersForOtherUser; i++ {
-		_, err := mintVoucher(testutils.GetAuthenticatedContext(testutils.AdminPubKey), tx, voucherDefinition, otherUserPubKey)
+		_, err := mintVoucher(testutils.GetAuthenticatedContext(testutils.AdminPubKey), tx, voucherDefinition, otherUserPubKey, nil)
 		require.NoError(t, err)
 	}
 	require.NoError(t, tx.Commit())
@@ -185,7 +185,7 @@ func TestInvalidateVoucher(t *testing.T) {
 
 			tx, err := depositDB.Begin(context.Background())
 			require.NoError(t, err)
-			mintedVoucherId, err := mintVoucher(testutils.GetAuthenticatedContext(testutils.AdminPubKey), tx, voucherDefinition, ownerPubKey)
+			mintedVoucherId, err := mintVoucher(testutils.GetAuthenticatedContext(testutils.AdminPubKey), tx, voucherDefinition, ownerPubKey, nil)
 			require.NoError(t, err)
 			require.NoError(t, tx.Commit())
 
@@ -215,3 +215,96 @@ func TestInvalidateVoucher(t *testing.T) {
 		})
 	}
 }
+
+func TestInvalidateVoucherTwice(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	testScheme, _, collectionPointPubKey := setupTestScheme(t)
+	_, err := MakeDeposit(testutils.GetAuthenticatedContext(collectionPointPubKey), &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		MassBalanceDeposits: defaultTestDeposit,
+		UserPubKey:          testUserPubKey,
+	})
+	require.NoError(t, err)
+
+	ctx := testutils.GetAuthenticatedContext(testUserPubKey)
+	vouchers, err := GetVouchersForUser(ctx, &GetVouchersForUserParams{UserPubKey: testUserPubKey})
+	require.NoError(t, err)
+	voucherID := vouchers.Vouchers[0].Voucher.ID
+	require.NoError(t, InvalidateVoucher(ctx, &InvalidateVoucherParams{VoucherID: voucherID}))
+
+	stats, err := GetUserStats(context.Background(), &GetUserStatsParams{UserPubKey: testUserPubKey})
+	require.NoError(t, err)
+	history, err := GetHistory(ctx, &GetHistoryParams{UserPubKey: testUserPubKey})
+	require.NoError(t, err)
+
+	for _, caller := range []string{testUserPubKey, testutils.AdminPubKey} {
+		err = InvalidateVoucher(testutils.GetAuthenticatedContext(caller), &InvalidateVoucherParams{VoucherID: voucherID})
+		require.Error(t, err)
+		require.Equal(t, errs.FailedPrecondition, err.(*errs.Error).Code)
+	}
+
+	// Nothing is counted or recorded again
+	statsAfter, err := GetUserStats(context.Background(), &GetUserStatsParams{UserPubKey: testUserPubKey})
+	require.NoError(t, err)
+	require.Equal(t, stats.AvailableVouchers, statsAfter.AvailableVouchers)
+	require.Equal(t, stats.UsedVouchers, statsAfter.UsedVouchers)
+	historyAfter, err := GetHistory(ctx, &GetHistoryParams{UserPubKey: testUserPubKey})
+	require.NoError(t, err)
+	require.Equal(t, len(history.Events), len(historyAfter.Events))
+}
+
+func TestGetVouchersForDeposit(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	testutils.ClearAllDBs()
+	require.NoError(t, admin.InsertTestData(context.Background()))
+
+	testScheme, _, collectionPointPubKey := setupTestScheme(t)
+	ctx := testutils.GetAuthenticatedContext(collectionPointPubKey)
+
+	deposit, err := MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		UserPubKey:          testUserPubKey,
+		MassBalanceDeposits: defaultTestDeposit,
+	})
+	require.NoError(t, err)
+
+	otherDeposit, err := MakeDeposit(ctx, &MakeDepositParams{
+		SchemeID:            testScheme.ID,
+		UserPubKey:          testUserPubKey,
+		MassBalanceDeposits: defaultTestDeposit,
+	})
+	require.NoError(t, err)
+
+	vouchers, err := GetVouchersForDeposit(ctx, &GetVouchersForDepositParams{DepositID: deposit.ID})
+	require.NoError(t, err)
+	require.Equal(t, int(defaultTestDeposit[0].Amount), len(vouchers.Vouchers))
+	for _, v := range vouchers.Vouchers {
+		require.Equal(t, deposit.ID, v.Voucher.DepositID)
+		require.Equal(t, testScheme.ID, v.Voucher.SchemeID)
+		require.NotNil(t, v.Voucher.RewardDefinitionIndex)
+		require.Equal(t, 0, *v.Voucher.RewardDefinitionIndex)
+		require.Equal(t, testUserPubKey, v.Voucher.OwnerPubKey)
+		require.Equal(t, defaultTestRewards.RewardTypeID, v.VoucherDefinition.ID)
+
+		single, err := GetVoucher(ctx, &GetVoucherParams{VoucherID: v.Voucher.ID})
+		require.NoError(t, err)
+		require.Equal(t, v.Voucher, single.Voucher)
+	}
+
+	otherVouchers, err := GetVouchersForDeposit(ctx, &GetVouchersForDepositParams{DepositID: otherDeposit.ID})
+	require.NoError(t, err)
+	require.Equal(t, int(defaultTestDeposit[0].Amount), len(otherVouchers.Vouchers))
+	require.Equal(t, otherDeposit.ID, otherVouchers.Vouchers[0].Voucher.DepositID)
+
+	noVouchers, err := GetVouchersForDeposit(ctx, &GetVouchersForDepositParams{DepositID: "does not exist"})
+	require.NoError(t, err)
+	require.NotNil(t, noVouchers.Vouchers)
+	require.Equal(t, 0, len(noVouchers.Vouchers))
+
+	_, err = GetVouchersForDeposit(ctx, &GetVouchersForDepositParams{})
+	require.Error(t, err)
+	require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+}
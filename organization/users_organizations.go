@@ -4,6 +4,8 @@ import (
 	"context"
 
 	"encore.app/commons"
+	"encore.app/commons/ecies"
+	"encore.dev/beta/errs"
 	"encore.dev/storage/sqldb"
 )
 
@@ -48,9 +50,11 @@ func GetUsersFromOrganization(ctx context.Context, params *GetUsersFromOrganizat
 }
 
 type PostUserToOrganizationParams struct {
-	OrganizationPubKey string `json:"organization_pub_key"`
-	UserPubKey         string `json:"user_pub_key"`
-	UserInformation    string `json:"content"`
+	OrganizationPubKey string `json:"organization_pub_key" validate:"required"`
+	UserPubKey         string `json:"user_pub_key" validate:"required"`
+	// UserInformation must be an ecies envelope addressed to the organization's EncryptionPubKey,
+	// see commons/encryption.md
+	UserInformation string `json:"content" validate:"required"`
 }
 
 type UserPosted struct {
@@ -59,6 +63,18 @@ type UserPosted struct {
 
 //encore:api public method=POST
 func PostUserToOrganization(ctx context.Context, params *PostUserToOrganizationParams) (*UserPosted, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	org, err := GetOrganization(ctx, &GetOrganizationParams{ID: params.OrganizationPubKey})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateUserInformation(params.UserInformation, org); err != nil {
+		return nil, err
+	}
 
 	registerID := commons.GenerateID()
 	organizationPubKey := params.OrganizationPubKey
@@ -104,3 +120,19 @@ func PostUserToOrganization(ctx context.Context, params *PostUserToOrganizationP
 		return &UserPosted{Successful: "post"}, nil
 	}
 }
+
+func validateUserInformation(content string, org *Organization) error {
+	envelope, err := ecies.Parse(content)
+	if err != nil {
+		return errs.WrapCode(err, errs.InvalidArgument, "content must be an encrypted envelope")
+	}
+
+	if !envelope.IsAddressedTo(org.EncryptionPubKey) {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "content is not encrypted for the current encryption key of the organization",
+		}
+	}
+
+	return nil
+}
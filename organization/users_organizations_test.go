@@ -6,7 +6,9 @@ import (
 	"testing"
 
 	"encore.app/admin"
+	"encore.app/commons/ecies"
 	"encore.app/commons/testutils"
+	"encore.dev/beta/errs"
 	"github.com/stretchr/testify/require"
 )
 
@@ -23,7 +25,7 @@ func TestGetUsersFromOrganization(t *testing.T) {
 	require.Equal(t, len(users.Users), 0)
 
 	signingPubKey, _ := testutils.GenerateKeys()
-	encryptionPubKey, _ := testutils.GenerateKeys()
+	encryptionPubKey, encryptionPrivKey := testutils.GenerateKeys()
 
 	_, err = CreateOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &CreateOrgParams{
 		ID:               "000",
@@ -38,7 +40,10 @@ func TestGetUsersFromOrganization(t *testing.T) {
 
 	require.Equal(t, len(users.Users), 0)
 
-	createUser, err := PostUserToOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &PostUserToOrganizationParams{OrganizationPubKey: "000", UserPubKey: "user", UserInformation: "content"})
+	content, err := ecies.Encrypt(encryptionPubKey, []byte("content"))
+	require.NoError(t, err)
+
+	createUser, err := PostUserToOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &PostUserToOrganizationParams{OrganizationPubKey: "000", UserPubKey: "user", UserInformation: content})
 	require.NoError(t, err)
 	require.Equal(t, createUser.Successful, "post")
 
@@ -48,7 +53,11 @@ func TestGetUsersFromOrganization(t *testing.T) {
 	require.Equal(t, newUser.OrganizationId, "000")
 	require.Equal(t, len(newUser.Users), 1)
 	require.Equal(t, newUser.Users[0].UserId, "user")
-	require.Equal(t, newUser.Users[0].Content, "content")
+	require.Equal(t, newUser.Users[0].Content, content)
+
+	decrypted, err := ecies.Decrypt(encryptionPrivKey, newUser.Users[0].Content)
+	require.NoError(t, err)
+	require.Equal(t, "content", string(decrypted))
 }
 
 func TestPostUserToOrganization(t *testing.T) {
@@ -59,9 +68,11 @@ func TestPostUserToOrganization(t *testing.T) {
 	require.NoError(t, admin.InsertTestData(context.Background()))
 	testutils.ClearAllDBs()
 
+	var encryptionPubKeys []string
 	for i := 0; i < numberOfOrgs; i++ {
 		signingPubKey, _ := testutils.GenerateKeys()
 		encryptionPubKey, _ := testutils.GenerateKeys()
+		encryptionPubKeys = append(encryptionPubKeys, encryptionPubKey)
 
 		_, err := CreateOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &CreateOrgParams{
 			ID:               strconv.Itoa(i),
@@ -86,7 +97,10 @@ func TestPostUserToOrganization(t *testing.T) {
 
 	require.Equal(t, len(users.Users), 0)
 
-	newUser, err := PostUserToOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &PostUserToOrganizationParams{OrganizationPubKey: "1", UserPubKey: "a", UserInformation: "content"})
+	content, err := ecies.Encrypt(encryptionPubKeys[1], []byte("content"))
+	require.NoError(t, err)
+
+	newUser, err := PostUserToOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &PostUserToOrganizationParams{OrganizationPubKey: "1", UserPubKey: "a", UserInformation: content})
 	require.NoError(t, err)
 
 	require.Equal(t, newUser.Successful, "post")
@@ -95,7 +109,10 @@ func TestPostUserToOrganization(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, len(getUser.Users), 1)
 
-	updateUser, err := PostUserToOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &PostUserToOrganizationParams{OrganizationPubKey: "1", UserPubKey: "a", UserInformation: "updated content"})
+	updatedContent, err := ecies.Encrypt(encryptionPubKeys[1], []byte("updated content"))
+	require.NoError(t, err)
+
+	updateUser, err := PostUserToOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &PostUserToOrganizationParams{OrganizationPubKey: "1", UserPubKey: "a", UserInformation: updatedContent})
 	require.NoError(t, err)
 
 	require.Equal(t, updateUser.Successful, "update")
@@ -104,3 +121,84 @@ func TestPostUserToOrganization(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, len(getUser.Users), 1)
 }
+
+func TestPostUserToOrganizationContentValidation(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	signingPubKey, _ := testutils.GenerateKeys()
+	encryptionPubKey, _ := testutils.GenerateKeys()
+	otherPubKey, _ := testutils.GenerateKeys()
+
+	_, err := CreateOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &CreateOrgParams{
+		ID:               "000",
+		Name:             "name",
+		SigningPubKey:    signingPubKey,
+		EncryptionPubKey: encryptionPubKey,
+	})
+	require.NoError(t, err)
+
+	validContent, err := ecies.Encrypt(encryptionPubKey, []byte("content"))
+	require.NoError(t, err)
+	contentForOtherKey, err := ecies.Encrypt(otherPubKey, []byte("content"))
+	require.NoError(t, err)
+
+	testTable := []struct {
+		name           string
+		organizationID string
+		content        string
+		errorCode      errs.ErrCode
+	}{
+		{
+			name:           "Happy path",
+			organizationID: "000",
+			content:        validContent,
+			errorCode:      errs.OK,
+		},
+		{
+			name:           "Plaintext content",
+			organizationID: "000",
+			content:        "content",
+			errorCode:      errs.InvalidArgument,
+		},
+		{
+			name:           "Encrypted for another key",
+			organizationID: "000",
+			content:        contentForOtherKey,
+			errorCode:      errs.InvalidArgument,
+		},
+		{
+			name:           "Organization not found",
+			organizationID: "does not exist",
+			content:        validContent,
+			errorCode:      errs.NotFound,
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			require.NoError(t, testutils.ClearDB(organizationDB, "user_organization"))
+
+			_, err := PostUserToOrganization(testutils.GetAuthenticatedContext(""), &PostUserToOrganizationParams{
+				OrganizationPubKey: test.organizationID,
+				UserPubKey:         "user",
+				UserInformation:    test.content,
+			})
+			if test.errorCode == errs.OK {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				require.Equal(t, test.errorCode, err.(*errs.Error).Code)
+			}
+
+			users, err := GetUsersFromOrganization(testutils.GetAuthenticatedContext(""), &GetUsersFromOrganizationParams{OrganizationId: test.organizationID})
+			require.NoError(t, err)
+			if test.errorCode == errs.OK {
+				require.Equal(t, 1, len(users.Users))
+			} else {
+				require.Equal(t, 0, len(users.Users))
+			}
+		})
+	}
+}
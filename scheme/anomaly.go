@@ -0,0 +1,122 @@
+package scheme
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/organization"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+// AnomalyRules decide which deposits look suspicious and are held for review instead of being claimed right away.
+// Every rule is off while its fields are zero, so the zero value flags nothing.
+type AnomalyRules struct {
+	// RepeatedAmountCount flags a deposit when the collection point made this many deposits with the exact same items
+	// (including this one) within RepeatedAmountWindowMinutes
+	RepeatedAmountCount         int `json:"repeatedAmountCount" validate:"min=0"`
+	RepeatedAmountWindowMinutes int `json:"repeatedAmountWindowMinutes" validate:"required_with=RepeatedAmountCount,min=0"`
+	// OpeningHours flags deposits captured while the collection points are closed
+	OpeningHours *OpeningHours `json:"openingHours"`
+	// VolumeFactor flags a deposit when its total amount is more than this many times the collection point's average
+	// deposit over the last VolumeHistoryDays
+	VolumeFactor      float64 `json:"volumeFactor" validate:"min=0"`
+	VolumeHistoryDays int     `json:"volumeHistoryDays" validate:"required_with=VolumeFactor,min=0"`
+	// MaxCollectionPointsPerUser flags a deposit when the user has deposited at more than this many different
+	// collection points within CollectionPointsWindowHours. Collection points have no location, so this counts
+	// collection points rather than measuring the distance between them.
+	MaxCollectionPointsPerUser  int `json:"maxCollectionPointsPerUser" validate:"min=0"`
+	CollectionPointsWindowHours int `json:"collectionPointsWindowHours" validate:"required_with=MaxCollectionPointsPerUser,min=0"`
+}
+
+type OpeningHours struct {
+	// Open and Close are HH:MM in TimeZone. Close before Open means the collection points are open past midnight.
+	Open     string `json:"open" validate:"required,datetime=15:04"`
+	Close    string `json:"close" validate:"required,datetime=15:04"`
+	TimeZone string `json:"timeZone" validate:"required,timezone"`
+}
+
+// IsOpenAt tells if t is within the opening hours
+func (h OpeningHours) IsOpenAt(t time.Time) bool {
+	loc, err := time.LoadLocation(h.TimeZone)
+	if err != nil {
+		// Validated when the scheme is saved
+		loc = time.UTC
+	}
+	open, err := time.Parse("15:04", h.Open)
+	if err != nil {
+		return true
+	}
+	closing, err := time.Parse("15:04", h.Close)
+	if err != nil {
+		return true
+	}
+
+	local := t.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	openMinute := open.Hour()*60 + open.Minute()
+	closeMinute := closing.Hour()*60 + closing.Minute()
+
+	if openMinute <= closeMinute {
+		return minute >= openMinute && minute < closeMinute
+	}
+
+	return minute >= openMinute || minute < closeMinute
+}
+
+type GetAnomalyRulesParams struct {
+	SchemeID string `json:"schemeID" validate:"required"`
+}
+
+// GetSchemeAnomalyRules returns the anomaly rules of a scheme to its organization.
+// They are not in GetScheme, which is public, so depositors can't keep their deposits just under them.
+//encore:api auth method=POST
+func GetSchemeAnomalyRules(ctx context.Context, params *GetAnomalyRulesParams) (*AnomalyRules, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	s, err := GetScheme(ctx, &GetSchemeParams{SchemeID: params.SchemeID})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: s.OrganizationID}); err != nil {
+		return nil, err
+	}
+
+	return getAnomalyRules(ctx, s.ID)
+}
+
+// GetAnomalyRules returns the anomaly rules of a scheme, for the deposit service
+//encore:api private method=POST
+func GetAnomalyRules(ctx context.Context, params *GetAnomalyRulesParams) (*AnomalyRules, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	return getAnomalyRules(ctx, params.SchemeID)
+}
+
+func getAnomalyRules(ctx context.Context, schemeID string) (*AnomalyRules, error) {
+	var anomalyRulesJson string
+	if err := sqldb.QueryRow(ctx, "SELECT anomaly_rules FROM scheme WHERE id=$1", schemeID).Scan(&anomalyRulesJson); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &errs.Error{
+				Code: errs.NotFound,
+			}
+		}
+		return nil, err
+	}
+
+	var rules AnomalyRules
+	if err := json.Unmarshal([]byte(anomalyRulesJson), &rules); err != nil {
+		return nil, err
+	}
+
+	return &rules, nil
+}
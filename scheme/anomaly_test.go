@@ -0,0 +1,78 @@
+package scheme
+
+import (
+	"testing"
+	"time"
+
+	"encore.app/commons"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsOpenAt(t *testing.T) {
+	daytime := OpeningHours{Open: "08:00", Close: "17:30", TimeZone: "Africa/Lagos"}
+	overnight := OpeningHours{Open: "22:00", Close: "06:00", TimeZone: "UTC"}
+
+	testTable := []struct {
+		name     string
+		hours    OpeningHours
+		at       time.Time
+		expected bool
+	}{
+		// Lagos is UTC+1
+		{name: "Before opening", hours: daytime, at: time.Date(2022, 8, 10, 6, 59, 0, 0, time.UTC), expected: false},
+		{name: "At opening", hours: daytime, at: time.Date(2022, 8, 10, 7, 0, 0, 0, time.UTC), expected: true},
+		{name: "Before closing", hours: daytime, at: time.Date(2022, 8, 10, 16, 29, 0, 0, time.UTC), expected: true},
+		{name: "At closing", hours: daytime, at: time.Date(2022, 8, 10, 16, 30, 0, 0, time.UTC), expected: false},
+		{name: "Overnight, late", hours: overnight, at: time.Date(2022, 8, 10, 23, 0, 0, 0, time.UTC), expected: true},
+		{name: "Overnight, early", hours: overnight, at: time.Date(2022, 8, 10, 5, 59, 0, 0, time.UTC), expected: true},
+		{name: "Overnight, daytime", hours: overnight, at: time.Date(2022, 8, 10, 12, 0, 0, 0, time.UTC), expected: false},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.expected, test.hours.IsOpenAt(test.at))
+		})
+	}
+}
+
+func TestValidateAnomalyRules(t *testing.T) {
+	testTable := []struct {
+		name      string
+		rules     AnomalyRules
+		errorCode errs.ErrCode
+	}{
+		{name: "Zero value", rules: AnomalyRules{}, errorCode: errs.OK},
+		{name: "Repeated amount", rules: AnomalyRules{RepeatedAmountCount: 3, RepeatedAmountWindowMinutes: 10}, errorCode: errs.OK},
+		{name: "Repeated amount without window", rules: AnomalyRules{RepeatedAmountCount: 3}, errorCode: errs.InvalidArgument},
+		{name: "Volume without history", rules: AnomalyRules{VolumeFactor: 5}, errorCode: errs.InvalidArgument},
+		{name: "Collection points without window", rules: AnomalyRules{MaxCollectionPointsPerUser: 3}, errorCode: errs.InvalidArgument},
+		{
+			name:      "Opening hours",
+			rules:     AnomalyRules{OpeningHours: &OpeningHours{Open: "08:00", Close: "17:00", TimeZone: "Europe/Oslo"}},
+			errorCode: errs.OK,
+		},
+		{
+			name:      "Invalid opening time",
+			rules:     AnomalyRules{OpeningHours: &OpeningHours{Open: "8am", Close: "17:00", TimeZone: "Europe/Oslo"}},
+			errorCode: errs.InvalidArgument,
+		},
+		{
+			name:      "Invalid time zone",
+			rules:     AnomalyRules{OpeningHours: &OpeningHours{Open: "08:00", Close: "17:00", TimeZone: "Mars/Olympus"}},
+			errorCode: errs.InvalidArgument,
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			err := commons.Validate(&test.rules)
+			if test.errorCode == errs.OK {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Equal(t, test.errorCode, err.(*errs.Error).Code)
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package scheme
+
+import "encore.app/commons"
+
+// ApprovalPolicy decides which deposits must be approved by the organization before they can be claimed.
+// The zero value approves every deposit automatically.
+type ApprovalPolicy struct {
+	// AmountThreshold requires approval for deposits with an item above this amount, 0 means no threshold
+	AmountThreshold float64 `json:"amountThreshold" validate:"min=0"`
+	// Materials requires approval for deposits with any of these items, regardless of amount
+	Materials []commons.ItemDefinition `json:"materials"`
+}
+
+func (p ApprovalPolicy) RequiresApproval(items []commons.MassBalance) bool {
+	for _, item := range items {
+		if p.AmountThreshold > 0 && item.Amount > p.AmountThreshold {
+			return true
+		}
+
+		for _, material := range p.Materials {
+			if material.SameAs(item.ItemDefinition) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
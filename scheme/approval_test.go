@@ -0,0 +1,63 @@
+package scheme
+
+import (
+	"testing"
+
+	"encore.app/commons"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequiresApproval(t *testing.T) {
+	pet := commons.ItemDefinition{
+		MaterialDefinition: map[string]string{"materialType": "PET"},
+		Magnitude:          commons.Weight,
+	}
+	ldpe := commons.ItemDefinition{
+		MaterialDefinition: map[string]string{"materialType": "LDPE"},
+		Magnitude:          commons.Weight,
+	}
+
+	testTable := []struct {
+		name     string
+		policy   ApprovalPolicy
+		items    []commons.MassBalance
+		expected bool
+	}{
+		{
+			name:     "No policy",
+			policy:   ApprovalPolicy{},
+			items:    []commons.MassBalance{{ItemDefinition: pet, Amount: 1000}},
+			expected: false,
+		},
+		{
+			name:     "Below threshold",
+			policy:   ApprovalPolicy{AmountThreshold: 50},
+			items:    []commons.MassBalance{{ItemDefinition: pet, Amount: 50}},
+			expected: false,
+		},
+		{
+			name:     "Above threshold",
+			policy:   ApprovalPolicy{AmountThreshold: 50},
+			items:    []commons.MassBalance{{ItemDefinition: pet, Amount: 10}, {ItemDefinition: ldpe, Amount: 50.5}},
+			expected: true,
+		},
+		{
+			name:     "Material needs approval",
+			policy:   ApprovalPolicy{Materials: []commons.ItemDefinition{ldpe}},
+			items:    []commons.MassBalance{{ItemDefinition: pet, Amount: 10}, {ItemDefinition: ldpe, Amount: 1}},
+			expected: true,
+		},
+		{
+			name:     "Other material",
+			policy:   ApprovalPolicy{Materials: []commons.ItemDefinition{ldpe}},
+			items:    []commons.MassBalance{{ItemDefinition: pet, Amount: 10}},
+			expected: false,
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.expected, test.policy.RequiresApproval(test.items))
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package scheme
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"encore.app/commons/outbox"
+	"encore.dev/cron"
+	"encore.dev/pubsub"
+	"encore.dev/storage/sqldb"
+)
+
+const (
+	EventTypeSchemeChanged        = "SchemeChanged"
+	EventTypeCollectionPointAdded = "CollectionPointAdded"
+)
+
+const (
+	SchemeCreated = "CREATED"
+	SchemeEdited  = "EDITED"
+)
+
+type SchemeChangedEvent struct {
+	outbox.Metadata
+	SchemeID       string `json:"schemeID"`
+	OrganizationID string `json:"organizationID"`
+	Change         string `json:"change"`
+	Scheme         Scheme `json:"scheme"`
+}
+
+func (*SchemeChangedEvent) EventType() string { return EventTypeSchemeChanged }
+
+type CollectionPointAddedEvent struct {
+	outbox.Metadata
+	SchemeID              string `json:"schemeID"`
+	OrganizationID        string `json:"organizationID"`
+	CollectionPointPubKey string `json:"collectionPointPubKey"`
+}
+
+func (*CollectionPointAddedEvent) EventType() string { return EventTypeCollectionPointAdded }
+
+var SchemeChanged = pubsub.NewTopic[*SchemeChangedEvent]("scheme-changed", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var CollectionPointAdded = pubsub.NewTopic[*CollectionPointAddedEvent]("collection-point-added", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var _ = cron.NewJob("relay-scheme-outbox", cron.JobConfig{
+	Title:    "Publish scheme events from the outbox",
+	Every:    1 * cron.Minute,
+	Endpoint: RelayOutbox,
+})
+
+type RelayOutboxResponse struct {
+	Published int `json:"published"`
+	Failed    int `json:"failed"`
+	// DeadLettered events failed too often and will not be tried again
+	DeadLettered int `json:"deadLettered"`
+}
+
+//encore:api private method=POST
+func RelayOutbox(ctx context.Context) (*RelayOutboxResponse, error) {
+	result, err := outbox.Relay(ctx, sqldb.Begin, publishEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RelayOutboxResponse{Published: result.Published, Failed: result.Failed, DeadLettered: result.DeadLettered}, nil
+}
+
+func publishEvent(ctx context.Context, eventType string, payload []byte) (err error) {
+	switch eventType {
+	case EventTypeSchemeChanged:
+		var e SchemeChangedEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return err
+		}
+		_, err = SchemeChanged.Publish(ctx, &e)
+	case EventTypeCollectionPointAdded:
+		var e CollectionPointAddedEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return err
+		}
+		_, err = CollectionPointAdded.Publish(ctx, &e)
+	default:
+		return fmt.Errorf("unknown event type %q in outbox", eventType)
+	}
+
+	return err
+}
@@ -0,0 +1,77 @@
+package scheme
+
+import (
+	"context"
+	"testing"
+
+	"encore.app/admin"
+	"encore.app/commons/testutils"
+	"encore.app/organization"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventsAreStoredInOutbox(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	testutils.ClearAllDBs()
+	require.NoError(t, admin.InsertTestData(context.Background()))
+
+	orgSigningPubKey, _ := testutils.GenerateKeys()
+	orgEncryptionPubKey, _ := testutils.GenerateKeys()
+	_, err := organization.CreateOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &organization.CreateOrgParams{
+		ID:               testOrganizationId,
+		Name:             testOrganizationId,
+		SigningPubKey:    orgSigningPubKey,
+		EncryptionPubKey: orgEncryptionPubKey,
+	})
+	require.NoError(t, err)
+
+	ctx := testutils.GetAuthenticatedContext(orgSigningPubKey)
+	scheme, err := CreateScheme(ctx, &CreateSchemeParams{
+		Name:              "SchemeName",
+		OrganizationID:    testOrganizationId,
+		RewardDefinitions: defaultTestRewards,
+	})
+	require.NoError(t, err)
+
+	collectionPointPubKey, _ := testutils.GenerateKeys()
+	require.NoError(t, AddCollectionPoint(ctx, &AddCollectionPointParams{
+		SchemeID:              scheme.ID,
+		CollectionPointPubKey: collectionPointPubKey,
+	}))
+
+	require.NoError(t, EditScheme(ctx, &EditSchemeParams{
+		SchemeID:          scheme.ID,
+		RewardDefinitions: defaultTestRewards,
+		CollectionPoints:  []string{},
+	}))
+
+	// Failed calls leave no events behind
+	notOrganizationPubKey, _ := testutils.GenerateKeys()
+	require.Error(t, AddCollectionPoint(testutils.GetAuthenticatedContext(notOrganizationPubKey), &AddCollectionPointParams{
+		SchemeID:              scheme.ID,
+		CollectionPointPubKey: collectionPointPubKey,
+	}))
+
+	var changes []string
+	rows, err := schemeDB.Query(context.Background(), "SELECT payload->>'change' FROM outbox WHERE event_type=$1 ORDER BY created_at", EventTypeSchemeChanged)
+	require.NoError(t, err)
+	for rows.Next() {
+		var change string
+		require.NoError(t, rows.Scan(&change))
+		changes = append(changes, change)
+	}
+	rows.Close()
+	require.Equal(t, []string{SchemeCreated, SchemeEdited}, changes)
+
+	var addedCollectionPoint string
+	require.NoError(t, schemeDB.QueryRow(context.Background(), "SELECT payload->>'collectionPointPubKey' FROM outbox WHERE event_type=$1", EventTypeCollectionPointAdded).Scan(&addedCollectionPoint))
+	require.Equal(t, collectionPointPubKey, addedCollectionPoint)
+
+	resp, err := RelayOutbox(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 3, resp.Published)
+
+	resp, err = RelayOutbox(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, resp.Published)
+}
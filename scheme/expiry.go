@@ -0,0 +1,41 @@
+package scheme
+
+import "time"
+
+// Destinations for the rewards of deposits that expired unclaimed
+const (
+	// ExpiryForfeit drops the rewards
+	ExpiryForfeit = "FORFEIT"
+	// ExpiryDonate pays the rewards out to the community pool
+	ExpiryDonate = "DONATE"
+	// ExpiryReturn returns the rewards to the organization's budget, nothing is paid out
+	ExpiryReturn = "RETURN"
+)
+
+// ExpiryPolicy decides when unclaimed deposits expire, and where their rewards go.
+// The zero value never expires deposits.
+type ExpiryPolicy struct {
+	// ClaimPeriodDays is how long a deposit can be claimed after it was captured, 0 means forever
+	ClaimPeriodDays int    `json:"claimPeriodDays" validate:"min=0"`
+	Destination     string `json:"destination" validate:"omitempty,oneof=FORFEIT DONATE RETURN"`
+	// CommunityPoolPubKey receives the rewards when the destination is DONATE
+	CommunityPoolPubKey string `json:"communityPoolPubKey" validate:"required_if=Destination DONATE"`
+}
+
+// ClaimDeadline is when a deposit captured at capturedAt expires. It is false if deposits never expire.
+func (p ExpiryPolicy) ClaimDeadline(capturedAt time.Time) (time.Time, bool) {
+	if p.ClaimPeriodDays == 0 {
+		return time.Time{}, false
+	}
+
+	return capturedAt.AddDate(0, 0, p.ClaimPeriodDays), true
+}
+
+// ExpiryDestination is where expired rewards go, FORFEIT unless set
+func (p ExpiryPolicy) ExpiryDestination() string {
+	if p.Destination == "" {
+		return ExpiryForfeit
+	}
+
+	return p.Destination
+}
@@ -0,0 +1,51 @@
+package scheme
+
+import (
+	"testing"
+	"time"
+
+	"encore.app/commons"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimDeadline(t *testing.T) {
+	capturedAt := time.Date(2022, 8, 10, 9, 15, 0, 0, time.UTC)
+
+	_, expires := ExpiryPolicy{}.ClaimDeadline(capturedAt)
+	require.False(t, expires)
+
+	deadline, expires := ExpiryPolicy{ClaimPeriodDays: 30}.ClaimDeadline(capturedAt)
+	require.True(t, expires)
+	require.Equal(t, time.Date(2022, 9, 9, 9, 15, 0, 0, time.UTC), deadline)
+
+	require.Equal(t, ExpiryForfeit, ExpiryPolicy{ClaimPeriodDays: 30}.ExpiryDestination())
+	require.Equal(t, ExpiryReturn, ExpiryPolicy{ClaimPeriodDays: 30, Destination: ExpiryReturn}.ExpiryDestination())
+}
+
+func TestValidateExpiryPolicy(t *testing.T) {
+	testTable := []struct {
+		name      string
+		policy    ExpiryPolicy
+		errorCode errs.ErrCode
+	}{
+		{name: "Zero value", policy: ExpiryPolicy{}, errorCode: errs.OK},
+		{name: "Forfeit", policy: ExpiryPolicy{ClaimPeriodDays: 30, Destination: ExpiryForfeit}, errorCode: errs.OK},
+		{name: "Donate", policy: ExpiryPolicy{ClaimPeriodDays: 30, Destination: ExpiryDonate, CommunityPoolPubKey: "pool"}, errorCode: errs.OK},
+		{name: "Donate without pool", policy: ExpiryPolicy{ClaimPeriodDays: 30, Destination: ExpiryDonate}, errorCode: errs.InvalidArgument},
+		{name: "Unknown destination", policy: ExpiryPolicy{ClaimPeriodDays: 30, Destination: "BURN"}, errorCode: errs.InvalidArgument},
+		{name: "Negative period", policy: ExpiryPolicy{ClaimPeriodDays: -1}, errorCode: errs.InvalidArgument},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			err := commons.Validate(&test.policy)
+			if test.errorCode == errs.OK {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Equal(t, test.errorCode, err.(*errs.Error).Code)
+		})
+	}
+}
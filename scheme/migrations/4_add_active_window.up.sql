@@ -0,0 +1,3 @@
+ALTER TABLE scheme
+ADD COLUMN active_from  TIMESTAMP,
+ADD COLUMN active_until TIMESTAMP;
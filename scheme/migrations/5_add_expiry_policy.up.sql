@@ -0,0 +1,2 @@
+ALTER TABLE scheme
+ADD COLUMN expiry_policy JSON NOT NULL DEFAULT '{}';
@@ -0,0 +1,2 @@
+ALTER TABLE scheme
+ADD COLUMN anomaly_rules JSON NOT NULL DEFAULT '{}';
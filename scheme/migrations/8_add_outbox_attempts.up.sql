@@ -0,0 +1,9 @@
+ALTER TABLE outbox
+ADD COLUMN attempts         INT  NOT NULL DEFAULT 0,
+ADD COLUMN last_error       TEXT NOT NULL DEFAULT '',
+ADD COLUMN claimed_until    TIMESTAMP,
+ADD COLUMN dead_lettered_at TIMESTAMP;
+
+DROP INDEX outbox_unpublished_index;
+CREATE INDEX outbox_unpublished_index
+ON outbox (created_at) WHERE published_at IS NULL AND dead_lettered_at IS NULL;
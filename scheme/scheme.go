@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"encoding/json"
 	"encore.app/commons"
+	"encore.app/commons/idempotency"
+	"encore.app/commons/outbox"
 	"encore.app/organization"
 	"encore.dev/beta/errs"
 	"encore.dev/storage/sqldb"
@@ -19,12 +21,38 @@ type Scheme struct {
 	CollectionPoints  []string                   `json:"collectionPoints"`
 	RewardDefinitions []commons.RewardDefinition `json:"rewardDefinitions"`
 	OrganizationID    string                     `json:"organizationID"`
+	ApprovalPolicy    ApprovalPolicy             `json:"approvalPolicy"`
+	ExpiryPolicy      ExpiryPolicy               `json:"expiryPolicy"`
+	// The anomaly rules are left out, so depositors can't see what is flagged. See GetSchemeAnomalyRules.
+	// ActiveFrom and ActiveUntil is the window the scheme runs in, nil means no limit
+	ActiveFrom  *time.Time `json:"activeFrom"`
+	ActiveUntil *time.Time `json:"activeUntil"`
+}
+
+// IsActiveAt tells if t is within the scheme's active window
+func (s *Scheme) IsActiveAt(t time.Time) bool {
+	if s.ActiveFrom != nil && t.Before(*s.ActiveFrom) {
+		return false
+	}
+
+	if s.ActiveUntil != nil && t.After(*s.ActiveUntil) {
+		return false
+	}
+
+	return true
 }
 
 type CreateSchemeParams struct {
 	Name              string                     `json:"name" validate:"required"`
 	OrganizationID    string                     `json:"organizationID" validate:"required"`
 	RewardDefinitions []commons.RewardDefinition `json:"rewardDefinitions" validate:"required"`
+	ApprovalPolicy    ApprovalPolicy             `json:"approvalPolicy"`
+	ExpiryPolicy      ExpiryPolicy               `json:"expiryPolicy"`
+	AnomalyRules      AnomalyRules               `json:"anomalyRules"`
+	ActiveFrom        *time.Time                 `json:"activeFrom"`
+	ActiveUntil       *time.Time                 `json:"activeUntil"`
+	// IdempotencyKey makes retries safe, see commons/idempotency
+	IdempotencyKey string `header:"Idempotency-Key"`
 }
 
 //encore:api auth method=POST
@@ -33,6 +61,16 @@ func CreateScheme(ctx context.Context, params *CreateSchemeParams) (*Scheme, err
 		return nil, err
 	}
 
+	return idempotency.Do(ctx, sqldb.Begin, "scheme.CreateScheme", params.IdempotencyKey, params, func(ctx context.Context) (*Scheme, error) {
+		return createScheme(ctx, params)
+	})
+}
+
+func createScheme(ctx context.Context, params *CreateSchemeParams) (*Scheme, error) {
+	if err := validateActiveWindow(params.ActiveFrom, params.ActiveUntil); err != nil {
+		return nil, err
+	}
+
 	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: params.OrganizationID}); err != nil {
 		return nil, err
 	}
@@ -42,14 +80,59 @@ func CreateScheme(ctx context.Context, params *CreateSchemeParams) (*Scheme, err
 		return nil, err
 	}
 
+	approvalPolicyJson, err := json.Marshal(params.ApprovalPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	expiryPolicyJson, err := json.Marshal(params.ExpiryPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	anomalyRulesJson, err := json.Marshal(params.AnomalyRules)
+	if err != nil {
+		return nil, err
+	}
+
 	id := commons.GenerateID()
-	_, err = sqldb.Exec(ctx, `
-        INSERT INTO scheme (id, organization_id, name, reward_definitions)
-        VALUES ($1, $2, $3, $4);
-    `, id, params.OrganizationID, params.Name, string(jsonb))
+
+	tx, err := sqldb.Begin(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(ctx, `
+        INSERT INTO scheme (id, organization_id, name, reward_definitions, approval_policy, expiry_policy, anomaly_rules, active_from, active_until)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);
+    `, id, params.OrganizationID, params.Name, string(jsonb), string(approvalPolicyJson), string(expiryPolicyJson), string(anomalyRulesJson), utc(params.ActiveFrom), utc(params.ActiveUntil))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := outbox.Enqueue(ctx, tx, &SchemeChangedEvent{
+		SchemeID:       id,
+		OrganizationID: params.OrganizationID,
+		Change:         SchemeCreated,
+		Scheme: Scheme{
+			ID:                id,
+			Name:              params.Name,
+			CollectionPoints:  []string{},
+			RewardDefinitions: params.RewardDefinitions,
+			OrganizationID:    params.OrganizationID,
+			ApprovalPolicy:    params.ApprovalPolicy,
+			ExpiryPolicy:      params.ExpiryPolicy,
+			ActiveFrom:        params.ActiveFrom,
+			ActiveUntil:       params.ActiveUntil,
+		},
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
 
 	return GetScheme(ctx, &GetSchemeParams{
 		SchemeID: id,
@@ -60,6 +143,17 @@ type EditSchemeParams struct {
 	SchemeID          string                     `json:"schemeID" validate:"required"`
 	RewardDefinitions []commons.RewardDefinition `json:"rewardDefinitions" validate:"required"`
 	CollectionPoints  []string                   `json:"collectionPoints" validate:"required"`
+	// ApprovalPolicy replaces the scheme's approval policy. Left out, the policy is kept.
+	ApprovalPolicy *ApprovalPolicy `json:"approvalPolicy"`
+	// ExpiryPolicy replaces the scheme's expiry policy. Left out, the policy is kept.
+	ExpiryPolicy *ExpiryPolicy `json:"expiryPolicy"`
+	// AnomalyRules replaces the scheme's anomaly rules. Left out, the rules are kept.
+	AnomalyRules *AnomalyRules `json:"anomalyRules"`
+	// ActiveFrom and ActiveUntil replace the limits of the scheme's active window, the ones left out are kept
+	ActiveFrom  *time.Time `json:"activeFrom"`
+	ActiveUntil *time.Time `json:"activeUntil"`
+	// ClearActiveWindow removes the limits of the active window that are not set in the edit
+	ClearActiveWindow bool `json:"clearActiveWindow"`
 }
 
 //encore:api auth method=PUT
@@ -81,21 +175,108 @@ func EditScheme(ctx context.Context, params *EditSchemeParams) error {
 
 	scheme.RewardDefinitions = params.RewardDefinitions
 	scheme.CollectionPoints = params.CollectionPoints
+	if params.ApprovalPolicy != nil {
+		scheme.ApprovalPolicy = *params.ApprovalPolicy
+	}
+	if params.ExpiryPolicy != nil {
+		scheme.ExpiryPolicy = *params.ExpiryPolicy
+	}
+	if params.ActiveFrom != nil || params.ClearActiveWindow {
+		scheme.ActiveFrom = params.ActiveFrom
+	}
+	if params.ActiveUntil != nil || params.ClearActiveWindow {
+		scheme.ActiveUntil = params.ActiveUntil
+	}
+	if err := validateActiveWindow(scheme.ActiveFrom, scheme.ActiveUntil); err != nil {
+		return err
+	}
 
 	jsonb, err := json.Marshal(scheme.RewardDefinitions)
 	if err != nil {
 		return err
 	}
 
-	_, err = sqldb.Exec(ctx, `
+	approvalPolicyJson, err := optionalJSON(params.ApprovalPolicy)
+	if err != nil {
+		return err
+	}
+
+	expiryPolicyJson, err := optionalJSON(params.ExpiryPolicy)
+	if err != nil {
+		return err
+	}
+
+	anomalyRulesJson, err := optionalJSON(params.AnomalyRules)
+	if err != nil {
+		return err
+	}
+
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(ctx, `
         UPDATE scheme
-		SET reward_definitions = $2, collection_points = $3
+		SET reward_definitions = $2, collection_points = $3, approval_policy = COALESCE($4, approval_policy), expiry_policy = COALESCE($5, expiry_policy), anomaly_rules = COALESCE($6, anomaly_rules),
+		    active_from = CASE WHEN $9 OR $7::timestamp IS NOT NULL THEN $7 ELSE active_from END,
+		    active_until = CASE WHEN $9 OR $8::timestamp IS NOT NULL THEN $8 ELSE active_until END
 		WHERE id=$1
-    `, scheme.ID, string(jsonb), scheme.CollectionPoints)
+    `, scheme.ID, string(jsonb), scheme.CollectionPoints, approvalPolicyJson, expiryPolicyJson, anomalyRulesJson,
+		utc(params.ActiveFrom), utc(params.ActiveUntil), params.ClearActiveWindow)
+	if err != nil {
+		return err
+	}
+
+	if err := outbox.Enqueue(ctx, tx, &SchemeChangedEvent{
+		SchemeID:       scheme.ID,
+		OrganizationID: scheme.OrganizationID,
+		Change:         SchemeEdited,
+		Scheme:         *scheme,
+	}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func validateActiveWindow(from *time.Time, until *time.Time) error {
+	if from != nil && until != nil && !until.After(*from) {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "activeUntil must be after activeFrom",
+		}
+	}
 
 	return nil
 }
 
+// optionalJSON encodes fields that are only updated when they are set, nil (NULL) leaves the column as is
+func optionalJSON[T any](v *T) (*string, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	s := string(b)
+	return &s, nil
+}
+
+// utc stores times as UTC, since the columns are without time zone
+func utc(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	u := t.UTC()
+	return &u
+}
+
 type GetSchemeParams struct {
 	SchemeID string `json:"schemeID"`
 }
@@ -107,8 +288,13 @@ func GetScheme(ctx context.Context, params *GetSchemeParams) (*Scheme, error) {
 	}
 
 	var s Scheme
-	var rewardDefinitionsJson string
-	if err := sqldb.QueryRow(ctx, "SELECT * FROM scheme WHERE id=$1", params.SchemeID).Scan(&s.ID, &s.OrganizationID, &s.Name, &s.CollectionPoints, &rewardDefinitionsJson, &s.CreatedAt); err != nil {
+	var rewardDefinitionsJson, approvalPolicyJson, expiryPolicyJson string
+	if err := sqldb.QueryRow(ctx, `
+        SELECT id, organization_id, name, collection_points, reward_definitions, created_at, approval_policy, expiry_policy,
+               active_from, active_until
+        FROM scheme WHERE id=$1
+    `, params.SchemeID).Scan(&s.ID, &s.OrganizationID, &s.Name, &s.CollectionPoints, &rewardDefinitionsJson, &s.CreatedAt, &approvalPolicyJson, &expiryPolicyJson,
+		&s.ActiveFrom, &s.ActiveUntil); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, &errs.Error{
 				Code: errs.NotFound,
@@ -121,6 +307,14 @@ func GetScheme(ctx context.Context, params *GetSchemeParams) (*Scheme, error) {
 		return nil, err
 	}
 
+	if err := json.Unmarshal([]byte(approvalPolicyJson), &s.ApprovalPolicy); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(expiryPolicyJson), &s.ExpiryPolicy); err != nil {
+		return nil, err
+	}
+
 	return &s, nil
 }
 
@@ -139,9 +333,9 @@ func GetAllSchemes(ctx context.Context, params *GetAllSchemesParams) (resp *GetA
 
 	var rows *sqldb.Rows
 	if params.OrganizationID == "" {
-		rows, err = sqldb.Query(ctx, `SELECT id, name FROM scheme`)
+		rows, err = sqldb.Query(ctx, `SELECT id, name, organization_id FROM scheme`)
 	} else {
-		rows, err = sqldb.Query(ctx, `SELECT id, name FROM scheme WHERE organization_id=$1`, params.OrganizationID)
+		rows, err = sqldb.Query(ctx, `SELECT id, name, organization_id FROM scheme WHERE organization_id=$1`, params.OrganizationID)
 	}
 	if err != nil {
 		return nil, err
@@ -150,7 +344,7 @@ func GetAllSchemes(ctx context.Context, params *GetAllSchemesParams) (resp *GetA
 
 	for rows.Next() {
 		var s Scheme
-		if err := rows.Scan(&s.ID, &s.Name); err != nil {
+		if err := rows.Scan(&s.ID, &s.Name, &s.OrganizationID); err != nil {
 			return nil, err
 		}
 		resp.Schemes = append(resp.Schemes, s)
@@ -179,6 +373,23 @@ func AddCollectionPoint(ctx context.Context, params *AddCollectionPointParams) e
 		return err
 	}
 
-	_, err = sqldb.Exec(ctx, "UPDATE scheme SET collection_points = array_append(collection_points, $1) WHERE id=$2", params.CollectionPointPubKey, s.ID)
-	return err
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(ctx, "UPDATE scheme SET collection_points = array_append(collection_points, $1) WHERE id=$2", params.CollectionPointPubKey, s.ID); err != nil {
+		return err
+	}
+
+	if err := outbox.Enqueue(ctx, tx, &CollectionPointAddedEvent{
+		SchemeID:              s.ID,
+		OrganizationID:        s.OrganizationID,
+		CollectionPointPubKey: params.CollectionPointPubKey,
+	}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
@@ -3,6 +3,7 @@ package scheme
 import (
 	"context"
 	"testing"
+	"time"
 
 	"encore.app/admin"
 	"encore.app/commons"
@@ -284,3 +285,158 @@ func TestEditScheme(t *testing.T) {
 	require.Equal(t, collectionPoint1, dbScheme.CollectionPoints[0])
 	require.Equal(t, collectionPoint2, dbScheme.CollectionPoints[1])
 }
+
+func TestEditSchemeKeepsPoliciesLeftOut(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	testutils.ClearAllDBs()
+	require.NoError(t, admin.InsertTestData(context.Background()))
+
+	orgSigningPubKey, _ := testutils.GenerateKeys()
+	notOrganizationPubKey, _ := testutils.GenerateKeys()
+	orgEncryptionPubKey, _ := testutils.GenerateKeys()
+	_, err := organization.CreateOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &organization.CreateOrgParams{
+		ID:               testOrganizationId,
+		Name:             testOrganizationId,
+		SigningPubKey:    orgSigningPubKey,
+		EncryptionPubKey: orgEncryptionPubKey,
+	})
+	require.NoError(t, err)
+	ctx := testutils.GetAuthenticatedContext(orgSigningPubKey)
+
+	approvalPolicy := ApprovalPolicy{AmountThreshold: 10}
+	expiryPolicy := ExpiryPolicy{ClaimPeriodDays: 30, Destination: ExpiryForfeit}
+	anomalyRules := AnomalyRules{VolumeFactor: 5, VolumeHistoryDays: 30}
+	activeFrom := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+	activeUntil := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	scheme, err := CreateScheme(ctx, &CreateSchemeParams{
+		Name:              "SchemeName",
+		OrganizationID:    testOrganizationId,
+		RewardDefinitions: defaultTestRewards,
+		ApprovalPolicy:    approvalPolicy,
+		ExpiryPolicy:      expiryPolicy,
+		AnomalyRules:      anomalyRules,
+		ActiveFrom:        &activeFrom,
+		ActiveUntil:       &activeUntil,
+	})
+	require.NoError(t, err)
+
+	// An edit from a client that doesn't know about the policies
+	require.NoError(t, EditScheme(ctx, &EditSchemeParams{
+		SchemeID:          scheme.ID,
+		RewardDefinitions: defaultTestRewards,
+		CollectionPoints:  []string{},
+	}))
+	dbScheme, err := GetScheme(ctx, &GetSchemeParams{SchemeID: scheme.ID})
+	require.NoError(t, err)
+	require.Equal(t, approvalPolicy, dbScheme.ApprovalPolicy)
+	require.Equal(t, expiryPolicy, dbScheme.ExpiryPolicy)
+	rules, err := GetSchemeAnomalyRules(ctx, &GetAnomalyRulesParams{SchemeID: scheme.ID})
+	require.NoError(t, err)
+	require.Equal(t, anomalyRules, *rules)
+
+	// The rules are only shown to the organization
+	_, err = GetSchemeAnomalyRules(testutils.GetAuthenticatedContext(notOrganizationPubKey), &GetAnomalyRulesParams{SchemeID: scheme.ID})
+	require.Error(t, err)
+	require.Equal(t, errs.PermissionDenied, err.(*errs.Error).Code)
+	require.True(t, activeFrom.Equal(*dbScheme.ActiveFrom))
+	require.True(t, activeUntil.Equal(*dbScheme.ActiveUntil))
+
+	// The window is checked with the limits that are kept
+	beforeFrom := activeFrom.Add(-time.Hour)
+	err = EditScheme(ctx, &EditSchemeParams{
+		SchemeID:          scheme.ID,
+		RewardDefinitions: defaultTestRewards,
+		CollectionPoints:  []string{},
+		ActiveUntil:       &beforeFrom,
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+
+	// Policies are removed by setting them empty
+	require.NoError(t, EditScheme(ctx, &EditSchemeParams{
+		SchemeID:          scheme.ID,
+		RewardDefinitions: defaultTestRewards,
+		CollectionPoints:  []string{},
+		ApprovalPolicy:    &ApprovalPolicy{},
+		ExpiryPolicy:      &ExpiryPolicy{},
+		AnomalyRules:      &AnomalyRules{},
+		ActiveFrom:        &activeFrom,
+		ClearActiveWindow: true,
+	}))
+	dbScheme, err = GetScheme(ctx, &GetSchemeParams{SchemeID: scheme.ID})
+	require.NoError(t, err)
+	require.Equal(t, ApprovalPolicy{}, dbScheme.ApprovalPolicy)
+	require.Equal(t, ExpiryPolicy{}, dbScheme.ExpiryPolicy)
+	rules, err = GetSchemeAnomalyRules(ctx, &GetAnomalyRulesParams{SchemeID: scheme.ID})
+	require.NoError(t, err)
+	require.Equal(t, AnomalyRules{}, *rules)
+	require.True(t, activeFrom.Equal(*dbScheme.ActiveFrom))
+	require.Nil(t, dbScheme.ActiveUntil)
+}
+
+func TestIsActiveAt(t *testing.T) {
+	from := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	testTable := []struct {
+		name     string
+		scheme   Scheme
+		at       time.Time
+		expected bool
+	}{
+		{name: "No window", scheme: Scheme{}, at: from.Add(-time.Hour), expected: true},
+		{name: "Before from", scheme: Scheme{ActiveFrom: &from}, at: from.Add(-time.Second), expected: false},
+		{name: "At from", scheme: Scheme{ActiveFrom: &from}, at: from, expected: true},
+		{name: "Within", scheme: Scheme{ActiveFrom: &from, ActiveUntil: &until}, at: from.Add(24 * time.Hour), expected: true},
+		{name: "After until", scheme: Scheme{ActiveFrom: &from, ActiveUntil: &until}, at: until.Add(time.Second), expected: false},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.expected, test.scheme.IsActiveAt(test.at))
+		})
+	}
+}
+
+func TestCreateSchemeWithIdempotencyKey(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	testutils.ClearAllDBs()
+	require.NoError(t, admin.InsertTestData(context.Background()))
+
+	orgSigningPubKey, _ := testutils.GenerateKeys()
+	orgEncryptionPubKey, _ := testutils.GenerateKeys()
+	_, err := organization.CreateOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &organization.CreateOrgParams{
+		ID:               testOrganizationId,
+		Name:             testOrganizationId,
+		SigningPubKey:    orgSigningPubKey,
+		EncryptionPubKey: orgEncryptionPubKey,
+	})
+	require.NoError(t, err)
+
+	ctx := testutils.GetAuthenticatedContext(orgSigningPubKey)
+	params := &CreateSchemeParams{
+		Name:              "Valid",
+		OrganizationID:    testOrganizationId,
+		RewardDefinitions: defaultTestRewards,
+		IdempotencyKey:    "scheme-1",
+	}
+	first, err := CreateScheme(ctx, params)
+	require.NoError(t, err)
+
+	retry, err := CreateScheme(ctx, params)
+	require.NoError(t, err)
+	require.Equal(t, first.ID, retry.ID)
+
+	all, err := GetAllSchemes(ctx, &GetAllSchemesParams{OrganizationID: testOrganizationId})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(all.Schemes))
+
+	_, err = CreateScheme(ctx, &CreateSchemeParams{
+		Name:              "Renamed",
+		OrganizationID:    testOrganizationId,
+		RewardDefinitions: defaultTestRewards,
+		IdempotencyKey:    "scheme-1",
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+}
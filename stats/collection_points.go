@@ -0,0 +1,145 @@
+package stats
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/deposit"
+	"encore.app/organization"
+	"encore.app/scheme"
+)
+
+// What the collection point report can be ranked by
+const (
+	RankByWeight      = "WEIGHT"
+	RankByDeposits    = "DEPOSITS"
+	RankByUniqueUsers = "UNIQUE_USERS"
+)
+
+type GetCollectionPointReportParams struct {
+	SchemeID string `json:"schemeID" validate:"required"`
+	// From and To limit the report to deposits captured in this period, nil means no limit
+	From *time.Time `json:"from"`
+	To   *time.Time `json:"to"`
+	// RankBy defaults to WEIGHT
+	RankBy string `json:"rankBy" validate:"omitempty,oneof=WEIGHT DEPOSITS UNIQUE_USERS"`
+}
+
+type CollectionPointReport struct {
+	// Rank starts at 1, and collection points that tie have the same rank
+	Rank                  int    `json:"rank"`
+	CollectionPointPubKey string `json:"collectionPointPubKey"`
+	Deposits              int    `json:"deposits"`
+	UniqueUsers           int    `json:"uniqueUsers"`
+	// Weight is the total of the items measured by weight, in kg
+	Weight float64 `json:"weight"`
+	// AverageWeight is the weight per deposit, in kg
+	AverageWeight float64 `json:"averageWeight"`
+	// UnclaimedShare is the share of deposits not claimed by a user, between 0 and 1
+	UnclaimedShare float64 `json:"unclaimedShare"`
+}
+
+type GetCollectionPointReportResponse struct {
+	RankBy string `json:"rankBy"`
+	// CollectionPoints has every collection point in the scheme, in order of rank
+	CollectionPoints []CollectionPointReport `json:"collectionPoints"`
+}
+
+// GetCollectionPointReport compares the collection points of a scheme, as a ranked leaderboard.
+// Only approved deposits are counted, and reversed deposits are left out.
+//encore:api auth method=POST
+func GetCollectionPointReport(ctx context.Context, params *GetCollectionPointReportParams) (*GetCollectionPointReportResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	s, err := scheme.GetScheme(ctx, &scheme.GetSchemeParams{SchemeID: params.SchemeID})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: s.OrganizationID}); err != nil {
+		return nil, err
+	}
+
+	stats, err := deposit.GetCollectionPointStats(ctx, &deposit.GetCollectionPointStatsParams{
+		SchemeID: params.SchemeID,
+		From:     params.From,
+		To:       params.To,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	byCollectionPoint := map[string]deposit.CollectionPointStats{}
+	for _, cp := range stats.CollectionPoints {
+		byCollectionPoint[cp.CollectionPointPubKey] = cp
+	}
+
+	rankBy := params.RankBy
+	if rankBy == "" {
+		rankBy = RankByWeight
+	}
+	resp := &GetCollectionPointReportResponse{RankBy: rankBy, CollectionPoints: []CollectionPointReport{}}
+
+	// Collection points that were removed from the scheme since are still in the report
+	collectionPoints := append([]string{}, s.CollectionPoints...)
+	for _, cp := range stats.CollectionPoints {
+		if !containsString(s.CollectionPoints, cp.CollectionPointPubKey) {
+			collectionPoints = append(collectionPoints, cp.CollectionPointPubKey)
+		}
+	}
+
+	for _, pubKey := range collectionPoints {
+		cp := byCollectionPoint[pubKey]
+		report := CollectionPointReport{
+			CollectionPointPubKey: pubKey,
+			Deposits:              cp.Deposits,
+			UniqueUsers:           cp.UniqueUsers,
+			Weight:                cp.Weight,
+		}
+		if cp.Deposits > 0 {
+			report.AverageWeight = cp.Weight / float64(cp.Deposits)
+			report.UnclaimedShare = float64(cp.Unclaimed) / float64(cp.Deposits)
+		}
+		resp.CollectionPoints = append(resp.CollectionPoints, report)
+	}
+
+	score := func(r CollectionPointReport) float64 {
+		switch rankBy {
+		case RankByDeposits:
+			return float64(r.Deposits)
+		case RankByUniqueUsers:
+			return float64(r.UniqueUsers)
+		default:
+			return r.Weight
+		}
+	}
+	sort.SliceStable(resp.CollectionPoints, func(i, j int) bool {
+		a, b := resp.CollectionPoints[i], resp.CollectionPoints[j]
+		if score(a) != score(b) {
+			return score(a) > score(b)
+		}
+		return a.CollectionPointPubKey < b.CollectionPointPubKey
+	})
+	for i := range resp.CollectionPoints {
+		resp.CollectionPoints[i].Rank = i + 1
+		if i > 0 && score(resp.CollectionPoints[i]) == score(resp.CollectionPoints[i-1]) {
+			resp.CollectionPoints[i].Rank = resp.CollectionPoints[i-1].Rank
+		}
+	}
+
+	return resp, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
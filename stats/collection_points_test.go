@@ -0,0 +1,139 @@
+package stats
+
+import (
+	"context"
+	"testing"
+
+	"encore.app/admin"
+	"encore.app/commons"
+	"encore.app/commons/testutils"
+	"encore.app/deposit"
+	"encore.app/organization"
+	"encore.app/scheme"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/require"
+)
+
+// setupReportScheme creates a scheme with rewards by weight and by count, and the given number of collection points
+func setupReportScheme(t *testing.T, collectionPoints int) (schemeID string, orgSigningPubKey string, collectionPointPubKeys []string, weightRewards commons.RewardDefinition, countRewards commons.RewardDefinition) {
+	orgSigningPubKey, _ = testutils.GenerateKeys()
+	orgEncryptionPubKey, _ := testutils.GenerateKeys()
+	_, err := organization.CreateOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &organization.CreateOrgParams{
+		ID:               testOrganizationId,
+		Name:             testOrganizationId,
+		SigningPubKey:    orgSigningPubKey,
+		EncryptionPubKey: orgEncryptionPubKey,
+	})
+	require.NoError(t, err)
+
+	definition, err := deposit.CreateVoucherDefinition(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &deposit.CreateVoucherDefinitionParams{
+		OrganizationID: testOrganizationId,
+		Name:           "Voucher def name",
+		PictureURL:     "https://does.not.matter.com",
+	})
+	require.NoError(t, err)
+
+	weightRewards = defaultTestRewardsMagnitude0
+	weightRewards.RewardTypeID = definition.ID
+	countRewards = defaultTestRewardsMagnitude1
+	countRewards.RewardTypeID = definition.ID
+
+	testScheme, err := scheme.CreateScheme(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &scheme.CreateSchemeParams{
+		Name:              "TestScheme",
+		RewardDefinitions: []commons.RewardDefinition{weightRewards, countRewards},
+		OrganizationID:    testOrganizationId,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < collectionPoints; i++ {
+		cp, _ := testutils.GenerateKeys()
+		require.NoError(t, scheme.AddCollectionPoint(testutils.GetAuthenticatedContext(orgSigningPubKey), &scheme.AddCollectionPointParams{
+			SchemeID:              testScheme.ID,
+			CollectionPointPubKey: cp,
+		}))
+		collectionPointPubKeys = append(collectionPointPubKeys, cp)
+	}
+
+	return testScheme.ID, orgSigningPubKey, collectionPointPubKeys, weightRewards, countRewards
+}
+
+func TestGetCollectionPointReport(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	schemeID, orgSigningPubKey, cps, weightRewards, countRewards := setupReportScheme(t, 3)
+
+	user1, _ := testutils.GenerateKeys()
+	user2, _ := testutils.GenerateKeys()
+	deposits := []struct {
+		collectionPoint string
+		user            string
+		items           []commons.MassBalance
+	}{
+		{cps[0], user1, []commons.MassBalance{{ItemDefinition: weightRewards.ItemDefinition, Amount: 10}}},
+		{cps[1], user1, []commons.MassBalance{{ItemDefinition: weightRewards.ItemDefinition, Amount: 2}, {ItemDefinition: countRewards.ItemDefinition, Amount: 3}}},
+		{cps[1], user2, []commons.MassBalance{{ItemDefinition: weightRewards.ItemDefinition, Amount: 4}}},
+		{cps[1], "", []commons.MassBalance{{ItemDefinition: weightRewards.ItemDefinition, Amount: 1}}},
+	}
+	for _, d := range deposits {
+		_, err := deposit.MakeDeposit(testutils.GetAuthenticatedContext(d.collectionPoint), &deposit.MakeDepositParams{
+			SchemeID:            schemeID,
+			UserPubKey:          d.user,
+			MassBalanceDeposits: d.items,
+		})
+		require.NoError(t, err)
+	}
+
+	testTable := []struct {
+		name   string
+		rankBy string
+		order  []string
+		ranks  []int
+	}{
+		{
+			name:  "Weight by default",
+			order: []string{cps[0], cps[1], cps[2]},
+			ranks: []int{1, 2, 3},
+		},
+		{
+			name:   "Deposits",
+			rankBy: RankByDeposits,
+			order:  []string{cps[1], cps[0], cps[2]},
+			ranks:  []int{1, 2, 3},
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			report, err := GetCollectionPointReport(testutils.GetAuthenticatedContext(orgSigningPubKey), &GetCollectionPointReportParams{
+				SchemeID: schemeID,
+				RankBy:   test.rankBy,
+			})
+			require.NoError(t, err)
+			require.Equal(t, 3, len(report.CollectionPoints))
+			for i, cp := range report.CollectionPoints {
+				require.Equal(t, test.order[i], cp.CollectionPointPubKey)
+				require.Equal(t, test.ranks[i], cp.Rank)
+			}
+		})
+	}
+
+	report, err := GetCollectionPointReport(testutils.GetAuthenticatedContext(orgSigningPubKey), &GetCollectionPointReportParams{SchemeID: schemeID})
+	require.NoError(t, err)
+	require.Equal(t, RankByWeight, report.RankBy)
+	require.Equal(t, CollectionPointReport{
+		Rank:                  2,
+		CollectionPointPubKey: cps[1],
+		Deposits:              3,
+		UniqueUsers:           2,
+		Weight:                7,
+		AverageWeight:         7.0 / 3.0,
+		UnclaimedShare:        1.0 / 3.0,
+	}, report.CollectionPoints[1])
+	require.Equal(t, CollectionPointReport{Rank: 3, CollectionPointPubKey: cps[2]}, report.CollectionPoints[2])
+
+	_, err = GetCollectionPointReport(testutils.GetAuthenticatedContext(cps[0]), &GetCollectionPointReportParams{SchemeID: schemeID})
+	require.Error(t, err)
+	require.Equal(t, errs.PermissionDenied, err.(*errs.Error).Code)
+}
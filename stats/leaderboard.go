@@ -0,0 +1,100 @@
+package stats
+
+import (
+	"context"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/deposit"
+	"encore.dev/beta/auth"
+)
+
+const (
+	defaultLeaderboardSize = 10
+	maxLeaderboardSize     = 100
+)
+
+type SetLeaderboardOptInParams struct {
+	OptIn bool `json:"optIn"`
+}
+
+type SetLeaderboardOptInResponse struct {
+	OptIn bool `json:"optIn"`
+	// Pseudonym is what the caller is shown as on the leaderboard, empty when they opted out
+	Pseudonym string `json:"pseudonym"`
+}
+
+// SetLeaderboardOptIn adds the caller to the public leaderboard, or takes them off it.
+// The caller gets a random pseudonym when they opt in, and a new one if they opt in again after opting out.
+//encore:api auth method=POST
+func SetLeaderboardOptIn(ctx context.Context, params *SetLeaderboardOptInParams) (*SetLeaderboardOptInResponse, error) {
+	caller, _ := auth.UserID()
+
+	resp, err := deposit.UpdateLeaderboardOptIn(ctx, &deposit.UpdateLeaderboardOptInParams{
+		UserPubKey: string(caller),
+		OptIn:      params.OptIn,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SetLeaderboardOptInResponse{OptIn: params.OptIn, Pseudonym: resp.Pseudonym}, nil
+}
+
+type GetLeaderboardParams struct {
+	// SchemeID limits the leaderboard to one scheme, empty means all schemes
+	SchemeID string `json:"schemeID"`
+	// From and To limit the leaderboard to deposits captured in this period, nil means no limit
+	From *time.Time `json:"from"`
+	To   *time.Time `json:"to"`
+	// Limit is the number of depositors, 10 by default and at most 100
+	Limit int `json:"limit" validate:"min=0,max=100"`
+}
+
+type LeaderboardEntry struct {
+	Rank      int    `json:"rank"`
+	Pseudonym string `json:"pseudonym"`
+	Deposits  int    `json:"deposits"`
+	// Weight is the total of the items measured by weight, in kg
+	Weight float64 `json:"weight"`
+}
+
+type Leaderboard struct {
+	Depositors []LeaderboardEntry `json:"depositors"`
+}
+
+// GetLeaderboard ranks the users that opted in by the weight of their claimed deposits.
+// Users are shown by a random pseudonym, so their pub key is not made public.
+//encore:api public method=POST
+func GetLeaderboard(ctx context.Context, params *GetLeaderboardParams) (*Leaderboard, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	limit := params.Limit
+	if limit == 0 {
+		limit = defaultLeaderboardSize
+	}
+
+	top, err := deposit.GetTopDepositors(ctx, &deposit.GetTopDepositorsParams{
+		SchemeID: params.SchemeID,
+		From:     params.From,
+		To:       params.To,
+		Limit:    limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &Leaderboard{Depositors: []LeaderboardEntry{}}
+	for i, d := range top.Depositors {
+		resp.Depositors = append(resp.Depositors, LeaderboardEntry{
+			Rank:      i + 1,
+			Pseudonym: d.Pseudonym,
+			Deposits:  d.Deposits,
+			Weight:    d.Weight,
+		})
+	}
+
+	return resp, nil
+}
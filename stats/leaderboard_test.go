@@ -0,0 +1,76 @@
+package stats
+
+import (
+	"context"
+	"testing"
+
+	"encore.app/admin"
+	"encore.app/commons"
+	"encore.app/commons/testutils"
+	"encore.app/deposit"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetLeaderboard(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	schemeID, _, cps, weightRewards, _ := setupReportScheme(t, 1)
+
+	user1, _ := testutils.GenerateKeys()
+	user2, _ := testutils.GenerateKeys()
+	user3, _ := testutils.GenerateKeys()
+	for _, d := range []struct {
+		user   string
+		amount float64
+	}{
+		{user1, 5},
+		{user2, 8},
+		{user3, 20},
+		{user1, 5},
+	} {
+		_, err := deposit.MakeDeposit(testutils.GetAuthenticatedContext(cps[0]), &deposit.MakeDepositParams{
+			SchemeID:            schemeID,
+			UserPubKey:          d.user,
+			MassBalanceDeposits: []commons.MassBalance{{ItemDefinition: weightRewards.ItemDefinition, Amount: d.amount}},
+		})
+		require.NoError(t, err)
+	}
+
+	// user3 deposited the most, but did not opt in
+	pseudonyms := map[string]string{}
+	for _, user := range []string{user1, user2} {
+		resp, err := SetLeaderboardOptIn(testutils.GetAuthenticatedContext(user), &SetLeaderboardOptInParams{OptIn: true})
+		require.NoError(t, err)
+		require.NotEmpty(t, resp.Pseudonym)
+		require.NotContains(t, user, resp.Pseudonym)
+		pseudonyms[user] = resp.Pseudonym
+	}
+	require.NotEqual(t, pseudonyms[user1], pseudonyms[user2])
+	// Opting in twice keeps the pseudonym
+	resp, err := SetLeaderboardOptIn(testutils.GetAuthenticatedContext(user1), &SetLeaderboardOptInParams{OptIn: true})
+	require.NoError(t, err)
+	require.Equal(t, pseudonyms[user1], resp.Pseudonym)
+
+	leaderboard, err := GetLeaderboard(context.Background(), &GetLeaderboardParams{SchemeID: schemeID})
+	require.NoError(t, err)
+	require.Equal(t, []LeaderboardEntry{
+		{Rank: 1, Pseudonym: pseudonyms[user1], Deposits: 2, Weight: 10},
+		{Rank: 2, Pseudonym: pseudonyms[user2], Deposits: 1, Weight: 8},
+	}, leaderboard.Depositors)
+
+	leaderboard, err = GetLeaderboard(context.Background(), &GetLeaderboardParams{Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(leaderboard.Depositors))
+
+	resp, err = SetLeaderboardOptIn(testutils.GetAuthenticatedContext(user1), &SetLeaderboardOptInParams{OptIn: false})
+	require.NoError(t, err)
+	require.Empty(t, resp.Pseudonym)
+	leaderboard, err = GetLeaderboard(context.Background(), &GetLeaderboardParams{SchemeID: schemeID})
+	require.NoError(t, err)
+	require.Equal(t, []LeaderboardEntry{{Rank: 1, Pseudonym: pseudonyms[user2], Deposits: 1, Weight: 8}}, leaderboard.Depositors)
+
+	_, err = GetLeaderboard(context.Background(), &GetLeaderboardParams{Limit: 101})
+	require.Error(t, err)
+}
@@ -0,0 +1,5 @@
+CREATE TABLE leaderboard_opt_in
+(
+    user_pub_key TEXT PRIMARY KEY,
+    created_at   TIMESTAMP NOT NULL DEFAULT now()
+);
@@ -0,0 +1,3 @@
+-- The opt-ins moved to the deposit service. They are not copied: the old pseudonyms were a hash of the
+-- public pub keys, so they could be linked to the users, who have to opt in again to get a random one.
+DROP TABLE leaderboard_opt_in;
@@ -0,0 +1,150 @@
+package stats
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/deposit"
+	"encore.app/organization"
+	"encore.app/scheme"
+)
+
+type GetOrganizationStatsParams struct {
+	OrganizationID string `json:"organizationID" validate:"required"`
+	// From and To limit the stats to this period, rounded down to UTC days. nil means no limit.
+	From *time.Time `json:"from"`
+	To   *time.Time `json:"to"`
+}
+
+type MaterialTotal struct {
+	Material           string            `json:"material"`
+	MaterialDefinition map[string]string `json:"materialDefinition"`
+	Amount             float64           `json:"amount"`
+}
+
+type SchemeStats struct {
+	SchemeID string `json:"schemeID"`
+	Name     string `json:"name"`
+	Deposits int    `json:"deposits"`
+}
+
+type CollectionPointStats struct {
+	CollectionPointPubKey string `json:"collectionPointPubKey"`
+	Deposits              int    `json:"deposits"`
+}
+
+type OrganizationStats struct {
+	Deposits int `json:"deposits"`
+	// WeightPerMaterial is the total weight collected per material, items counted by number are not included
+	WeightPerMaterial []MaterialTotal        `json:"weightPerMaterial"`
+	Schemes           []SchemeStats          `json:"schemes"`
+	CollectionPoints  []CollectionPointStats `json:"collectionPoints"`
+	UniqueDepositors  int                    `json:"uniqueDepositors"`
+	Vouchers          []deposit.VoucherStats `json:"vouchers"`
+	// ClaimRate is the share of deposits claimed by a user, between 0 and 1
+	ClaimRate float64 `json:"claimRate"`
+}
+
+// GetOrganizationStats is the impact dashboard of an organization.
+// Only approved deposits are counted, and reversed deposits are left out.
+//encore:api auth method=POST
+func GetOrganizationStats(ctx context.Context, params *GetOrganizationStatsParams) (*OrganizationStats, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: params.OrganizationID}); err != nil {
+		return nil, err
+	}
+
+	schemes, err := scheme.GetAllSchemes(ctx, &scheme.GetAllSchemesParams{OrganizationID: params.OrganizationID})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &OrganizationStats{
+		WeightPerMaterial: []MaterialTotal{},
+		Schemes:           []SchemeStats{},
+		CollectionPoints:  []CollectionPointStats{},
+	}
+
+	schemeIDs := make([]string, 0, len(schemes.Schemes))
+	schemeIndex := map[string]int{}
+	for _, s := range schemes.Schemes {
+		schemeIDs = append(schemeIDs, s.ID)
+		schemeIndex[s.ID] = len(resp.Schemes)
+		resp.Schemes = append(resp.Schemes, SchemeStats{SchemeID: s.ID, Name: s.Name})
+	}
+
+	deposits, err := deposit.GetDepositStats(ctx, &deposit.GetDepositStatsParams{
+		SchemeIDs: schemeIDs,
+		From:      params.From,
+		To:        params.To,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claimed := 0
+	for _, s := range deposits.Schemes {
+		resp.Deposits += s.Deposits
+		resp.Schemes[schemeIndex[s.SchemeID]].Deposits = s.Deposits
+		claimed += s.Claimed
+	}
+	for _, cp := range deposits.CollectionPoints {
+		resp.CollectionPoints = append(resp.CollectionPoints, CollectionPointStats{
+			CollectionPointPubKey: cp.CollectionPointPubKey,
+			Deposits:              cp.Deposits,
+		})
+	}
+	for _, m := range deposits.Materials {
+		if m.ItemDefinition.Magnitude != commons.Weight {
+			continue
+		}
+		resp.WeightPerMaterial = append(resp.WeightPerMaterial, MaterialTotal{
+			Material:           materialName(m.ItemDefinition),
+			MaterialDefinition: m.ItemDefinition.MaterialDefinition,
+			Amount:             m.Amount,
+		})
+	}
+
+	resp.UniqueDepositors = deposits.UniqueDepositors
+	if resp.Deposits > 0 {
+		resp.ClaimRate = float64(claimed) / float64(resp.Deposits)
+	}
+
+	vouchers, err := deposit.GetVoucherStats(ctx, &deposit.GetVoucherStatsParams{
+		OrganizationID: params.OrganizationID,
+		From:           params.From,
+		To:             params.To,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.Vouchers = vouchers.VoucherDefinitions
+
+	sort.Slice(resp.WeightPerMaterial, func(i, j int) bool {
+		return resp.WeightPerMaterial[i].Material < resp.WeightPerMaterial[j].Material
+	})
+
+	return resp, nil
+}
+
+// materialName is a readable name for the material: its definition's values, sorted by key, e.g. "PET" for {"materialType": "PET"}
+func materialName(itemDefinition commons.ItemDefinition) string {
+	keys := make([]string, 0, len(itemDefinition.MaterialDefinition))
+	for k := range itemDefinition.MaterialDefinition {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	values := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values = append(values, itemDefinition.MaterialDefinition[k])
+	}
+
+	return strings.Join(values, " ")
+}
@@ -0,0 +1,162 @@
+package stats
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/admin"
+	"encore.app/commons"
+	"encore.app/commons/testutils"
+	"encore.app/deposit"
+	"encore.app/organization"
+	"encore.app/scheme"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetOrganizationStats(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	orgSigningPubKey, _ := testutils.GenerateKeys()
+	orgEncryptionPubKey, _ := testutils.GenerateKeys()
+	_, err := organization.CreateOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &organization.CreateOrgParams{
+		ID:               testOrganizationId,
+		Name:             testOrganizationId,
+		SigningPubKey:    orgSigningPubKey,
+		EncryptionPubKey: orgEncryptionPubKey,
+	})
+	require.NoError(t, err)
+
+	definition, err := deposit.CreateVoucherDefinition(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &deposit.CreateVoucherDefinitionParams{
+		OrganizationID: testOrganizationId,
+		Name:           "Voucher def name",
+		PictureURL:     "https://does.not.matter.com",
+	})
+	require.NoError(t, err)
+
+	weightRewards := defaultTestRewardsMagnitude0
+	weightRewards.RewardTypeID = definition.ID
+	countRewards := defaultTestRewardsMagnitude1
+	countRewards.RewardTypeID = definition.ID
+
+	collectionPoint1, _ := testutils.GenerateKeys()
+	collectionPoint2, _ := testutils.GenerateKeys()
+	testScheme, err := scheme.CreateScheme(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &scheme.CreateSchemeParams{
+		Name:              "TestScheme",
+		RewardDefinitions: []commons.RewardDefinition{weightRewards, countRewards},
+		OrganizationID:    testOrganizationId,
+	})
+	require.NoError(t, err)
+	for _, cp := range []string{collectionPoint1, collectionPoint2} {
+		require.NoError(t, scheme.AddCollectionPoint(testutils.GetAuthenticatedContext(orgSigningPubKey), &scheme.AddCollectionPointParams{
+			SchemeID:              testScheme.ID,
+			CollectionPointPubKey: cp,
+		}))
+	}
+
+	user1, _ := testutils.GenerateKeys()
+	user2, _ := testutils.GenerateKeys()
+	lastWeek := time.Now().UTC().AddDate(0, 0, -7)
+	deposits := []struct {
+		collectionPoint string
+		user            string
+		items           []commons.MassBalance
+		capturedAt      *time.Time
+	}{
+		{collectionPoint1, user1, []commons.MassBalance{{ItemDefinition: weightRewards.ItemDefinition, Amount: 10}}, &lastWeek},
+		{collectionPoint1, user1, []commons.MassBalance{{ItemDefinition: weightRewards.ItemDefinition, Amount: 5}, {ItemDefinition: countRewards.ItemDefinition, Amount: 3}}, nil},
+		{collectionPoint2, user2, []commons.MassBalance{{ItemDefinition: weightRewards.ItemDefinition, Amount: 4}}, nil},
+		{collectionPoint2, "", []commons.MassBalance{{ItemDefinition: weightRewards.ItemDefinition, Amount: 1}}, nil},
+	}
+	for _, d := range deposits {
+		_, err := deposit.MakeDeposit(testutils.GetAuthenticatedContext(d.collectionPoint), &deposit.MakeDepositParams{
+			SchemeID:            testScheme.ID,
+			UserPubKey:          d.user,
+			MassBalanceDeposits: d.items,
+			CapturedAt:          d.capturedAt,
+		})
+		require.NoError(t, err)
+	}
+
+	vouchers, err := deposit.GetVouchersForUser(testutils.GetAuthenticatedContext(user2), &deposit.GetVouchersForUserParams{UserPubKey: user2})
+	require.NoError(t, err)
+	require.NoError(t, deposit.InvalidateVoucher(testutils.GetAuthenticatedContext(user2), &deposit.InvalidateVoucherParams{VoucherID: vouchers.Vouchers[0].Voucher.ID}))
+
+	yesterday := time.Now().UTC().AddDate(0, 0, -1)
+	testTable := []struct {
+		name             string
+		from             *time.Time
+		deposits         int
+		weight           float64
+		perCP            map[string]int
+		uniqueDepositors int
+		minted           int
+		redeemed         int
+		claimRate        float64
+	}{
+		{
+			name:             "All time",
+			deposits:         4,
+			weight:           20,
+			perCP:            map[string]int{collectionPoint1: 2, collectionPoint2: 2},
+			uniqueDepositors: 2,
+			// 2 per kg and 1 per counted item
+			minted:    20 + 10 + 3 + 8,
+			redeemed:  1,
+			claimRate: 0.75,
+		},
+		{
+			name:             "Since yesterday",
+			from:             &yesterday,
+			deposits:         3,
+			weight:           10,
+			perCP:            map[string]int{collectionPoint1: 1, collectionPoint2: 2},
+			uniqueDepositors: 2,
+			// Vouchers are minted when claimed, which is now also for the deposit captured last week
+			minted:    20 + 10 + 3 + 8,
+			redeemed:  1,
+			claimRate: 2.0 / 3.0,
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			stats, err := GetOrganizationStats(testutils.GetAuthenticatedContext(orgSigningPubKey), &GetOrganizationStatsParams{
+				OrganizationID: testOrganizationId,
+				From:           test.from,
+			})
+			require.NoError(t, err)
+
+			require.Equal(t, test.deposits, stats.Deposits)
+			require.Equal(t, 1, len(stats.WeightPerMaterial))
+			require.Equal(t, "PET", stats.WeightPerMaterial[0].Material)
+			require.Equal(t, test.weight, stats.WeightPerMaterial[0].Amount)
+
+			require.Equal(t, 1, len(stats.Schemes))
+			require.Equal(t, test.deposits, stats.Schemes[0].Deposits)
+
+			perCP := map[string]int{}
+			for _, cp := range stats.CollectionPoints {
+				perCP[cp.CollectionPointPubKey] = cp.Deposits
+			}
+			require.Equal(t, test.perCP, perCP)
+
+			require.Equal(t, test.uniqueDepositors, stats.UniqueDepositors)
+			require.InDelta(t, test.claimRate, stats.ClaimRate, 0.0001)
+
+			require.Equal(t, 1, len(stats.Vouchers))
+			require.Equal(t, test.minted, stats.Vouchers[0].Minted)
+			require.Equal(t, test.redeemed, stats.Vouchers[0].Redeemed)
+			require.Equal(t, test.minted-1, stats.Vouchers[0].Outstanding)
+		})
+	}
+
+	_, err = GetOrganizationStats(testutils.GetAuthenticatedContext(collectionPoint1), &GetOrganizationStatsParams{
+		OrganizationID: testOrganizationId,
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.PermissionDenied, err.(*errs.Error).Code)
+}
@@ -2,13 +2,13 @@ package stats
 
 import (
 	"context"
+	"sort"
 
 	"encore.app/commons"
 	"encore.app/deposit"
 	"encore.app/organization"
 	"encore.app/scheme"
 	"encore.dev/beta/errs"
-	"golang.org/x/exp/maps"
 )
 
 type User struct {
@@ -16,15 +16,35 @@ type User struct {
 }
 
 type DepositDescription struct {
-	Magnitude          int64             `json:"magnitude"`
+	// Key is the canonical item definition, see commons.ItemDefinition.Key
+	Key       string `json:"key"`
+	Magnitude int64  `json:"magnitude"`
+	Unit      string `json:"unit"`
+	// IsPlastic is only true for items classified as plastic, see commons.PlasticKey
+	IsPlastic          bool              `json:"isPlastic"`
 	Amount             float64           `json:"amount"`
 	MaterialDefinition map[string]string `json:"materialDefinition"`
 }
+
+// MagnitudeTotal is the total of all materials measured in a unit
+type MagnitudeTotal struct {
+	Magnitude int64   `json:"magnitude"`
+	Unit      string  `json:"unit"`
+	Amount    float64 `json:"amount"`
+	// PlasticAmount is the amount of items classified as plastic.
+	// Items that are not classified count as plastic when measured by weight, as they did before the classification.
+	PlasticAmount float64 `json:"plasticAmount"`
+}
+
 type Stats struct {
-	NumberOfAvailableVouchers int64                `json:"numberOfAvailableVouchers"`
-	PlasticCollected          float64              `json:"plasticCollected"`
-	NumberOfUsedVouchers      int64                `json:"numberOfUsedVouchers"`
-	DepositAmounts            []DepositDescription `json:"depositAmounts"`
+	NumberOfAvailableVouchers int64 `json:"numberOfAvailableVouchers"`
+	// PlasticCollected is the weight of plastic materials, in kg
+	PlasticCollected     float64 `json:"plasticCollected"`
+	NumberOfUsedVouchers int64   `json:"numberOfUsedVouchers"`
+	// DepositAmounts has a total per item definition, ordered by key
+	DepositAmounts []DepositDescription `json:"depositAmounts"`
+	// Totals has a total per magnitude, ordered by magnitude
+	Totals []MagnitudeTotal `json:"totals"`
 }
 
 //encore:api public method=POST
@@ -35,61 +55,68 @@ func GetStats(ctx context.Context, params *User) (*Stats, error) {
 		}
 	}
 
-	resp := &Stats{DepositAmounts: []DepositDescription{}}
-
-	allVouchers, err := deposit.GetAllVouchers(ctx, &deposit.GetAllVouchersParams{PubKey: params.PubKey})
+	userStats, err := deposit.GetUserStats(ctx, &deposit.GetUserStatsParams{UserPubKey: params.PubKey})
 	if err != nil {
 		return nil, err
 	}
 
-	for _, voucher := range allVouchers.Vouchers {
-		if voucher.Voucher.Invalidated {
-			resp.NumberOfUsedVouchers += 1
-		} else {
-			resp.NumberOfAvailableVouchers += 1
+	resp := &Stats{
+		NumberOfAvailableVouchers: userStats.AvailableVouchers,
+		NumberOfUsedVouchers:      userStats.UsedVouchers,
+	}
+	resp.DepositAmounts, resp.Totals = aggregateMaterials(userStats.Materials)
+	for _, total := range resp.Totals {
+		if total.Magnitude == int64(commons.Weight) {
+			resp.PlasticCollected = total.PlasticAmount
 		}
 	}
 
-	allDeposits, err := deposit.GetAllDeposits(ctx, &deposit.GetAllDepositsParams{UserPubKey: params.PubKey})
-	if err != nil {
-		return nil, err
-	}
+	return resp, nil
+}
 
-	var materialsExisting = make(map[string]DepositDescription)
-
-	var materials = []DepositDescription{}
-	for _, register := range allDeposits.Deposits {
-		var currentDepositDescription DepositDescription = DepositDescription{} // Deposit to add in list
-		var masses = register.MassBalanceDeposits                               // List of massDeposits
-		var materialKey string                                                  // plastic we're storing
-		for _, mass := range masses {
-			currentDepositDescription.MaterialDefinition = mass.ItemDefinition.MaterialDefinition // describes the material
-			materialKey = maps.Values(mass.ItemDefinition.MaterialDefinition)[0]                  // Plastic stored
-			currentDepositDescription.Amount += mass.Amount
-			if mass.ItemDefinition.Magnitude == 0 {
-				currentDepositDescription.Magnitude = 0
-			} else {
-				currentDepositDescription.Magnitude = 1
-			}
-			var updatedDepositDescription DepositDescription = materialsExisting[materialKey] // if it's empty np
-			if _, usedMaterial := materialsExisting[materialKey]; usedMaterial {
-				updatedDepositDescription.Amount += currentDepositDescription.Amount // If not, update amount
-			} else {
-				updatedDepositDescription = currentDepositDescription
-			}
-			materialsExisting[materialKey] = updatedDepositDescription
+// aggregateMaterials totals the amounts per item definition and per magnitude
+func aggregateMaterials(materials []deposit.MaterialAmount) ([]DepositDescription, []MagnitudeTotal) {
+	descriptions := []DepositDescription{}
+	byKey := map[string]int{}
+	totals := []MagnitudeTotal{}
+	byMagnitude := map[commons.MagnitudeType]int{}
+
+	for _, m := range materials {
+		isPlastic, classified := m.ItemDefinition.IsPlastic()
+		key := m.ItemDefinition.Key()
+		i, ok := byKey[key]
+		if !ok {
+			i = len(descriptions)
+			byKey[key] = i
+			descriptions = append(descriptions, DepositDescription{
+				Key:                key,
+				Magnitude:          int64(m.ItemDefinition.Magnitude),
+				Unit:               m.ItemDefinition.Magnitude.Unit(),
+				IsPlastic:          isPlastic,
+				MaterialDefinition: m.ItemDefinition.MaterialDefinition,
+			})
 		}
-	}
-	for _, material := range materialsExisting {
-		if material.Magnitude == 0 {
-			resp.PlasticCollected += material.Amount
+		descriptions[i].Amount += m.Amount
+
+		j, ok := byMagnitude[m.ItemDefinition.Magnitude]
+		if !ok {
+			j = len(totals)
+			byMagnitude[m.ItemDefinition.Magnitude] = j
+			totals = append(totals, MagnitudeTotal{
+				Magnitude: int64(m.ItemDefinition.Magnitude),
+				Unit:      m.ItemDefinition.Magnitude.Unit(),
+			})
+		}
+		totals[j].Amount += m.Amount
+		if isPlastic || (!classified && m.ItemDefinition.Magnitude == commons.Weight) {
+			totals[j].PlasticAmount += m.Amount
 		}
-		materials = append(materials, material)
 	}
 
-	resp.DepositAmounts = materials
+	sort.Slice(descriptions, func(i, j int) bool { return descriptions[i].Key < descriptions[j].Key })
+	sort.Slice(totals, func(i, j int) bool { return totals[i].Magnitude < totals[j].Magnitude })
 
-	return resp, nil
+	return descriptions, totals
 }
 
 type OrganizationData struct {
@@ -109,21 +136,34 @@ func GetOrganizationsByUser(ctx context.Context, params *User) (*Organizations,
 		}
 	}
 
-	var resp = &Organizations{DepositOrgsForUser: []OrganizationData{}}
+	userStats, err := deposit.GetUserStats(ctx, &deposit.GetUserStatsParams{UserPubKey: params.PubKey})
+	if err != nil {
+		return nil, err
+	}
+
+	userSchemes := map[string]bool{}
+	for _, schemeID := range userStats.SchemeIDs {
+		userSchemes[schemeID] = true
+	}
 
-	allDeposits, _ := deposit.GetAllDeposits(ctx, &deposit.GetAllDepositsParams{UserPubKey: params.PubKey})
+	schemes, err := scheme.GetAllSchemes(ctx, &scheme.GetAllSchemesParams{})
+	if err != nil {
+		return nil, err
+	}
 
-	var registeredOrganizations = make(map[string]string)
+	var resp = &Organizations{DepositOrgsForUser: []OrganizationData{}}
+	var registeredOrganizations = make(map[string]bool)
+	for _, s := range schemes.Schemes {
+		if !userSchemes[s.ID] || registeredOrganizations[s.OrganizationID] {
+			continue
+		}
 
-	for _, deposit := range allDeposits.Deposits {
-		depositData, _ := scheme.GetScheme(ctx, &scheme.GetSchemeParams{SchemeID: deposit.SchemeID})
-		organizationId := depositData.OrganizationID
-		if _, organizationRegistered := registeredOrganizations[organizationId]; !organizationRegistered {
-			organizationName, _ := organization.GetOrganization(ctx, &organization.GetOrganizationParams{ID: organizationId})
-			registeredOrganizations[organizationId] = organizationName.Name // Updating map
-			var currentOrganization = OrganizationData{Name: organizationName.Name, ID: organizationId}
-			resp.DepositOrgsForUser = append(resp.DepositOrgsForUser, currentOrganization)
+		org, err := organization.GetOrganization(ctx, &organization.GetOrganizationParams{ID: s.OrganizationID})
+		if err != nil {
+			return nil, err
 		}
+		registeredOrganizations[s.OrganizationID] = true
+		resp.DepositOrgsForUser = append(resp.DepositOrgsForUser, OrganizationData{ID: org.ID, Name: org.Name})
 	}
 
 	return resp, nil
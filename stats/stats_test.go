@@ -313,3 +313,91 @@ func TestGetOrganizationsByUser(t *testing.T) {
 	require.Equal(t, int(0), len(userOrganizations.DepositOrgsForUser))
 
 }
+
+func TestAggregateMaterials(t *testing.T) {
+	clearPET := commons.ItemDefinition{MaterialDefinition: map[string]string{"materialType": "PET", "color": "clear", "plastic": "true"}, Magnitude: commons.Weight}
+	greenPET := commons.ItemDefinition{MaterialDefinition: map[string]string{"color": "green", "materialType": "PET", "plastic": "true"}, Magnitude: commons.Weight}
+	petBottles := commons.ItemDefinition{MaterialDefinition: map[string]string{"materialType": "PET", "color": "clear", "plastic": "true"}, Magnitude: commons.Count}
+	glass := commons.ItemDefinition{MaterialDefinition: map[string]string{"materialType": "GLASS", "color": "clear", "plastic": "false"}, Magnitude: commons.Weight}
+	unclassifiedLDPE := commons.ItemDefinition{MaterialDefinition: map[string]string{"plasticType": "LDPE"}, Magnitude: commons.Weight}
+	unclassifiedBottles := commons.ItemDefinition{MaterialDefinition: map[string]string{"plasticType": "LDPE"}, Magnitude: commons.Count}
+
+	testTable := []struct {
+		name           string
+		materials      []deposit.MaterialAmount
+		expectedKeys   []string
+		expectedAmount []float64
+		expectedTotals []MagnitudeTotal
+	}{
+		{
+			name:           "Nothing",
+			materials:      []deposit.MaterialAmount{},
+			expectedKeys:   []string{},
+			expectedAmount: []float64{},
+			expectedTotals: []MagnitudeTotal{},
+		},
+		{
+			name: "Multi-attribute materials are kept apart",
+			materials: []deposit.MaterialAmount{
+				{ItemDefinition: clearPET, Amount: 2},
+				{ItemDefinition: greenPET, Amount: 3},
+			},
+			expectedKeys:   []string{"color=clear&materialType=PET&plastic=true|0", "color=green&materialType=PET&plastic=true|0"},
+			expectedAmount: []float64{2, 3},
+			expectedTotals: []MagnitudeTotal{{Magnitude: 0, Unit: "kg", Amount: 5, PlasticAmount: 5}},
+		},
+		{
+			name: "The same definition is added up, whatever the attribute order",
+			materials: []deposit.MaterialAmount{
+				{ItemDefinition: clearPET, Amount: 2},
+				{ItemDefinition: commons.ItemDefinition{MaterialDefinition: map[string]string{"plastic": "true", "color": "clear", "materialType": "PET"}}, Amount: 4},
+			},
+			expectedKeys:   []string{"color=clear&materialType=PET&plastic=true|0"},
+			expectedAmount: []float64{6},
+			expectedTotals: []MagnitudeTotal{{Magnitude: 0, Unit: "kg", Amount: 6, PlasticAmount: 6}},
+		},
+		{
+			name: "Magnitudes and non-plastics are totalled separately",
+			materials: []deposit.MaterialAmount{
+				{ItemDefinition: petBottles, Amount: 10},
+				{ItemDefinition: glass, Amount: 7},
+				{ItemDefinition: clearPET, Amount: 2},
+			},
+			expectedKeys:   []string{"color=clear&materialType=GLASS&plastic=false|0", "color=clear&materialType=PET&plastic=true|0", "color=clear&materialType=PET&plastic=true|1"},
+			expectedAmount: []float64{7, 2, 10},
+			expectedTotals: []MagnitudeTotal{
+				{Magnitude: 0, Unit: "kg", Amount: 9, PlasticAmount: 2},
+				{Magnitude: 1, Unit: "items", Amount: 10, PlasticAmount: 10},
+			},
+		},
+		{
+			name: "Items that are not classified count as plastic by weight",
+			materials: []deposit.MaterialAmount{
+				{ItemDefinition: unclassifiedLDPE, Amount: 3},
+				{ItemDefinition: unclassifiedBottles, Amount: 4},
+			},
+			expectedKeys:   []string{"plasticType=LDPE|0", "plasticType=LDPE|1"},
+			expectedAmount: []float64{3, 4},
+			expectedTotals: []MagnitudeTotal{
+				{Magnitude: 0, Unit: "kg", Amount: 3, PlasticAmount: 3},
+				{Magnitude: 1, Unit: "items", Amount: 4, PlasticAmount: 0},
+			},
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			descriptions, totals := aggregateMaterials(test.materials)
+
+			keys := []string{}
+			amounts := []float64{}
+			for _, d := range descriptions {
+				keys = append(keys, d.Key)
+				amounts = append(amounts, d.Amount)
+			}
+			require.Equal(t, test.expectedKeys, keys)
+			require.Equal(t, test.expectedAmount, amounts)
+			require.Equal(t, test.expectedTotals, totals)
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package stats
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/deposit"
+	"encore.app/organization"
+	"encore.app/scheme"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+)
+
+// maxTimeSeriesBuckets keeps a long period with a short interval from making a huge response
+const maxTimeSeriesBuckets = 1000
+
+type GetTimeSeriesParams struct {
+	OrganizationID string `json:"organizationID" validate:"required"`
+	// SchemeID and CollectionPointPubKey narrow the series down, empty means all of the organization's
+	SchemeID              string `json:"schemeID"`
+	CollectionPointPubKey string `json:"collectionPointPubKey"`
+	Interval              string `json:"interval" validate:"required,oneof=DAY WEEK MONTH"`
+	// TimeZone is where days start, e.g. "Africa/Lagos". Defaults to UTC. Weeks start on Monday.
+	TimeZone string `json:"timeZone" validate:"omitempty,timezone"`
+	// From and To limit the series to this period, nil means from the first and to the last bucket with data
+	From *time.Time `json:"from"`
+	To   *time.Time `json:"to"`
+}
+
+type TimeSeriesBucket struct {
+	Start             time.Time       `json:"start"`
+	Deposits          int             `json:"deposits"`
+	WeightPerMaterial []MaterialTotal `json:"weightPerMaterial"`
+	VouchersMinted    int             `json:"vouchersMinted"`
+	VouchersRedeemed  int             `json:"vouchersRedeemed"`
+}
+
+type TimeSeries struct {
+	Interval string `json:"interval"`
+	TimeZone string `json:"timeZone"`
+	// Buckets are in order and without gaps, so buckets without data are included with zeros
+	Buckets []TimeSeriesBucket `json:"buckets"`
+}
+
+// GetTimeSeries buckets the organization's deposits and vouchers by day, week or month, for trend charts.
+// A collection point can get the series of its own deposits.
+//encore:api auth method=POST
+func GetTimeSeries(ctx context.Context, params *GetTimeSeriesParams) (*TimeSeries, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	if caller, _ := auth.UserID(); params.CollectionPointPubKey == "" || string(caller) != params.CollectionPointPubKey {
+		if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: params.OrganizationID}); err != nil {
+			return nil, err
+		}
+	}
+
+	timeZone := params.TimeZone
+	if timeZone == "" {
+		timeZone = "UTC"
+	}
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	schemes, err := scheme.GetAllSchemes(ctx, &scheme.GetAllSchemesParams{OrganizationID: params.OrganizationID})
+	if err != nil {
+		return nil, err
+	}
+	schemeIDs := make([]string, 0, len(schemes.Schemes))
+	for _, s := range schemes.Schemes {
+		if params.SchemeID == "" || s.ID == params.SchemeID {
+			schemeIDs = append(schemeIDs, s.ID)
+		}
+	}
+	if params.SchemeID != "" && len(schemeIDs) == 0 {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "the scheme is not one of the organization's",
+		}
+	}
+
+	series, err := deposit.GetTimeSeries(ctx, &deposit.GetTimeSeriesParams{
+		SchemeIDs:             schemeIDs,
+		CollectionPointPubKey: params.CollectionPointPubKey,
+		Interval:              params.Interval,
+		TimeZone:              timeZone,
+		From:                  params.From,
+		To:                    params.To,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &TimeSeries{Interval: params.Interval, TimeZone: timeZone, Buckets: []TimeSeriesBucket{}}
+
+	var first, last time.Time
+	if params.From != nil {
+		first = bucketStart(*params.From, params.Interval, loc)
+	} else if len(series.Buckets) > 0 {
+		first = series.Buckets[0].Start.In(loc)
+	}
+	if params.To != nil {
+		// To is exclusive
+		last = bucketStart(params.To.Add(-time.Nanosecond), params.Interval, loc)
+	} else if len(series.Buckets) > 0 {
+		last = series.Buckets[len(series.Buckets)-1].Start.In(loc)
+	}
+	if first.IsZero() || last.IsZero() {
+		return resp, nil
+	}
+
+	data := make(map[int64]deposit.TimeSeriesBucket, len(series.Buckets))
+	for _, b := range series.Buckets {
+		data[b.Start.Unix()] = b
+	}
+
+	for start := first; !start.After(last); start = nextBucketStart(start, params.Interval) {
+		if len(resp.Buckets) == maxTimeSeriesBuckets {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "the period is too long for the interval",
+			}
+		}
+
+		b := TimeSeriesBucket{Start: start, WeightPerMaterial: []MaterialTotal{}}
+		if d, ok := data[start.Unix()]; ok {
+			b.Deposits = d.Deposits
+			b.VouchersMinted = d.VouchersMinted
+			b.VouchersRedeemed = d.VouchersRedeemed
+			for _, w := range d.Weights {
+				b.WeightPerMaterial = append(b.WeightPerMaterial, MaterialTotal{
+					Material:           materialName(commons.ItemDefinition{MaterialDefinition: w.MaterialDefinition}),
+					MaterialDefinition: w.MaterialDefinition,
+					Amount:             w.Amount,
+				})
+			}
+			sort.Slice(b.WeightPerMaterial, func(i, j int) bool {
+				return b.WeightPerMaterial[i].Material < b.WeightPerMaterial[j].Material
+			})
+		}
+		resp.Buckets = append(resp.Buckets, b)
+	}
+
+	return resp, nil
+}
+
+// bucketStart is the start of the day, week (from Monday) or month of t in loc
+func bucketStart(t time.Time, interval string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch interval {
+	case deposit.IntervalWeek:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case deposit.IntervalMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	}
+}
+
+func nextBucketStart(start time.Time, interval string) time.Time {
+	switch interval {
+	case deposit.IntervalWeek:
+		return start.AddDate(0, 0, 7)
+	case deposit.IntervalMonth:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
@@ -0,0 +1,181 @@
+package stats
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/admin"
+	"encore.app/commons"
+	"encore.app/commons/testutils"
+	"encore.app/deposit"
+	"encore.app/organization"
+	"encore.app/scheme"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketStart(t *testing.T) {
+	lagos, err := time.LoadLocation("Africa/Lagos")
+	require.NoError(t, err)
+
+	// A Sunday evening in UTC, which is already Monday in Lagos
+	sunday := time.Date(2022, 8, 14, 23, 30, 0, 0, time.UTC)
+
+	testTable := []struct {
+		name     string
+		interval string
+		loc      *time.Location
+		expected time.Time
+	}{
+		{"Day", deposit.IntervalDay, time.UTC, time.Date(2022, 8, 14, 0, 0, 0, 0, time.UTC)},
+		{"Day in Lagos", deposit.IntervalDay, lagos, time.Date(2022, 8, 15, 0, 0, 0, 0, lagos)},
+		{"Week", deposit.IntervalWeek, time.UTC, time.Date(2022, 8, 8, 0, 0, 0, 0, time.UTC)},
+		{"Week in Lagos", deposit.IntervalWeek, lagos, time.Date(2022, 8, 15, 0, 0, 0, 0, lagos)},
+		{"Month", deposit.IntervalMonth, time.UTC, time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			require.True(t, test.expected.Equal(bucketStart(sunday, test.interval, test.loc)))
+		})
+	}
+}
+
+func TestGetTimeSeries(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	require.NoError(t, admin.InsertTestData(context.Background()))
+	testutils.ClearAllDBs()
+
+	orgSigningPubKey, _ := testutils.GenerateKeys()
+	orgEncryptionPubKey, _ := testutils.GenerateKeys()
+	_, err := organization.CreateOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &organization.CreateOrgParams{
+		ID:               testOrganizationId,
+		Name:             testOrganizationId,
+		SigningPubKey:    orgSigningPubKey,
+		EncryptionPubKey: orgEncryptionPubKey,
+	})
+	require.NoError(t, err)
+
+	definition, err := deposit.CreateVoucherDefinition(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &deposit.CreateVoucherDefinitionParams{
+		OrganizationID: testOrganizationId,
+		Name:           "Voucher def name",
+		PictureURL:     "https://does.not.matter.com",
+	})
+	require.NoError(t, err)
+	rewards := defaultTestRewardsMagnitude0
+	rewards.RewardTypeID = definition.ID
+
+	collectionPoint1, _ := testutils.GenerateKeys()
+	collectionPoint2, _ := testutils.GenerateKeys()
+	testScheme, err := scheme.CreateScheme(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &scheme.CreateSchemeParams{
+		Name:              "TestScheme",
+		RewardDefinitions: []commons.RewardDefinition{rewards},
+		OrganizationID:    testOrganizationId,
+	})
+	require.NoError(t, err)
+	for _, cp := range []string{collectionPoint1, collectionPoint2} {
+		require.NoError(t, scheme.AddCollectionPoint(testutils.GetAuthenticatedContext(orgSigningPubKey), &scheme.AddCollectionPointParams{
+			SchemeID:              testScheme.ID,
+			CollectionPointPubKey: cp,
+		}))
+	}
+
+	today := bucketStart(time.Now(), deposit.IntervalDay, time.UTC)
+	twoDaysAgo := today.AddDate(0, 0, -2).Add(time.Hour)
+	for _, d := range []struct {
+		collectionPoint string
+		user            string
+		capturedAt      time.Time
+	}{
+		{collectionPoint1, testUserPubKey, twoDaysAgo},
+		{collectionPoint1, "", today.Add(time.Minute)},
+		{collectionPoint2, "", today.Add(time.Minute)},
+	} {
+		capturedAt := d.capturedAt
+		_, err := deposit.MakeDeposit(testutils.GetAuthenticatedContext(d.collectionPoint), &deposit.MakeDepositParams{
+			SchemeID:            testScheme.ID,
+			UserPubKey:          d.user,
+			MassBalanceDeposits: []commons.MassBalance{{ItemDefinition: rewards.ItemDefinition, Amount: 3}},
+			CapturedAt:          &capturedAt,
+		})
+		require.NoError(t, err)
+	}
+
+	testTable := []struct {
+		name            string
+		caller          string
+		collectionPoint string
+		deposits        []int
+	}{
+		{
+			name:     "Organization",
+			caller:   orgSigningPubKey,
+			deposits: []int{1, 0, 2},
+		},
+		{
+			name:            "Organization for a collection point",
+			caller:          orgSigningPubKey,
+			collectionPoint: collectionPoint2,
+			deposits:        []int{1},
+		},
+		{
+			name:            "Collection point",
+			caller:          collectionPoint1,
+			collectionPoint: collectionPoint1,
+			deposits:        []int{1, 0, 1},
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			series, err := GetTimeSeries(testutils.GetAuthenticatedContext(test.caller), &GetTimeSeriesParams{
+				OrganizationID:        testOrganizationId,
+				CollectionPointPubKey: test.collectionPoint,
+				Interval:              deposit.IntervalDay,
+			})
+			require.NoError(t, err)
+			require.Equal(t, "UTC", series.TimeZone)
+			require.Equal(t, len(test.deposits), len(series.Buckets))
+			for i, b := range series.Buckets {
+				require.Equal(t, test.deposits[i], b.Deposits)
+				if b.Deposits > 0 {
+					require.Equal(t, "PET", b.WeightPerMaterial[0].Material)
+					require.Equal(t, 3*float64(b.Deposits), b.WeightPerMaterial[0].Amount)
+				} else {
+					require.Equal(t, 0, len(b.WeightPerMaterial))
+				}
+			}
+		})
+	}
+
+	// The claimed deposit's vouchers are minted today, and From and To fill in the empty buckets
+	from := today.AddDate(0, 0, -3)
+	to := today.AddDate(0, 0, 2)
+	series, err := GetTimeSeries(testutils.GetAuthenticatedContext(orgSigningPubKey), &GetTimeSeriesParams{
+		OrganizationID: testOrganizationId,
+		Interval:       deposit.IntervalDay,
+		From:           &from,
+		To:             &to,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 5, len(series.Buckets))
+	require.True(t, from.Equal(series.Buckets[0].Start))
+	require.Equal(t, 6, series.Buckets[3].VouchersMinted)
+	require.Equal(t, 0, series.Buckets[1].VouchersMinted)
+
+	_, err = GetTimeSeries(testutils.GetAuthenticatedContext(collectionPoint1), &GetTimeSeriesParams{
+		OrganizationID: testOrganizationId,
+		Interval:       deposit.IntervalDay,
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.PermissionDenied, err.(*errs.Error).Code)
+
+	_, err = GetTimeSeries(testutils.GetAuthenticatedContext(orgSigningPubKey), &GetTimeSeriesParams{
+		OrganizationID: testOrganizationId,
+		SchemeID:       "otherScheme",
+		Interval:       deposit.IntervalDay,
+	})
+	require.Error(t, err)
+	require.Equal(t, errs.InvalidArgument, err.(*errs.Error).Code)
+}
@@ -0,0 +1,314 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/organization"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/storage/sqldb"
+)
+
+const (
+	StatusPending   = "PENDING"
+	StatusDelivered = "DELIVERED"
+	StatusDead      = "DEAD"
+)
+
+const (
+	SignatureHeader  = "Empower-Signature"
+	EventTypeHeader  = "Empower-Event-Type"
+	DeliveryIDHeader = "Empower-Delivery-ID"
+)
+
+const (
+	// maxAttempts is the number of failed attempts before a delivery is moved to the dead-letter list
+	maxAttempts       = 8
+	baseRetryDelay    = 30 * time.Second
+	maxRetryDelay     = 6 * time.Hour
+	deliveryBatchSize = 50
+	// deliveryLease is how long a delivery is reserved for the DeliverWebhooks run that picked it up
+	deliveryLease = 5 * time.Minute
+)
+
+type Delivery struct {
+	ID            string     `json:"id"`
+	EndpointID    string     `json:"endpointID"`
+	EventID       string     `json:"eventID"`
+	EventType     string     `json:"eventType"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"nextAttemptAt"`
+	LastError     string     `json:"lastError"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	DeliveredAt   *time.Time `json:"deliveredAt"`
+}
+
+// Payload is the body POSTed to webhook endpoints
+type Payload struct {
+	DeliveryID string          `json:"deliveryID"`
+	EventID    string          `json:"eventID"`
+	EventType  string          `json:"eventType"`
+	Data       json.RawMessage `json:"data"`
+}
+
+var _ = cron.NewJob("deliver-webhooks", cron.JobConfig{
+	Title:    "Deliver pending webhooks",
+	Every:    1 * cron.Minute,
+	Endpoint: DeliverWebhooks,
+})
+
+type DeliverWebhooksResponse struct {
+	Delivered int `json:"delivered"`
+	Failed    int `json:"failed"`
+}
+
+//encore:api private method=POST
+func DeliverWebhooks(ctx context.Context) (*DeliverWebhooksResponse, error) {
+	due, err := reserveDueDeliveries(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &DeliverWebhooksResponse{}
+	for _, d := range due {
+		d.delivery.Attempts++
+		sendErr := send(ctx, d.url, d.secret, &d.delivery, d.payload)
+
+		switch {
+		case sendErr == nil:
+			resp.Delivered++
+			_, err = sqldb.Exec(ctx, `
+                UPDATE webhook_delivery SET status=$2, attempts=$3, last_error='', delivered_at=now() WHERE id=$1
+            `, d.delivery.ID, StatusDelivered, d.delivery.Attempts)
+		case d.delivery.Attempts >= maxAttempts:
+			resp.Failed++
+			_, err = sqldb.Exec(ctx, `
+                UPDATE webhook_delivery SET status=$2, attempts=$3, last_error=$4 WHERE id=$1
+            `, d.delivery.ID, StatusDead, d.delivery.Attempts, sendErr.Error())
+		default:
+			resp.Failed++
+			_, err = sqldb.Exec(ctx, `
+                UPDATE webhook_delivery SET attempts=$2, last_error=$3, next_attempt_at=$4 WHERE id=$1
+            `, d.delivery.ID, d.delivery.Attempts, sendErr.Error(), time.Now().UTC().Add(retryDelay(d.delivery.Attempts)))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
+
+type dueDelivery struct {
+	delivery Delivery
+	payload  string
+	url      string
+	secret   string
+}
+
+// reserveDueDeliveries picks up pending deliveries that are due and leases them,
+// so the HTTP calls don't have to happen inside a transaction.
+func reserveDueDeliveries(ctx context.Context) ([]dueDelivery, error) {
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(ctx, `
+        SELECT d.id, d.endpoint_id, d.event_id, d.event_type, d.payload, d.attempts, e.url, e.secret
+        FROM webhook_delivery d JOIN webhook_endpoint e ON e.id = d.endpoint_id
+        WHERE d.status=$1 AND d.next_attempt_at <= now()
+        ORDER BY d.next_attempt_at
+        LIMIT $2
+        FOR UPDATE OF d SKIP LOCKED
+    `, StatusPending, deliveryBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var due []dueDelivery
+	var ids []string
+	for rows.Next() {
+		var d dueDelivery
+		if err := rows.Scan(&d.delivery.ID, &d.delivery.EndpointID, &d.delivery.EventID, &d.delivery.EventType, &d.payload, &d.delivery.Attempts, &d.url, &d.secret); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		due = append(due, d)
+		ids = append(ids, d.delivery.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ids) > 0 {
+		if _, err := tx.Exec(ctx, "UPDATE webhook_delivery SET next_attempt_at=$2 WHERE id = ANY($1)", ids, time.Now().UTC().Add(deliveryLease)); err != nil {
+			return nil, err
+		}
+	}
+
+	return due, tx.Commit()
+}
+
+func send(ctx context.Context, endpointURL string, secret string, delivery *Delivery, data string) error {
+	// Endpoints registered before https was required are not delivered to
+	if u, err := url.Parse(endpointURL); err != nil || u.Scheme != "https" {
+		return errors.New("endpoint url must use https")
+	}
+
+	body, err := json.Marshal(&Payload{
+		DeliveryID: delivery.ID,
+		EventID:    delivery.EventID,
+		EventType:  delivery.EventType,
+		Data:       json.RawMessage(data),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpointURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventTypeHeader, delivery.EventType)
+	req.Header.Set(DeliveryIDHeader, delivery.ID)
+	req.Header.Set(SignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp, Sign(secret, timestamp, body)))
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("endpoint responded with status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of "timestamp.body" with the endpoint secret.
+// Receivers should recompute it to verify the Empower-Signature header, and reject old timestamps.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay is the exponential backoff after the given number of failed attempts
+func retryDelay(attempts int) time.Duration {
+	delay := baseRetryDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= maxRetryDelay {
+			return maxRetryDelay
+		}
+	}
+
+	return delay
+}
+
+type GetDeadLettersParams struct {
+	OrganizationID string `json:"organizationID" validate:"required"`
+}
+
+type GetDeadLettersResponse struct {
+	Deliveries []Delivery `json:"deliveries"`
+}
+
+//encore:api auth method=POST
+func GetDeadLetters(ctx context.Context, params *GetDeadLettersParams) (*GetDeadLettersResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: params.OrganizationID}); err != nil {
+		return nil, err
+	}
+
+	rows, err := sqldb.Query(ctx, `
+        SELECT d.id, d.endpoint_id, d.event_id, d.event_type, d.status, d.attempts, d.next_attempt_at, d.last_error, d.created_at, d.delivered_at
+        FROM webhook_delivery d JOIN webhook_endpoint e ON e.id = d.endpoint_id
+        WHERE e.organization_id=$1 AND d.status=$2
+        ORDER BY d.created_at
+    `, params.OrganizationID, StatusDead)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resp := &GetDeadLettersResponse{Deliveries: []Delivery{}}
+	for rows.Next() {
+		var d Delivery
+		if err := rows.Scan(&d.ID, &d.EndpointID, &d.EventID, &d.EventType, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.LastError, &d.CreatedAt, &d.DeliveredAt); err != nil {
+			return nil, err
+		}
+		resp.Deliveries = append(resp.Deliveries, d)
+	}
+
+	return resp, rows.Err()
+}
+
+type ReplayDeliveryParams struct {
+	DeliveryID string `json:"deliveryID" validate:"required"`
+}
+
+// ReplayDelivery moves a dead delivery back to pending, so it is attempted again on the next run
+//encore:api auth method=POST
+func ReplayDelivery(ctx context.Context, params *ReplayDeliveryParams) error {
+	if err := commons.Validate(params); err != nil {
+		return err
+	}
+
+	var organizationID, status string
+	if err := sqldb.QueryRow(ctx, `
+        SELECT e.organization_id, d.status
+        FROM webhook_delivery d JOIN webhook_endpoint e ON e.id = d.endpoint_id
+        WHERE d.id=$1
+    `, params.DeliveryID).Scan(&organizationID, &status); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &errs.Error{
+				Code: errs.NotFound,
+			}
+		}
+		return err
+	}
+
+	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: organizationID}); err != nil {
+		return err
+	}
+
+	if status != StatusDead {
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "only dead deliveries can be replayed",
+		}
+	}
+
+	_, err := sqldb.Exec(ctx, `
+        UPDATE webhook_delivery SET status=$2, attempts=0, last_error='', next_attempt_at=now() WHERE id=$1
+    `, params.DeliveryID, StatusPending)
+	return err
+}
@@ -0,0 +1,239 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"encore.app/admin"
+	"encore.app/commons"
+	"encore.app/commons/outbox"
+	"encore.app/commons/testutils"
+	"encore.app/deposit"
+	"encore.dev/beta/errs"
+	"github.com/stretchr/testify/require"
+)
+
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// testReceiver is a local webhook receiver that responds with the configured status code
+type testReceiver struct {
+	mu         sync.Mutex
+	statusCode int
+	received   []receivedRequest
+}
+
+func (r *testReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.received = append(r.received, receivedRequest{header: req.Header.Clone(), body: body})
+	w.WriteHeader(r.statusCode)
+}
+
+func (r *testReceiver) setStatusCode(statusCode int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statusCode = statusCode
+}
+
+func (r *testReceiver) requests() []receivedRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]receivedRequest{}, r.received...)
+}
+
+func TestDeliverWebhooks(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	testutils.ClearAllDBs()
+	require.NoError(t, admin.InsertTestData(context.Background()))
+
+	orgSigningPubKey := createTestOrganization(t)
+	ctx := testutils.GetAuthenticatedContext(orgSigningPubKey)
+
+	receiver := &testReceiver{statusCode: http.StatusOK}
+	server := httptest.NewTLSServer(receiver)
+	defer server.Close()
+	allowTestServer(t, server)
+
+	endpoint, err := CreateEndpoint(ctx, &CreateEndpointParams{
+		OrganizationID: testOrganizationId,
+		URL:            server.URL,
+		EventTypes:     []string{deposit.EventTypeDepositMade},
+	})
+	require.NoError(t, err)
+
+	event := &deposit.DepositMadeEvent{
+		Metadata: outbox.Metadata{
+			EventID:    "event1",
+			OccurredAt: time.Now().UTC(),
+		},
+		DepositID:      "deposit1",
+		SchemeID:       "scheme1",
+		OrganizationID: testOrganizationId,
+		MassBalanceDeposits: []commons.MassBalance{
+			{
+				ItemDefinition: commons.ItemDefinition{
+					MaterialDefinition: map[string]string{"materialType": "PET"},
+					Magnitude:          commons.Weight,
+				},
+				Amount: 12,
+			},
+		},
+	}
+	require.NoError(t, handleDepositMade(context.Background(), event))
+	// Redelivered event is only delivered once
+	require.NoError(t, handleDepositMade(context.Background(), event))
+	// Not subscribed to
+	require.NoError(t, handleDepositClaimed(context.Background(), &deposit.DepositClaimedEvent{
+		Metadata:       outbox.Metadata{EventID: "event2"},
+		OrganizationID: testOrganizationId,
+	}))
+	// Another organization
+	require.NoError(t, handleDepositMade(context.Background(), &deposit.DepositMadeEvent{
+		Metadata:       outbox.Metadata{EventID: "event3"},
+		OrganizationID: "someOtherOrg",
+	}))
+
+	resp, err := DeliverWebhooks(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, resp.Delivered)
+	require.Equal(t, 0, resp.Failed)
+
+	requests := receiver.requests()
+	require.Equal(t, 1, len(requests))
+	require.Equal(t, deposit.EventTypeDepositMade, requests[0].header.Get(EventTypeHeader))
+
+	var timestamp int64
+	var signature string
+	_, err = fmt.Sscanf(requests[0].header.Get(SignatureHeader), "t=%d,v1=%s", &timestamp, &signature)
+	require.NoError(t, err)
+	require.Equal(t, Sign(endpoint.Secret, timestamp, requests[0].body), signature)
+	require.NotEqual(t, Sign("wrong secret", timestamp, requests[0].body), signature)
+
+	var payload Payload
+	require.NoError(t, json.Unmarshal(requests[0].body, &payload))
+	require.Equal(t, "event1", payload.EventID)
+	require.Equal(t, deposit.EventTypeDepositMade, payload.EventType)
+
+	var data deposit.DepositMadeEvent
+	require.NoError(t, json.Unmarshal(payload.Data, &data))
+	require.Equal(t, event.DepositID, data.DepositID)
+	require.Equal(t, event.MassBalanceDeposits, data.MassBalanceDeposits)
+
+	// Nothing left to deliver
+	resp, err = DeliverWebhooks(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, resp.Delivered)
+	require.Equal(t, 0, resp.Failed)
+}
+
+func TestDeliverWebhooksRetriesAndDeadLetters(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	testutils.ClearAllDBs()
+	require.NoError(t, admin.InsertTestData(context.Background()))
+
+	orgSigningPubKey := createTestOrganization(t)
+	ctx := testutils.GetAuthenticatedContext(orgSigningPubKey)
+
+	receiver := &testReceiver{statusCode: http.StatusInternalServerError}
+	server := httptest.NewTLSServer(receiver)
+	defer server.Close()
+	allowTestServer(t, server)
+
+	_, err := CreateEndpoint(ctx, &CreateEndpointParams{
+		OrganizationID: testOrganizationId,
+		URL:            server.URL,
+		EventTypes:     []string{deposit.EventTypeVoucherInvalidated},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, handleVoucherInvalidated(context.Background(), &deposit.VoucherInvalidatedEvent{
+		Metadata:       outbox.Metadata{EventID: "event1"},
+		VoucherID:      "voucher1",
+		OrganizationID: testOrganizationId,
+	}))
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		resp, err := DeliverWebhooks(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 1, resp.Failed)
+
+		// Not due until the backoff has passed
+		resp, err = DeliverWebhooks(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 0, resp.Failed)
+
+		_, err = webhookDB.Exec(context.Background(), "UPDATE webhook_delivery SET next_attempt_at = now()")
+		require.NoError(t, err)
+	}
+	require.Equal(t, maxAttempts, len(receiver.requests()))
+
+	deadLetters, err := GetDeadLetters(ctx, &GetDeadLettersParams{OrganizationID: testOrganizationId})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(deadLetters.Deliveries))
+	require.Equal(t, StatusDead, deadLetters.Deliveries[0].Status)
+	require.Equal(t, maxAttempts, deadLetters.Deliveries[0].Attempts)
+	require.Equal(t, "endpoint responded with status 500", deadLetters.Deliveries[0].LastError)
+
+	// Dead deliveries are not retried
+	resp, err := DeliverWebhooks(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, resp.Failed)
+
+	notOrganizationPubKey, _ := testutils.GenerateKeys()
+	err = ReplayDelivery(testutils.GetAuthenticatedContext(notOrganizationPubKey), &ReplayDeliveryParams{DeliveryID: deadLetters.Deliveries[0].ID})
+	require.Error(t, err)
+	require.Equal(t, errs.PermissionDenied, err.(*errs.Error).Code)
+
+	receiver.setStatusCode(http.StatusNoContent)
+	require.NoError(t, ReplayDelivery(ctx, &ReplayDeliveryParams{DeliveryID: deadLetters.Deliveries[0].ID}))
+
+	resp, err = DeliverWebhooks(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, resp.Delivered)
+
+	deadLetters, err = GetDeadLetters(ctx, &GetDeadLettersParams{OrganizationID: testOrganizationId})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(deadLetters.Deliveries))
+
+	// Only dead deliveries can be replayed
+	err = ReplayDelivery(ctx, &ReplayDeliveryParams{DeliveryID: deliveredID(t)})
+	require.Error(t, err)
+	require.Equal(t, errs.FailedPrecondition, err.(*errs.Error).Code)
+}
+
+func deliveredID(t *testing.T) string {
+	var id string
+	require.NoError(t, webhookDB.QueryRow(context.Background(), "SELECT id FROM webhook_delivery").Scan(&id))
+	return id
+}
+
+func TestRetryDelay(t *testing.T) {
+	testTable := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{attempts: 1, expected: 30 * time.Second},
+		{attempts: 2, expected: time.Minute},
+		{attempts: 3, expected: 2 * time.Minute},
+		{attempts: 7, expected: 32 * time.Minute},
+		{attempts: 20, expected: maxRetryDelay},
+	}
+
+	for _, test := range testTable {
+		t.Run(fmt.Sprintf("After %d attempts", test.attempts), func(t *testing.T) {
+			require.Equal(t, test.expected, retryDelay(test.attempts))
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"encore.dev/beta/errs"
+)
+
+// blockedNetworks are ranges that are not private, loopback or link-local, but are not on the internet either
+var blockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"100.64.0.0/10",  // carrier-grade NAT
+	"192.0.0.0/24",   // IETF protocol assignments
+	"198.18.0.0/15",  // benchmarking
+	"240.0.0.0/4",    // reserved, including broadcast
+	"64:ff9b::/96",   // NAT64, which can reach IPv4 addresses
+	"64:ff9b:1::/48", // local-use NAT64
+	"2001:db8::/32",  // documentation
+	"fec0::/10",      // deprecated site-local
+	"2002::/16",      // 6to4, which can reach IPv4 addresses
+)
+
+// isAllowedIP decides if webhooks can be sent to an address. Only public internet addresses are allowed,
+// so endpoints can't be used to reach the backend's own network (SSRF). Overridden in tests.
+var isAllowedIP = isPublicIP
+
+// lookupIPAddr resolves endpoint hosts. Overridden in tests.
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+var errForbiddenAddress = errors.New("endpoint must not resolve to a loopback, private or link-local address")
+
+// httpClient sends the webhooks. It only connects to allowed addresses, checked when dialing so a host
+// can't resolve to a public address at registration and a private one at delivery, and does not follow redirects.
+var httpClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		// A proxy would be dialed instead of the endpoint, and bypass the check
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !isAllowedIP(ip) {
+					return errForbiddenAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range blockedNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateEndpointURL checks that webhooks can be sent to rawURL: it must be https, and its host must only
+// resolve to allowed addresses. Deliveries are checked again when connecting.
+func validateEndpointURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "invalid endpoint url",
+		}
+	}
+	if u.Scheme != "https" {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "endpoint url must use https",
+		}
+	}
+	if u.User != nil {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "endpoint url must not contain credentials",
+		}
+	}
+
+	host := u.Hostname()
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := lookupIPAddr(ctx, host)
+		if err != nil || len(addrs) == 0 {
+			return &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: fmt.Sprintf("could not resolve endpoint host %q", host),
+			}
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	for _, ip := range ips {
+		if !isAllowedIP(ip) {
+			return &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: errForbiddenAddress.Error(),
+			}
+		}
+	}
+
+	return nil
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}
@@ -0,0 +1,32 @@
+CREATE TABLE webhook_endpoint
+(
+    id              TEXT PRIMARY KEY,
+    organization_id TEXT      NOT NULL,
+    url             TEXT      NOT NULL,
+    secret          TEXT      NOT NULL,
+    event_types     TEXT[]    NOT NULL,
+    created_at      TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX webhook_endpoint_organization_index
+ON webhook_endpoint (organization_id);
+
+CREATE TABLE webhook_delivery
+(
+    id              TEXT PRIMARY KEY,
+    endpoint_id     TEXT      NOT NULL,
+    event_id        TEXT      NOT NULL,
+    event_type      TEXT      NOT NULL,
+    payload         JSON      NOT NULL,
+    status          TEXT      NOT NULL DEFAULT 'PENDING',
+    attempts        INT       NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT now(),
+    last_error      TEXT      NOT NULL DEFAULT '',
+    delivered_at    TIMESTAMP,
+    created_at      TIMESTAMP NOT NULL DEFAULT now(),
+    CONSTRAINT fk_webhook_endpoint FOREIGN KEY (endpoint_id) REFERENCES webhook_endpoint (id) ON DELETE CASCADE,
+    CONSTRAINT unique_endpoint_event UNIQUE (endpoint_id, event_id)
+);
+
+CREATE INDEX webhook_delivery_due_index
+ON webhook_delivery (next_attempt_at) WHERE status = 'PENDING';
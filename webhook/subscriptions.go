@@ -0,0 +1,126 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+
+	"encore.app/commons"
+	"encore.app/deposit"
+	"encore.app/scheme"
+	"encore.dev/pubsub"
+	"encore.dev/storage/sqldb"
+)
+
+var _ = pubsub.NewSubscription(deposit.DepositMade, "webhook-deposit-made", pubsub.SubscriptionConfig[*deposit.DepositMadeEvent]{
+	Handler: handleDepositMade,
+})
+
+var _ = pubsub.NewSubscription(deposit.DepositClaimed, "webhook-deposit-claimed", pubsub.SubscriptionConfig[*deposit.DepositClaimedEvent]{
+	Handler: handleDepositClaimed,
+})
+
+var _ = pubsub.NewSubscription(deposit.DepositReversed, "webhook-deposit-reversed", pubsub.SubscriptionConfig[*deposit.DepositReversedEvent]{
+	Handler: handleDepositReversed,
+})
+
+var _ = pubsub.NewSubscription(deposit.DepositReviewed, "webhook-deposit-reviewed", pubsub.SubscriptionConfig[*deposit.DepositReviewedEvent]{
+	Handler: handleDepositReviewed,
+})
+
+var _ = pubsub.NewSubscription(deposit.DepositExpired, "webhook-deposit-expired", pubsub.SubscriptionConfig[*deposit.DepositExpiredEvent]{
+	Handler: handleDepositExpired,
+})
+
+var _ = pubsub.NewSubscription(deposit.VoucherMinted, "webhook-voucher-minted", pubsub.SubscriptionConfig[*deposit.VoucherMintedEvent]{
+	Handler: handleVoucherMinted,
+})
+
+var _ = pubsub.NewSubscription(deposit.VoucherInvalidated, "webhook-voucher-invalidated", pubsub.SubscriptionConfig[*deposit.VoucherInvalidatedEvent]{
+	Handler: handleVoucherInvalidated,
+})
+
+var _ = pubsub.NewSubscription(scheme.SchemeChanged, "webhook-scheme-changed", pubsub.SubscriptionConfig[*scheme.SchemeChangedEvent]{
+	Handler: handleSchemeChanged,
+})
+
+var _ = pubsub.NewSubscription(scheme.CollectionPointAdded, "webhook-collection-point-added", pubsub.SubscriptionConfig[*scheme.CollectionPointAddedEvent]{
+	Handler: handleCollectionPointAdded,
+})
+
+func handleDepositMade(ctx context.Context, e *deposit.DepositMadeEvent) error {
+	return enqueueDeliveries(ctx, e.OrganizationID, e.EventType(), e.EventID, e)
+}
+
+func handleDepositClaimed(ctx context.Context, e *deposit.DepositClaimedEvent) error {
+	return enqueueDeliveries(ctx, e.OrganizationID, e.EventType(), e.EventID, e)
+}
+
+func handleDepositReversed(ctx context.Context, e *deposit.DepositReversedEvent) error {
+	return enqueueDeliveries(ctx, e.OrganizationID, e.EventType(), e.EventID, e)
+}
+
+func handleDepositReviewed(ctx context.Context, e *deposit.DepositReviewedEvent) error {
+	return enqueueDeliveries(ctx, e.OrganizationID, e.EventType(), e.EventID, e)
+}
+
+func handleDepositExpired(ctx context.Context, e *deposit.DepositExpiredEvent) error {
+	return enqueueDeliveries(ctx, e.OrganizationID, e.EventType(), e.EventID, e)
+}
+
+func handleVoucherMinted(ctx context.Context, e *deposit.VoucherMintedEvent) error {
+	return enqueueDeliveries(ctx, e.OrganizationID, e.EventType(), e.EventID, e)
+}
+
+func handleVoucherInvalidated(ctx context.Context, e *deposit.VoucherInvalidatedEvent) error {
+	return enqueueDeliveries(ctx, e.OrganizationID, e.EventType(), e.EventID, e)
+}
+
+func handleSchemeChanged(ctx context.Context, e *scheme.SchemeChangedEvent) error {
+	return enqueueDeliveries(ctx, e.OrganizationID, e.EventType(), e.EventID, e)
+}
+
+func handleCollectionPointAdded(ctx context.Context, e *scheme.CollectionPointAddedEvent) error {
+	return enqueueDeliveries(ctx, e.OrganizationID, e.EventType(), e.EventID, e)
+}
+
+// enqueueDeliveries schedules a delivery of the event to every endpoint of the organization that subscribes to it.
+// Events are delivered at-least-once, so a delivery is only created once per endpoint and event.
+func enqueueDeliveries(ctx context.Context, organizationID string, eventType string, eventID string, event interface{}) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	rows, err := sqldb.Query(ctx, `
+        SELECT id FROM webhook_endpoint WHERE organization_id=$1 AND $2 = ANY(event_types)
+    `, organizationID, eventType)
+	if err != nil {
+		return err
+	}
+
+	var endpointIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		endpointIDs = append(endpointIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, endpointID := range endpointIDs {
+		if _, err := sqldb.Exec(ctx, `
+            INSERT INTO webhook_delivery (id, endpoint_id, event_id, event_type, payload)
+            VALUES ($1, $2, $3, $4, $5)
+            ON CONFLICT (endpoint_id, event_id) DO NOTHING
+        `, commons.GenerateID(), endpointID, eventID, eventType, string(payload)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"encore.app/commons"
+	"encore.app/deposit"
+	"encore.app/organization"
+	"encore.app/scheme"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+// SupportedEventTypes are the event types an endpoint can subscribe to
+var SupportedEventTypes = []string{
+	deposit.EventTypeDepositMade,
+	deposit.EventTypeDepositClaimed,
+	deposit.EventTypeDepositReversed,
+	deposit.EventTypeDepositReviewed,
+	deposit.EventTypeDepositExpired,
+	deposit.EventTypeVoucherMinted,
+	deposit.EventTypeVoucherInvalidated,
+	scheme.EventTypeSchemeChanged,
+	scheme.EventTypeCollectionPointAdded,
+}
+
+type Endpoint struct {
+	ID             string    `json:"id"`
+	OrganizationID string    `json:"organizationID"`
+	URL            string    `json:"url"`
+	EventTypes     []string  `json:"eventTypes"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+type CreateEndpointParams struct {
+	OrganizationID string   `json:"organizationID" validate:"required"`
+	URL            string   `json:"url" validate:"required,url"`
+	EventTypes     []string `json:"eventTypes" validate:"required,min=1"`
+}
+
+type CreateEndpointResponse struct {
+	Endpoint Endpoint `json:"endpoint"`
+	// Secret is used to sign deliveries to the endpoint. It is only returned once, when the endpoint is created.
+	Secret string `json:"secret"`
+}
+
+//encore:api auth method=POST
+func CreateEndpoint(ctx context.Context, params *CreateEndpointParams) (*CreateEndpointResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	for _, eventType := range params.EventTypes {
+		if !isSupportedEventType(eventType) {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "unsupported event type: " + eventType,
+			}
+		}
+	}
+
+	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: params.OrganizationID}); err != nil {
+		return nil, err
+	}
+
+	if err := validateEndpointURL(ctx, params.URL); err != nil {
+		return nil, err
+	}
+
+	secret, err := generateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	id := commons.GenerateID()
+	_, err = sqldb.Exec(ctx, `
+        INSERT INTO webhook_endpoint (id, organization_id, url, secret, event_types)
+        VALUES ($1, $2, $3, $4, $5)
+    `, id, params.OrganizationID, params.URL, secret, params.EventTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, _, err := getEndpoint(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CreateEndpointResponse{
+		Endpoint: *endpoint,
+		Secret:   secret,
+	}, nil
+}
+
+type GetEndpointsParams struct {
+	OrganizationID string `json:"organizationID" validate:"required"`
+}
+
+type GetEndpointsResponse struct {
+	Endpoints []Endpoint `json:"endpoints"`
+}
+
+//encore:api auth method=POST
+func GetEndpoints(ctx context.Context, params *GetEndpointsParams) (*GetEndpointsResponse, error) {
+	if err := commons.Validate(params); err != nil {
+		return nil, err
+	}
+
+	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: params.OrganizationID}); err != nil {
+		return nil, err
+	}
+
+	rows, err := sqldb.Query(ctx, `
+        SELECT id, organization_id, url, event_types, created_at FROM webhook_endpoint
+        WHERE organization_id=$1 ORDER BY created_at
+    `, params.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resp := &GetEndpointsResponse{Endpoints: []Endpoint{}}
+	for rows.Next() {
+		var e Endpoint
+		if err := rows.Scan(&e.ID, &e.OrganizationID, &e.URL, &e.EventTypes, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		resp.Endpoints = append(resp.Endpoints, e)
+	}
+
+	return resp, rows.Err()
+}
+
+type DeleteEndpointParams struct {
+	EndpointID string `json:"endpointID" validate:"required"`
+}
+
+//encore:api auth method=POST
+func DeleteEndpoint(ctx context.Context, params *DeleteEndpointParams) error {
+	if err := commons.Validate(params); err != nil {
+		return err
+	}
+
+	endpoint, _, err := getEndpoint(ctx, params.EndpointID)
+	if err != nil {
+		return err
+	}
+
+	if err := organization.AuthorizeCallerForOrg(ctx, &organization.AuthorizeCallerForOrgParams{OrganizationID: endpoint.OrganizationID}); err != nil {
+		return err
+	}
+
+	_, err = sqldb.Exec(ctx, "DELETE FROM webhook_endpoint WHERE id=$1", endpoint.ID)
+	return err
+}
+
+func getEndpoint(ctx context.Context, id string) (*Endpoint, string, error) {
+	var e Endpoint
+	var secret string
+	if err := sqldb.QueryRow(ctx, `
+        SELECT id, organization_id, url, secret, event_types, created_at FROM webhook_endpoint WHERE id=$1
+    `, id).Scan(&e.ID, &e.OrganizationID, &e.URL, &secret, &e.EventTypes, &e.CreatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, "", &errs.Error{
+				Code: errs.NotFound,
+			}
+		}
+		return nil, "", err
+	}
+
+	return &e, secret, nil
+}
+
+func isSupportedEventType(eventType string) bool {
+	for _, supported := range SupportedEventTypes {
+		if eventType == supported {
+			return true
+		}
+	}
+
+	return false
+}
+
+func generateSecret() (string, error) {
+	var data [32]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(data[:]), nil
+}
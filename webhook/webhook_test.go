@@ -0,0 +1,189 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+
+	"encore.app/admin"
+	"encore.app/commons/testutils"
+	"encore.app/deposit"
+	"encore.app/organization"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"github.com/stretchr/testify/require"
+)
+
+const testOrganizationId = "myOrgId1"
+
+var webhookDB = sqldb.Named("webhook")
+
+func createTestOrganization(t *testing.T) (orgSigningPubKey string) {
+	orgSigningPubKey, _ = testutils.GenerateKeys()
+	orgEncryptionPubKey, _ := testutils.GenerateKeys()
+	_, err := organization.CreateOrganization(testutils.GetAuthenticatedContext(testutils.AdminPubKey), &organization.CreateOrgParams{
+		ID:               testOrganizationId,
+		Name:             testOrganizationId,
+		SigningPubKey:    orgSigningPubKey,
+		EncryptionPubKey: orgEncryptionPubKey,
+	})
+	require.NoError(t, err)
+
+	return orgSigningPubKey
+}
+
+func TestCreateEndpoint(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	testutils.ClearAllDBs()
+	require.NoError(t, admin.InsertTestData(context.Background()))
+
+	useTestResolver(t)
+	orgSigningPubKey := createTestOrganization(t)
+	notOrganizationPubKey, _ := testutils.GenerateKeys()
+
+	testTable := []struct {
+		name      string
+		params    CreateEndpointParams
+		errorCode errs.ErrCode
+		uid       string
+	}{
+		{
+			name: "Happy path",
+			params: CreateEndpointParams{
+				OrganizationID: testOrganizationId,
+				URL:            "https://partner.example.com/webhooks",
+				EventTypes:     []string{deposit.EventTypeDepositMade, deposit.EventTypeVoucherInvalidated},
+			},
+			errorCode: errs.OK,
+			uid:       orgSigningPubKey,
+		},
+		{
+			name: "By admin",
+			params: CreateEndpointParams{
+				OrganizationID: testOrganizationId,
+				URL:            "https://partner.example.com/webhooks",
+				EventTypes:     []string{deposit.EventTypeDepositMade},
+			},
+			errorCode: errs.OK,
+			uid:       testutils.AdminPubKey,
+		},
+		{
+			name: "Invalid URL",
+			params: CreateEndpointParams{
+				OrganizationID: testOrganizationId,
+				URL:            "not a url",
+				EventTypes:     []string{deposit.EventTypeDepositMade},
+			},
+			errorCode: errs.InvalidArgument,
+			uid:       orgSigningPubKey,
+		},
+		{
+			name: "Plain http",
+			params: CreateEndpointParams{
+				OrganizationID: testOrganizationId,
+				URL:            "http://partner.example.com/webhooks",
+				EventTypes:     []string{deposit.EventTypeDepositMade},
+			},
+			errorCode: errs.InvalidArgument,
+			uid:       orgSigningPubKey,
+		},
+		{
+			name: "Internal address",
+			params: CreateEndpointParams{
+				OrganizationID: testOrganizationId,
+				URL:            "https://169.254.169.254/latest/meta-data",
+				EventTypes:     []string{deposit.EventTypeDepositMade},
+			},
+			errorCode: errs.InvalidArgument,
+			uid:       orgSigningPubKey,
+		},
+		{
+			name: "No event types",
+			params: CreateEndpointParams{
+				OrganizationID: testOrganizationId,
+				URL:            "https://partner.example.com/webhooks",
+				EventTypes:     []string{},
+			},
+			errorCode: errs.InvalidArgument,
+			uid:       orgSigningPubKey,
+		},
+		{
+			name: "Unsupported event type",
+			params: CreateEndpointParams{
+				OrganizationID: testOrganizationId,
+				URL:            "https://partner.example.com/webhooks",
+				EventTypes:     []string{"SomethingHappened"},
+			},
+			errorCode: errs.InvalidArgument,
+			uid:       orgSigningPubKey,
+		},
+		{
+			name: "Not done by organization",
+			params: CreateEndpointParams{
+				OrganizationID: testOrganizationId,
+				URL:            "https://partner.example.com/webhooks",
+				EventTypes:     []string{deposit.EventTypeDepositMade},
+			},
+			errorCode: errs.PermissionDenied,
+			uid:       notOrganizationPubKey,
+		},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			require.NoError(t, testutils.ClearDB(webhookDB, "webhook_delivery", "webhook_endpoint"))
+
+			ctx := testutils.GetAuthenticatedContext(test.uid)
+			resp, err := CreateEndpoint(ctx, &test.params)
+			if test.errorCode == errs.OK {
+				require.NoError(t, err)
+				require.NotEqual(t, "", resp.Endpoint.ID)
+				require.Equal(t, 64, len(resp.Secret))
+
+				endpoints, err := GetEndpoints(ctx, &GetEndpointsParams{OrganizationID: testOrganizationId})
+				require.NoError(t, err)
+				require.Equal(t, 1, len(endpoints.Endpoints))
+				require.Equal(t, test.params.URL, endpoints.Endpoints[0].URL)
+				require.Equal(t, test.params.EventTypes, endpoints.Endpoints[0].EventTypes)
+			} else {
+				require.Error(t, err)
+				require.Equal(t, test.errorCode, err.(*errs.Error).Code)
+
+				endpoints, err := GetEndpoints(testutils.GetAuthenticatedContext(orgSigningPubKey), &GetEndpointsParams{OrganizationID: testOrganizationId})
+				require.NoError(t, err)
+				require.Equal(t, 0, len(endpoints.Endpoints))
+			}
+		})
+	}
+}
+
+func TestDeleteEndpoint(t *testing.T) {
+	testutils.EnsureExclusiveDatabaseAccess(t)
+	testutils.ClearAllDBs()
+	require.NoError(t, admin.InsertTestData(context.Background()))
+
+	useTestResolver(t)
+	orgSigningPubKey := createTestOrganization(t)
+	notOrganizationPubKey, _ := testutils.GenerateKeys()
+	ctx := testutils.GetAuthenticatedContext(orgSigningPubKey)
+
+	resp, err := CreateEndpoint(ctx, &CreateEndpointParams{
+		OrganizationID: testOrganizationId,
+		URL:            "https://partner.example.com/webhooks",
+		EventTypes:     []string{deposit.EventTypeDepositMade},
+	})
+	require.NoError(t, err)
+
+	err = DeleteEndpoint(testutils.GetAuthenticatedContext(notOrganizationPubKey), &DeleteEndpointParams{EndpointID: resp.Endpoint.ID})
+	require.Error(t, err)
+	require.Equal(t, errs.PermissionDenied, err.(*errs.Error).Code)
+
+	require.NoError(t, DeleteEndpoint(ctx, &DeleteEndpointParams{EndpointID: resp.Endpoint.ID}))
+
+	endpoints, err := GetEndpoints(ctx, &GetEndpointsParams{OrganizationID: testOrganizationId})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(endpoints.Endpoints))
+
+	err = DeleteEndpoint(ctx, &DeleteEndpointParams{EndpointID: resp.Endpoint.ID})
+	require.Error(t, err)
+	require.Equal(t, errs.NotFound, err.(*errs.Error).Code)
+}